@@ -128,6 +128,23 @@ func (m *Cache) getData(key string, data CacheData) error {
 	return nil
 }
 
+// GetRaw stored bytes of key, ok is false on miss, e.g. read by the migration mode of value.Cache
+func (m *Cache) GetRaw(ctx context.Context, key string) (data []byte, ok bool, err error) {
+	fun := "Cache.GetRaw -->"
+	client, err := m.getRedisClient()
+	if err != nil {
+		return nil, false, fmt.Errorf("%s get redis client err:%s", fun, err.Error())
+	}
+	data, err = client.Get(m.fixKey(key)).Bytes()
+	if err != nil {
+		if err.Error() == constants.RedisNil {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
 func (m *Cache) GetCache(key string, data CacheData) error {
 	fun := "Cache.GetCache -->"
 
@@ -225,7 +242,7 @@ func SetConfiger(ctx context.Context, configerType constants.ConfigerType) error
 }
 
 func WatchUpdate(ctx context.Context) {
-	go redis.DefaultInstanceManager.Watch(ctx)
+	go redis.DefaultInstanceManager.WatchConfiger(ctx, redis.DefaultConfiger)
 }
 
 func init() {
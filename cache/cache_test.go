@@ -3,10 +3,8 @@ package cache
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"github.com/stretchr/testify/assert"
 	"testing"
-	"time"
 )
 
 type Test struct {
@@ -29,9 +27,15 @@ func (p *Test) Load(key string) error{
 
 func TestNewCommonCache(t *testing.T) {
 	id := 3
-	c, err := NewCommonCache("base/changeboard", "test", 10, 60)
+	// NewCommonCache 固定连接codis，这里换成测试server的地址
+	redisClient, err := newRedisClient(server.Addr(), "base/changeboard", 10)
 	if err != nil {
-		t.Errorf("NewCommonCache err: %s", err.Error())
+		t.Errorf("newRedisClient err: %s", err.Error())
+	}
+	c := &Cache{
+		redisClient: redisClient,
+		expire:      60,
+		prefix:      "test",
 	}
 	var test Test
 	test.ID = id
@@ -68,23 +72,25 @@ func TestCache_Get(t *testing.T) {
 	if err != nil {
 		t.Errorf("NewCacheByNamespace err: %s", err.Error())
 	}
-	//WatchUpdate(ctx)
 	var test Test
-	for {
-		err = c.Get("test", &test)
-		if err != nil {
-			t.Errorf("Get err: %s", err.Error())
-			return
-		}
-		fmt.Println(test)
-		time.Sleep(time.Second)
+	test.ID = 3
+	err = c.Set("test", &test)
+	if err != nil {
+		t.Errorf("Set err: %s", err.Error())
+	}
+	test = Test{}
+	err = c.Get("test", &test)
+	if err != nil {
+		t.Errorf("Get err: %s", err.Error())
+	}
+	assert.Equal(t, 3, test.ID)
+
+	c.Del("test")
+	// load
+	test = Test{}
+	err = c.Get("test", &test)
+	if err != nil {
+		t.Errorf("Get err: %s", err.Error())
 	}
-	//t.Log(test)
-	//c.Del("test")
-	//// load
-	//err = c.Get("test", &test)
-	//if err != nil {
-	//	t.Errorf("Get err: %s", err.Error())
-	//}
-	//assert.Equal(t, 1, test.ID)
+	assert.Equal(t, 1, test.ID)
 }
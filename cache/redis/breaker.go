@@ -0,0 +1,249 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shawnfeng/sutil/slog/slog"
+)
+
+const (
+	breakerBuckets = 10
+
+	defaultBreakerErrorRate   = 50
+	defaultBreakerMinRequests = 20
+	defaultBreakerWindow      = 10 * time.Second
+	defaultBreakerOpenTimeout = 5 * time.Second
+	defaultBreakerProbes      = 3
+)
+
+type BreakerState int32
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("BreakerState(%d)", int32(s))
+	}
+}
+
+// BreakerConfig thresholds of the circuit breaker of a namespace, ErrorRate 0 disables it
+type BreakerConfig struct {
+	// ErrorRate percent of timeouts and connection errors in Window that opens the breaker
+	ErrorRate int
+	// MinRequests the breaker doesn't open until Window has at least MinRequests requests
+	MinRequests int
+	Window      time.Duration
+	// OpenTimeout how long the breaker stays open before letting probes through
+	OpenTimeout time.Duration
+	// Probes number of requests let through when half open, all must succeed to close the breaker
+	Probes int
+}
+
+func defaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		ErrorRate:   defaultBreakerErrorRate,
+		MinRequests: defaultBreakerMinRequests,
+		Window:      defaultBreakerWindow,
+		OpenTimeout: defaultBreakerOpenTimeout,
+		Probes:      defaultBreakerProbes,
+	}
+}
+
+// CircuitOpenError returned by every command without sending it while the breaker is open
+type CircuitOpenError struct {
+	Namespace string
+	Group     string
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("redis: circuit breaker of namespace:%s group:%s is open", e.Namespace, e.Group)
+}
+
+func IsCircuitOpen(err error) bool {
+	_, ok := err.(*CircuitOpenError)
+	return ok
+}
+
+// isBreakerFailure only timeouts and connection errors count, redis.Nil and error replies mean redis is up
+func isBreakerFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return err.Error() == "redis: connection pool timeout"
+}
+
+type breakerBucket struct {
+	total, failures int
+}
+
+// Breaker closed/open/half-open circuit breaker, it implements go-redis Limiter so every command
+// and pipeline of a client goes through Allow and ReportResult
+type Breaker struct {
+	namespace, group string
+
+	mu    sync.Mutex
+	conf  BreakerConfig
+	state BreakerState
+	// closed: sliding window of results
+	buckets     [breakerBuckets]breakerBucket
+	bucketStart time.Time
+	bucketIdx   int
+	// open: since when
+	openedAt time.Time
+	// half open: probes let through and succeeded
+	probes, successes int
+}
+
+// namespace-group -> *Breaker, breakers outlive clients replaced on config change
+var breakers sync.Map
+
+func getBreaker(namespace, group string, conf BreakerConfig) *Breaker {
+	key := namespace + keySep + group
+	b, ok := breakers.Load(key)
+	if !ok {
+		b, _ = breakers.LoadOrStore(key, &Breaker{
+			namespace:   namespace,
+			group:       group,
+			bucketStart: time.Now(),
+		})
+	}
+	breaker := b.(*Breaker)
+	breaker.setConfig(conf)
+	return breaker
+}
+
+// GetBreakerState return the breaker state of namespace and group, closed if no client was created
+func GetBreakerState(namespace, group string) BreakerState {
+	b, ok := breakers.Load(namespace + keySep + group)
+	if !ok {
+		return BreakerClosed
+	}
+	breaker := b.(*Breaker)
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	return breaker.state
+}
+
+func (m *Breaker) setConfig(conf BreakerConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conf = conf
+	if conf.ErrorRate <= 0 {
+		m.setState(BreakerClosed, time.Now())
+	}
+}
+
+// Allow implement go-redis Limiter
+func (m *Breaker) Allow() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch m.state {
+	case BreakerOpen:
+		now := time.Now()
+		if now.Sub(m.openedAt) < m.conf.OpenTimeout {
+			return &CircuitOpenError{Namespace: m.namespace, Group: m.group}
+		}
+		m.setState(BreakerHalfOpen, now)
+		fallthrough
+	case BreakerHalfOpen:
+		if m.probes >= m.conf.Probes {
+			return &CircuitOpenError{Namespace: m.namespace, Group: m.group}
+		}
+		m.probes++
+	}
+	return nil
+}
+
+// ReportResult implement go-redis Limiter
+func (m *Breaker) ReportResult(result error) {
+	failed := isBreakerFailure(result)
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conf.ErrorRate <= 0 {
+		return
+	}
+
+	switch m.state {
+	case BreakerClosed:
+		m.advance(now)
+		bucket := &m.buckets[m.bucketIdx]
+		bucket.total++
+		if failed {
+			bucket.failures++
+		}
+
+		var total, failures int
+		for _, b := range m.buckets {
+			total += b.total
+			failures += b.failures
+		}
+		if total >= m.conf.MinRequests && failures*100 >= total*m.conf.ErrorRate {
+			m.setState(BreakerOpen, now)
+		}
+
+	case BreakerHalfOpen:
+		if failed {
+			m.setState(BreakerOpen, now)
+			return
+		}
+		m.successes++
+		if m.successes >= m.conf.Probes {
+			m.setState(BreakerClosed, now)
+		}
+	}
+}
+
+// advance rotate buckets so that the window covers [now-Window, now]
+func (m *Breaker) advance(now time.Time) {
+	size := m.conf.Window / breakerBuckets
+	if size <= 0 {
+		size = time.Millisecond
+	}
+	for n := 0; now.Sub(m.bucketStart) >= size; n++ {
+		if n >= breakerBuckets {
+			m.bucketStart = now
+			break
+		}
+		m.bucketIdx = (m.bucketIdx + 1) % breakerBuckets
+		m.buckets[m.bucketIdx] = breakerBucket{}
+		m.bucketStart = m.bucketStart.Add(size)
+	}
+}
+
+func (m *Breaker) setState(state BreakerState, now time.Time) {
+	if m.state == state {
+		return
+	}
+	slog.Warnf(context.TODO(), "Breaker.setState --> namespace:%s group:%s breaker %s -> %s", m.namespace, m.group, m.state, state)
+	m.state = state
+	m.openedAt = now
+	m.probes, m.successes = 0, 0
+	m.buckets = [breakerBuckets]breakerBucket{}
+	m.bucketStart, m.bucketIdx = now, 0
+	statBreakerState(m.namespace, m.group, state)
+}
@@ -0,0 +1,60 @@
+package redis
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreaker(t *testing.T) {
+	b := getBreaker("test/breaker", "default", BreakerConfig{
+		ErrorRate:   50,
+		MinRequests: 4,
+		Window:      time.Second,
+		OpenTimeout: 100 * time.Millisecond,
+		Probes:      2,
+	})
+	timeout := &net.OpError{Op: "read", Err: &net.DNSError{IsTimeout: true}}
+
+	// redis.Nil and error replies don't count as failures
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, b.Allow())
+		b.ReportResult(redis.Nil)
+	}
+	assert.Equal(t, BreakerClosed, GetBreakerState("test/breaker", "default"))
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, b.Allow())
+		b.ReportResult(timeout)
+	}
+	assert.Equal(t, BreakerOpen, GetBreakerState("test/breaker", "default"))
+	err := b.Allow()
+	assert.True(t, IsCircuitOpen(err))
+
+	// half open, one failed probe opens it again
+	time.Sleep(150 * time.Millisecond)
+	assert.NoError(t, b.Allow())
+	assert.Equal(t, BreakerHalfOpen, GetBreakerState("test/breaker", "default"))
+	b.ReportResult(timeout)
+	assert.Equal(t, BreakerOpen, GetBreakerState("test/breaker", "default"))
+
+	// all probes succeed
+	time.Sleep(150 * time.Millisecond)
+	assert.NoError(t, b.Allow())
+	assert.NoError(t, b.Allow())
+	assert.True(t, IsCircuitOpen(b.Allow()))
+	b.ReportResult(nil)
+	b.ReportResult(nil)
+	assert.Equal(t, BreakerClosed, GetBreakerState("test/breaker", "default"))
+
+	// disabled
+	getBreaker("test/breaker", "default", BreakerConfig{})
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, b.Allow())
+		b.ReportResult(timeout)
+	}
+	assert.Equal(t, BreakerClosed, GetBreakerState("test/breaker", "default"))
+}
@@ -23,6 +23,16 @@ const (
 	apolloConfigKeyPoolSize   = "poolsize"
 	apolloConfigKeyTimeout    = "timeout"
 	apolloConfigKeyUseWrapper = "usewrapper"
+	// comma separated replica addrs, and how reads choose among them: random, roundrobin or latency
+	apolloConfigKeyReplicas   = "replicas"
+	apolloConfigKeyReadPolicy = "readpolicy"
+
+	// circuit breaker thresholds, durations in seconds, see BreakerConfig
+	apolloConfigKeyBreakerErrorRate   = "breakererrorrate"
+	apolloConfigKeyBreakerMinRequests = "breakerminrequests"
+	apolloConfigKeyBreakerWindow      = "breakerwindow"
+	apolloConfigKeyBreakerOpenTimeout = "breakeropentimeout"
+	apolloConfigKeyBreakerProbes      = "breakerprobes"
 
 	defaultPoolSize          = 128
 	defaultTimeoutNumSeconds = 3
@@ -35,6 +45,9 @@ type Config struct {
 	poolSize   int
 	timeout    time.Duration
 	useWrapper bool
+	breaker    BreakerConfig
+	replicas   []string
+	readPolicy ReadPolicy
 }
 
 type KeyParts struct {
@@ -51,6 +64,11 @@ type Configer interface {
 	Watch(ctx context.Context) <-chan *center.ChangeEvent
 }
 
+// ItemConfiger Configer 的可选接口, 获取 namespace 下的任意配置项, 供 redisext 等上层组件使用
+type ItemConfiger interface {
+	GetItem(ctx context.Context, namespace, item string) (string, bool)
+}
+
 func NewConfiger(configType constants.ConfigerType) (Configer, error) {
 	switch configType {
 	case constants.ConfigerTypeSimple:
@@ -94,6 +112,7 @@ func (m *SimpleConfig) GetConfig(ctx context.Context, namespace string) (*Config
 		namespace: namespace,
 		timeout:   defaultTimeoutNumSeconds * time.Second,
 		poolSize:  defaultPoolSize,
+		breaker:   defaultBreakerConfig(),
 	}, nil
 }
 
@@ -109,6 +128,80 @@ func (m *SimpleConfig) Watch(ctx context.Context) <-chan *center.ChangeEvent {
 	return nil
 }
 
+func (m *SimpleConfig) GetItem(ctx context.Context, namespace, item string) (string, bool) {
+	return "", false
+}
+
+// StaticConfig namespaces configured in code, e.g. pointing at a test server
+type StaticConfig struct {
+	mu    sync.RWMutex
+	addrs map[string]string
+	items map[string]map[string]string
+}
+
+func NewStaticConfiger() *StaticConfig {
+	return &StaticConfig{
+		addrs: map[string]string{},
+		items: map[string]map[string]string{},
+	}
+}
+
+// SetAddr route namespace to addr, other config items use defaults
+func (m *StaticConfig) SetAddr(namespace, addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addrs[namespace] = addr
+}
+
+// SetItem set an item returned by GetItem, e.g. ratelimit rules
+func (m *StaticConfig) SetItem(namespace, item, value string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.items[namespace] == nil {
+		m.items[namespace] = map[string]string{}
+	}
+	m.items[namespace][item] = value
+}
+
+func (m *StaticConfig) Init(ctx context.Context) error {
+	return nil
+}
+
+func (m *StaticConfig) GetConfig(ctx context.Context, namespace string) (*Config, error) {
+	fun := "StaticConfig.GetConfig-->"
+	m.mu.RLock()
+	addr, ok := m.addrs[namespace]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%s no addr of namespace:%s", fun, namespace)
+	}
+
+	return &Config{
+		addr:       addr,
+		namespace:  namespace,
+		timeout:    defaultTimeoutNumSeconds * time.Second,
+		poolSize:   defaultPoolSize,
+		useWrapper: defaultUseWrapper,
+		breaker:    defaultBreakerConfig(),
+	}, nil
+}
+
+func (m *StaticConfig) ParseKey(ctx context.Context, key string) (*KeyParts, error) {
+	fun := "StaticConfig.ParseKey-->"
+	return nil, fmt.Errorf("%s not implemented", fun)
+}
+
+func (m *StaticConfig) Watch(ctx context.Context) <-chan *center.ChangeEvent {
+	return nil
+}
+
+func (m *StaticConfig) GetItem(ctx context.Context, namespace, item string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v, ok := m.items[namespace][item]
+	return v, ok
+}
+
 type EtcdConfig struct {
 	etcdAddr []string
 }
@@ -246,15 +339,63 @@ func (m *ApolloConfig) GetConfig(ctx context.Context, namespace string) (*Config
 	}
 	slog.Infof(ctx, "%s got config usewrapper:%v", fun, useWrapper)
 
+	breaker := m.getBreakerConfig(ctx, namespace)
+	slog.Infof(ctx, "%s got config breaker:%+v", fun, breaker)
+
+	var replicas []string
+	if s, ok := m.getConfigStringItemWithFallback(ctx, namespace, apolloConfigKeyReplicas); ok {
+		for _, addr := range strings.Split(s, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				replicas = append(replicas, addr)
+			}
+		}
+	}
+	policyStr, _ := m.getConfigStringItemWithFallback(ctx, namespace, apolloConfigKeyReadPolicy)
+	readPolicy, err := parseReadPolicy(policyStr)
+	if err != nil {
+		slog.Errorf(ctx, "%s parse read policy err:%v, use default:%s", fun, err, readPolicy)
+	}
+	slog.Infof(ctx, "%s got config replicas:%v readpolicy:%s", fun, replicas, readPolicy)
+
 	return &Config{
 		addr:       addr,
 		namespace:  namespace,
 		poolSize:   poolSize,
 		timeout:    time.Duration(timeout) * time.Second,
 		useWrapper: useWrapper,
+		breaker:    breaker,
+		replicas:   replicas,
+		readPolicy: readPolicy,
 	}, nil
 }
 
+func (m *ApolloConfig) getBreakerConfig(ctx context.Context, namespace string) BreakerConfig {
+	conf := defaultBreakerConfig()
+	if v, ok := m.getConfigIntItemWithFallback(ctx, namespace, apolloConfigKeyBreakerErrorRate); ok {
+		conf.ErrorRate = v
+	}
+	if v, ok := m.getConfigIntItemWithFallback(ctx, namespace, apolloConfigKeyBreakerMinRequests); ok {
+		conf.MinRequests = v
+	}
+	if v, ok := m.getConfigIntItemWithFallback(ctx, namespace, apolloConfigKeyBreakerWindow); ok && v > 0 {
+		conf.Window = time.Duration(v) * time.Second
+	}
+	if v, ok := m.getConfigIntItemWithFallback(ctx, namespace, apolloConfigKeyBreakerOpenTimeout); ok && v > 0 {
+		conf.OpenTimeout = time.Duration(v) * time.Second
+	}
+	if v, ok := m.getConfigIntItemWithFallback(ctx, namespace, apolloConfigKeyBreakerProbes); ok && v > 0 {
+		conf.Probes = v
+	}
+	return conf
+}
+
+func (m *ApolloConfig) GetItem(ctx context.Context, namespace, item string) (string, bool) {
+	if m.center == nil {
+		return "", false
+	}
+	return m.getConfigStringItemWithFallback(ctx, namespace, item)
+}
+
 func (m *ApolloConfig) ParseKey(ctx context.Context, key string) (*KeyParts, error) {
 	fun := "ApolloConfig.ParseKey-->"
 	parts := strings.Split(key, apolloConfigSep)
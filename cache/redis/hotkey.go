@@ -0,0 +1,232 @@
+package redis
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultHotKeyTopK          = 20
+	defaultHotKeySketchWidth   = 2048
+	defaultHotKeySketchDepth   = 4
+	defaultHotKeyDecayInterval = time.Minute
+)
+
+// HotKeyOptions options of the hot key tracker, zero values use defaults
+type HotKeyOptions struct {
+	// SampleRate fraction of key accesses recorded, e.g. 0.01, 1 records all
+	SampleRate float64
+	// TopK number of hottest keys kept per namespace, default 20
+	TopK int
+	// SketchWidth, SketchDepth size of the count-min sketch per namespace, default 2048x4
+	SketchWidth int
+	SketchDepth int
+	// DecayInterval counts are halved every interval, so that keys no longer hot fade out, default 1min
+	DecayInterval time.Duration
+}
+
+func (m HotKeyOptions) withDefaults() HotKeyOptions {
+	if m.SampleRate <= 0 || m.SampleRate > 1 {
+		m.SampleRate = 1
+	}
+	if m.TopK <= 0 {
+		m.TopK = defaultHotKeyTopK
+	}
+	if m.SketchWidth <= 0 {
+		m.SketchWidth = defaultHotKeySketchWidth
+	}
+	if m.SketchDepth <= 0 {
+		m.SketchDepth = defaultHotKeySketchDepth
+	}
+	if m.DecayInterval <= 0 {
+		m.DecayInterval = defaultHotKeyDecayInterval
+	}
+	return m
+}
+
+// HotKey Count is estimated from samples, scaled by 1/SampleRate
+type HotKey struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+type hotKeyTracker struct {
+	opts HotKeyOptions
+	// namespace -> *hotKeySketch
+	sketches sync.Map
+}
+
+// current tracker, nil when disabled
+var _hotKeyTracker atomic.Value
+
+func loadHotKeyTracker() *hotKeyTracker {
+	t, _ := _hotKeyTracker.Load().(*hotKeyTracker)
+	return t
+}
+
+// EnableHotKeyTracker start sampling accessed keys of all clients, previous samples are dropped
+func EnableHotKeyTracker(opts HotKeyOptions) {
+	_hotKeyTracker.Store(&hotKeyTracker{opts: opts.withDefaults()})
+}
+
+// DisableHotKeyTracker stop sampling and drop all samples
+func DisableHotKeyTracker() {
+	_hotKeyTracker.Store((*hotKeyTracker)(nil))
+}
+
+func recordHotKey(namespace, key string) {
+	t := loadHotKeyTracker()
+	if t == nil {
+		return
+	}
+	if t.opts.SampleRate < 1 && rand.Float64() >= t.opts.SampleRate {
+		return
+	}
+
+	s, ok := t.sketches.Load(namespace)
+	if !ok {
+		s, _ = t.sketches.LoadOrStore(namespace, newHotKeySketch(t.opts))
+	}
+	s.(*hotKeySketch).add(key)
+}
+
+// HotKeys return the hottest keys of namespace in descending order, nil if tracker is disabled
+func HotKeys(namespace string) []HotKey {
+	t := loadHotKeyTracker()
+	if t == nil {
+		return nil
+	}
+	s, ok := t.sketches.Load(namespace)
+	if !ok {
+		return nil
+	}
+	return s.(*hotKeySketch).top(t.opts.SampleRate)
+}
+
+// HotKeyHandler serve hot keys as json, of the namespace in query or of all namespaces, it can be
+// mounted on the metrics router, e.g. smetric.RegisterHandler("GET", "/debug/redis/hotkeys", redis.HotKeyHandler())
+func HotKeyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := loadHotKeyTracker()
+		if t == nil {
+			http.Error(w, "hot key tracker disabled", http.StatusNotFound)
+			return
+		}
+
+		result := map[string][]HotKey{}
+		if ns := r.URL.Query().Get("namespace"); ns != "" {
+			result[ns] = HotKeys(ns)
+		} else {
+			t.sketches.Range(func(k, v interface{}) bool {
+				result[k.(string)] = v.(*hotKeySketch).top(t.opts.SampleRate)
+				return true
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(result)
+	})
+}
+
+// hotKeySketch count-min sketch of key accesses, plus the top k keys by estimated count
+type hotKeySketch struct {
+	mu            sync.Mutex
+	counts        [][]uint32
+	topK          int
+	heavy         map[string]uint32
+	decayInterval time.Duration
+	lastDecay     time.Time
+}
+
+func newHotKeySketch(opts HotKeyOptions) *hotKeySketch {
+	counts := make([][]uint32, opts.SketchDepth)
+	for i := range counts {
+		counts[i] = make([]uint32, opts.SketchWidth)
+	}
+	return &hotKeySketch{
+		counts:        counts,
+		topK:          opts.TopK,
+		heavy:         make(map[string]uint32, opts.TopK),
+		decayInterval: opts.DecayInterval,
+		lastDecay:     time.Now(),
+	}
+}
+
+func (m *hotKeySketch) add(key string) {
+	// row i uses h1 + i*h2, the two halves of fnv128a
+	h := fnv.New128a()
+	_, _ = h.Write([]byte(key))
+	sum := h.Sum(nil)
+	h1 := binary.BigEndian.Uint64(sum[:8])
+	h2 := binary.BigEndian.Uint64(sum[8:])
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now := time.Now(); now.Sub(m.lastDecay) >= m.decayInterval {
+		m.decay()
+		m.lastDecay = now
+	}
+
+	// estimate is the minimum over rows, after incrementing
+	var estimate uint32
+	width := uint64(len(m.counts[0]))
+	for i, row := range m.counts {
+		j := (h1 + uint64(i)*h2) % width
+		if row[j] < ^uint32(0) {
+			row[j]++
+		}
+		if i == 0 || row[j] < estimate {
+			estimate = row[j]
+		}
+	}
+
+	if _, ok := m.heavy[key]; ok || len(m.heavy) < m.topK {
+		m.heavy[key] = estimate
+		return
+	}
+	minKey, minCount := "", ^uint32(0)
+	for k, c := range m.heavy {
+		if c < minCount {
+			minKey, minCount = k, c
+		}
+	}
+	if estimate > minCount {
+		delete(m.heavy, minKey)
+		m.heavy[key] = estimate
+	}
+}
+
+func (m *hotKeySketch) decay() {
+	for _, row := range m.counts {
+		for j := range row {
+			row[j] >>= 1
+		}
+	}
+	for k, c := range m.heavy {
+		m.heavy[k] = c >> 1
+	}
+}
+
+func (m *hotKeySketch) top(sampleRate float64) []HotKey {
+	m.mu.Lock()
+	keys := make([]HotKey, 0, len(m.heavy))
+	for k, c := range m.heavy {
+		keys = append(keys, HotKey{Key: k, Count: uint64(float64(c) / sampleRate)})
+	}
+	m.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Count != keys[j].Count {
+			return keys[i].Count > keys[j].Count
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	return keys
+}
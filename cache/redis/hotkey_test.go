@@ -0,0 +1,43 @@
+package redis
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHotKeys(t *testing.T) {
+	EnableHotKeyTracker(HotKeyOptions{TopK: 3})
+	defer DisableHotKeyTracker()
+
+	for i := 0; i < 1000; i++ {
+		recordHotKey("test/test", fmt.Sprintf("cold.%d", i))
+		if i%2 == 0 {
+			recordHotKey("test/test", "hot.1")
+		}
+		if i%4 == 0 {
+			recordHotKey("test/test", "hot.2")
+		}
+	}
+
+	keys := HotKeys("test/test")
+	assert.Equal(t, 3, len(keys))
+	assert.Equal(t, "hot.1", keys[0].Key)
+	assert.True(t, keys[0].Count >= 500)
+	assert.Equal(t, "hot.2", keys[1].Key)
+	assert.True(t, keys[1].Count >= 250)
+	assert.Nil(t, HotKeys("test/none"))
+
+	w := httptest.NewRecorder()
+	HotKeyHandler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/redis/hotkeys?namespace=test/test", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `"key":"hot.1"`)
+
+	DisableHotKeyTracker()
+	assert.Nil(t, HotKeys("test/test"))
+	w = httptest.NewRecorder()
+	HotKeyHandler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/redis/hotkeys", nil))
+	assert.Equal(t, 404, w.Code)
+}
@@ -47,9 +47,16 @@ func instanceConfFromString(s string) (conf *InstanceConf, err error) {
 
 var DefaultInstanceManager = NewInstanceManager()
 
+// InstanceHook 在 InstanceManager 新建或替换 client 之后调用
+type InstanceHook func(ctx context.Context, client *Client)
+
 type InstanceManager struct {
 	instances sync.Map
 	watchOnce sync.Once
+	statOnce  sync.Once
+
+	hooksMu sync.RWMutex
+	hooks   []InstanceHook
 }
 
 func NewInstanceManager() *InstanceManager {
@@ -72,8 +79,28 @@ func (m *InstanceManager) newInstance(ctx context.Context, conf *InstanceConf) (
 	return NewClient(ctx, conf.Namespace, conf.Wrapper)
 }
 
+// AddInstanceHook register hook which runs whenever a client is created or replaced
+func (m *InstanceManager) AddInstanceHook(hook InstanceHook) {
+	m.hooksMu.Lock()
+	defer m.hooksMu.Unlock()
+	m.hooks = append(m.hooks, hook)
+}
+
+func (m *InstanceManager) runInstanceHooks(ctx context.Context, client *Client) {
+	m.hooksMu.RLock()
+	hooks := m.hooks
+	m.hooksMu.RUnlock()
+
+	for _, hook := range hooks {
+		hook(ctx, client)
+	}
+}
+
 func (m *InstanceManager) GetInstance(ctx context.Context, conf *InstanceConf) (*Client, error) {
 	fun := "InstanceManager.GetInstance -->"
+	m.statOnce.Do(func() {
+		go m.statPoolStatsLoop(context.Background())
+	})
 
 	var err error
 	var in interface{}
@@ -88,7 +115,11 @@ func (m *InstanceManager) GetInstance(ctx context.Context, conf *InstanceConf) (
 			return nil, err
 		}
 
-		in, _ = m.instances.LoadOrStore(key, in)
+		var loaded bool
+		in, loaded = m.instances.LoadOrStore(key, in)
+		if !loaded {
+			m.runInstanceHooks(ctx, in.(*Client))
+		}
 	}
 
 	client, ok := in.(*Client)
@@ -140,6 +171,7 @@ func (m *InstanceManager) applyChange(ctx context.Context, key string, change *c
 				return
 			}
 			m.instances.Store(k, in)
+			m.runInstanceHooks(ctx, in)
 		}
 
 		return
@@ -160,6 +192,13 @@ func (m *InstanceManager) applyChangeEvent(ctx context.Context, ce *center.Chang
 }
 
 func (m *InstanceManager) Watch(ctx context.Context) {
+	m.WatchConfiger(ctx, DefaultConfiger)
+}
+
+// WatchConfiger 同Watch，监听指定的configer；
+// 以 go m.WatchConfiger(ctx, DefaultConfiger) 启动时configer在调用方读取，
+// 之后替换DefaultConfiger（例如测试中）不会与监听goroutine竞争
+func (m *InstanceManager) WatchConfiger(ctx context.Context, configer Configer) {
 	fun := "InstanceManager.Watch-->"
 	defer func() {
 		if err := recover(); err != nil {
@@ -170,7 +209,7 @@ func (m *InstanceManager) Watch(ctx context.Context) {
 	}()
 	m.watchOnce.Do(func() {
 		slog.Infof(ctx, "%s start watching updates", fun)
-		ceChan := DefaultConfiger.Watch(ctx)
+		ceChan := configer.Watch(ctx)
 	Loop:
 		for {
 			select {
@@ -0,0 +1,98 @@
+package redis
+
+import (
+	"context"
+	"time"
+
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+)
+
+const (
+	namespace = "palfish"
+	subsystem = "redis_pool"
+
+	poolStatsInterval = 15 * time.Second
+)
+
+var (
+	poolStatsLabels = []string{"namespace", "group", "wrapper"}
+
+	_metricPoolHits = xprometheus.NewGauge(&xprometheus.GaugeVecOpts{
+		Namespace:  namespace,
+		Subsystem:  subsystem,
+		Name:       "hits",
+		Help:       "number of times a free connection was found in the pool",
+		LabelNames: poolStatsLabels,
+	})
+	_metricPoolMisses = xprometheus.NewGauge(&xprometheus.GaugeVecOpts{
+		Namespace:  namespace,
+		Subsystem:  subsystem,
+		Name:       "misses",
+		Help:       "number of times a free connection was not found in the pool",
+		LabelNames: poolStatsLabels,
+	})
+	_metricPoolTimeouts = xprometheus.NewGauge(&xprometheus.GaugeVecOpts{
+		Namespace:  namespace,
+		Subsystem:  subsystem,
+		Name:       "timeouts",
+		Help:       "number of times a wait for connection timed out",
+		LabelNames: poolStatsLabels,
+	})
+	_metricPoolTotalConns = xprometheus.NewGauge(&xprometheus.GaugeVecOpts{
+		Namespace:  namespace,
+		Subsystem:  subsystem,
+		Name:       "total_conns",
+		Help:       "number of total connections in the pool",
+		LabelNames: poolStatsLabels,
+	})
+	_metricBreakerState = xprometheus.NewGauge(&xprometheus.GaugeVecOpts{
+		Namespace:  namespace,
+		Subsystem:  "redis_breaker",
+		Name:       "state",
+		Help:       "circuit breaker state, 0 closed, 1 open, 2 half open",
+		LabelNames: []string{"namespace", "group"},
+	})
+	_metricPoolIdleConns = xprometheus.NewGauge(&xprometheus.GaugeVecOpts{
+		Namespace:  namespace,
+		Subsystem:  subsystem,
+		Name:       "idle_conns",
+		Help:       "number of idle connections in the pool",
+		LabelNames: poolStatsLabels,
+	})
+)
+
+func statPoolStats(conf *InstanceConf, client *Client) {
+	stats := client.PoolStats()
+	labels := []string{"namespace", conf.Namespace, "group", conf.Group, "wrapper", conf.Wrapper}
+	_metricPoolHits.With(labels...).Set(float64(stats.Hits))
+	_metricPoolMisses.With(labels...).Set(float64(stats.Misses))
+	_metricPoolTimeouts.With(labels...).Set(float64(stats.Timeouts))
+	_metricPoolTotalConns.With(labels...).Set(float64(stats.TotalConns))
+	_metricPoolIdleConns.With(labels...).Set(float64(stats.IdleConns))
+}
+
+// statPoolStatsLoop export pool stats of all instances periodically until ctx is done
+func (m *InstanceManager) statPoolStatsLoop(ctx context.Context) {
+	ticker := time.NewTicker(poolStatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.instances.Range(func(k, v interface{}) bool {
+				sk, _ := k.(string)
+				client, ok := v.(*Client)
+				conf, err := instanceConfFromString(sk)
+				if ok && err == nil {
+					statPoolStats(conf, client)
+				}
+				return true
+			})
+		}
+	}
+}
+
+func statBreakerState(ns, group string, state BreakerState) {
+	_metricBreakerState.With("namespace", ns, "group", group).Set(float64(state))
+}
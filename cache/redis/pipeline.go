@@ -0,0 +1,70 @@
+package redis
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Pipeline queue commands with keys fixed the same way as Client, commands are sent by Exec
+type Pipeline struct {
+	client *Client
+	pipe   redis.Pipeliner
+	// distinct keys of queued commands, for span log
+	keys []string
+	seen map[string]struct{}
+}
+
+func (m *Pipeline) fixKey(key string) string {
+	k := m.client.fixKey(key)
+	if m.seen == nil {
+		m.seen = map[string]struct{}{}
+	}
+	if _, ok := m.seen[k]; !ok {
+		m.seen[k] = struct{}{}
+		m.keys = append(m.keys, k)
+	}
+	return k
+}
+
+func (m *Pipeline) Get(ctx context.Context, key string) *redis.StringCmd {
+	return m.pipe.Get(m.fixKey(key))
+}
+
+func (m *Pipeline) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
+	return m.pipe.Set(m.fixKey(key), value, expiration)
+}
+
+func (m *Pipeline) Del(ctx context.Context, key string) *redis.IntCmd {
+	return m.pipe.Del(m.fixKey(key))
+}
+
+func (m *Pipeline) Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd {
+	return m.pipe.Expire(m.fixKey(key), expiration)
+}
+
+func (m *Pipeline) PTTL(ctx context.Context, key string) *redis.DurationCmd {
+	return m.pipe.PTTL(m.fixKey(key))
+}
+
+func (m *Pipeline) GetBit(ctx context.Context, key string, offset int64) *redis.IntCmd {
+	return m.pipe.GetBit(m.fixKey(key), offset)
+}
+
+func (m *Pipeline) SetBit(ctx context.Context, key string, offset int64, value int) *redis.IntCmd {
+	return m.pipe.SetBit(m.fixKey(key), offset, value)
+}
+
+// Exec send all queued commands, err is the first failed command's error
+func (m *Pipeline) Exec(ctx context.Context) ([]redis.Cmder, error) {
+	m.client.logSpan(ctx, "Pipeline", strings.Join(m.keys, ","))
+	m.keys, m.seen = nil, nil
+	return m.pipe.Exec()
+}
+
+// Close discard all queued commands
+func (m *Pipeline) Close() error {
+	return m.pipe.Close()
+}
@@ -2,14 +2,19 @@ package redis
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis"
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/log"
 	"github.com/shawnfeng/sutil/cache/constants"
+	"github.com/shawnfeng/sutil/scontext"
 	"github.com/shawnfeng/sutil/slog/slog"
 )
 
@@ -20,6 +25,12 @@ type Client struct {
 	namespace  string
 	wrapper    string
 	useWrapper bool
+
+	// 已经 load 到该实例的 lua 脚本 hash
+	scripts sync.Map
+
+	// read-only commands go to replicas when configured
+	replicas *replicaSet
 }
 
 func NewClient(ctx context.Context, namespace string, wrapper string) (*Client, error) {
@@ -30,25 +41,35 @@ func NewClient(ctx context.Context, namespace string, wrapper string) (*Client,
 		return nil, err
 	}
 
-	client := redis.NewClient(&redis.Options{
+	opts := &redis.Options{
 		Addr:         config.addr,
 		DialTimeout:  3 * config.timeout,
 		ReadTimeout:  config.timeout,
 		WriteTimeout: config.timeout,
 		PoolSize:     config.poolSize,
 		PoolTimeout:  2 * config.timeout,
-	})
+	}
+	client := redis.NewClient(opts)
+	group := scontext.GetControlRouteGroupWithDefault(ctx, defaultGroup)
+	client.SetLimiter(getBreaker(namespace, group, config.breaker))
 
 	pong, err := client.Ping().Result()
 	if err != nil {
 		slog.Errorf(ctx, "%s ping:%s err:%s", fun, pong, err)
 	}
 
+	var replicas *replicaSet
+	if len(config.replicas) > 0 {
+		slog.Infof(ctx, "%s namespace:%s replicas:%v read policy:%s", fun, namespace, config.replicas, config.readPolicy)
+		replicas = newReplicaSet(namespace, group, config.replicas, config.readPolicy, opts, config.breaker)
+	}
+
 	return &Client{
 		client:     client,
 		namespace:  namespace,
 		wrapper:    wrapper,
 		useWrapper: config.useWrapper,
+		replicas:   replicas,
 	}, err
 }
 
@@ -77,7 +98,9 @@ func NewDefaultClient(ctx context.Context, namespace, addr, wrapper string, pool
 	}, err
 }
 
+// fixKey every key accessed goes through it, so it's where hot keys are sampled
 func (m *Client) fixKey(key string) string {
+	recordHotKey(m.namespace, key)
 	parts := []string{
 		m.namespace,
 		m.wrapper,
@@ -92,6 +115,14 @@ func (m *Client) fixKey(key string) string {
 	return strings.Join(parts, ".")
 }
 
+func (m *Client) fixKeys(keys []string) []string {
+	fixKeys := make([]string, len(keys))
+	for i, key := range keys {
+		fixKeys[i] = m.fixKey(key)
+	}
+	return fixKeys
+}
+
 func (m *Client) logSpan(ctx context.Context, op, key string) {
 	if span := opentracing.SpanFromContext(ctx); span != nil {
 		span.LogFields(
@@ -104,7 +135,7 @@ func (m *Client) logSpan(ctx context.Context, op, key string) {
 func (m *Client) Get(ctx context.Context, key string) *redis.StringCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "Get", k)
-	return m.client.Get(k)
+	return m.reader(ctx).Get(k)
 }
 
 func (m *Client) MGet(ctx context.Context, keys ...string) *redis.SliceCmd {
@@ -114,7 +145,7 @@ func (m *Client) MGet(ctx context.Context, keys ...string) *redis.SliceCmd {
 		fixKeys[k] = key
 	}
 	m.logSpan(ctx, "MGet", strings.Join(fixKeys, "||"))
-	return m.client.MGet(fixKeys...)
+	return m.reader(ctx).MGet(fixKeys...)
 }
 
 func (m *Client) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
@@ -142,7 +173,7 @@ func (m *Client) MSet(ctx context.Context, pairs ...interface{}) *redis.StatusCm
 func (m *Client) GetBit(ctx context.Context, key string, offset int64) *redis.IntCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "GetBit", k)
-	return m.client.GetBit(k, offset)
+	return m.reader(ctx).GetBit(k, offset)
 }
 
 func (m *Client) SetBit(ctx context.Context, key string, offset int64, value int) *redis.IntCmd {
@@ -151,10 +182,40 @@ func (m *Client) SetBit(ctx context.Context, key string, offset int64, value int
 	return m.client.SetBit(k, offset, value)
 }
 
+func (m *Client) BitCount(ctx context.Context, key string, bitCount *redis.BitCount) *redis.IntCmd {
+	k := m.fixKey(key)
+	m.logSpan(ctx, "BitCount", k)
+	return m.reader(ctx).BitCount(k, bitCount)
+}
+
+func (m *Client) BitOpAnd(ctx context.Context, destKey string, keys ...string) *redis.IntCmd {
+	dk, ks := m.fixKey(destKey), m.fixKeys(keys)
+	m.logSpan(ctx, "BitOpAnd", dk)
+	return m.client.BitOpAnd(dk, ks...)
+}
+
+func (m *Client) BitOpOr(ctx context.Context, destKey string, keys ...string) *redis.IntCmd {
+	dk, ks := m.fixKey(destKey), m.fixKeys(keys)
+	m.logSpan(ctx, "BitOpOr", dk)
+	return m.client.BitOpOr(dk, ks...)
+}
+
+func (m *Client) BitOpXor(ctx context.Context, destKey string, keys ...string) *redis.IntCmd {
+	dk, ks := m.fixKey(destKey), m.fixKeys(keys)
+	m.logSpan(ctx, "BitOpXor", dk)
+	return m.client.BitOpXor(dk, ks...)
+}
+
+func (m *Client) BitOpNot(ctx context.Context, destKey string, key string) *redis.IntCmd {
+	dk, k := m.fixKey(destKey), m.fixKey(key)
+	m.logSpan(ctx, "BitOpNot", dk)
+	return m.client.BitOpNot(dk, k)
+}
+
 func (m *Client) Exists(ctx context.Context, key string) *redis.IntCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "Exists", k)
-	return m.client.Exists(k)
+	return m.reader(ctx).Exists(k)
 }
 
 func (m *Client) Del(ctx context.Context, keys ...string) *redis.IntCmd {
@@ -218,19 +279,19 @@ func (m *Client) HDel(ctx context.Context, key string, fields ...string) *redis.
 func (m *Client) HExists(ctx context.Context, key string, field string) *redis.BoolCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "HExists", k)
-	return m.client.HExists(k, field)
+	return m.reader(ctx).HExists(k, field)
 }
 
 func (m *Client) HGet(ctx context.Context, key string, field string) *redis.StringCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "HGet", k)
-	return m.client.HGet(k, field)
+	return m.reader(ctx).HGet(k, field)
 }
 
 func (m *Client) HGetAll(ctx context.Context, key string) *redis.StringStringMapCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "HGetAll", k)
-	return m.client.HGetAll(k)
+	return m.reader(ctx).HGetAll(k)
 }
 
 func (m *Client) HIncrBy(ctx context.Context, key string, field string, incr int64) *redis.IntCmd {
@@ -248,19 +309,19 @@ func (m *Client) HIncrByFloat(ctx context.Context, key string, field string, inc
 func (m *Client) HKeys(ctx context.Context, key string) *redis.StringSliceCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "HKeys", k)
-	return m.client.HKeys(k)
+	return m.reader(ctx).HKeys(k)
 }
 
 func (m *Client) HLen(ctx context.Context, key string) *redis.IntCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "HLen", k)
-	return m.client.HLen(k)
+	return m.reader(ctx).HLen(k)
 }
 
 func (m *Client) HMGet(ctx context.Context, key string, fields ...string) *redis.SliceCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "HMGet", k)
-	return m.client.HMGet(k, fields...)
+	return m.reader(ctx).HMGet(k, fields...)
 }
 
 func (m *Client) HMSet(ctx context.Context, key string, fields map[string]interface{}) *redis.StatusCmd {
@@ -278,7 +339,19 @@ func (m *Client) HSetNX(ctx context.Context, key string, field string, val inter
 func (m *Client) HVals(ctx context.Context, key string) *redis.StringSliceCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "HVals", k)
-	return m.client.HVals(k)
+	return m.reader(ctx).HVals(k)
+}
+
+func (m *Client) SMembers(ctx context.Context, key string) *redis.StringSliceCmd {
+	k := m.fixKey(key)
+	m.logSpan(ctx, "SMembers", k)
+	return m.reader(ctx).SMembers(k)
+}
+
+func (m *Client) SRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	k := m.fixKey(key)
+	m.logSpan(ctx, "SRem", k)
+	return m.client.SRem(k, members...)
 }
 
 func (m *Client) ZAdd(ctx context.Context, key string, members ...redis.Z) *redis.IntCmd {
@@ -320,61 +393,61 @@ func (m *Client) ZAddCh(ctx context.Context, key string, members ...redis.Z) *re
 func (m *Client) ZCard(ctx context.Context, key string) *redis.IntCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "ZCard", k)
-	return m.client.ZCard(k)
+	return m.reader(ctx).ZCard(k)
 }
 
 func (m *Client) ZCount(ctx context.Context, key, min, max string) *redis.IntCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "ZCount", k)
-	return m.client.ZCount(k, min, max)
+	return m.reader(ctx).ZCount(k, min, max)
 }
 
 func (m *Client) ZRange(ctx context.Context, key string, start, stop int64) *redis.StringSliceCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "ZRange", k)
-	return m.client.ZRange(k, start, stop)
+	return m.reader(ctx).ZRange(k, start, stop)
 }
 
 func (m *Client) ZRangeByLex(ctx context.Context, key string, by redis.ZRangeBy) *redis.StringSliceCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "ZRangeByLex", k)
-	return m.client.ZRangeByLex(k, by)
+	return m.reader(ctx).ZRangeByLex(k, by)
 }
 
 func (m *Client) ZRangeByScore(ctx context.Context, key string, by redis.ZRangeBy) *redis.StringSliceCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "ZRangeByScore", k)
-	return m.client.ZRangeByScore(k, by)
+	return m.reader(ctx).ZRangeByScore(k, by)
 }
 
 func (m *Client) ZRangeWithScores(ctx context.Context, key string, start, stop int64) *redis.ZSliceCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "ZRangeWithScores", k)
-	return m.client.ZRangeWithScores(k, start, stop)
+	return m.reader(ctx).ZRangeWithScores(k, start, stop)
 }
 
 func (m *Client) ZRevRange(ctx context.Context, key string, start, stop int64) *redis.StringSliceCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "ZRevRange", k)
-	return m.client.ZRevRange(k, start, stop)
+	return m.reader(ctx).ZRevRange(k, start, stop)
 }
 
 func (m *Client) ZRevRangeWithScores(ctx context.Context, key string, start, stop int64) *redis.ZSliceCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "ZRevRangeWithScores", k)
-	return m.client.ZRevRangeWithScores(k, start, stop)
+	return m.reader(ctx).ZRevRangeWithScores(k, start, stop)
 }
 
 func (m *Client) ZRank(ctx context.Context, key string, member string) *redis.IntCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "ZRank", k)
-	return m.client.ZRank(k, member)
+	return m.reader(ctx).ZRank(k, member)
 }
 
 func (m *Client) ZRevRank(ctx context.Context, key string, member string) *redis.IntCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "ZRevRank", k)
-	return m.client.ZRevRank(k, member)
+	return m.reader(ctx).ZRevRank(k, member)
 }
 
 func (m *Client) ZRem(ctx context.Context, key string, members []interface{}) *redis.IntCmd {
@@ -410,13 +483,13 @@ func (m *Client) ZIncrBy(ctx context.Context, key string, increment float64, mem
 func (m *Client) ZScore(ctx context.Context, key string, member string) *redis.FloatCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "ZScore", k)
-	return m.client.ZScore(k, member)
+	return m.reader(ctx).ZScore(k, member)
 }
 
 func (m *Client) LIndex(ctx context.Context, key string, index int64) *redis.StringCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "LIndex", k)
-	return m.client.LIndex(k, index)
+	return m.reader(ctx).LIndex(k, index)
 }
 
 func (m *Client) LInsert(ctx context.Context, key, op string, pivot, value interface{}) *redis.IntCmd {
@@ -428,7 +501,7 @@ func (m *Client) LInsert(ctx context.Context, key, op string, pivot, value inter
 func (m *Client) LLen(ctx context.Context, key string) *redis.IntCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "LLen", k)
-	return m.client.LLen(k)
+	return m.reader(ctx).LLen(k)
 }
 
 func (m *Client) LPop(ctx context.Context, key string) *redis.StringCmd {
@@ -452,7 +525,7 @@ func (m *Client) LPushX(ctx context.Context, key string, value interface{}) *red
 func (m *Client) LRange(ctx context.Context, key string, start, stop int64) *redis.StringSliceCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "LRange", k)
-	return m.client.LRange(k, start, stop)
+	return m.reader(ctx).LRange(k, start, stop)
 }
 
 func (m *Client) LRem(ctx context.Context, key string, count int64, value interface{}) *redis.IntCmd {
@@ -491,12 +564,20 @@ func (m *Client) RPushX(ctx context.Context, key string, value interface{}) *red
 	return m.client.RPushX(k, value)
 }
 
+// TTL always on the primary, replicas don't expire keys themselves and may report stale ttl
 func (m *Client) TTL(ctx context.Context, key string) *redis.DurationCmd {
 	k := m.fixKey(key)
 	m.logSpan(ctx, "TTL", k)
 	return m.client.TTL(k)
 }
 
+// PTTL always on the primary, see TTL
+func (m *Client) PTTL(ctx context.Context, key string) *redis.DurationCmd {
+	k := m.fixKey(key)
+	m.logSpan(ctx, "PTTL", k)
+	return m.client.PTTL(k)
+}
+
 func (m *Client) ScriptLoad(ctx context.Context, script string) *redis.StringCmd {
 	m.logSpan(ctx, "ScriptLoad", script)
 	return m.client.ScriptLoad(script)
@@ -523,6 +604,76 @@ func (m *Client) EvalSha(ctx context.Context, scriptHash string, keys []string,
 	return m.client.EvalSha(scriptHash, keys, args...)
 }
 
+// RunScript exec script with EVALSHA of scriptHash, see ScriptHash, fallback to EVAL if the script
+// is not loaded on the redis server, e.g. after a redis restart or failover. Loaded status is
+// cached per client.
+func (m *Client) RunScript(ctx context.Context, script, scriptHash string, keys []string, args ...interface{}) *redis.Cmd {
+	m.logSpan(ctx, "RunScript", scriptHash)
+	fixKeys := make([]string, len(keys))
+	for i, key := range keys {
+		fixKeys[i] = m.fixKey(key)
+	}
+
+	if m.ScriptLoaded(scriptHash) {
+		cmd := m.client.EvalSha(scriptHash, fixKeys, args...)
+		if !isNoScriptErr(cmd.Err()) {
+			return cmd
+		}
+		m.SetScriptLoaded(scriptHash, false)
+	}
+
+	// EVAL caches the script on redis server as a side effect
+	cmd := m.client.Eval(script, fixKeys, args...)
+	if err := cmd.Err(); err == nil || err == redis.Nil {
+		m.SetScriptLoaded(scriptHash, true)
+	}
+	return cmd
+}
+
+// ScriptHash sha1 hex of script, the hash of EVALSHA
+func ScriptHash(script string) string {
+	h := sha1.New()
+	_, _ = io.WriteString(h, script)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func isNoScriptErr(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT")
+}
+
+// Pipeline send queued commands in one round trip when Exec is called
+func (m *Client) Pipeline(ctx context.Context) *Pipeline {
+	return &Pipeline{
+		client: m,
+		pipe:   m.client.Pipeline(),
+	}
+}
+
+// ScriptLoaded report whether script of scriptHash is known to be loaded on this client
+func (m *Client) ScriptLoaded(scriptHash string) bool {
+	_, ok := m.scripts.Load(scriptHash)
+	return ok
+}
+
+// SetScriptLoaded record the loaded status of script, e.g. after ScriptLoad or NOSCRIPT
+func (m *Client) SetScriptLoaded(scriptHash string, loaded bool) {
+	if loaded {
+		m.scripts.Store(scriptHash, struct{}{})
+	} else {
+		m.scripts.Delete(scriptHash)
+	}
+}
+
+// PoolStats return connection pool stats of the underlying redis client
+func (m *Client) PoolStats() *redis.PoolStats {
+	return m.client.PoolStats()
+}
+
 func (m *Client) Close(ctx context.Context) error {
+	if m.replicas != nil {
+		if err := m.replicas.close(); err != nil {
+			slog.Errorf(ctx, "Client.Close --> close replicas err:%v", err)
+		}
+	}
 	return m.client.Close()
 }
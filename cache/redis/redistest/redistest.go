@@ -0,0 +1,254 @@
+// Package redistest in-process redis server for tests of cache, redisext and redispool.
+//
+// Commands are served by miniredis, including EVAL and pub/sub. Its clock only moves by
+// FastForward or SetTime, so TTLs are deterministic. Every connection goes through a proxy
+// which can inject latency, error replies and connection drops.
+package redistest
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/shawnfeng/sutil/cache/redis"
+	"github.com/shawnfeng/sutil/slog/slog"
+)
+
+type Server struct {
+	mr       *miniredis.Miniredis
+	listener net.Listener
+
+	// injected faults
+	latency int64
+	errMu   sync.RWMutex
+	errMsg  string
+
+	connsMu sync.Mutex
+	conns   map[net.Conn]struct{}
+	wg      sync.WaitGroup
+}
+
+// NewServer start a server listening on a random local port
+func NewServer() (*Server, error) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		mr.Close()
+		return nil, err
+	}
+
+	s := &Server{
+		mr:       mr,
+		listener: listener,
+		conns:    map[net.Conn]struct{}{},
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// Use start a server and route namespaces to it through redis.DefaultConfiger, instances
+// created before are closed so that they are recreated against the server
+func Use(namespaces ...string) (*Server, error) {
+	s, err := NewServer()
+	if err != nil {
+		return nil, err
+	}
+
+	configer := redis.NewStaticConfiger()
+	for _, namespace := range namespaces {
+		configer.SetAddr(namespace, s.Addr())
+	}
+	redis.DefaultConfiger = configer
+	redis.DefaultInstanceManager.Close()
+	return s, nil
+}
+
+// MustUse same as Use but panic on error, e.g. s := redistest.MustUse("test/test") in TestMain
+func MustUse(namespaces ...string) *Server {
+	s, err := Use(namespaces...)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Addr address of the proxy, clients should connect to it instead of miniredis
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Miniredis the underlying server, e.g. to inspect or seed keys directly
+func (s *Server) Miniredis() *miniredis.Miniredis {
+	return s.mr
+}
+
+// FastForward move the clock of the server, keys expire accordingly
+func (s *Server) FastForward(d time.Duration) {
+	s.mr.FastForward(d)
+}
+
+// SetTime set the time returned by TIME and used by scripts
+func (s *Server) SetTime(t time.Time) {
+	s.mr.SetTime(t)
+}
+
+// FlushAll remove all keys
+func (s *Server) FlushAll() {
+	s.mr.FlushAll()
+}
+
+// SetLatency delay every command by d, 0 removes the delay
+func (s *Server) SetLatency(d time.Duration) {
+	atomic.StoreInt64(&s.latency, int64(d))
+}
+
+// SetError reply every command with error msg instead of running it, "" stops it
+func (s *Server) SetError(msg string) {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	s.errMsg = msg
+}
+
+func (s *Server) injectedError() string {
+	s.errMu.RLock()
+	defer s.errMu.RUnlock()
+	return s.errMsg
+}
+
+// DropConnections close all current connections, clients see EOF or connection reset
+func (s *Server) DropConnections() {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	for c := range s.conns {
+		_ = c.Close()
+	}
+}
+
+func (s *Server) Close() {
+	_ = s.listener.Close()
+	s.DropConnections()
+	s.wg.Wait()
+	s.mr.Close()
+}
+
+func (s *Server) track(c net.Conn, add bool) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if add {
+		s.conns[c] = struct{}{}
+	} else {
+		delete(s.conns, c)
+	}
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go s.serve(c)
+	}
+}
+
+// slot of a reply to write back to the client in command order
+type slot struct {
+	// injected error, otherwise the next reply of upstream is forwarded
+	errMsg string
+	// after SUBSCRIBE replies are pushed by upstream, everything is forwarded as is
+	passthrough bool
+}
+
+func (s *Server) serve(client net.Conn) {
+	fun := "Server.serve -->"
+	defer s.wg.Done()
+
+	upstream, err := net.Dial("tcp", s.mr.Addr())
+	if err != nil {
+		slog.Errorf(context.TODO(), "%s dial miniredis err:%v", fun, err)
+		_ = client.Close()
+		return
+	}
+	s.track(client, true)
+	s.track(upstream, true)
+	defer func() {
+		_ = client.Close()
+		_ = upstream.Close()
+		s.track(client, false)
+		s.track(upstream, false)
+	}()
+
+	slots := make(chan slot, 1024)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.writeReplies(client, bufio.NewReader(upstream), slots)
+		_ = client.Close()
+	}()
+	defer func() {
+		// unblock the writer if it's waiting for upstream
+		close(slots)
+		_ = upstream.Close()
+		<-done
+	}()
+
+	r := bufio.NewReader(client)
+	for {
+		raw, err := readValue(r)
+		if err != nil {
+			return
+		}
+		if d := atomic.LoadInt64(&s.latency); d > 0 {
+			time.Sleep(time.Duration(d))
+		}
+		if msg := s.injectedError(); msg != "" {
+			slots <- slot{errMsg: msg}
+			continue
+		}
+
+		if _, err = upstream.Write(raw); err != nil {
+			return
+		}
+		slots <- slot{}
+
+		switch commandName(raw) {
+		case "SUBSCRIBE", "PSUBSCRIBE":
+			slots <- slot{passthrough: true}
+			_, _ = io.Copy(upstream, r)
+			return
+		}
+	}
+}
+
+func (s *Server) writeReplies(client net.Conn, upstream *bufio.Reader, slots <-chan slot) {
+	for sl := range slots {
+		switch {
+		case sl.passthrough:
+			_, _ = io.Copy(client, upstream)
+			return
+		case sl.errMsg != "":
+			if _, err := client.Write(errorReply(sl.errMsg)); err != nil {
+				return
+			}
+		default:
+			raw, err := readValue(upstream)
+			if err != nil {
+				return
+			}
+			if _, err = client.Write(raw); err != nil {
+				return
+			}
+		}
+	}
+}
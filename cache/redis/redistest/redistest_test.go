@@ -0,0 +1,95 @@
+package redistest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	redis2 "github.com/go-redis/redis"
+	"github.com/shawnfeng/sutil/cache/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer(t *testing.T) {
+	s, err := NewServer()
+	assert.NoError(t, err)
+	defer s.Close()
+
+	c := redis2.NewClient(&redis2.Options{Addr: s.Addr(), ReadTimeout: 100 * time.Millisecond, MaxRetries: 0})
+	defer c.Close()
+
+	assert.NoError(t, c.Set("k", "v", time.Second).Err())
+	pipe := c.Pipeline()
+	get := pipe.Get("k")
+	pipe.HSet("h", "f", 1)
+	hget := pipe.HGet("h", "f")
+	_, err = pipe.Exec()
+	assert.NoError(t, err)
+	assert.Equal(t, "v", get.Val())
+	assert.Equal(t, "1", hget.Val())
+
+	// clock
+	s.FastForward(2 * time.Second)
+	assert.Equal(t, redis2.Nil, c.Get("k").Err())
+
+	// scripts
+	n, err := c.Eval("return redis.call('INCRBY', KEYS[1], ARGV[1])", []string{"n"}, 3).Int64()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+
+	// injected error
+	s.SetError("ERR injected")
+	assert.EqualError(t, c.Get("k").Err(), "ERR injected")
+	s.SetError("")
+	assert.Equal(t, redis2.Nil, c.Get("k").Err())
+
+	// latency beyond read timeout
+	s.SetLatency(200 * time.Millisecond)
+	err = c.Get("k").Err()
+	assert.Error(t, err)
+	assert.NotEqual(t, redis2.Nil, err)
+	s.SetLatency(0)
+	time.Sleep(300 * time.Millisecond)
+
+	// dropped connections are redialed by the pool
+	assert.NoError(t, c.Ping().Err())
+	s.DropConnections()
+	_ = c.Ping().Err()
+	assert.NoError(t, c.Ping().Err())
+}
+
+func TestServer_PubSub(t *testing.T) {
+	s, err := NewServer()
+	assert.NoError(t, err)
+	defer s.Close()
+
+	c := redis2.NewClient(&redis2.Options{Addr: s.Addr()})
+	defer c.Close()
+
+	sub := c.Subscribe("ch")
+	defer sub.Close()
+	_, err = sub.Receive()
+	assert.NoError(t, err)
+
+	assert.NoError(t, c.Publish("ch", "hello").Err())
+	msg, err := sub.ReceiveMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", msg.Payload)
+}
+
+func TestUse(t *testing.T) {
+	s := MustUse("test/redistest")
+	defer s.Close()
+
+	ctx := context.Background()
+	client, err := redis.DefaultInstanceManager.GetInstance(ctx, &redis.InstanceConf{
+		Group:     "default",
+		Namespace: "test/redistest",
+		Wrapper:   "e",
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, client.Set(ctx, "k", "v", 0).Err())
+	v, err := s.Miniredis().Get("test/redistest.e.k")
+	assert.NoError(t, err)
+	assert.Equal(t, "v", v)
+}
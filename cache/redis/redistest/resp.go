@@ -0,0 +1,76 @@
+package redistest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// readValue read one RESP value, raw is its bytes as read, e.g. to be forwarded as is
+func readValue(r *bufio.Reader) (raw []byte, err error) {
+	var buf bytes.Buffer
+	if err = readValueTo(r, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func readValueTo(r *bufio.Reader, buf *bytes.Buffer) error {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	buf.Write(line)
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return fmt.Errorf("invalid resp line:%q", line)
+	}
+
+	switch line[0] {
+	case '+', '-', ':':
+		return nil
+	case '$':
+		n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return nil
+		}
+		data := make([]byte, n+2)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return err
+		}
+		buf.Write(data)
+		return nil
+	case '*':
+		n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err = readValueTo(r, buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid resp type:%q", line[0])
+	}
+}
+
+// commandName upper case name of a command sent as an array of bulk strings
+func commandName(raw []byte) string {
+	// *<n>\r\n$<len>\r\n<name>\r\n
+	parts := bytes.SplitN(raw, []byte("\r\n"), 4)
+	if len(parts) < 3 {
+		return ""
+	}
+	return strings.ToUpper(string(parts[2]))
+}
+
+func errorReply(msg string) []byte {
+	return []byte("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(msg) + "\r\n")
+}
@@ -0,0 +1,201 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/shawnfeng/sutil/slog/slog"
+)
+
+const (
+	replicaCheckInterval = time.Second
+	// weight of the latest ping in the latency moving average
+	replicaLatencyAlpha = 0.2
+)
+
+// ReadPolicy how read-only commands choose among healthy replicas
+type ReadPolicy int
+
+const (
+	ReadRandom ReadPolicy = iota
+	ReadRoundRobin
+	// ReadLowestLatency the replica with the lowest moving average ping latency
+	ReadLowestLatency
+)
+
+func (p ReadPolicy) String() string {
+	switch p {
+	case ReadRandom:
+		return "random"
+	case ReadRoundRobin:
+		return "roundrobin"
+	case ReadLowestLatency:
+		return "latency"
+	default:
+		return fmt.Sprintf("ReadPolicy(%d)", int(p))
+	}
+}
+
+func parseReadPolicy(s string) (ReadPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "random":
+		return ReadRandom, nil
+	case "roundrobin":
+		return ReadRoundRobin, nil
+	case "latency":
+		return ReadLowestLatency, nil
+	default:
+		return ReadRandom, fmt.Errorf("unknown read policy:%s", s)
+	}
+}
+
+type primaryKey struct{}
+
+// WithPrimary force read-only commands issued with the returned context to the primary,
+// e.g. to read your own writes
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+func isPrimaryForced(ctx context.Context) bool {
+	forced, _ := ctx.Value(primaryKey{}).(bool)
+	return forced
+}
+
+type replica struct {
+	addr    string
+	client  *redis.Client
+	healthy int32
+	// moving average of ping latency in nanoseconds
+	latency int64
+}
+
+type replicaSet struct {
+	namespace string
+	policy    ReadPolicy
+	replicas  []*replica
+	next      uint64
+	done      chan struct{}
+}
+
+// newReplicaSet replicas are unhealthy until the first ping in the background succeeds, reads go
+// to the primary meanwhile. Every replica has a breaker of its own, so a broken replica doesn't
+// open the breaker of the primary, and an open breaker fails the ping and removes the replica.
+func newReplicaSet(namespace, group string, addrs []string, policy ReadPolicy, opts *redis.Options, breaker BreakerConfig) *replicaSet {
+	m := &replicaSet{
+		namespace: namespace,
+		policy:    policy,
+		done:      make(chan struct{}),
+	}
+	for _, addr := range addrs {
+		o := *opts
+		o.Addr = addr
+		client := redis.NewClient(&o)
+		client.SetLimiter(getBreaker(namespace, replicaBreakerGroup(group, addr), breaker))
+		m.replicas = append(m.replicas, &replica{
+			addr:   addr,
+			client: client,
+		})
+	}
+	go m.checkLoop()
+	return m
+}
+
+// replicaBreakerGroup group of the breaker of a replica, e.g. GetBreakerState(namespace, "default@10.0.0.2:6379")
+func replicaBreakerGroup(group, addr string) string {
+	return group + "@" + addr
+}
+
+// pick return a healthy replica by policy, nil if none
+func (m *replicaSet) pick() *redis.Client {
+	healthy := make([]*replica, 0, len(m.replicas))
+	for _, r := range m.replicas {
+		if atomic.LoadInt32(&r.healthy) == 1 {
+			healthy = append(healthy, r)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	switch m.policy {
+	case ReadRoundRobin:
+		return healthy[atomic.AddUint64(&m.next, 1)%uint64(len(healthy))].client
+	case ReadLowestLatency:
+		best := healthy[0]
+		for _, r := range healthy[1:] {
+			if atomic.LoadInt64(&r.latency) < atomic.LoadInt64(&best.latency) {
+				best = r
+			}
+		}
+		return best.client
+	default:
+		return healthy[rand.Intn(len(healthy))].client
+	}
+}
+
+func (m *replicaSet) checkLoop() {
+	m.check()
+	ticker := time.NewTicker(replicaCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			m.check()
+		}
+	}
+}
+
+// check ping every replica, a failed ping removes the replica until a ping succeeds again
+func (m *replicaSet) check() {
+	fun := "replicaSet.check -->"
+	for _, r := range m.replicas {
+		st := time.Now()
+		err := r.client.Ping().Err()
+		if err != nil {
+			if atomic.SwapInt32(&r.healthy, 0) == 1 {
+				slog.Warnf(context.TODO(), "%s namespace:%s replica:%s unhealthy, err:%v", fun, m.namespace, r.addr, err)
+			}
+			continue
+		}
+
+		latency := int64(time.Since(st))
+		if old := atomic.LoadInt64(&r.latency); old > 0 {
+			latency = int64(replicaLatencyAlpha*float64(latency) + (1-replicaLatencyAlpha)*float64(old))
+		}
+		atomic.StoreInt64(&r.latency, latency)
+		if atomic.SwapInt32(&r.healthy, 1) == 0 {
+			slog.Infof(context.TODO(), "%s namespace:%s replica:%s healthy", fun, m.namespace, r.addr)
+		}
+	}
+}
+
+func (m *replicaSet) close() error {
+	close(m.done)
+	var err error
+	for _, r := range m.replicas {
+		if e := r.client.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// reader return the client of read-only commands: a healthy replica, or the primary if
+// forced by ctx or no replica is available
+func (m *Client) reader(ctx context.Context) *redis.Client {
+	if m.replicas == nil || isPrimaryForced(ctx) {
+		return m.client
+	}
+	if c := m.replicas.pick(); c != nil {
+		return c
+	}
+	return m.client
+}
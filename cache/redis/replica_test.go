@@ -0,0 +1,73 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplicaSet_Pick(t *testing.T) {
+	newReplica := func(addr string, healthy int32, latency int64) *replica {
+		return &replica{
+			addr:    addr,
+			client:  redis.NewClient(&redis.Options{Addr: addr}),
+			healthy: healthy,
+			latency: latency,
+		}
+	}
+	a := newReplica("a:6379", 1, 300)
+	b := newReplica("b:6379", 1, 100)
+	c := newReplica("c:6379", 0, 10)
+	rs := &replicaSet{replicas: []*replica{a, b, c}}
+
+	rs.policy = ReadRoundRobin
+	picked := map[string]int{}
+	for i := 0; i < 10; i++ {
+		picked[rs.pick().Options().Addr]++
+	}
+	assert.Equal(t, map[string]int{"a:6379": 5, "b:6379": 5}, picked)
+
+	rs.policy = ReadLowestLatency
+	assert.Equal(t, "b:6379", rs.pick().Options().Addr)
+
+	rs.policy = ReadRandom
+	for i := 0; i < 10; i++ {
+		assert.NotEqual(t, "c:6379", rs.pick().Options().Addr)
+	}
+
+	primary := redis.NewClient(&redis.Options{Addr: "primary:6379"})
+	client := &Client{client: primary, replicas: rs}
+	ctx := context.Background()
+	assert.NotEqual(t, "primary:6379", client.reader(ctx).Options().Addr)
+	assert.Equal(t, "primary:6379", client.reader(WithPrimary(ctx)).Options().Addr)
+
+	a.healthy, b.healthy = 0, 0
+	assert.Equal(t, "primary:6379", client.reader(ctx).Options().Addr)
+}
+
+func TestParseReadPolicy(t *testing.T) {
+	for s, want := range map[string]ReadPolicy{"": ReadRandom, "random": ReadRandom, "RoundRobin": ReadRoundRobin, "latency": ReadLowestLatency} {
+		p, err := parseReadPolicy(s)
+		assert.NoError(t, err)
+		assert.Equal(t, want, p)
+	}
+	_, err := parseReadPolicy("nearest")
+	assert.Error(t, err)
+}
+
+func TestNewReplicaSet(t *testing.T) {
+	s, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer s.Close()
+
+	rs := newReplicaSet("test/replica", "default", []string{s.Addr()}, ReadRandom, &redis.Options{}, defaultBreakerConfig())
+	defer rs.close()
+	_, ok := breakers.Load("test/replica" + keySep + replicaBreakerGroup("default", s.Addr()))
+	assert.True(t, ok)
+	// probed in the background
+	assert.Eventually(t, func() bool { return rs.pick() != nil }, time.Second, 10*time.Millisecond)
+}
@@ -6,9 +6,8 @@ import (
 	"time"
 )
 
-var client, _ = NewCommonRedis("test/test", 1024)
-
 func TestTtl(t *testing.T) {
+	client := newTestRedis(t)
 	key := "aaa"
 	val := "bbb"
 	exp := 2 * time.Hour
@@ -24,9 +23,19 @@ func TestTtl(t *testing.T) {
 }
 
 func TestGet(t *testing.T) {
+	client := newTestRedis(t)
 	key := "aaa"
 	ttl := client.TTL(key)
 	t.Log(ttl.Val().Seconds())
 	get := client.Get(key)
 	t.Log(get.Val())
 }
+
+// NewCommonRedis 固定连接codis，测试连接redistest server
+func newTestRedis(t *testing.T) *RedisClient {
+	client, err := newRedisClient(server.Addr(), "test/test", 1024)
+	if err != nil {
+		t.Fatalf("newRedisClient err: %s", err.Error())
+	}
+	return client
+}
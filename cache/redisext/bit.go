@@ -0,0 +1,104 @@
+package redisext
+
+import (
+	"context"
+
+	redis2 "github.com/go-redis/redis"
+	"github.com/opentracing/opentracing-go"
+	"github.com/shawnfeng/sutil/stime"
+)
+
+type BitCount struct {
+	Start, End int64
+}
+
+func toRedisBitCount(bitCount *BitCount) *redis2.BitCount {
+	if bitCount == nil {
+		return nil
+	}
+	return &redis2.BitCount{
+		Start: bitCount.Start,
+		End:   bitCount.End,
+	}
+}
+
+// BitCount count set bits of key, bitCount is nil for the whole string
+func (m *RedisExt) BitCount(ctx context.Context, key string, bitCount *BitCount) (n int64, err error) {
+	command := "redisext.BitCount"
+	span, ctx := opentracing.StartSpanFromContext(ctx, command)
+	st := stime.NewTimeStat()
+	defer func() {
+		span.Finish()
+		statReqDuration(m.namespace, command, st.Millisecond())
+	}()
+	client, err := m.getRedisInstance(ctx)
+	if err == nil {
+		n, err = client.BitCount(ctx, m.prefixKey(key), toRedisBitCount(bitCount)).Result()
+	}
+	statReqErr(m.namespace, command, err)
+	return
+}
+
+func (m *RedisExt) BitOpAnd(ctx context.Context, destKey string, keys ...string) (n int64, err error) {
+	command := "redisext.BitOpAnd"
+	span, ctx := opentracing.StartSpanFromContext(ctx, command)
+	st := stime.NewTimeStat()
+	defer func() {
+		span.Finish()
+		statReqDuration(m.namespace, command, st.Millisecond())
+	}()
+	client, err := m.getRedisInstance(ctx)
+	if err == nil {
+		n, err = client.BitOpAnd(ctx, m.prefixKey(destKey), m.prefixKeys(keys)...).Result()
+	}
+	statReqErr(m.namespace, command, err)
+	return
+}
+
+func (m *RedisExt) BitOpOr(ctx context.Context, destKey string, keys ...string) (n int64, err error) {
+	command := "redisext.BitOpOr"
+	span, ctx := opentracing.StartSpanFromContext(ctx, command)
+	st := stime.NewTimeStat()
+	defer func() {
+		span.Finish()
+		statReqDuration(m.namespace, command, st.Millisecond())
+	}()
+	client, err := m.getRedisInstance(ctx)
+	if err == nil {
+		n, err = client.BitOpOr(ctx, m.prefixKey(destKey), m.prefixKeys(keys)...).Result()
+	}
+	statReqErr(m.namespace, command, err)
+	return
+}
+
+func (m *RedisExt) BitOpXor(ctx context.Context, destKey string, keys ...string) (n int64, err error) {
+	command := "redisext.BitOpXor"
+	span, ctx := opentracing.StartSpanFromContext(ctx, command)
+	st := stime.NewTimeStat()
+	defer func() {
+		span.Finish()
+		statReqDuration(m.namespace, command, st.Millisecond())
+	}()
+	client, err := m.getRedisInstance(ctx)
+	if err == nil {
+		n, err = client.BitOpXor(ctx, m.prefixKey(destKey), m.prefixKeys(keys)...).Result()
+	}
+	statReqErr(m.namespace, command, err)
+	return
+}
+
+func (m *RedisExt) BitOpNot(ctx context.Context, destKey string, key string) (n int64, err error) {
+	command := "redisext.BitOpNot"
+	span, ctx := opentracing.StartSpanFromContext(ctx, command)
+	st := stime.NewTimeStat()
+	defer func() {
+		span.Finish()
+		statReqDuration(m.namespace, command, st.Millisecond())
+	}()
+	client, err := m.getRedisInstance(ctx)
+	if err == nil {
+		n, err = client.BitOpNot(ctx, m.prefixKey(destKey), m.prefixKey(key)).Result()
+	}
+	statReqErr(m.namespace, command, err)
+	return
+}
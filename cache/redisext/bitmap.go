@@ -0,0 +1,115 @@
+package redisext
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/shawnfeng/sutil/stime"
+)
+
+const (
+	dailyBitmapDayLayout = "20060102"
+	// the temp key of CountAny/CountAll is deleted right after counting, it expires in case the delete is missed
+	dailyBitmapTmpExpiration = time.Minute
+)
+
+// DailyBitmap one bitmap per day, e.g. bit uid is set when user uid is active that day.
+// Days are formatted in the location of the given time.
+type DailyBitmap struct {
+	ext  *RedisExt
+	name string
+	// how long the bitmap of a day is kept, 0 means forever
+	retention time.Duration
+}
+
+func NewDailyBitmap(ext *RedisExt, name string, retention time.Duration) *DailyBitmap {
+	return &DailyBitmap{
+		ext:       ext,
+		name:      name,
+		retention: retention,
+	}
+}
+
+// braces make it a hash tag, so BITOP over days of one bitmap stays in the same slot
+func (m *DailyBitmap) key(day time.Time) string {
+	return fmt.Sprintf("bitmap.{%s}.%s", m.name, day.Format(dailyBitmapDayLayout))
+}
+
+func (m *DailyBitmap) keys(days []time.Time) []string {
+	keys := make([]string, len(days))
+	for i, day := range days {
+		keys[i] = m.key(day)
+	}
+	return keys
+}
+
+// Set set bit offset of day, return the previous bit
+func (m *DailyBitmap) Set(ctx context.Context, day time.Time, offset int64) (old bool, err error) {
+	command := "redisext.DailyBitmap.Set"
+	span, ctx := opentracing.StartSpanFromContext(ctx, command)
+	st := stime.NewTimeStat()
+	defer func() {
+		span.Finish()
+		statReqDuration(m.ext.namespace, command, st.Millisecond())
+		statReqErr(m.ext.namespace, command, err)
+	}()
+
+	client, err := m.ext.getRedisInstance(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	key := m.ext.prefixKey(m.key(day))
+	pipe := client.Pipeline(ctx)
+	defer pipe.Close()
+	cmd := pipe.SetBit(ctx, key, offset, 1)
+	if m.retention > 0 {
+		pipe.Expire(ctx, key, m.retention)
+	}
+	if _, err = pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	return cmd.Val() == 1, nil
+}
+
+// Get report whether bit offset of day is set
+func (m *DailyBitmap) Get(ctx context.Context, day time.Time, offset int64) (bool, error) {
+	n, err := m.ext.GetBit(ctx, m.key(day), offset)
+	return n == 1, err
+}
+
+// Count count set bits of day
+func (m *DailyBitmap) Count(ctx context.Context, day time.Time) (int64, error) {
+	return m.ext.BitCount(ctx, m.key(day), nil)
+}
+
+// CountAny count bits set in any of days, e.g. active users of a week
+func (m *DailyBitmap) CountAny(ctx context.Context, days ...time.Time) (int64, error) {
+	return m.countBitOp(ctx, m.ext.BitOpOr, days)
+}
+
+// CountAll count bits set in all of days, e.g. users active every day of a week
+func (m *DailyBitmap) CountAll(ctx context.Context, days ...time.Time) (int64, error) {
+	return m.countBitOp(ctx, m.ext.BitOpAnd, days)
+}
+
+func (m *DailyBitmap) countBitOp(ctx context.Context, op func(context.Context, string, ...string) (int64, error), days []time.Time) (int64, error) {
+	if len(days) == 0 {
+		return 0, nil
+	}
+
+	dest := fmt.Sprintf("bitmap.{%s}.tmp.%d", m.name, rand.Int63())
+	defer m.ext.Del(ctx, dest)
+
+	if _, err := op(ctx, dest, m.keys(days)...); err != nil {
+		return 0, err
+	}
+	if _, err := m.ext.Expire(ctx, dest, dailyBitmapTmpExpiration); err != nil {
+		return 0, err
+	}
+	// dest was just written to the primary, replicas may not have it yet
+	return m.ext.BitCount(WithPrimary(ctx), dest, nil)
+}
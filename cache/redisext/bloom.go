@@ -0,0 +1,176 @@
+package redisext
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"time"
+
+	redis2 "github.com/go-redis/redis"
+	"github.com/opentracing/opentracing-go"
+	"github.com/shawnfeng/sutil/stime"
+)
+
+// a redis string holds at most 512MB
+const maxBloomFilterBits = 1 << 32
+
+// BloomFilter redis backed bloom filter, the bit array is a single redis string
+type BloomFilter struct {
+	ext        *RedisExt
+	name       string
+	bits       uint64
+	hashes     uint64
+	expiration time.Duration
+}
+
+// NewBloomFilter derive the number of bits and hash functions from the expected capacity
+// and false positive rate, expiration is refreshed on every Add, 0 means never expire
+func NewBloomFilter(ext *RedisExt, name string, capacity uint64, fpRate float64, expiration time.Duration) (*BloomFilter, error) {
+	if capacity == 0 {
+		return nil, fmt.Errorf("invalid bloom filter capacity:%d", capacity)
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		return nil, fmt.Errorf("invalid bloom filter false positive rate:%v", fpRate)
+	}
+
+	bits, hashes := bloomFilterParams(capacity, fpRate)
+	if bits > maxBloomFilterBits {
+		return nil, fmt.Errorf("bloom filter too large, bits:%d", bits)
+	}
+
+	return &BloomFilter{
+		ext:        ext,
+		name:       name,
+		bits:       bits,
+		hashes:     hashes,
+		expiration: expiration,
+	}, nil
+}
+
+// bloomFilterParams m = -n*ln(p)/(ln2)^2, k = m/n*ln2
+func bloomFilterParams(capacity uint64, fpRate float64) (bits, hashes uint64) {
+	n := float64(capacity)
+	m := math.Ceil(-n * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	k := math.Round(m / n * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+	return uint64(m), uint64(k)
+}
+
+// bloomFilterLocations double hashing by the two halves of fnv128a, g_i(x) = h1(x) + i*h2(x)
+func bloomFilterLocations(item string, bits, hashes uint64) []int64 {
+	h := fnv.New128a()
+	_, _ = h.Write([]byte(item))
+	sum := h.Sum(nil)
+	h1 := binary.BigEndian.Uint64(sum[:8])
+	h2 := binary.BigEndian.Uint64(sum[8:])
+
+	locations := make([]int64, hashes)
+	for i := uint64(0); i < hashes; i++ {
+		locations[i] = int64((h1 + i*h2) % bits)
+	}
+	return locations
+}
+
+// Bits return the size of bit array
+func (m *BloomFilter) Bits() uint64 {
+	return m.bits
+}
+
+// Hashes return the number of hash functions
+func (m *BloomFilter) Hashes() uint64 {
+	return m.hashes
+}
+
+// braces make it a hash tag, so keys of one filter stay in the same slot
+func (m *BloomFilter) key() string {
+	return fmt.Sprintf("bloom.{%s}", m.name)
+}
+
+// Add items to the filter in one pipeline
+func (m *BloomFilter) Add(ctx context.Context, items ...string) (err error) {
+	command := "redisext.BloomFilter.Add"
+	span, ctx := opentracing.StartSpanFromContext(ctx, command)
+	st := stime.NewTimeStat()
+	defer func() {
+		span.Finish()
+		statReqDuration(m.ext.namespace, command, st.Millisecond())
+		statReqErr(m.ext.namespace, command, err)
+	}()
+	if len(items) == 0 {
+		return nil
+	}
+
+	client, err := m.ext.getRedisInstance(ctx)
+	if err != nil {
+		return err
+	}
+
+	key := m.ext.prefixKey(m.key())
+	pipe := client.Pipeline(ctx)
+	defer pipe.Close()
+	for _, item := range items {
+		for _, location := range bloomFilterLocations(item, m.bits, m.hashes) {
+			pipe.SetBit(ctx, key, location, 1)
+		}
+	}
+	if m.expiration > 0 {
+		pipe.Expire(ctx, key, m.expiration)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// MightContain report for every item whether it may have been added, false means definitely not
+func (m *BloomFilter) MightContain(ctx context.Context, items ...string) (r []bool, err error) {
+	command := "redisext.BloomFilter.MightContain"
+	span, ctx := opentracing.StartSpanFromContext(ctx, command)
+	st := stime.NewTimeStat()
+	defer func() {
+		span.Finish()
+		statReqDuration(m.ext.namespace, command, st.Millisecond())
+		statReqErr(m.ext.namespace, command, err)
+	}()
+	if len(items) == 0 {
+		return nil, nil
+	}
+
+	client, err := m.ext.getRedisInstance(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	key := m.ext.prefixKey(m.key())
+	pipe := client.Pipeline(ctx)
+	defer pipe.Close()
+	cmds := make([][]*redis2.IntCmd, len(items))
+	for i, item := range items {
+		for _, location := range bloomFilterLocations(item, m.bits, m.hashes) {
+			cmds[i] = append(cmds[i], pipe.GetBit(ctx, key, location))
+		}
+	}
+	if _, err = pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	r = make([]bool, len(items))
+	for i := range items {
+		r[i] = true
+		for _, cmd := range cmds[i] {
+			if cmd.Val() == 0 {
+				r[i] = false
+				break
+			}
+		}
+	}
+	return r, nil
+}
+
+// Clear remove all items from the filter
+func (m *BloomFilter) Clear(ctx context.Context) error {
+	_, err := m.ext.Del(ctx, m.key())
+	return err
+}
@@ -0,0 +1,95 @@
+package redisext
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBloomFilterParams(t *testing.T) {
+	bits, hashes := bloomFilterParams(1000000, 0.01)
+	assert.Equal(t, uint64(9585059), bits)
+	assert.Equal(t, uint64(7), hashes)
+
+	locations := bloomFilterLocations("hello", bits, hashes)
+	assert.Len(t, locations, 7)
+	for _, l := range locations {
+		assert.True(t, l >= 0 && uint64(l) < bits)
+	}
+	assert.Equal(t, locations, bloomFilterLocations("hello", bits, hashes))
+
+	_, err := NewBloomFilter(nil, "test", 0, 0.01, 0)
+	assert.Error(t, err)
+	_, err = NewBloomFilter(nil, "test", 1000, 1, 0)
+	assert.Error(t, err)
+	_, err = NewBloomFilter(nil, "test", 1<<40, 0.0001, 0)
+	assert.Error(t, err)
+}
+
+func TestBloomFilter(t *testing.T) {
+	ctx := context.Background()
+	m := NewRedisExt("test/test", "test")
+	bf, err := NewBloomFilter(m, "test", 1000, 0.01, time.Minute)
+	assert.NoError(t, err)
+	_ = bf.Clear(ctx)
+
+	var items []string
+	for i := 0; i < 100; i++ {
+		items = append(items, fmt.Sprintf("item%d", i))
+	}
+	assert.NoError(t, bf.Add(ctx, items...))
+
+	r, err := bf.MightContain(ctx, items...)
+	assert.NoError(t, err)
+	for _, ok := range r {
+		assert.True(t, ok)
+	}
+
+	r, err = bf.MightContain(ctx, "missing")
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{false}, r)
+
+	assert.NoError(t, bf.Clear(ctx))
+}
+
+func TestDailyBitmap(t *testing.T) {
+	ctx := context.Background()
+	m := NewRedisExt("test/test", "test")
+	bm := NewDailyBitmap(m, "active", time.Hour)
+	today := time.Now()
+	yesterday := today.AddDate(0, 0, -1)
+	m.Del(ctx, bm.key(today))
+	m.Del(ctx, bm.key(yesterday))
+
+	old, err := bm.Set(ctx, today, 7)
+	assert.NoError(t, err)
+	assert.False(t, old)
+	old, err = bm.Set(ctx, today, 7)
+	assert.NoError(t, err)
+	assert.True(t, old)
+	_, _ = bm.Set(ctx, today, 100)
+	_, _ = bm.Set(ctx, yesterday, 7)
+	_, _ = bm.Set(ctx, yesterday, 8)
+
+	ok, err := bm.Get(ctx, today, 100)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	n, err := bm.Count(ctx, today)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+
+	n, err = bm.CountAny(ctx, today, yesterday)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+
+	n, err = bm.CountAll(ctx, today, yesterday)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	m.Del(ctx, bm.key(today))
+	m.Del(ctx, bm.key(yesterday))
+}
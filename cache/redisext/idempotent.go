@@ -0,0 +1,192 @@
+package redisext
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// states of an idempotent record: init -> doing -> done/failed, failed records can be acquired again
+const (
+	IdempotentInit   = "init"
+	IdempotentDoing  = "doing"
+	IdempotentDone   = "done"
+	IdempotentFailed = "failed"
+)
+
+// ErrIdempotentNotOwner the record is not held by the caller, e.g. it timed out and was taken over
+var ErrIdempotentNotOwner = errors.New("idempotent record not owned by caller")
+
+// Idempotent guard a business operation identified by key, so that it's handled only once.
+//
+// The record is stored as a redis hash with state, owner, deadline and result, and all
+// transitions are done by lua scripts atomically.
+type Idempotent struct {
+	ext *RedisExt
+	// expiration of the whole record, e.g. 24h
+	expiration time.Duration
+	// timeout of one attempt, a doing record can be taken over after it, e.g. 2min
+	timeout time.Duration
+}
+
+func NewIdempotent(ext *RedisExt, expiration, timeout time.Duration) *Idempotent {
+	return &Idempotent{
+		ext:        ext,
+		expiration: expiration,
+		timeout:    timeout,
+	}
+}
+
+// IdempotentRecord State is the state before Acquire when returned by Acquire
+type IdempotentRecord struct {
+	State    string
+	Owner    string
+	Deadline time.Time
+	Result   string
+}
+
+// Acquire try to become the owner of key, acquired is true when the record is new, failed,
+// or doing but beyond its deadline. Otherwise the record is returned so duplicate callers
+// can use the stored result of a done record.
+func (m *Idempotent) Acquire(ctx context.Context, key, owner string) (acquired bool, record *IdempotentRecord, err error) {
+	now := time.Now()
+	r, err := idempotentAcquireScript.Run(ctx, m.ext, []string{key},
+		toMillisecond(now), owner, toMillisecond(now.Add(m.timeout)), int64(m.expiration/time.Millisecond))
+	if err != nil {
+		return false, nil, err
+	}
+
+	values, ok := r.([]interface{})
+	if !ok || len(values) != 5 {
+		return false, nil, fmt.Errorf("unexpected idempotent reply:%v", r)
+	}
+	acquiredN, _ := values[0].(int64)
+	state, _ := values[1].(string)
+	holder, _ := values[2].(string)
+	deadline, _ := values[3].(int64)
+	result, _ := values[4].(string)
+
+	return acquiredN == 1, &IdempotentRecord{
+		State:    state,
+		Owner:    holder,
+		Deadline: fromMillisecond(deadline),
+		Result:   result,
+	}, nil
+}
+
+// Done mark the record held by owner as done with result
+func (m *Idempotent) Done(ctx context.Context, key, owner, result string) error {
+	return m.finish(ctx, key, owner, IdempotentDone, result)
+}
+
+// Fail mark the record held by owner as failed with reason, it can be acquired again
+func (m *Idempotent) Fail(ctx context.Context, key, owner, reason string) error {
+	return m.finish(ctx, key, owner, IdempotentFailed, reason)
+}
+
+// Get return the record of key from the primary, nil if not exists
+func (m *Idempotent) Get(ctx context.Context, key string) (*IdempotentRecord, error) {
+	fields, err := m.ext.HGetAll(WithPrimary(ctx), key)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	var deadline int64
+	_, _ = fmt.Sscan(fields["deadline"], &deadline)
+	return &IdempotentRecord{
+		State:    fields["state"],
+		Owner:    fields["owner"],
+		Deadline: fromMillisecond(deadline),
+		Result:   fields["result"],
+	}, nil
+}
+
+func (m *Idempotent) finish(ctx context.Context, key, owner, state, result string) error {
+	r, err := idempotentFinishScript.Run(ctx, m.ext, []string{key},
+		owner, state, result, int64(m.expiration/time.Millisecond))
+	if err != nil {
+		return err
+	}
+	if n, _ := r.(int64); n != 1 {
+		return ErrIdempotentNotOwner
+	}
+	return nil
+}
+
+func toMillisecond(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromMillisecond(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// KEYS[1]: record ARGV: now(ms), owner, deadline(ms), expiration(ms)
+// reply: {acquired, state, owner, deadline, result}
+//
+// records written by the old string based TryAcquire are converted: "99" is done, any other
+// value is a doing record whose deadline was never correct, it may still be in flight, so it
+// stays doing until the record expires, or for one timeout of the caller if it never expires.
+var idempotentAcquireScript = NewScript(`
+local now = tonumber(ARGV[1])
+
+local keyType = redis.call('TYPE', KEYS[1])
+if type(keyType) == 'table' then
+	keyType = keyType.ok
+end
+if keyType == 'string' then
+	local legacy = redis.call('GET', KEYS[1])
+	local ttl = redis.call('PTTL', KEYS[1])
+	redis.call('DEL', KEYS[1])
+	if legacy == '99' then
+		redis.call('HMSET', KEYS[1], 'state', 'done', 'owner', '', 'deadline', 0, 'result', '')
+	else
+		local legacyDeadline = ARGV[3]
+		if ttl > 0 then
+			legacyDeadline = string.format('%d', now + ttl)
+		end
+		redis.call('HMSET', KEYS[1], 'state', 'doing', 'owner', '', 'deadline', legacyDeadline, 'result', '')
+	end
+	if ttl > 0 then
+		redis.call('PEXPIRE', KEYS[1], string.format('%d', ttl))
+	end
+end
+
+local record = redis.call('HMGET', KEYS[1], 'state', 'owner', 'deadline', 'result')
+local state = record[1] or 'init'
+local owner = record[2] or ''
+local deadline = tonumber(record[3] or '0')
+local result = record[4] or ''
+
+if state == 'done' or (state == 'doing' and now < deadline) then
+	return {0, state, owner, deadline, result}
+end
+
+redis.call('HMSET', KEYS[1], 'state', 'doing', 'owner', ARGV[2], 'deadline', ARGV[3], 'result', '')
+if state == 'init' and tonumber(ARGV[4]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[4])
+end
+return {1, state, owner, deadline, result}
+`)
+
+// KEYS[1]: record ARGV: owner, state, result, expiration(ms), empty owner matches any owner
+// reply: 1 if finished, 0 if not owned by owner or the record doesn't exist
+var idempotentFinishScript = NewScript(`
+local record = redis.call('HMGET', KEYS[1], 'state', 'owner')
+if not record[1] then
+	return 0
+end
+if ARGV[1] ~= '' and (record[1] ~= 'doing' or record[2] ~= ARGV[1]) then
+	return 0
+end
+
+redis.call('HMSET', KEYS[1], 'state', ARGV[2], 'result', ARGV[3])
+if tonumber(ARGV[4]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[4])
+end
+return 1
+`)
@@ -0,0 +1,110 @@
+package redisext
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotent(t *testing.T) {
+	orderID := "c4ca4238a0b923820dcc509a6f75849b"
+	ctx := context.Background()
+	m := NewRedisExt("test/test", "test")
+	m.Del(ctx, orderID)
+	idem := NewIdempotent(m, time.Hour, time.Second)
+
+	acquired, record, err := idem.Acquire(ctx, orderID, "worker1")
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+	assert.Equal(t, IdempotentInit, record.State)
+
+	// held by worker1
+	acquired, record, err = idem.Acquire(ctx, orderID, "worker2")
+	assert.NoError(t, err)
+	assert.False(t, acquired)
+	assert.Equal(t, IdempotentDoing, record.State)
+	assert.Equal(t, "worker1", record.Owner)
+
+	// failed record can be acquired again
+	assert.NoError(t, idem.Fail(ctx, orderID, "worker1", "db timeout"))
+	acquired, record, err = idem.Acquire(ctx, orderID, "worker2")
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+	assert.Equal(t, IdempotentFailed, record.State)
+	assert.Equal(t, "db timeout", record.Result)
+
+	// worker2 times out, worker3 takes over and worker2 can no longer finish it
+	time.Sleep(time.Second)
+	acquired, record, err = idem.Acquire(ctx, orderID, "worker3")
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+	assert.Equal(t, IdempotentDoing, record.State)
+	assert.Equal(t, "worker2", record.Owner)
+	assert.Equal(t, ErrIdempotentNotOwner, idem.Done(ctx, orderID, "worker2", "paid"))
+
+	assert.NoError(t, idem.Done(ctx, orderID, "worker3", "paid"))
+	acquired, record, err = idem.Acquire(ctx, orderID, "worker4")
+	assert.NoError(t, err)
+	assert.False(t, acquired)
+	assert.Equal(t, IdempotentDone, record.State)
+	assert.Equal(t, "paid", record.Result)
+
+	record, err = idem.Get(ctx, orderID)
+	assert.NoError(t, err)
+	assert.Equal(t, IdempotentDone, record.State)
+	assert.Equal(t, "worker3", record.Owner)
+
+	m.Del(ctx, orderID)
+}
+
+func TestIdempotent_Legacy(t *testing.T) {
+	orderID := "c81e728d9d4c2f636f067f89cc14862c"
+	ctx := context.Background()
+	m := NewRedisExt("test/test", "test")
+	idem := NewIdempotent(m, time.Hour, time.Second)
+
+	m.Set(ctx, orderID, Done, time.Hour)
+	acquired, record, err := idem.Acquire(ctx, orderID, "worker1")
+	assert.NoError(t, err)
+	assert.False(t, acquired)
+	assert.Equal(t, IdempotentDone, record.State)
+
+	// a legacy doing record may be in flight, it's doing until it expires
+	m.Del(ctx, orderID)
+	m.Set(ctx, orderID, 37, time.Hour)
+	acquired, record, err = idem.Acquire(ctx, orderID, "worker1")
+	assert.NoError(t, err)
+	assert.False(t, acquired)
+	assert.Equal(t, IdempotentDoing, record.State)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), record.Deadline, time.Minute)
+	assert.Equal(t, ErrIdempotentNotOwner, idem.Done(ctx, orderID, "worker1", "paid"))
+
+	// without expiration, it's doing for one timeout
+	m.Del(ctx, orderID)
+	m.Set(ctx, orderID, 37, 0)
+	acquired, _, err = idem.Acquire(ctx, orderID, "worker1")
+	assert.NoError(t, err)
+	assert.False(t, acquired)
+	time.Sleep(time.Second)
+	acquired, record, err = idem.Acquire(ctx, orderID, "worker1")
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+	assert.Equal(t, IdempotentDoing, record.State)
+
+	m.Del(ctx, orderID)
+}
+
+func TestIdempotent_FinishMissing(t *testing.T) {
+	orderID := "eccbc87e4b5ce2fe28308d09f0f8e3f9"
+	ctx := context.Background()
+	m := NewRedisExt("test/test", "test")
+	m.Del(ctx, orderID)
+
+	// finishing a missing record doesn't create it
+	assert.Equal(t, ErrIdempotentNotOwner, NewIdempotent(m, time.Hour, time.Second).Done(ctx, orderID, "", "paid"))
+	record, err := NewIdempotent(m, time.Hour, time.Second).Get(ctx, orderID)
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+}
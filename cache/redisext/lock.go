@@ -2,6 +2,7 @@ package redisext
 
 import (
 	"context"
+	"math/rand"
 	"strconv"
 	"time"
 )
@@ -35,11 +36,11 @@ func (m *RedisExt) LockWithTimeout(ctx context.Context, key string, value interf
 	return r, err
 }
 
+var unlockScript = NewScript("if redis.call('get', KEYS[1]) == ARGV[1] then return redis.call('del', KEYS[1]) else return 0 end")
+
 // Unlock release lock with check lock value
 func (m *RedisExt) Unlock(ctx context.Context, key string, value interface{}) (bool, error) {
-	src := "if redis.call('get', KEYS[1]) == ARGV[1] then return redis.call('del', KEYS[1]) else return 0 end"
-	script := NewScript(src)
-	r, err := m.Eval(ctx, script, []string{key}, value)
+	r, err := m.Eval(ctx, unlockScript, []string{key}, value)
 	if err != nil {
 		return false, err
 	}
@@ -59,44 +60,47 @@ func (m *RedisExt) Unlock(ctx context.Context, key string, value interface{}) (b
 //
 // 特别说明:
 // 可以继续执行该笔业务记录的情况有: 记录为初始状态或者记录为Doing状态，且超过了timeout这个执行时间
+//
+// Deprecated: 兼容旧接口，基于 Idempotent 实现，新代码请使用 Idempotent，可以区分 owner 并保存处理结果
 func (m *RedisExt) TryAcquire(ctx context.Context, key string, expiration, timeout time.Duration) (canHandle bool, state string, err error) {
-	value := time.Now().Add(timeout).Second()
-	r, err := m.SetNX(ctx, key, value, expiration)
+	owner := strconv.FormatInt(rand.Int63(), 36)
+	acquired, record, err := NewIdempotent(m, expiration, timeout).Acquire(ctx, key, owner)
 	if err != nil {
 		return false, "unknown", err
 	}
-	// 加锁成功，可以继续业务处理
-	if r {
-		return true, InitState, nil
-	}
 
-	// 加锁失败，需要分情况判断
-	// 状态已经被确认，不需要重新处理业务，可以根据状态进行自己所需操作，如直接返回成功
-	s, err := m.Get(ctx, key)
-	if s == Done {
+	switch {
+	case acquired && record.State == IdempotentInit:
+		return true, InitState, nil
+	case acquired:
+		return true, Doing, nil
+	case record.State == IdempotentDone:
 		return false, Done, nil
-	}
-
-	// 当前时间小于业务处理过期时间，应该是有其他的进程/线程在处理，不需要处理业务，返回处理中
-	now := time.Now().Second()
-	result, _ := strconv.Atoi(s)
-	if now < result {
+	default:
 		return false, Doing, nil
 	}
-
-	// 锁处于处理中，当前时间大于业务处理过期时间，类似乐观锁
-	delta := now - result + int(timeout.Seconds())
-	r1, err := m.IncrBy(ctx, key, int64(delta))
-	if r1 == int64(result+delta) {
-		return true, Doing, nil
-	} else {
-		m.DecrBy(ctx, key, int64(delta))
-	}
-	return false, Doing, nil
 }
 
-// Confirm 确定业务处理完成
+// 同旧接口的 SET key 99 0：记录不存在（或是旧的字符串记录）时创建为done，并且不再过期
+var confirmScript = NewScript(`
+local keyType = redis.call('TYPE', KEYS[1])
+if type(keyType) == 'table' then
+	keyType = keyType.ok
+end
+if keyType == 'hash' then
+	redis.call('HSET', KEYS[1], 'state', 'done')
+else
+	redis.call('DEL', KEYS[1])
+	redis.call('HMSET', KEYS[1], 'state', 'done', 'owner', '', 'deadline', 0, 'result', '')
+end
+redis.call('PERSIST', KEYS[1])
+return 1
+`)
+
+// Confirm 确定业务处理完成，记录不存在时会创建，记录不再过期
+//
+// Deprecated: 兼容旧接口，新代码请使用 Idempotent.Done
 func (m *RedisExt) Confirm(ctx context.Context, key string) error {
-	_, err := m.Set(ctx, key, Done, 0)
+	_, err := m.Eval(ctx, confirmScript, []string{key})
 	return err
 }
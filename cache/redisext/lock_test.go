@@ -19,7 +19,7 @@ func TestLock(t *testing.T) {
 	r1, err := m.Lock(ctx, key, value, time.Second*1)
 	assert.Nil(t, err)
 	assert.Equal(t, false, r1)
-	time.Sleep(time.Second * 1)
+	server.FastForward(time.Second * 1)
 	r2, err := m.Lock(ctx, key, value, time.Second*1)
 	assert.Nil(t, err)
 	assert.Equal(t, true, r2)
@@ -41,6 +41,7 @@ func TestUnlock(t *testing.T) {
 	value := "76c8c07d15c32fa90dd2b89f141246e8"
 	ctx := context.Background()
 	m := NewRedisExt("test/test", "test")
+	m.Del(ctx, key)
 	r, err := m.Lock(ctx, key, value, time.Second*5)
 	assert.Nil(t, err)
 	assert.Equal(t, true, r)
@@ -88,3 +89,35 @@ func TestTryAcquire(t *testing.T) {
 	assert.Equal(t, false, canHandle3)
 	assert.Equal(t, Done, state3)
 }
+
+func TestConfirm(t *testing.T) {
+	orderID := "a87ff679a2f3e71d9181a67b7542122c"
+	ctx := context.Background()
+	m := NewRedisExt("test/test", "test")
+	m.Del(ctx, orderID)
+
+	// a missing record is created as done, like the old SET key 99 0
+	assert.Nil(t, m.Confirm(ctx, orderID))
+	record, err := NewIdempotent(m, time.Hour, time.Second).Get(ctx, orderID)
+	assert.Nil(t, err)
+	assert.Equal(t, IdempotentDone, record.State)
+
+	// the record never expires even if it was acquired with an expiration
+	m.Del(ctx, orderID)
+	canHandle, _, err := m.TryAcquire(ctx, orderID, time.Hour, time.Second)
+	assert.Nil(t, err)
+	assert.True(t, canHandle)
+	assert.Nil(t, m.Confirm(ctx, orderID))
+
+	server.FastForward(time.Hour * 2)
+
+	n, err := m.Exists(ctx, orderID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+	canHandle, state, err := m.TryAcquire(ctx, orderID, time.Hour, time.Second)
+	assert.Nil(t, err)
+	assert.False(t, canHandle)
+	assert.Equal(t, Done, state)
+
+	m.Del(ctx, orderID)
+}
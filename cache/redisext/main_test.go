@@ -0,0 +1,17 @@
+package redisext
+
+import (
+	"os"
+	"testing"
+
+	"github.com/shawnfeng/sutil/cache/redis/redistest"
+)
+
+var server *redistest.Server
+
+func TestMain(m *testing.M) {
+	server = redistest.MustUse("test/test", "base/report")
+	code := m.Run()
+	server.Close()
+	os.Exit(code)
+}
@@ -28,6 +28,14 @@ var (
 		Help:       "redisext requests error total",
 		LabelNames: []string{"namespace", "command"},
 	})
+
+	_metricRateLimit = xprometheus.NewCounter(&xprometheus.CounterVecOpts{
+		Namespace:  namespace,
+		Subsystem:  subsystem,
+		Name:       "ratelimit_total",
+		Help:       "redisext rate limiter decisions total",
+		LabelNames: []string{"namespace", "limiter", "result"},
+	})
 )
 
 func statReqDuration(namespace, command string, durationMS int64) {
@@ -40,3 +48,13 @@ func statReqErr(namespace, command string, err error) {
 	}
 	return
 }
+
+func statRateLimit(namespace, limiter string, r *RateLimitResult, err error) {
+	result := "allowed"
+	if err != nil {
+		result = "error"
+	} else if !r.Allowed {
+		result = "rejected"
+	}
+	_metricRateLimit.With("namespace", namespace, "limiter", limiter, "result", result).Inc()
+}
@@ -0,0 +1,82 @@
+package redisext
+
+import (
+	"context"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/shawnfeng/sutil/cache/serializer"
+	"github.com/shawnfeng/sutil/stime"
+)
+
+// WithSerializer return a copy of m whose GetObject and SetObject use s, default serializer.JSON
+func (m *RedisExt) WithSerializer(s serializer.Serializer) *RedisExt {
+	return &RedisExt{
+		namespace:  m.namespace,
+		prefix:     m.prefix,
+		serializer: s,
+	}
+}
+
+// objectKey tag key by serializer, so values of different serializers don't mix
+func (m *RedisExt) objectKey(key string) string {
+	return serializer.TagKey(m.prefixKey(key), m.serializer)
+}
+
+// SetObject encode value by the serializer of m and set it
+func (m *RedisExt) SetObject(ctx context.Context, key string, value interface{}, exp time.Duration) (s string, err error) {
+	command := "redisext.SetObject"
+	span, ctx := opentracing.StartSpanFromContext(ctx, command)
+	st := stime.NewTimeStat()
+	defer func() {
+		span.Finish()
+		statReqDuration(m.namespace, command, st.Millisecond())
+	}()
+	data, err := serializer.OrDefault(m.serializer).Marshal(value)
+	if err == nil {
+		client, err1 := m.getRedisInstance(ctx)
+		if err = err1; err == nil {
+			s, err = client.Set(ctx, m.objectKey(key), data, exp).Result()
+		}
+	}
+	statReqErr(m.namespace, command, err)
+	return
+}
+
+// GetObject get key and decode it into value by the serializer of m
+func (m *RedisExt) GetObject(ctx context.Context, key string, value interface{}) (err error) {
+	command := "redisext.GetObject"
+	span, ctx := opentracing.StartSpanFromContext(ctx, command)
+	st := stime.NewTimeStat()
+	defer func() {
+		span.Finish()
+		statReqDuration(m.namespace, command, st.Millisecond())
+	}()
+	client, err := m.getRedisInstance(ctx)
+	if err == nil {
+		var data []byte
+		data, err = client.Get(ctx, m.objectKey(key)).Bytes()
+		if err == nil {
+			err = serializer.OrDefault(m.serializer).Unmarshal(data, value)
+		}
+	}
+	statReqErr(m.namespace, command, err)
+	return
+}
+
+// DelObject delete key written by SetObject
+func (m *RedisExt) DelObject(ctx context.Context, key string) (n int64, err error) {
+	command := "redisext.DelObject"
+	span, ctx := opentracing.StartSpanFromContext(ctx, command)
+	st := stime.NewTimeStat()
+	defer func() {
+		span.Finish()
+		statReqDuration(m.namespace, command, st.Millisecond())
+	}()
+	client, err := m.getRedisInstance(ctx)
+	if err == nil {
+		n, err = client.Del(ctx, m.objectKey(key)).Result()
+	}
+	statReqErr(m.namespace, command, err)
+	return
+}
@@ -0,0 +1,404 @@
+package redisext
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shawnfeng/sutil/cache/redis"
+	"github.com/shawnfeng/sutil/slog/slog"
+)
+
+// RateLimitAlgorithm algorithm used by RateLimiter
+type RateLimitAlgorithm int
+
+const (
+	// RateLimitFixedWindow counts requests in a window which starts at the first request
+	RateLimitFixedWindow RateLimitAlgorithm = iota
+	// RateLimitSlidingWindow keeps a log of requests in a sorted set, precise but memory costly
+	RateLimitSlidingWindow
+	// RateLimitGCRA generic cell rate algorithm, equivalent to a token bucket with Burst capacity
+	RateLimitGCRA
+)
+
+func (a RateLimitAlgorithm) String() string {
+	switch a {
+	case RateLimitFixedWindow:
+		return "fixed"
+	case RateLimitSlidingWindow:
+		return "sliding"
+	case RateLimitGCRA:
+		return "gcra"
+	default:
+		return "unknown"
+	}
+}
+
+func rateLimitAlgorithmFromString(s string) (RateLimitAlgorithm, error) {
+	switch strings.ToLower(s) {
+	case "fixed", "":
+		return RateLimitFixedWindow, nil
+	case "sliding":
+		return RateLimitSlidingWindow, nil
+	case "gcra", "tokenbucket":
+		return RateLimitGCRA, nil
+	default:
+		return 0, fmt.Errorf("unknown rate limit algorithm:%s", s)
+	}
+}
+
+const (
+	rateLimitKeyPrefix = "ratelimit"
+
+	// apollo 配置项, 值为 json: {"limiterName": [{"pattern": "sms.*", "algorithm": "gcra", "limit": 10, "period": "1m", "burst": 5}]}
+	apolloConfigKeyRateLimit = "ratelimit"
+)
+
+// RateLimit allow Limit requests per Period, Burst is only used by RateLimitGCRA
+// and defaults to Limit
+type RateLimit struct {
+	Algorithm RateLimitAlgorithm
+	Limit     int64
+	Period    time.Duration
+	Burst     int64
+}
+
+func (l RateLimit) String() string {
+	return fmt.Sprintf("%s:%d/%s burst:%d", l.Algorithm, l.Limit, l.Period, l.Burst)
+}
+
+func (l RateLimit) validate() error {
+	if l.Limit <= 0 {
+		return fmt.Errorf("invalid rate limit:%d", l.Limit)
+	}
+	if l.Period < time.Millisecond {
+		return fmt.Errorf("invalid rate limit period:%s", l.Period)
+	}
+	return nil
+}
+
+// RateLimitResult RetryAfter is -1 when the request can never be allowed, e.g. n > Limit
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int64
+	RetryAfter time.Duration
+	ResetAfter time.Duration
+}
+
+type rateLimitRule struct {
+	Pattern   string `json:"pattern"`
+	Algorithm string `json:"algorithm"`
+	Limit     int64  `json:"limit"`
+	Period    string `json:"period"`
+	Burst     int64  `json:"burst"`
+
+	limit RateLimit
+}
+
+type rateLimitRules struct {
+	raw   string
+	rules map[string][]*rateLimitRule
+}
+
+func parseRateLimitRules(raw string) (*rateLimitRules, error) {
+	rules := map[string][]*rateLimitRule{}
+	if err := json.Unmarshal([]byte(raw), &rules); err != nil {
+		return nil, err
+	}
+
+	for name, rs := range rules {
+		for _, r := range rs {
+			algorithm, err := rateLimitAlgorithmFromString(r.Algorithm)
+			if err != nil {
+				return nil, fmt.Errorf("limiter:%s pattern:%s err:%v", name, r.Pattern, err)
+			}
+			period, err := time.ParseDuration(r.Period)
+			if err != nil {
+				return nil, fmt.Errorf("limiter:%s pattern:%s err:%v", name, r.Pattern, err)
+			}
+			if _, err := path.Match(r.Pattern, ""); err != nil {
+				return nil, fmt.Errorf("limiter:%s pattern:%s err:%v", name, r.Pattern, err)
+			}
+			r.limit = RateLimit{
+				Algorithm: algorithm,
+				Limit:     r.Limit,
+				Period:    period,
+				Burst:     r.Burst,
+			}
+			if err := r.limit.validate(); err != nil {
+				return nil, fmt.Errorf("limiter:%s pattern:%s err:%v", name, r.Pattern, err)
+			}
+		}
+	}
+
+	return &rateLimitRules{
+		raw:   raw,
+		rules: rules,
+	}, nil
+}
+
+// match return the limit of the first rule whose pattern matches key
+func (m *rateLimitRules) match(name, key string) (RateLimit, bool) {
+	for _, r := range m.rules[name] {
+		if ok, _ := path.Match(r.Pattern, key); ok {
+			return r.limit, true
+		}
+	}
+	return RateLimit{}, false
+}
+
+// RateLimiter limit requests identified by key, all state is kept in redis and updated
+// atomically by lua scripts, so it can be shared by many processes.
+//
+// Limits can be overridden per key pattern by the "ratelimit" item of the namespace in apollo,
+// keys which match no pattern use the default limit.
+type RateLimiter struct {
+	name  string
+	ext   *RedisExt
+	limit RateLimit
+
+	mu    sync.Mutex
+	rules *rateLimitRules
+}
+
+// NewRateLimiter name: limiter name, used in redis keys, apollo config and metrics
+func NewRateLimiter(ext *RedisExt, name string, limit RateLimit) (*RateLimiter, error) {
+	if err := limit.validate(); err != nil {
+		return nil, err
+	}
+	return &RateLimiter{
+		name:  name,
+		ext:   ext,
+		limit: limit,
+	}, nil
+}
+
+// Allow is shorthand for AllowN(ctx, key, 1)
+func (m *RateLimiter) Allow(ctx context.Context, key string) (*RateLimitResult, error) {
+	return m.AllowN(ctx, key, 1)
+}
+
+// AllowN report whether n requests identified by key may happen now
+func (m *RateLimiter) AllowN(ctx context.Context, key string, n int64) (r *RateLimitResult, err error) {
+	limit := m.getLimit(ctx, key)
+	defer func() {
+		statRateLimit(m.ext.namespace, m.name, r, err)
+	}()
+
+	switch limit.Algorithm {
+	case RateLimitFixedWindow:
+		return m.allowFixedWindow(ctx, key, limit, n)
+	case RateLimitSlidingWindow:
+		return m.allowSlidingWindow(ctx, key, limit, n)
+	case RateLimitGCRA:
+		return m.allowGCRA(ctx, key, limit, n)
+	default:
+		return nil, fmt.Errorf("unknown rate limit algorithm:%d", limit.Algorithm)
+	}
+}
+
+// Reset clear the state of key
+func (m *RateLimiter) Reset(ctx context.Context, key string) error {
+	_, err := m.ext.Del(ctx, m.buildKey(key))
+	return err
+}
+
+func (m *RateLimiter) buildKey(key string) string {
+	return strings.Join([]string{rateLimitKeyPrefix, m.name, key}, ".")
+}
+
+func (m *RateLimiter) getLimit(ctx context.Context, key string) RateLimit {
+	fun := "RateLimiter.getLimit -->"
+	// configers without items, e.g. etcd, use the limit of the limiter only
+	configer, ok := redis.DefaultConfiger.(redis.ItemConfiger)
+	if !ok {
+		return m.limit
+	}
+
+	raw, ok := configer.GetItem(ctx, m.ext.namespace, apolloConfigKeyRateLimit)
+	if !ok || raw == "" {
+		return m.limit
+	}
+
+	m.mu.Lock()
+	rules := m.rules
+	m.mu.Unlock()
+
+	if rules == nil || rules.raw != raw {
+		var err error
+		rules, err = parseRateLimitRules(raw)
+		if err != nil {
+			slog.Errorf(ctx, "%s parse rate limit config of namespace:%s err:%v", fun, m.ext.namespace, err)
+			return m.limit
+		}
+		m.mu.Lock()
+		m.rules = rules
+		m.mu.Unlock()
+	}
+
+	if limit, ok := rules.match(m.name, key); ok {
+		return limit
+	}
+	return m.limit
+}
+
+func (m *RateLimiter) allowFixedWindow(ctx context.Context, key string, limit RateLimit, n int64) (*RateLimitResult, error) {
+	r, err := rateLimitFixedWindowScript.Run(ctx, m.ext, []string{m.buildKey(key)},
+		limit.Limit, int64(limit.Period/time.Millisecond), n)
+	if err != nil {
+		return nil, err
+	}
+	return rateLimitResultFromReply(r)
+}
+
+func (m *RateLimiter) allowSlidingWindow(ctx context.Context, key string, limit RateLimit, n int64) (*RateLimitResult, error) {
+	now := time.Now()
+	r, err := rateLimitSlidingWindowScript.Run(ctx, m.ext, []string{m.buildKey(key)},
+		limit.Limit, int64(limit.Period/time.Millisecond), now.UnixNano()/int64(time.Millisecond), n,
+		fmt.Sprintf("%d.%d", now.UnixNano(), rand.Int63()))
+	if err != nil {
+		return nil, err
+	}
+	return rateLimitResultFromReply(r)
+}
+
+func (m *RateLimiter) allowGCRA(ctx context.Context, key string, limit RateLimit, n int64) (*RateLimitResult, error) {
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = limit.Limit
+	}
+	r, err := rateLimitGCRAScript.Run(ctx, m.ext, []string{m.buildKey(key)},
+		burst, limit.Limit, int64(limit.Period/time.Microsecond), time.Now().UnixNano()/int64(time.Microsecond), n)
+	if err != nil {
+		return nil, err
+	}
+	return rateLimitResultFromReply(r)
+}
+
+// all rate limit scripts reply {allowed, remaining, retry_after_ms, reset_after_ms}
+func rateLimitResultFromReply(reply interface{}) (*RateLimitResult, error) {
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 4 {
+		return nil, fmt.Errorf("unexpected rate limit reply:%v", reply)
+	}
+
+	var ns [4]int64
+	for i, v := range values {
+		n, ok := v.(int64)
+		if !ok {
+			return nil, fmt.Errorf("unexpected rate limit reply:%v", reply)
+		}
+		ns[i] = n
+	}
+
+	retryAfter := time.Duration(-1)
+	if ns[2] >= 0 {
+		retryAfter = time.Duration(ns[2]) * time.Millisecond
+	}
+	return &RateLimitResult{
+		Allowed:    ns[0] == 1,
+		Remaining:  ns[1],
+		RetryAfter: retryAfter,
+		ResetAfter: time.Duration(ns[3]) * time.Millisecond,
+	}, nil
+}
+
+// KEYS[1]: counter ARGV: limit, period(ms), n
+var rateLimitFixedWindowScript = NewScript(`
+local limit = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+
+local current = tonumber(redis.call('GET', KEYS[1]) or '0')
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl < 0 then
+	ttl = period
+end
+
+if current + n > limit then
+	local retry = ttl
+	if n > limit then
+		retry = -1
+	end
+	return {0, limit - current, retry, ttl}
+end
+
+-- integer arguments are passed as received, lua numbers may be formatted as floats
+current = redis.call('INCRBY', KEYS[1], ARGV[3])
+if redis.call('PTTL', KEYS[1]) < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return {1, limit - current, 0, ttl}
+`)
+
+// KEYS[1]: zset of requests ARGV: limit, window(ms), now(ms), n, unique member prefix
+var rateLimitSlidingWindowScript = NewScript(`
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+
+if count + n > limit then
+	local retry = -1
+	if n <= limit then
+		local idx = count + n - limit - 1
+		local oldest = redis.call('ZRANGE', KEYS[1], idx, idx, 'WITHSCORES')
+		retry = tonumber(oldest[2]) + window - now
+	end
+	local reset = 0
+	local newest = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+	if #newest > 0 then
+		reset = tonumber(newest[2]) + window - now
+	end
+	return {0, limit - count, retry, reset}
+end
+
+for i = 1, n do
+	redis.call('ZADD', KEYS[1], ARGV[3], ARGV[5] .. '.' .. i)
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return {1, limit - count - n, 0, window}
+`)
+
+// KEYS[1]: theoretical arrival time ARGV: burst, rate, period(us), now(us), n
+var rateLimitGCRAScript = NewScript(`
+local burst = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local period = tonumber(ARGV[3])
+local now = tonumber(ARGV[4])
+local n = tonumber(ARGV[5])
+
+local emission = period / rate
+local increment = emission * n
+local tolerance = emission * burst
+
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+
+local newTat = tat + increment
+local diff = now - (newTat - tolerance)
+if diff < 0 then
+	local retry = -1
+	if increment <= tolerance then
+		retry = math.ceil(-diff / 1000)
+	end
+	local remaining = math.floor((now - (tat - tolerance)) / emission)
+	return {0, remaining, retry, math.ceil((tat - now) / 1000)}
+end
+
+local reset = math.ceil((newTat - now) / 1000)
+if reset > 0 then
+	redis.call('SET', KEYS[1], string.format('%.0f', newTat), 'PX', string.format('%d', reset))
+end
+return {1, math.floor(diff / emission), 0, reset}
+`)
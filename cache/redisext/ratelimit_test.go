@@ -0,0 +1,93 @@
+package redisext
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/shawnfeng/sutil/cache/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRateLimitRules(t *testing.T) {
+	raw := `{"sms": [
+		{"pattern": "vip.*", "algorithm": "gcra", "limit": 100, "period": "1m", "burst": 10},
+		{"pattern": "*", "algorithm": "sliding", "limit": 5, "period": "1m"}
+	]}`
+	rules, err := parseRateLimitRules(raw)
+	assert.NoError(t, err)
+
+	limit, ok := rules.match("sms", "vip.13800000000")
+	assert.True(t, ok)
+	assert.Equal(t, RateLimit{RateLimitGCRA, 100, time.Minute, 10}, limit)
+
+	limit, ok = rules.match("sms", "13800000000")
+	assert.True(t, ok)
+	assert.Equal(t, RateLimit{RateLimitSlidingWindow, 5, time.Minute, 0}, limit)
+
+	_, ok = rules.match("push", "13800000000")
+	assert.False(t, ok)
+
+	_, err = parseRateLimitRules(`{"sms": [{"pattern": "*", "algorithm": "leaky", "limit": 5, "period": "1m"}]}`)
+	assert.Error(t, err)
+	_, err = parseRateLimitRules(`{"sms": [{"pattern": "*", "limit": 0, "period": "1m"}]}`)
+	assert.Error(t, err)
+}
+
+func TestRateLimiter_AllowN(t *testing.T) {
+	ctx := context.Background()
+	m := NewRedisExt("test/test", "test")
+
+	for _, algorithm := range []RateLimitAlgorithm{RateLimitFixedWindow, RateLimitSlidingWindow, RateLimitGCRA} {
+		limiter, err := NewRateLimiter(m, "test", RateLimit{Algorithm: algorithm, Limit: 3, Period: time.Second})
+		assert.NoError(t, err)
+		key := algorithm.String()
+		_ = limiter.Reset(ctx, key)
+
+		for i := 0; i < 3; i++ {
+			r, err := limiter.Allow(ctx, key)
+			assert.NoError(t, err)
+			assert.True(t, r.Allowed, algorithm.String())
+			assert.Equal(t, int64(2-i), r.Remaining, algorithm.String())
+		}
+
+		r, err := limiter.Allow(ctx, key)
+		assert.NoError(t, err)
+		assert.False(t, r.Allowed, algorithm.String())
+		assert.True(t, r.RetryAfter > 0 && r.RetryAfter <= time.Second, algorithm.String())
+
+		r, err = limiter.AllowN(ctx, key, 4)
+		assert.NoError(t, err)
+		assert.False(t, r.Allowed, algorithm.String())
+		assert.Equal(t, time.Duration(-1), r.RetryAfter, algorithm.String())
+
+		time.Sleep(time.Second)
+		server.FastForward(time.Second)
+		r, err = limiter.Allow(ctx, key)
+		assert.NoError(t, err)
+		assert.True(t, r.Allowed, algorithm.String())
+
+		assert.NoError(t, limiter.Reset(ctx, key))
+	}
+}
+
+func TestRateLimiter_GetLimit(t *testing.T) {
+	ctx := context.Background()
+	limit := RateLimit{Algorithm: RateLimitFixedWindow, Limit: 3, Period: time.Second}
+	limiter, err := NewRateLimiter(NewRedisExt("test/test", "test"), "sms", limit)
+	assert.NoError(t, err)
+
+	saved := redis.DefaultConfiger
+	defer func() { redis.DefaultConfiger = saved }()
+
+	configer := redis.NewStaticConfiger()
+	configer.SetItem("test/test", apolloConfigKeyRateLimit, `{"sms": [{"pattern": "*", "limit": 5, "period": "1m"}]}`)
+	redis.DefaultConfiger = configer
+	assert.Equal(t, int64(5), limiter.getLimit(ctx, "138").Limit)
+
+	// configers without items use the limit of the limiter
+	redis.DefaultConfiger = redis.NewEtcdConfiger()
+	assert.Equal(t, limit, limiter.getLimit(ctx, "138"))
+	redis.DefaultConfiger = nil
+	assert.Equal(t, limit, limiter.getLimit(ctx, "138"))
+}
@@ -10,18 +10,20 @@ import (
 	"github.com/shawnfeng/sutil/cache"
 	"github.com/shawnfeng/sutil/cache/constants"
 	"github.com/shawnfeng/sutil/cache/redis"
+	"github.com/shawnfeng/sutil/cache/serializer"
 	"github.com/shawnfeng/sutil/scontext"
 	"github.com/shawnfeng/sutil/slog/slog"
 	"github.com/shawnfeng/sutil/stime"
 )
 
 type RedisExt struct {
-	namespace string
-	prefix    string
+	namespace  string
+	prefix     string
+	serializer serializer.Serializer
 }
 
 func NewRedisExt(namespace, prefix string) *RedisExt {
-	return &RedisExt{namespace, prefix}
+	return &RedisExt{namespace: namespace, prefix: prefix}
 }
 
 type Z struct {
@@ -78,6 +80,28 @@ func (m *RedisExt) prefixKey(key string) string {
 	return key
 }
 
+// prefixKeys return prefixed keys in a new slice, redis.Client modifies keys in place
+func (m *RedisExt) prefixKeys(keys []string) []string {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = m.prefixKey(key)
+	}
+	return prefixed
+}
+
+// CircuitOpenError returned by every method without touching redis while the circuit
+// breaker of the namespace is open
+type CircuitOpenError = redis.CircuitOpenError
+
+func IsCircuitOpen(err error) bool {
+	return redis.IsCircuitOpen(err)
+}
+
+// WithPrimary read from the primary even if the namespace has replicas, e.g. right after a write
+func WithPrimary(ctx context.Context) context.Context {
+	return redis.WithPrimary(ctx)
+}
+
 func (m *RedisExt) getRedisInstance(ctx context.Context) (client *redis.Client, err error) {
 	conf := m.getInstanceConf(ctx)
 	return redis.DefaultInstanceManager.GetInstance(ctx, conf)
@@ -909,7 +933,7 @@ func SetConfiger(ctx context.Context, configerType constants.ConfigerType) error
 }
 
 func WatchUpdate(ctx context.Context) {
-	go redis.DefaultInstanceManager.Watch(ctx)
+	go redis.DefaultInstanceManager.WatchConfiger(ctx, redis.DefaultConfiger)
 }
 
 func init() {
@@ -922,4 +946,5 @@ func init() {
 		slog.Infof(ctx, "%s redisext configer:%v been set", fun, constants.ConfigerTypeApollo)
 	}
 	WatchUpdate(ctx)
+	redis.DefaultInstanceManager.AddInstanceHook(preloadScripts)
 }
@@ -3,6 +3,7 @@ package redisext
 import (
 	"context"
 	"fmt"
+	"github.com/shawnfeng/sutil/cache/serializer"
 	"github.com/stretchr/testify/assert"
 	"testing"
 	"time"
@@ -204,7 +205,7 @@ func TestRedisExt_Expire(t *testing.T) {
 	assert.NoError(t, err)
 	assert.True(t, b)
 
-	time.Sleep(expiration * 2)
+	server.FastForward(expiration * 2)
 
 	n, err = re.Exists(ctx, zsetTestKey)
 	assert.NoError(t, err)
@@ -223,6 +224,7 @@ func TestRedisExt_SetBit(t *testing.T) {
 func TestRedisExt_GetBit(t *testing.T) {
 	ctx := context.Background()
 	re := NewRedisExt("base/report", "test")
+	re.SetBit(ctx, "bitoptest", 1, 1)
 
 	n, err := re.GetBit(ctx, "bitoptest", 1)
 	assert.NoError(t, err)
@@ -249,3 +251,26 @@ func TestRedisExt_MGet(t *testing.T) {
 	assert.Contains(t, []string{"getvalue1", "getvalue2"}, resp[0])
 	assert.Contains(t, []string{"getvalue1", "getvalue2"}, resp[1])
 }
+
+func TestRedisExt_SetObject(t *testing.T) {
+	ctx := context.Background()
+	type user struct {
+		Id   int64
+		Name string
+	}
+	u := user{Id: 1<<62 + 1, Name: "sutil"}
+
+	for _, s := range []serializer.Serializer{nil, serializer.Msgpack, serializer.WithCompression(serializer.Gob, 8)} {
+		re := NewRedisExt("test/test", "test").WithSerializer(s)
+		_, err := re.SetObject(ctx, "user", &u, 10*time.Second)
+		assert.NoError(t, err)
+
+		var r user
+		assert.NoError(t, re.GetObject(ctx, "user", &r))
+		assert.Equal(t, u, r)
+
+		n, err := re.DelObject(ctx, "user")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), n)
+	}
+}
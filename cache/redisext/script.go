@@ -2,26 +2,30 @@ package redisext
 
 import (
 	"context"
-	"crypto/sha1"
-	"encoding/hex"
-	"io"
+	"sync"
 
 	"github.com/opentracing/opentracing-go"
+	"github.com/shawnfeng/sutil/cache/redis"
+	"github.com/shawnfeng/sutil/slog/slog"
 	"github.com/shawnfeng/sutil/stime"
 )
 
+// scripts will be loaded whenever InstanceManager creates or replaces a client
+var scriptRegistry sync.Map
+
 type Script struct {
 	src, hash string
 }
 
-// NewScript src: script content
+// NewScript src: script content, the script is registered to be preloaded, create scripts once,
+// e.g. as package variables, instead of on every call
 func NewScript(src string) *Script {
-	h := sha1.New()
-	_, _ = io.WriteString(h, src)
-	return &Script{
+	s := &Script{
 		src:  src,
-		hash: hex.EncodeToString(h.Sum(nil)),
+		hash: redis.ScriptHash(src),
 	}
+	RegisterScript(s)
+	return s
 }
 
 // Hash return hash of script
@@ -29,6 +33,51 @@ func (s *Script) Hash() string {
 	return s.hash
 }
 
+// RegisterScript register scripts to be preloaded by ScriptLoad on every new redis client
+func RegisterScript(scripts ...*Script) {
+	for _, s := range scripts {
+		scriptRegistry.Store(s.hash, s)
+	}
+}
+
+// Run exec script with EVALSHA, fallback to EVAL if the script is not loaded on the redis server,
+// e.g. after a redis restart or failover. Loaded status is cached per client.
+func (s *Script) Run(ctx context.Context, ext *RedisExt, keys []string, args ...interface{}) (r interface{}, err error) {
+	command := "redisext.Script.Run"
+	span, ctx := opentracing.StartSpanFromContext(ctx, command)
+	st := stime.NewTimeStat()
+	defer func() {
+		span.Finish()
+		statReqDuration(ext.namespace, command, st.Millisecond())
+		statReqErr(ext.namespace, command, err)
+	}()
+
+	client, err := ext.getRedisInstance(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.RunScript(ctx, s.src, s.hash, ext.prefixKeys(keys), args...).Result()
+}
+
+// preloadScripts load all registered scripts into the redis server of client in the background,
+// Run falls back to EVAL until they are loaded, so creating the client needn't wait for it
+func preloadScripts(ctx context.Context, client *redis.Client) {
+	go loadScripts(context.Background(), client)
+}
+
+func loadScripts(ctx context.Context, client *redis.Client) {
+	fun := "redisext.loadScripts -->"
+	scriptRegistry.Range(func(key, value interface{}) bool {
+		s := value.(*Script)
+		if err := client.ScriptLoad(ctx, s.src).Err(); err != nil {
+			slog.Warnf(ctx, "%s load script:%s err:%v", fun, s.hash, err)
+			return true
+		}
+		client.SetScriptLoaded(s.hash, true)
+		return true
+	})
+}
+
 // ScriptLoad load script to redis server
 func (m *RedisExt) ScriptLoad(ctx context.Context, script *Script) (r string, err error) {
 	command := "redisext.ScriptLoad"
@@ -58,7 +107,7 @@ func (m *RedisExt) ScriptExists(ctx context.Context, script *Script) (r bool, er
 	}()
 	client, err := m.getRedisInstance(ctx)
 	if err == nil {
-		result, err := client.ScriptExists(ctx, script.src).Result()
+		result, err := client.ScriptExists(ctx, script.hash).Result()
 		if err != nil {
 			return false, err
 		}
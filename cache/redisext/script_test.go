@@ -2,6 +2,7 @@ package redisext
 
 import (
 	"context"
+	"fmt"
 	"testing"
 	"time"
 
@@ -17,6 +18,8 @@ func TestNewScript(t *testing.T) {
 	s := NewScript(script)
 	assert.NotNil(t, s)
 	assert.Equal(t, s.Hash(), "0b2cd31fec150908e9e0304c8189bc7168c0b441")
+	_, ok := scriptRegistry.Load(s.Hash())
+	assert.True(t, ok)
 }
 
 func TestEval(t *testing.T) {
@@ -35,3 +38,49 @@ func TestEval(t *testing.T) {
 	assert.Equal(t, r, int64(200))
 	assert.Equal(t, r1, "200")
 }
+
+func TestScript_Run(t *testing.T) {
+	ctx := context.Background()
+	m := NewRedisExt("test/test", "test")
+	// unique script, never loaded on the redis server before
+	s := NewScript(fmt.Sprintf("return redis.call('INCRBY', KEYS[1], ARGV[1]) -- %d", time.Now().UnixNano()))
+	m.Del(ctx, "key2")
+
+	client, err := m.getRedisInstance(ctx)
+	assert.NoError(t, err)
+	// pretend the script was loaded, EVALSHA fails with NOSCRIPT and falls back to EVAL
+	client.SetScriptLoaded(s.Hash(), true)
+
+	keys := []string{"key2"}
+	r, err := s.Run(ctx, m, keys, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), r)
+	assert.Equal(t, []string{"key2"}, keys)
+	assert.True(t, client.ScriptLoaded(s.Hash()))
+
+	r, err = s.Run(ctx, m, keys, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), r)
+
+	_, err = m.ScriptLoad(ctx, s)
+	assert.NoError(t, err)
+	exists, err := m.ScriptExists(ctx, s)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	m.Del(ctx, "key2")
+}
+
+func TestPreloadScripts(t *testing.T) {
+	ctx := context.Background()
+	m := NewRedisExt("test/test", "test")
+	s := NewScript(fmt.Sprintf("return 1 -- %d", time.Now().UnixNano()))
+
+	client, err := m.getRedisInstance(ctx)
+	assert.NoError(t, err)
+	client.SetScriptLoaded(s.Hash(), false)
+	preloadScripts(ctx, client)
+	assert.Eventually(t, func() bool { return client.ScriptLoaded(s.Hash()) }, time.Second, 10*time.Millisecond)
+	exists, err := m.ScriptExists(ctx, s)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
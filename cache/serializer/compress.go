@@ -0,0 +1,78 @@
+package serializer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+)
+
+// header byte of values written by compressor
+const (
+	compressNone byte = iota
+	compressGzip
+)
+
+type compressor struct {
+	Serializer
+	threshold int
+}
+
+// WithCompression gzip values of s larger than threshold bytes, smaller values are stored
+// as is. Every value carries a header byte, so the key tag differs from s.
+func WithCompression(s Serializer, threshold int) Serializer {
+	return &compressor{
+		Serializer: OrDefault(s),
+		threshold:  threshold,
+	}
+}
+
+func (m *compressor) Name() string {
+	return m.Serializer.Name() + "+gzip"
+}
+
+func (m *compressor) Marshal(v interface{}) ([]byte, error) {
+	data, err := m.Serializer.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) <= m.threshold {
+		return append([]byte{compressNone}, data...), nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(compressGzip)
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (m *compressor) Unmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return fmt.Errorf("compressor: empty data")
+	}
+
+	switch data[0] {
+	case compressNone:
+		return m.Serializer.Unmarshal(data[1:], v)
+	case compressGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data[1:]))
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		raw, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return m.Serializer.Unmarshal(raw, v)
+	default:
+		return fmt.Errorf("compressor: unknown header:%d", data[0])
+	}
+}
@@ -0,0 +1,137 @@
+// Package serializer encodes cache values, every serializer has a name which tags the
+// cache keys it writes, so a namespace can switch serializer without flushing old values.
+package serializer
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/ugorji/go/codec"
+)
+
+type Serializer interface {
+	// Name identify the encoding, used as key tag. Empty for serializers which must keep the
+	// key layout of values written by other code, e.g. CacheData of legacy caches.
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSON the default serializer, its keys are not tagged to stay compatible with old values
+	JSON Serializer = jsonSerializer{}
+	// JSONUseNumber decode numbers into interface{} as json.Number, so large int64 ids keep precision
+	JSONUseNumber Serializer = jsonNumberSerializer{}
+	// Protobuf values must be proto.Message
+	Protobuf Serializer = protobufSerializer{}
+	Msgpack  Serializer = msgpackSerializer{}
+	Gob      Serializer = gobSerializer{}
+)
+
+const keyTagSep = "@"
+
+// TagKey tag key with the name of s, keys of JSON and of unnamed serializers are not tagged
+func TagKey(key string, s Serializer) string {
+	if s == nil || s.Name() == "" || s.Name() == JSON.Name() {
+		return key
+	}
+	return key + keyTagSep + s.Name()
+}
+
+// OrDefault return s, or JSON if s is nil
+func OrDefault(s Serializer) Serializer {
+	if s == nil {
+		return JSON
+	}
+	return s
+}
+
+type jsonSerializer struct{}
+
+func (jsonSerializer) Name() string {
+	return "json"
+}
+
+func (jsonSerializer) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonSerializer) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type jsonNumberSerializer struct{}
+
+func (jsonNumberSerializer) Name() string {
+	return "jsonnum"
+}
+
+func (jsonNumberSerializer) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonNumberSerializer) Unmarshal(data []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+type protobufSerializer struct{}
+
+func (protobufSerializer) Name() string {
+	return "pb"
+}
+
+func (protobufSerializer) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("protobuf serializer: %T is not proto.Message", v)
+	}
+	return proto.Marshal(msg)
+}
+
+func (protobufSerializer) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("protobuf serializer: %T is not proto.Message", v)
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+var msgpackHandle = &codec.MsgpackHandle{
+	WriteExt: true,
+}
+
+type msgpackSerializer struct{}
+
+func (msgpackSerializer) Name() string {
+	return "msgpack"
+}
+
+func (msgpackSerializer) Marshal(v interface{}) (data []byte, err error) {
+	err = codec.NewEncoderBytes(&data, msgpackHandle).Encode(v)
+	return data, err
+}
+
+func (msgpackSerializer) Unmarshal(data []byte, v interface{}) error {
+	return codec.NewDecoderBytes(data, msgpackHandle).Decode(v)
+}
+
+type gobSerializer struct{}
+
+func (gobSerializer) Name() string {
+	return "gob"
+}
+
+func (gobSerializer) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (gobSerializer) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -0,0 +1,79 @@
+package serializer
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	connproto "github.com/shawnfeng/sutil/paconn/pb"
+	"github.com/stretchr/testify/assert"
+)
+
+type testValue struct {
+	Id   int64
+	Name string
+	Tags []string
+}
+
+func TestSerializers(t *testing.T) {
+	v := &testValue{Id: 1<<62 + 1, Name: "sutil", Tags: []string{"a", "b"}}
+	for _, s := range []Serializer{JSON, JSONUseNumber, Msgpack, Gob, WithCompression(Msgpack, 8), WithCompression(nil, 1024)} {
+		data, err := s.Marshal(v)
+		assert.NoError(t, err, s.Name())
+
+		var r testValue
+		assert.NoError(t, s.Unmarshal(data, &r), s.Name())
+		assert.Equal(t, *v, r, s.Name())
+	}
+}
+
+func TestJSONUseNumber(t *testing.T) {
+	data, err := JSONUseNumber.Marshal(map[string]int64{"id": 1<<62 + 1})
+	assert.NoError(t, err)
+
+	var r map[string]interface{}
+	assert.NoError(t, JSONUseNumber.Unmarshal(data, &r))
+	n, err := r["id"].(json.Number).Int64()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1<<62+1), n)
+}
+
+func TestProtobuf(t *testing.T) {
+	v := &connproto.ConnProto{Type: connproto.ConnProto_CALL.Enum(), Msgid: proto.Uint64(7), Bussdata: []byte("hello")}
+	data, err := Protobuf.Marshal(v)
+	assert.NoError(t, err)
+
+	var r connproto.ConnProto
+	assert.NoError(t, Protobuf.Unmarshal(data, &r))
+	assert.Equal(t, v.GetMsgid(), r.GetMsgid())
+	assert.Equal(t, v.Bussdata, r.Bussdata)
+
+	_, err = Protobuf.Marshal(testValue{})
+	assert.Error(t, err)
+}
+
+func TestCompression(t *testing.T) {
+	s := WithCompression(JSON, 64)
+	small, err := s.Marshal("hello")
+	assert.NoError(t, err)
+	assert.Equal(t, compressNone, small[0])
+
+	large, err := s.Marshal(strings.Repeat("hello", 100))
+	assert.NoError(t, err)
+	assert.Equal(t, compressGzip, large[0])
+	assert.True(t, len(large) < 500)
+
+	var r string
+	assert.NoError(t, s.Unmarshal(large, &r))
+	assert.Equal(t, strings.Repeat("hello", 100), r)
+
+	assert.Error(t, s.Unmarshal([]byte("record not found"), &r))
+}
+
+func TestTagKey(t *testing.T) {
+	assert.Equal(t, "user.1", TagKey("user.1", nil))
+	assert.Equal(t, "user.1", TagKey("user.1", JSON))
+	assert.Equal(t, "user.1@msgpack", TagKey("user.1", Msgpack))
+	assert.Equal(t, "user.1@msgpack+gzip", TagKey("user.1", WithCompression(Msgpack, 1024)))
+}
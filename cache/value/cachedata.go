@@ -0,0 +1,208 @@
+package value
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/shawnfeng/sutil/cache"
+	"github.com/shawnfeng/sutil/cache/redis"
+	"github.com/shawnfeng/sutil/cache/serializer"
+	"github.com/shawnfeng/sutil/slog/slog"
+	"github.com/shawnfeng/sutil/stime"
+)
+
+// CacheDataSerializer encode values by their own CacheData Marshal and Unmarshal. It has no
+// name, so keys are laid out as cache.Cache of the same namespace and prefix lays them out.
+var CacheDataSerializer serializer.Serializer = cacheDataSerializer{}
+
+type cacheDataSerializer struct{}
+
+func (cacheDataSerializer) Name() string {
+	return ""
+}
+
+func (cacheDataSerializer) Marshal(v interface{}) ([]byte, error) {
+	data, ok := v.(cache.CacheData)
+	if !ok {
+		return nil, fmt.Errorf("value of type %T is not CacheData", v)
+	}
+	return data.Marshal()
+}
+
+func (cacheDataSerializer) Unmarshal(b []byte, v interface{}) error {
+	data, ok := v.(cache.CacheData)
+	if !ok {
+		return fmt.Errorf("value of type %T is not CacheData", v)
+	}
+	return data.Unmarshal(b)
+}
+
+// LoadFuncOf bridge CacheData.Load to LoadFunc, newData return an empty value for every load
+func LoadFuncOf(newData func() cache.CacheData) LoadFunc {
+	return func(ctx context.Context, key interface{}) (interface{}, error) {
+		data := newData()
+		if err := data.Load(fmt.Sprint(key)); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+}
+
+// DataCache api of cache.Cache and rediscache.Cache on Cache, with ctx, spans and metrics.
+// Set CacheOptions.Legacy to the old cache to migrate without starting cold.
+type DataCache struct {
+	cache *Cache
+}
+
+func NewDataCache(namespace, prefix string, expire time.Duration, newData func() cache.CacheData) *DataCache {
+	return NewDataCacheWithOptions(namespace, prefix, newData, CacheOptions{Expire: expire})
+}
+
+// NewDataCacheWithOptions opts.Serializer is always CacheDataSerializer
+func NewDataCacheWithOptions(namespace, prefix string, newData func() cache.CacheData, opts CacheOptions) *DataCache {
+	opts.Serializer = CacheDataSerializer
+	c := NewCacheWithOptions(namespace, prefix, LoadFuncOf(newData), opts)
+	c.newValue = func() interface{} { return newData() }
+	return &DataCache{
+		cache: c,
+	}
+}
+
+// Cache the underlying Cache, e.g. to Warm or InvalidateTags
+func (m *DataCache) Cache() *Cache {
+	return m.cache
+}
+
+// Get same as cache.Cache.Get, a miss is loaded by a new value of newData, not by data
+func (m *DataCache) Get(ctx context.Context, key string, data cache.CacheData) error {
+	return m.cache.Get(ctx, key, data)
+}
+
+// GetCache same as cache.Cache.GetCache, a miss is not loaded and data is left untouched
+func (m *DataCache) GetCache(ctx context.Context, key string, data cache.CacheData) error {
+	fun := "DataCache.GetCache -->"
+	command := "cache.value.GetCache"
+	span, ctx := opentracing.StartSpanFromContext(ctx, command)
+	st := stime.NewTimeStat()
+	defer func() {
+		span.Finish()
+		statReqDuration(m.cache.namespace, command, st.Millisecond())
+	}()
+
+	_, err := m.cache.getValueFromCache(ctx, key, data)
+	if err != nil && err.Error() == redis.RedisNil {
+		_metricMiss.With("namespace", m.cache.namespace, "command", command).Inc()
+		return nil
+	}
+	if err != nil {
+		statReqErr(m.cache.namespace, command, err)
+		slog.Warnf(ctx, "%s cache key:%s err:%v", fun, key, err)
+		return err
+	}
+	_metricHits.With("namespace", m.cache.namespace, "command", command).Inc()
+	return nil
+}
+
+// Set cache data without loading
+func (m *DataCache) Set(ctx context.Context, key string, data cache.CacheData) error {
+	fun := "DataCache.Set -->"
+	command := "cache.value.Set"
+	span, ctx := opentracing.StartSpanFromContext(ctx, command)
+	st := stime.NewTimeStat()
+	var err error
+	defer func() {
+		span.Finish()
+		statReqDuration(m.cache.namespace, command, st.Millisecond())
+		statReqErr(m.cache.namespace, command, err)
+	}()
+
+	sdata, err := data.Marshal()
+	if err != nil {
+		return fmt.Errorf("%s marshal err, cache key:%s err:%v", fun, key, err)
+	}
+
+	skey, err := m.cache.prefixKey(key)
+	if err != nil {
+		return err
+	}
+
+	client, err := redis.DefaultInstanceManager.GetInstance(ctx, m.cache.getInstanceConf(ctx))
+	if err != nil {
+		slog.Errorf(ctx, "%s get instance err, namespace: %s", fun, m.cache.namespace)
+		return err
+	}
+
+	err = m.cache.setValue(ctx, client, skey, sdata, m.cache.opts.expire(), nil)
+	if err != nil {
+		return fmt.Errorf("%s set err, cache key:%s err:%v", fun, key, err)
+	}
+	return nil
+}
+
+func (m *DataCache) Del(ctx context.Context, key string) error {
+	return m.cache.Del(ctx, key)
+}
+
+// LegacyStore a legacy cache read by the migration mode of Cache, cache.Cache and
+// rediscache.Cache implement it
+type LegacyStore interface {
+	// GetRaw return the stored value of key, ok is false on miss
+	GetRaw(ctx context.Context, key string) (data []byte, ok bool, err error)
+	Del(key string) error
+}
+
+// migrate copy the legacy value of key into the cache and unmarshal it into value, false if
+// there is none and key should be loaded
+func (m *Cache) migrate(ctx context.Context, key, value interface{}) bool {
+	fun := "Cache.migrate -->"
+
+	lkey, err := m.keyToString(key)
+	if err != nil {
+		return false
+	}
+	data, ok, err := m.opts.Legacy.GetRaw(ctx, lkey)
+	if err != nil {
+		slog.Warnf(ctx, "%s get legacy key:%v err:%v", fun, key, err)
+		_metricMigrate.With("namespace", m.namespace, "result", "failed").Inc()
+		return false
+	}
+	if !ok {
+		_metricMigrate.With("namespace", m.namespace, "result", "miss").Inc()
+		return false
+	}
+	// e.g. an error cached by the legacy cache on a failed load
+	if err = m.serializer().Unmarshal(data, value); err != nil {
+		slog.Warnf(ctx, "%s unmarshal legacy key:%v err:%v", fun, key, err)
+		_metricMigrate.With("namespace", m.namespace, "result", "failed").Inc()
+		return false
+	}
+	_metricMigrate.With("namespace", m.namespace, "result", "hit").Inc()
+
+	skey, err := m.prefixKey(key)
+	if err != nil {
+		return true
+	}
+	client, err := redis.DefaultInstanceManager.GetInstance(ctx, m.getInstanceConf(ctx))
+	if err != nil {
+		slog.Errorf(ctx, "%s get instance err, namespace: %s", fun, m.namespace)
+		return true
+	}
+	if err = m.setValue(ctx, client, skey, data, m.opts.expire(), nil); err != nil {
+		slog.Errorf(ctx, "%s set err, cache key:%v err:%v", fun, key, err)
+	}
+	return true
+}
+
+// delLegacy a legacy value left behind would be migrated back by the next miss
+func (m *Cache) delLegacy(ctx context.Context, key interface{}) error {
+	lkey, err := m.keyToString(key)
+	if err != nil {
+		return err
+	}
+	if err = m.opts.Legacy.Del(lkey); err != nil {
+		return fmt.Errorf("del legacy cache key: %v err: %s", key, err.Error())
+	}
+	return nil
+}
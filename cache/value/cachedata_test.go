@@ -0,0 +1,106 @@
+package value
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shawnfeng/sutil/cache"
+	rediscache "github.com/shawnfeng/sutil/redispool/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	_ LegacyStore = (*cache.Cache)(nil)
+	_ LegacyStore = (*rediscache.Cache)(nil)
+)
+
+var dataLoads int64
+
+type testData struct {
+	Key string
+	Tst int64
+}
+
+func (m *testData) Marshal() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+func (m *testData) Unmarshal(data []byte) error {
+	return json.Unmarshal(data, m)
+}
+
+func (m *testData) Load(key string) error {
+	atomic.AddInt64(&dataLoads, 1)
+	*m = testData{Key: key, Tst: 12345}
+	return nil
+}
+
+func newTestData() cache.CacheData {
+	return &testData{}
+}
+
+func TestDataCache(t *testing.T) {
+	server.FlushAll()
+	ctx := context.Background()
+	atomic.StoreInt64(&dataLoads, 0)
+	c := NewDataCache("test/test", "data", time.Minute, newTestData)
+
+	var data testData
+	assert.NoError(t, c.GetCache(ctx, "1", &data))
+	assert.Equal(t, testData{}, data)
+
+	assert.NoError(t, c.Get(ctx, "1", &data))
+	assert.Equal(t, testData{Key: "1", Tst: 12345}, data)
+	assert.NoError(t, c.Get(ctx, "1", &data))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&dataLoads))
+
+	// the key layout of cache.Cache by namespace
+	assert.True(t, server.Miniredis().Exists("test/test.c.data.1"))
+	legacy, err := cache.NewCacheByNamespace(ctx, "test/test", "data", 60)
+	assert.NoError(t, err)
+	var old testData
+	assert.NoError(t, legacy.GetCache("1", &old))
+	assert.Equal(t, data, old)
+
+	assert.NoError(t, c.Set(ctx, "2", &testData{Key: "2", Tst: 1}))
+	assert.NoError(t, c.GetCache(ctx, "2", &data))
+	assert.Equal(t, testData{Key: "2", Tst: 1}, data)
+
+	assert.NoError(t, c.Del(ctx, "2"))
+	assert.False(t, server.Miniredis().Exists("test/test.c.data.2"))
+}
+
+func TestDataCache_Migrate(t *testing.T) {
+	server.FlushAll()
+	ctx := context.Background()
+	atomic.StoreInt64(&dataLoads, 0)
+
+	old := rediscache.NewCache([]string{server.Addr()}, "old", 60)
+	assert.NoError(t, old.Set("1", &testData{Key: "1", Tst: 1}))
+
+	c := NewDataCacheWithOptions("test/test", "new", newTestData, CacheOptions{
+		Expire: time.Minute,
+		Legacy: old,
+	})
+
+	// read from the old layout and written to the new one, without loading
+	var data testData
+	assert.NoError(t, c.Get(ctx, "1", &data))
+	assert.Equal(t, testData{Key: "1", Tst: 1}, data)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&dataLoads))
+	assert.True(t, server.Miniredis().Exists("test/test.c.new.1"))
+
+	// missing in both
+	assert.NoError(t, c.Get(ctx, "2", &data))
+	assert.Equal(t, testData{Key: "2", Tst: 12345}, data)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&dataLoads))
+
+	// deleted from both, so the old value doesn't come back
+	assert.NoError(t, c.Del(ctx, "1"))
+	assert.False(t, server.Miniredis().Exists("old.1"))
+	assert.NoError(t, c.Get(ctx, "1", &data))
+	assert.Equal(t, testData{Key: "1", Tst: 12345}, data)
+}
@@ -41,6 +41,34 @@ var (
 		Help:       "cache.value miss total",
 		LabelNames: []string{"namespace", "command"},
 	})
+	_metricFallback = xprometheus.NewCounter(&xprometheus.CounterVecOpts{
+		Namespace:  namespace,
+		Subsystem:  subsystem,
+		Name:       "fallback_total",
+		Help:       "cache.value loads bypassing redis when its circuit breaker is open",
+		LabelNames: []string{"namespace"},
+	})
+	_metricRefresh = xprometheus.NewCounter(&xprometheus.CounterVecOpts{
+		Namespace:  namespace,
+		Subsystem:  subsystem,
+		Name:       "refresh_total",
+		Help:       "cache.value asynchronous refresh total",
+		LabelNames: []string{"namespace", "type"},
+	})
+	_metricWarm = xprometheus.NewCounter(&xprometheus.CounterVecOpts{
+		Namespace:  namespace,
+		Subsystem:  subsystem,
+		Name:       "warm_total",
+		Help:       "cache.value keys processed by Warm",
+		LabelNames: []string{"namespace", "result"},
+	})
+	_metricMigrate = xprometheus.NewCounter(&xprometheus.CounterVecOpts{
+		Namespace:  namespace,
+		Subsystem:  subsystem,
+		Name:       "migrate_total",
+		Help:       "cache.value misses looked up in the legacy cache",
+		LabelNames: []string{"namespace", "result"},
+	})
 )
 
 func statReqDuration(namespace, command string, durationMS int64) {
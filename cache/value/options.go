@@ -0,0 +1,79 @@
+package value
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/shawnfeng/sutil/cache/serializer"
+)
+
+const defaultRefreshLockExpire = 10 * time.Second
+
+// CacheOptions options of Cache, zero values disable the related feature
+type CacheOptions struct {
+	// Expire ttl of loaded values
+	Expire time.Duration
+
+	// ExpireJitter extend the ttl of every loaded value by a random duration in [0, ExpireJitter*Expire),
+	// so that keys loaded together don't expire together, e.g. 0.1
+	ExpireJitter float64
+
+	// RefreshAhead when a hit has less than RefreshAhead*Expire ttl left, it's served and
+	// reloaded asynchronously once, e.g. 0.2
+	RefreshAhead float64
+
+	// MaxStale values are kept MaxStale longer than their ttl, a stale hit is served and
+	// reloaded asynchronously once, instead of loading synchronously
+	MaxStale time.Duration
+
+	// Serializer encoding of values, default serializer.JSON. Keys are tagged by its name, so
+	// switching serializer doesn't read values written by the old one.
+	Serializer serializer.Serializer
+
+	// RefreshLockExpire bound of one asynchronous reload, other processes won't reload the
+	// same key within it, default 10s
+	RefreshLockExpire time.Duration
+
+	// Legacy migration mode: a miss reads the value of a legacy cache before loading and writes
+	// it to this cache, Del deletes both. Values must be encoded the same way in both.
+	Legacy LegacyStore
+}
+
+func (m CacheOptions) refreshEnabled() bool {
+	return m.RefreshAhead > 0 || m.MaxStale > 0
+}
+
+// expire return the redis ttl of a loaded value, jitter and max stale included
+func (m CacheOptions) expire() time.Duration {
+	expire := m.Expire
+	if expire <= 0 {
+		return expire
+	}
+	if m.ExpireJitter > 0 {
+		expire += time.Duration(rand.Int63n(int64(float64(m.Expire)*m.ExpireJitter) + 1))
+	}
+	if m.MaxStale > 0 {
+		expire += m.MaxStale
+	}
+	return expire
+}
+
+// needRefresh ttl is the remaining redis ttl of a hit
+func (m CacheOptions) needRefresh(ttl time.Duration) (stale, refresh bool) {
+	if !m.refreshEnabled() || ttl < 0 {
+		return false, false
+	}
+
+	fresh := ttl - m.MaxStale
+	if fresh <= 0 {
+		return true, true
+	}
+	return false, float64(fresh) < m.RefreshAhead*float64(m.Expire)
+}
+
+func (m CacheOptions) refreshLockExpire() time.Duration {
+	if m.RefreshLockExpire > 0 {
+		return m.RefreshLockExpire
+	}
+	return defaultRefreshLockExpire
+}
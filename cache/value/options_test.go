@@ -0,0 +1,48 @@
+package value
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheOptions_expire(t *testing.T) {
+	opts := CacheOptions{Expire: time.Minute}
+	assert.Equal(t, time.Minute, opts.expire())
+
+	opts = CacheOptions{Expire: time.Minute, ExpireJitter: 0.1, MaxStale: time.Hour}
+	for i := 0; i < 100; i++ {
+		expire := opts.expire()
+		assert.True(t, expire >= time.Hour+time.Minute)
+		assert.True(t, expire <= time.Hour+time.Minute+6*time.Second)
+	}
+
+	opts = CacheOptions{Expire: 0, MaxStale: time.Hour}
+	assert.Equal(t, time.Duration(0), opts.expire())
+}
+
+func TestCacheOptions_needRefresh(t *testing.T) {
+	opts := CacheOptions{Expire: time.Minute}
+	stale, refresh := opts.needRefresh(time.Second)
+	assert.False(t, stale)
+	assert.False(t, refresh)
+
+	opts = CacheOptions{Expire: time.Minute, RefreshAhead: 0.2, MaxStale: time.Minute}
+	cases := []struct {
+		ttl            time.Duration
+		stale, refresh bool
+	}{
+		{2 * time.Minute, false, false},
+		{time.Minute + 13*time.Second, false, false},
+		{time.Minute + 11*time.Second, false, true},
+		{time.Minute, true, true},
+		{time.Second, true, true},
+		{-time.Millisecond, false, false},
+	}
+	for _, c := range cases {
+		stale, refresh = opts.needRefresh(c.ttl)
+		assert.Equal(t, c.stale, stale, c.ttl.String())
+		assert.Equal(t, c.refresh, refresh, c.ttl.String())
+	}
+}
@@ -0,0 +1,110 @@
+package value
+
+import (
+	"context"
+	"runtime"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/shawnfeng/sutil/cache/redis"
+	"github.com/shawnfeng/sutil/slog/slog"
+	"github.com/shawnfeng/sutil/stime"
+)
+
+const (
+	refreshTypeAhead = "ahead"
+	refreshTypeStale = "stale"
+
+	refreshLockSuffix = ".refresh"
+)
+
+// detachedContext keep values of parent, e.g. route group and span, but not its deadline and cancellation
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+// refreshIfNeeded reload key asynchronously if the hit is stale or about to expire, at most
+// one reload of a key runs in this process, and a redis lock keeps other processes away
+func (m *Cache) refreshIfNeeded(ctx context.Context, key interface{}, ttl time.Duration) {
+	stale, refresh := m.opts.needRefresh(ttl)
+	if !refresh {
+		return
+	}
+
+	skey, err := m.prefixKey(key)
+	if err != nil {
+		return
+	}
+	if _, loaded := m.refreshing.LoadOrStore(skey, struct{}{}); loaded {
+		return
+	}
+
+	refreshType := refreshTypeAhead
+	if stale {
+		refreshType = refreshTypeStale
+	}
+	go m.refresh(detachedContext{ctx}, key, skey, refreshType)
+}
+
+func (m *Cache) refresh(ctx context.Context, key interface{}, skey, refreshType string) {
+	fun := "Cache.refresh -->"
+	command := "cache.value.Refresh"
+	span, ctx := opentracing.StartSpanFromContext(ctx, command)
+	st := stime.NewTimeStat()
+	var err error
+	defer func() {
+		if r := recover(); r != nil {
+			buf := make([]byte, 4096)
+			buf = buf[:runtime.Stack(buf, false)]
+			slog.Errorf(ctx, "%s recover err: %v, stack: %s", fun, r, string(buf))
+		}
+		m.refreshing.Delete(skey)
+		span.Finish()
+		statReqDuration(m.namespace, command, st.Millisecond())
+		statReqErr(m.namespace, command, err)
+	}()
+
+	client, err := redis.DefaultInstanceManager.GetInstance(ctx, m.getInstanceConf(ctx))
+	if err != nil {
+		slog.Errorf(ctx, "%s get instance err, namespace: %s", fun, m.namespace)
+		return
+	}
+
+	locked, err := client.SetNX(ctx, skey+refreshLockSuffix, 1, m.opts.refreshLockExpire()).Result()
+	if err != nil || !locked {
+		return
+	}
+	defer client.Del(ctx, skey+refreshLockSuffix)
+	_metricRefresh.With("namespace", m.namespace, "type", refreshType).Inc()
+
+	// unlike loadValueToCache, a failed reload keeps the old value instead of caching the error
+	value, err := m.load(ctx, key)
+	if err != nil {
+		slog.Warnf(ctx, "%s load err, cache key:%v err:%v", fun, key, err)
+		return
+	}
+
+	value, tags := untag(value)
+	data, err := m.serializer().Marshal(value)
+	if err != nil {
+		slog.Errorf(ctx, "%s marshal err, cache key:%v err:%v", fun, key, err)
+		return
+	}
+
+	err = m.setValue(ctx, client, skey, data, m.opts.expire(), tags)
+	if err != nil {
+		slog.Errorf(ctx, "%s set err, cache key:%v err:%v", fun, key, err)
+	}
+}
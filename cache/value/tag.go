@@ -0,0 +1,137 @@
+package value
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/shawnfeng/sutil/cache/redis"
+	"github.com/shawnfeng/sutil/slog/slog"
+	"github.com/shawnfeng/sutil/stime"
+)
+
+// tag sets are not prefixed by Cache.prefix, so one tag groups keys of all caches in a namespace
+const tagKeyPrefix = "_tag."
+
+type taggedValue struct {
+	value interface{}
+	tags  []string
+}
+
+// WithTags wrap a value returned by LoadFunc, the cached key is added to every tag,
+// e.g. WithTags(profile, "teacher:123"), and is deleted by InvalidateTags of any of them
+func WithTags(value interface{}, tags ...string) interface{} {
+	return &taggedValue{
+		value: value,
+		tags:  tags,
+	}
+}
+
+func untag(value interface{}) (interface{}, []string) {
+	if t, ok := value.(*taggedValue); ok {
+		return t.value, t.tags
+	}
+	return value, nil
+}
+
+func tagKeys(tags []string) []string {
+	keys := make([]string, len(tags))
+	for i, tag := range tags {
+		keys[i] = tagKeyPrefix + tag
+	}
+	return keys
+}
+
+// setValue set skey and add it to the sets of tags, a tag set lives as long as the longest lived
+// key in it. Every command touches one key, so the value key and the tag sets can be in different
+// slots of codis or redis cluster.
+func (m *Cache) setValue(ctx context.Context, client *redis.Client, skey string, data []byte, expire time.Duration, tags []string) error {
+	if err := client.Set(ctx, skey, data, expire).Err(); err != nil {
+		return err
+	}
+	for _, key := range tagKeys(tags) {
+		err := client.RunScript(ctx, tagAddScript, tagAddScriptHash, []string{key}, skey, int64(expire/time.Millisecond)).Err()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InvalidateTags delete every key tagged by any of tags, in all caches of the namespace.
+// The deletion is not atomic: keys are removed from the tag set and deleted one by one,
+// a key tagged again during the call may be deleted while it stays in the set.
+func (m *Cache) InvalidateTags(ctx context.Context, tags ...string) error {
+	fun := "Cache.InvalidateTags -->"
+	command := "cache.value.InvalidateTags"
+	span, ctx := opentracing.StartSpanFromContext(ctx, command)
+	st := stime.NewTimeStat()
+	defer func() {
+		span.Finish()
+		statReqDuration(m.namespace, command, st.Millisecond())
+	}()
+	if len(tags) == 0 {
+		return nil
+	}
+
+	client, err := redis.DefaultInstanceManager.GetInstance(ctx, m.getInstanceConf(ctx))
+	if err != nil {
+		statReqErr(m.namespace, command, err)
+		slog.Errorf(ctx, "%s get instance err, namespace: %s", fun, m.namespace)
+		return err
+	}
+
+	var n int64
+	for _, key := range tagKeys(tags) {
+		deleted, err := invalidateTag(ctx, client, key)
+		n += deleted
+		if err != nil {
+			statReqErr(m.namespace, command, err)
+			return fmt.Errorf("invalidate cache tags: %v err: %s", tags, err.Error())
+		}
+	}
+	slog.Infof(ctx, "%s tags: %v deleted keys: %d", fun, tags, n)
+
+	return nil
+}
+
+// invalidateTag delete the keys in the tag set of key, every member is removed from the set
+// before its key is deleted, so a key tagged again meanwhile keeps its membership
+func invalidateTag(ctx context.Context, client *redis.Client, key string) (int64, error) {
+	members, err := client.SMembers(redis.WithPrimary(ctx), key).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int64
+	for _, member := range members {
+		if err := client.SRem(ctx, key, member).Err(); err != nil {
+			return deleted, err
+		}
+		n, err := client.Del(ctx, member).Result()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
+
+// KEYS[1]: tag set ARGV: value key, expire(ms) of the value key, 0 means never expire
+const tagAddScript = `
+local expire = tonumber(ARGV[2])
+local existed = redis.call('EXISTS', KEYS[1])
+redis.call('SADD', KEYS[1], ARGV[1])
+if expire > 0 then
+	local ttl = redis.call('PTTL', KEYS[1])
+	if existed == 0 or (ttl >= 0 and ttl < expire) then
+		redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	end
+else
+	redis.call('PERSIST', KEYS[1])
+end
+return 1
+`
+
+var tagAddScriptHash = redis.ScriptHash(tagAddScript)
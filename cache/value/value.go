@@ -10,16 +10,17 @@ package value
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/opentracing/opentracing-go"
 	"github.com/shawnfeng/sutil/cache"
 	"github.com/shawnfeng/sutil/cache/constants"
 	"github.com/shawnfeng/sutil/cache/redis"
+	"github.com/shawnfeng/sutil/cache/serializer"
 	"github.com/shawnfeng/sutil/scontext"
 	"github.com/shawnfeng/sutil/slog/slog"
 	"github.com/shawnfeng/sutil/stime"
+	"sync"
 	"time"
 )
 
@@ -30,16 +31,33 @@ type Cache struct {
 	namespace string
 	prefix    string
 	load      LoadFunc
-	expire    time.Duration
+	opts      CacheOptions
+	// newValue return an empty value to decode into without a caller, e.g. legacy values by
+	// Warm, nil is interface{}
+	newValue func() interface{}
+
+	// keys being reloaded asynchronously by this process
+	refreshing sync.Map
 }
 
 func NewCache(namespace, prefix string, expire time.Duration, load LoadFunc) *Cache {
+	return NewCacheWithOptions(namespace, prefix, load, CacheOptions{Expire: expire})
+}
+
+func NewCacheWithOptions(namespace, prefix string, load LoadFunc, opts CacheOptions) *Cache {
 	return &Cache{
 		namespace: namespace,
 		prefix:    prefix,
 		load:      load,
-		expire:    expire,
+		opts:      opts,
+	}
+}
+
+func (m *Cache) emptyValue() interface{} {
+	if m.newValue != nil {
+		return m.newValue()
 	}
+	return new(interface{})
 }
 
 func (m *Cache) getInstanceConf(ctx context.Context) *redis.InstanceConf {
@@ -61,12 +79,20 @@ func (m *Cache) Get(ctx context.Context, key, value interface{}) error {
 		statReqDuration(m.namespace, command, st.Millisecond())
 	}()
 
-	err := m.getValueFromCache(ctx, key, value)
+	ttl, err := m.getValueFromCache(ctx, key, value)
 	if err == nil {
 		_metricHits.With("namespace", m.namespace, "command", command).Inc()
+		m.refreshIfNeeded(ctx, key, ttl)
 		return nil
 	}
 
+	if redis.IsCircuitOpen(err) {
+		_metricFallback.With("namespace", m.namespace).Inc()
+		err = m.loadValueDirectly(ctx, key, value)
+		statReqErr(m.namespace, command, err)
+		return err
+	}
+
 	if err.Error() != redis.RedisNil {
 		statReqErr(m.namespace, command, err)
 		slog.Errorf(ctx, "%s cache key: %v err: %v", fun, key, err)
@@ -74,6 +100,10 @@ func (m *Cache) Get(ctx context.Context, key, value interface{}) error {
 	}
 	_metricMiss.With("namespace", m.namespace, "command", command).Inc()
 
+	if m.opts.Legacy != nil && m.migrate(ctx, key, value) {
+		return nil
+	}
+
 	data, err := m.loadValueToCache(ctx, key)
 	if err != nil {
 		statReqErr(m.namespace, command, err)
@@ -81,7 +111,7 @@ func (m *Cache) Get(ctx context.Context, key, value interface{}) error {
 		return err
 	}
 
-	err = json.Unmarshal(data, value)
+	err = m.serializer().Unmarshal(data, value)
 	if err != nil {
 		statReqErr(m.namespace, command, err)
 		return errors.New(string(data))
@@ -121,6 +151,12 @@ func (m *Cache) Del(ctx context.Context, key interface{}) error {
 		return fmt.Errorf("del cache key: %v err: %s", key, err.Error())
 	}
 
+	if m.opts.Legacy != nil {
+		err = m.delLegacy(ctx, key)
+		statReqErr(m.namespace, command, err)
+		return err
+	}
+
 	return nil
 }
 
@@ -176,82 +212,128 @@ func (m *Cache) prefixKey(key interface{}) (string, error) {
 	}
 
 	if len(m.prefix) > 0 {
-		return fmt.Sprintf("%s.%s", m.prefix, skey), nil
+		skey = fmt.Sprintf("%s.%s", m.prefix, skey)
 	}
 
-	return skey, nil
+	return serializer.TagKey(skey, m.opts.Serializer), nil
 }
 
-func (m *Cache) getValueFromCache(ctx context.Context, key, value interface{}) error {
+func (m *Cache) serializer() serializer.Serializer {
+	return serializer.OrDefault(m.opts.Serializer)
+}
+
+// getValueFromCache ttl is the remaining ttl of key, only fetched when refresh is enabled, otherwise -1
+func (m *Cache) getValueFromCache(ctx context.Context, key, value interface{}) (ttl time.Duration, err error) {
 	fun := "Cache.getValueFromCache -->"
+	ttl = -1
 
 	skey, err := m.prefixKey(key)
 	if err != nil {
-		return err
+		return ttl, err
 	}
 
 	client, err := redis.DefaultInstanceManager.GetInstance(ctx, m.getInstanceConf(ctx))
 	if err != nil {
 		slog.Errorf(ctx, "%s get instance err, namespace: %s", fun, m.namespace)
-		return err
+		return ttl, err
 	}
 
-	data, err := client.Get(ctx, skey).Bytes()
-	if err != nil {
-		return err
+	var data []byte
+	if m.opts.refreshEnabled() {
+		pipe := client.Pipeline(ctx)
+		defer pipe.Close()
+		getCmd := pipe.Get(ctx, skey)
+		ttlCmd := pipe.PTTL(ctx, skey)
+		if _, err = pipe.Exec(ctx); err != nil {
+			return ttl, err
+		}
+		data, _ = getCmd.Bytes()
+		ttl = ttlCmd.Val()
+	} else {
+		data, err = client.Get(ctx, skey).Bytes()
+		if err != nil {
+			return ttl, err
+		}
 	}
 
 	//slog.Infof(ctx, "%s key: %v data: %s", fun, key, string(data))
 
-	err = json.Unmarshal(data, value)
+	err = m.serializer().Unmarshal(data, value)
 	if err != nil {
-		return errors.New(string(data))
+		return ttl, errors.New(string(data))
 	}
 
-	return nil
+	return ttl, nil
 }
 
 func (m *Cache) loadValueToCache(ctx context.Context, key interface{}) (data []byte, err error) {
-	fun := "Cache.loadValueToCache -->"
-	expire := m.expire
+	data, _, err = m.loadToCache(ctx, key)
+	return data, err
+}
 
-	value, err := m.load(ctx, key)
-	if err != nil {
-		slog.Warnf(ctx, "%s load err, cache key:%v err:%v", fun, key, err)
-		data = []byte(err.Error())
+// loadToCache loadErr is the error of load or marshal, its message is cached as data for
+// CacheDirtyExpireTime, err is the error of caching it
+func (m *Cache) loadToCache(ctx context.Context, key interface{}) (data []byte, loadErr, err error) {
+	fun := "Cache.loadToCache -->"
+	expire := m.opts.expire()
+
+	value, loadErr := m.load(ctx, key)
+	value, tags := untag(value)
+	if loadErr != nil {
+		slog.Warnf(ctx, "%s load err, cache key:%v err:%v", fun, key, loadErr)
+		data = []byte(loadErr.Error())
 		expire = constants.CacheDirtyExpireTime
 
 	} else {
-		data, err = json.Marshal(value)
-		if err != nil {
-			slog.Errorf(ctx, "%s marshal err, cache key:%v err:%v", fun, key, err)
-			data = []byte(err.Error())
+		data, loadErr = m.serializer().Marshal(value)
+		if loadErr != nil {
+			slog.Errorf(ctx, "%s marshal err, cache key:%v err:%v", fun, key, loadErr)
+			data = []byte(loadErr.Error())
 			expire = constants.CacheDirtyExpireTime
+			tags = nil
 		}
 	}
 
 	skey, err := m.prefixKey(key)
 	if err != nil {
 		slog.Errorf(ctx, "%s fixkey, key: %v err:%v", fun, key, err)
-		return nil, err
+		return nil, loadErr, err
 	}
 
 	client, err := redis.DefaultInstanceManager.GetInstance(ctx, m.getInstanceConf(ctx))
 	if err != nil {
 		slog.Errorf(ctx, "%s get instance err, namespace: %s", fun, m.namespace)
-		return nil, err
+		return nil, loadErr, err
 	}
 
-	rerr := client.Set(ctx, skey, data, expire).Err()
+	rerr := m.setValue(ctx, client, skey, data, expire, tags)
 	if rerr != nil {
 		slog.Errorf(ctx, "%s set err, cache key:%v rerr:%v", fun, key, rerr)
 	}
 
 	if err != nil {
-		return nil, err
+		return nil, loadErr, err
 	}
 
-	return data, nil
+	return data, loadErr, nil
+}
+
+// loadValueDirectly bypass redis when its circuit breaker is open, nothing is cached
+func (m *Cache) loadValueDirectly(ctx context.Context, key, value interface{}) error {
+	fun := "Cache.loadValueDirectly -->"
+	v, err := m.load(ctx, key)
+	if err != nil {
+		slog.Warnf(ctx, "%s load err, cache key:%v err:%v", fun, key, err)
+		return err
+	}
+	v, _ = untag(v)
+
+	data, err := m.serializer().Marshal(v)
+	if err != nil {
+		slog.Errorf(ctx, "%s marshal err, cache key:%v err:%v", fun, key, err)
+		return err
+	}
+	return m.serializer().Unmarshal(data, value)
 }
 
 func SetConfiger(ctx context.Context, configerType constants.ConfigerType) error {
@@ -271,7 +353,7 @@ func SetConfiger(ctx context.Context, configerType constants.ConfigerType) error
 }
 
 func WatchUpdate(ctx context.Context) {
-	go redis.DefaultInstanceManager.Watch(ctx)
+	go redis.DefaultInstanceManager.WatchConfiger(ctx, redis.DefaultConfiger)
 }
 
 func init() {
@@ -2,7 +2,11 @@ package value
 
 import (
 	"context"
+	"fmt"
+	"github.com/shawnfeng/sutil/cache/serializer"
 	"github.com/shawnfeng/sutil/trace"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
 
 	//"fmt"
 	"github.com/shawnfeng/sutil/slog/slog"
@@ -46,3 +50,80 @@ func TestGet(t *testing.T) {
 
 	time.Sleep(2 * time.Second)
 }
+
+func TestGetRefresh(t *testing.T) {
+	ctx := context.Background()
+	var loads int64
+	c := NewCacheWithOptions("test/test", "test", func(ctx context.Context, key interface{}) (value interface{}, err error) {
+		return &Test{Id: atomic.AddInt64(&loads, 1)}, nil
+	}, CacheOptions{
+		Expire:       2 * time.Second,
+		RefreshAhead: 0.5,
+		MaxStale:     time.Minute,
+	})
+	c.Del(ctx, 8)
+
+	var test Test
+	err := c.Get(ctx, 8, &test)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), test.Id)
+
+	// within refresh ahead window, the old value is served and reloaded asynchronously
+	server.FastForward(1500 * time.Millisecond)
+	err = c.Get(ctx, 8, &test)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), test.Id)
+
+	time.Sleep(200 * time.Millisecond)
+	err = c.Get(ctx, 8, &test)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), test.Id)
+
+	c.Del(ctx, 8)
+}
+
+func TestGetSerializer(t *testing.T) {
+	ctx := context.Background()
+	for _, s := range []serializer.Serializer{serializer.Msgpack, serializer.WithCompression(serializer.Gob, 8)} {
+		c := NewCacheWithOptions("test/test", "test", load, CacheOptions{
+			Expire:     60 * time.Second,
+			Serializer: s,
+		})
+		_ = c.Del(ctx, 21)
+
+		var test Test
+		assert.NoError(t, c.Get(ctx, 21, &test))
+		assert.Equal(t, int64(1), test.Id)
+
+		test = Test{}
+		assert.NoError(t, c.Get(ctx, 21, &test))
+		assert.Equal(t, int64(1), test.Id, s.Name())
+	}
+}
+
+func TestInvalidateTags(t *testing.T) {
+	ctx := context.Background()
+	var loads int64
+	tagged := func(ctx context.Context, key interface{}) (value interface{}, err error) {
+		return WithTags(&Test{Id: atomic.AddInt64(&loads, 1)}, fmt.Sprintf("teacher:%v", key)), nil
+	}
+	profile := NewCache("test/test", "profile", 60*time.Second, tagged)
+	lessons := NewCache("test/test", "lessons", 60*time.Second, tagged)
+	_ = lessons.InvalidateTags(ctx, "teacher:123", "teacher:456")
+
+	var test Test
+	assert.NoError(t, profile.Get(ctx, 123, &test))
+	assert.NoError(t, lessons.Get(ctx, 123, &test))
+	assert.NoError(t, lessons.Get(ctx, 456, &test))
+	assert.Equal(t, int64(3), atomic.LoadInt64(&loads))
+
+	assert.NoError(t, profile.InvalidateTags(ctx, "teacher:123"))
+
+	assert.NoError(t, lessons.Get(ctx, 456, &test))
+	assert.Equal(t, int64(3), atomic.LoadInt64(&loads))
+	assert.NoError(t, profile.Get(ctx, 123, &test))
+	assert.NoError(t, lessons.Get(ctx, 123, &test))
+	assert.Equal(t, int64(5), atomic.LoadInt64(&loads))
+
+	assert.NoError(t, lessons.InvalidateTags(ctx, "teacher:123", "teacher:456"))
+}
@@ -0,0 +1,260 @@
+package value
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/shawnfeng/sutil/cache/redis"
+	"github.com/shawnfeng/sutil/slog/slog"
+	"github.com/shawnfeng/sutil/stime"
+)
+
+const (
+	defaultWarmConcurrency   = 8
+	defaultWarmProgressEvery = 1000
+)
+
+// KeySource stream keys to Warm by calling yield for each of them, it should stop and
+// return nil as soon as yield returns false
+type KeySource func(ctx context.Context, yield func(key interface{}) bool) error
+
+// KeyIterator Next return ok false when there is no more key
+type KeyIterator interface {
+	Next(ctx context.Context) (key interface{}, ok bool, err error)
+}
+
+// FromIterator adapt a KeyIterator, e.g. rows of a db scan, to a KeySource
+func FromIterator(it KeyIterator) KeySource {
+	return func(ctx context.Context, yield func(key interface{}) bool) error {
+		for {
+			key, ok, err := it.Next(ctx)
+			if err != nil {
+				return err
+			}
+			if !ok || !yield(key) {
+				return nil
+			}
+		}
+	}
+}
+
+// FromKeys a KeySource of keys known in advance
+func FromKeys(keys ...interface{}) KeySource {
+	return func(ctx context.Context, yield func(key interface{}) bool) error {
+		for _, key := range keys {
+			if !yield(key) {
+				return nil
+			}
+		}
+		return nil
+	}
+}
+
+type WarmOptions struct {
+	// Concurrency number of concurrent loads, default 8
+	Concurrency int
+	// QPS max loads per second, 0 means unlimited
+	QPS float64
+	// Overwrite load keys already cached too, by default they are skipped
+	Overwrite bool
+	// Offset skip the first Offset keys of the source, e.g. WarmProgress.Offset of a paused warm
+	Offset int64
+	// OnProgress called every ProgressEvery processed keys and once at the end, never concurrently
+	OnProgress    func(WarmProgress)
+	ProgressEvery int64
+	// OnError called for every key failed to load, the failure is cached like a miss of Get
+	OnError func(key interface{}, err error)
+}
+
+type WarmProgress struct {
+	Loaded  int64
+	Skipped int64
+	Failed  int64
+	// Offset keys of the source processed without gap, pass it as WarmOptions.Offset with the
+	// same source to resume
+	Offset int64
+	Done   bool
+}
+
+func (m WarmProgress) processed() int64 {
+	return m.Loaded + m.Skipped + m.Failed
+}
+
+// Warm load keys of source into the cache, e.g. after a failover or before a new namespace
+// takes traffic. It blocks until source is exhausted or ctx is done, run it in a goroutine
+// from an init hook so that startup isn't delayed. Cancelling ctx pauses it, keys in flight
+// are finished and the returned progress tells where to resume.
+func (m *Cache) Warm(ctx context.Context, source KeySource, opts WarmOptions) (WarmProgress, error) {
+	fun := "Cache.Warm -->"
+	command := "cache.value.Warm"
+	st := stime.NewTimeStat()
+	defer func() {
+		statReqDuration(m.namespace, command, st.Millisecond())
+	}()
+
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultWarmConcurrency
+	}
+	if opts.ProgressEvery <= 0 {
+		opts.ProgressEvery = defaultWarmProgressEvery
+	}
+
+	w := &warmer{
+		cache:    m,
+		opts:     opts,
+		progress: WarmProgress{Offset: opts.Offset},
+		finished: map[int64]bool{},
+	}
+
+	// QPS over 1e9 is less than 1ns per load, i.e. unlimited
+	var limit <-chan time.Time
+	if interval := time.Duration(float64(time.Second) / opts.QPS); opts.QPS > 0 && interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		limit = ticker.C
+	}
+
+	jobs := make(chan warmJob)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				w.warm(ctx, job, limit)
+			}
+		}()
+	}
+
+	var seq int64
+	err := source(ctx, func(key interface{}) bool {
+		seq++
+		if seq <= opts.Offset {
+			return true
+		}
+		select {
+		case jobs <- warmJob{seq: seq, key: key}:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	})
+	close(jobs)
+	wg.Wait()
+
+	if err == nil {
+		err = ctx.Err()
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.progress.Done = err == nil
+	if opts.OnProgress != nil {
+		opts.OnProgress(w.progress)
+	}
+	statReqErr(m.namespace, command, err)
+	slog.Infof(ctx, "%s namespace:%s prefix:%s progress:%+v err:%v", fun, m.namespace, m.prefix, w.progress, err)
+	return w.progress, err
+}
+
+type warmJob struct {
+	// 1-based position in the source
+	seq int64
+	key interface{}
+}
+
+type warmer struct {
+	cache *Cache
+	opts  WarmOptions
+
+	mu       sync.Mutex
+	progress WarmProgress
+	// seqs finished after a gap, the offset moves past them once the gap is filled
+	finished map[int64]bool
+}
+
+func (m *warmer) warm(ctx context.Context, job warmJob, limit <-chan time.Time) {
+	// paused, keys not started are left for the next run
+	if ctx.Err() != nil {
+		return
+	}
+
+	loaded, err := m.cache.warmKey(ctx, job.key, m.opts.Overwrite, limit)
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+	if err != nil && m.opts.OnError != nil {
+		m.opts.OnError(job.key, err)
+	}
+
+	result := "skipped"
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case err != nil:
+		result = "failed"
+		m.progress.Failed++
+	case loaded:
+		result = "loaded"
+		m.progress.Loaded++
+	default:
+		m.progress.Skipped++
+	}
+	_metricWarm.With("namespace", m.cache.namespace, "result", result).Inc()
+
+	m.finished[job.seq] = true
+	for m.finished[m.progress.Offset+1] {
+		delete(m.finished, m.progress.Offset+1)
+		m.progress.Offset++
+	}
+
+	if m.opts.OnProgress != nil && m.progress.processed()%m.opts.ProgressEvery == 0 {
+		m.opts.OnProgress(m.progress)
+	}
+}
+
+// warmKey loaded is false if key is already cached, limit is taken before loading
+func (m *Cache) warmKey(ctx context.Context, key interface{}, overwrite bool, limit <-chan time.Time) (loaded bool, err error) {
+	skey, err := m.prefixKey(key)
+	if err != nil {
+		return false, err
+	}
+
+	client, err := redis.DefaultInstanceManager.GetInstance(ctx, m.getInstanceConf(ctx))
+	if err != nil {
+		return false, err
+	}
+
+	if !overwrite {
+		n, err := client.Exists(ctx, skey).Result()
+		if err != nil {
+			return false, err
+		}
+		if n > 0 {
+			return false, nil
+		}
+	}
+
+	if limit != nil {
+		select {
+		case <-limit:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+
+	// the same as a miss of Get: migrate the legacy value, or load and cache it, Overwrite
+	// always loads. Legacy values that don't decode into the empty value of the cache, e.g.
+	// protobuf into interface{}, are loaded instead
+	if !overwrite && m.opts.Legacy != nil && m.migrate(ctx, key, m.emptyValue()) {
+		return true, nil
+	}
+	_, loadErr, err := m.loadToCache(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if loadErr != nil {
+		return false, loadErr
+	}
+	return true, nil
+}
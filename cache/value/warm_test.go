@@ -0,0 +1,137 @@
+package value
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	rediscache "github.com/shawnfeng/sutil/redispool/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWarm(t *testing.T) {
+	server.FlushAll()
+	ctx := context.Background()
+	var loads int64
+	c := NewCache("test/test", "warm", time.Minute, func(ctx context.Context, key interface{}) (interface{}, error) {
+		atomic.AddInt64(&loads, 1)
+		if key.(int) == 13 {
+			return nil, fmt.Errorf("not found")
+		}
+		return &Test{Id: int64(key.(int))}, nil
+	})
+
+	var cached Test
+	assert.NoError(t, c.Get(ctx, 1, &cached))
+
+	keys := make([]interface{}, 100)
+	for i := range keys {
+		keys[i] = i
+	}
+	var failed []interface{}
+	var reports int
+	progress, err := c.Warm(ctx, FromKeys(keys...), WarmOptions{
+		Concurrency:   4,
+		ProgressEvery: 10,
+		OnProgress:    func(WarmProgress) { reports++ },
+		OnError:       func(key interface{}, err error) { failed = append(failed, key) },
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, WarmProgress{Loaded: 98, Skipped: 1, Failed: 1, Offset: 100, Done: true}, progress)
+	assert.Equal(t, []interface{}{13}, failed)
+	assert.Equal(t, 11, reports)
+
+	loads = 0
+	for i := 0; i < 100; i++ {
+		if i == 13 {
+			continue
+		}
+		var v Test
+		assert.NoError(t, c.Get(ctx, i, &v))
+		assert.Equal(t, int64(i), v.Id)
+	}
+	assert.Equal(t, int64(0), loads)
+
+	// the failed load is cached the same as a miss of Get
+	assert.Error(t, c.Get(ctx, 13, &cached))
+	assert.Equal(t, int64(0), loads)
+	// Load keeps its contract, the failure is cached but not returned
+	assert.NoError(t, c.Load(ctx, 13))
+	assert.Equal(t, int64(1), loads)
+	loads = 0
+
+	// rate limited
+	st := time.Now()
+	progress, err = c.Warm(ctx, FromKeys(keys[:3]...), WarmOptions{QPS: 20, Overwrite: true})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), progress.Loaded)
+	assert.Equal(t, int64(3), loads)
+	assert.True(t, time.Since(st) >= 100*time.Millisecond)
+
+	// less than 1ns per load is unlimited
+	progress, err = c.Warm(ctx, FromKeys(keys[:3]...), WarmOptions{QPS: 2e9, Overwrite: true})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), progress.Loaded)
+}
+
+func TestWarm_Legacy(t *testing.T) {
+	server.FlushAll()
+	ctx := context.Background()
+	atomic.StoreInt64(&dataLoads, 0)
+
+	old := rediscache.NewCache([]string{server.Addr()}, "old", 60)
+	assert.NoError(t, old.Set("1", &testData{Key: "1", Tst: 1}))
+	c := NewDataCacheWithOptions("test/test", "new", newTestData, CacheOptions{
+		Expire: time.Minute,
+		Legacy: old,
+	})
+
+	// migrated like a miss of Get, only the key missing in the legacy cache is loaded
+	progress, err := c.cache.Warm(ctx, FromKeys("1", "2"), WarmOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), progress.Loaded)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&dataLoads))
+
+	var data testData
+	assert.NoError(t, c.Get(ctx, "1", &data))
+	assert.Equal(t, testData{Key: "1", Tst: 1}, data)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&dataLoads))
+}
+
+type seqIterator struct {
+	next, n int
+}
+
+func (m *seqIterator) Next(ctx context.Context) (interface{}, bool, error) {
+	if m.next >= m.n {
+		return nil, false, nil
+	}
+	m.next++
+	return m.next, true, nil
+}
+
+func TestWarm_Resume(t *testing.T) {
+	server.FlushAll()
+	ctx, cancel := context.WithCancel(context.Background())
+	var loads int64
+	c := NewCache("test/test", "warm.resume", time.Minute, func(ctx context.Context, key interface{}) (interface{}, error) {
+		if atomic.AddInt64(&loads, 1) == 30 {
+			cancel()
+		}
+		return &Test{Id: int64(key.(int))}, nil
+	})
+
+	progress, err := c.Warm(ctx, FromIterator(&seqIterator{n: 100}), WarmOptions{Concurrency: 2})
+	assert.Equal(t, context.Canceled, err)
+	assert.False(t, progress.Done)
+	assert.True(t, progress.Offset >= 28 && progress.Offset <= 30, "%+v", progress)
+
+	// the same source from where it paused
+	resumed, err := c.Warm(context.Background(), FromIterator(&seqIterator{n: 100}), WarmOptions{Offset: progress.Offset})
+	assert.NoError(t, err)
+	assert.True(t, resumed.Done)
+	assert.Equal(t, int64(100), resumed.Offset)
+	assert.Equal(t, int64(100), progress.Loaded+resumed.Loaded)
+}
@@ -3,124 +3,558 @@ package dbrouter
 import (
 	"bytes"
 	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
 	"github.com/shawnfeng/sutil/sconf/center"
 	"github.com/shawnfeng/sutil/slog/slog"
+	"gopkg.in/mgo.v2"
 )
 
 var (
-	configCenter center.ConfigCenter
+	configMu      sync.Mutex
+	configCenter  center.ConfigCenter
+	configInitAt  time.Time
+	configIniting bool
+	// newConfigCenter replaced in tests
+	newConfigCenter = initConfig
 )
 
 const (
-	globalGranularityKey = "global.granularity" // 精度
-	globalThresholdKey   = "global.threshold"   // 精度内阈值
-	globalBreakerGapKey  = "global.breakergap"  // 触发熔断后的熔断间隔,单位: 秒
+	// 熔断配置, 按cluster配置为 <cluster>.breaker.xxx, 未配置时取 global.breaker.xxx
+	breakerKeyErrorRate     = "breaker.errorrate"     // 窗口内失败百分比阈值, 0关闭熔断
+	breakerKeySlowRate      = "breaker.slowrate"      // 窗口内慢请求百分比阈值, 0不按慢请求熔断
+	breakerKeySlowThreshold = "breaker.slowthreshold" // 慢请求耗时, 单位: 毫秒
+	breakerKeyMinRequests   = "breaker.minrequests"   // 窗口内请求数不足时不熔断
+	breakerKeyWindow        = "breaker.window"        // 滑动窗口, 单位: 秒
+	breakerKeyOpenTimeout   = "breaker.opentimeout"   // 熔断后进入半开的间隔, 单位: 秒
+	breakerKeyProbes        = "breaker.probes"        // 半开时放行的探测请求数
+	// 旧配置: 旧熔断器在 granularity 内超时数超过 threshold 时熔断 breakergap 秒，
+	// 迁移到 breaker.xxx 后删除; 未配置对应的新配置时按下面的方式兼容:
+	// breakergap -> opentimeout, granularity -> window, threshold -> minrequests = threshold+1,
+	// 即失败数不超过 threshold 时不会熔断
+	globalBreakerGapKey  = "global.breakergap"  // 单位: 秒
+	globalGranularityKey = "global.granularity" // 如 1s
+	globalThresholdKey   = "global.threshold"
 
-	checkTick         = time.Millisecond * 25
-	defaultThreshold  = 10
-	defaultBreakerGap = 10
+	breakerBuckets = 10
+	// breakers of more cluster/table than this share one breaker per cluster
+	maxBreakers          = 4096
+	breakerConfigRefresh = 10 * time.Second
+	// apollo failed to init is retried after this, with default thresholds meanwhile
+	configInitRetry = time.Minute
+
+	defaultBreakerErrorRate     = 50
+	defaultBreakerSlowThreshold = time.Second
+	defaultBreakerMinRequests   = 20
+	defaultBreakerWindow        = 10 * time.Second
+	defaultBreakerOpenTimeout   = 10 * time.Second
+	defaultBreakerProbes        = 3
 )
 
-// TOOD 简单计数法实现熔断操作，后续改为滑动窗口或三方组件的方式
+// ErrBreakerOpen returned without executing while the breaker of the cluster and table is open
+var ErrBreakerOpen = errors.New("sql cause breaker, because too many timeout")
+
+type BreakerState int32
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("BreakerState(%d)", int32(s))
+	}
+}
+
+// BreakerConfig thresholds of the breakers of a cluster, ErrorRate 0 disables them
+type BreakerConfig struct {
+	// ErrorRate percent of failures in Window that opens the breaker, see isBreakerFailure
+	ErrorRate int
+	// SlowRate percent of requests slower than SlowThreshold in Window that opens the breaker, 0 disables it
+	SlowRate      int
+	SlowThreshold time.Duration
+	// MinRequests the breaker doesn't open until Window has at least MinRequests requests
+	MinRequests int
+	Window      time.Duration
+	// OpenTimeout how long the breaker stays open before letting probes through
+	OpenTimeout time.Duration
+	// Probes number of requests let through when half open, all must succeed to close the breaker
+	Probes int
+}
+
+func defaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		ErrorRate:     defaultBreakerErrorRate,
+		SlowThreshold: defaultBreakerSlowThreshold,
+		MinRequests:   defaultBreakerMinRequests,
+		Window:        defaultBreakerWindow,
+		OpenTimeout:   defaultBreakerOpenTimeout,
+		Probes:        defaultBreakerProbes,
+	}
+}
+
+// isBreakerFailure errors telling the db is down or overloaded, errors of the statement itself,
+// e.g. duplicate key, syntax, deadlock, or cancellation by the caller don't count
+func isBreakerFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		switch myErr.Number {
+		// too many connections, max user connections, query interrupted, max_execution_time exceeded
+		case 1040, 1203, 1317, 3024:
+			return true
+		// tidb: pd server timeout, tikv server timeout, tikv server busy, region unavailable
+		case 9001, 9002, 9003, 9005:
+			return true
+		}
+		return false
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// connection exception, insufficient resources, statement timeout, admin shutdown
+		return pqErr.Code.Class() == "08" || pqErr.Code.Class() == "53" ||
+			pqErr.Code == "57014" || pqErr.Code == "57P01"
+	}
+	return isMgoFailure(err)
+}
+
+// mgo returns most failures of the servers as plain errors, see cluster.go, server.go and socket.go of mgo
+var mgoFailureMessages = []string{
+	"no reachable servers",
+	"Closed explicitly",
+	"server was closed",
+	"server not available",
+	"per-server connection limit reached",
+	"i/o timeout",
+}
+
+func isMgoFailure(err error) bool {
+	var queryErr *mgo.QueryError
+	if errors.As(err, &queryErr) {
+		return isMgoFailureCode(queryErr.Code)
+	}
+	var lastErr *mgo.LastError
+	if errors.As(err, &lastErr) {
+		return isMgoFailureCode(lastErr.Code)
+	}
+	if err == mgo.ErrNotFound {
+		return false
+	}
+	msg := err.Error()
+	for _, m := range mgoFailureMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
+
+func isMgoFailureCode(code int) bool {
+	switch code {
+	// exceeded time limit, network timeout, shutdown in progress, interrupted at shutdown
+	case 50, 89, 91, 11600:
+		return true
+	// primary stepped down, not master, not master no slaveok, interrupted due to repl state change
+	case 189, 10107, 13435, 11602:
+		return true
+	}
+	return false
+}
+
+type breakerBucket struct {
+	total, failures, slows int
+}
+
+// Breaker closed/open/half-open circuit breaker of a cluster and table, results are kept in a
+// sliding window of breakerBuckets buckets
+type Breaker struct {
+	// Deprecated: 1 while the breaker is open, use GetBreakerState
+	Rejected int32
+	// Deprecated: unix seconds the breaker last changed state
+	RejectedStart int64
+	// Deprecated: failures in the window of the breaker
+	Count int32
+
+	cluster, table string
+
+	mu    sync.Mutex
+	conf  BreakerConfig
+	state BreakerState
+	// closed: sliding window of results
+	buckets     [breakerBuckets]breakerBucket
+	bucketStart time.Time
+	bucketIdx   int
+	// open and half open: since when
+	openedAt time.Time
+	// half open: probes let through and succeeded
+	probes, successes int
+}
+
+type breakerConfigEntry struct {
+	conf     BreakerConfig
+	loadedAt time.Time
+}
+
 type BreakerManager struct {
 	lock     sync.Mutex
 	Breakers map[string]*Breaker
+	// cluster -> config, reloaded every breakerConfigRefresh
+	configs    map[string]*breakerConfigEntry
+	loadConfig func(cluster string) BreakerConfig
 }
 
-type Breaker struct {
-	Rejected      int32
-	RejectedStart int64
-	Count         int32
+var (
+	bm     *BreakerManager
+	bmOnce sync.Once
+)
+
+// defaultBreakerManager breakers of Entry and of routers without RouterOptions.BreakerConfig
+func defaultBreakerManager() *BreakerManager {
+	bmOnce.Do(func() {
+		bm = newBreakerManager(loadBreakerConfig)
+	})
+	return bm
 }
 
-var bm *BreakerManager
+func newBreakerManager(loadConfig func(cluster string) BreakerConfig) *BreakerManager {
+	return &BreakerManager{
+		Breakers:   make(map[string]*Breaker),
+		configs:    make(map[string]*breakerConfigEntry),
+		loadConfig: loadConfig,
+	}
+}
 
-func statBreaker(cluster, table string, err error) {
-	if err != nil && (strings.Contains(err.Error(), "timeout") || strings.Contains(err.Error(), "invalid connection")) {
-		key := concat(cluster, "_", table)
-		bm.lock.Lock()
-		if _, ok := bm.Breakers[key]; !ok {
-			breaker := new(Breaker)
-			breaker.Run()
-			bm.Breakers[key] = breaker
+func (m *BreakerManager) get(cluster, table string) *Breaker {
+	now := time.Now()
+	key := concat(cluster, "_", table)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	conf, ok := m.configs[cluster]
+	if !ok || now.Sub(conf.loadedAt) >= breakerConfigRefresh {
+		// loaded under the lock, so a cluster is loaded once per refresh
+		conf = &breakerConfigEntry{conf: m.loadConfig(cluster), loadedAt: now}
+		m.configs[cluster] = conf
+	}
+
+	breaker, ok := m.Breakers[key]
+	if !ok {
+		if len(m.Breakers) >= maxBreakers {
+			table = "*"
+			key = concat(cluster, "_", table)
+			breaker, ok = m.Breakers[key]
+		}
+		if !ok {
+			breaker = &Breaker{cluster: cluster, table: table, bucketStart: now}
+			m.Breakers[key] = breaker
 		}
-		breaker := bm.Breakers[key]
-		bm.lock.Unlock()
-		atomic.AddInt32(&breaker.Count, 1)
 	}
+	breaker.setConfig(conf.conf)
+	return breaker
 }
 
+func (m *BreakerManager) entry(cluster, table string) bool {
+	ok := m.get(cluster, table).allow(time.Now())
+	if !ok {
+		statBreakerReject(cluster, table)
+	}
+	return ok
+}
+
+func (m *BreakerManager) stat(cluster, table string, err error, dur time.Duration) {
+	m.get(cluster, table).report(time.Now(), err, dur)
+}
+
+// Entry false if the breaker of cluster and table is open, the request must not be executed.
+// Every request let through must be reported by statBreaker.
 func Entry(cluster, table string) bool {
-	key := concat(cluster, "_", table)
-	bm.lock.Lock()
-	breaker := bm.Breakers[key]
-	bm.lock.Unlock()
-	if breaker != nil {
-		return atomic.LoadInt32(&breaker.Rejected) != 1
+	return defaultBreakerManager().entry(cluster, table)
+}
+
+func statBreaker(cluster, table string, err error, dur time.Duration) {
+	defaultBreakerManager().stat(cluster, table, err, dur)
+}
+
+// GetBreakerState return the breaker state of cluster and table of routers without
+// RouterOptions.BreakerConfig, closed if none was executed
+func GetBreakerState(cluster, table string) BreakerState {
+	return defaultBreakerManager().state(cluster, table)
+}
+
+func (m *BreakerManager) state(cluster, table string) BreakerState {
+	m.lock.Lock()
+	breaker, ok := m.Breakers[concat(cluster, "_", table)]
+	m.lock.Unlock()
+	if !ok {
+		return BreakerClosed
+	}
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	return breaker.state
+}
+
+// Run Deprecated: the breaker is updated on every request reported, nothing to run
+func (m *Breaker) Run() {}
+
+func (m *Breaker) setConfig(conf BreakerConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conf = conf
+	if conf.ErrorRate <= 0 {
+		m.setState(BreakerClosed, time.Now())
+	}
+}
+
+func (m *Breaker) allow(now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch m.state {
+	case BreakerOpen:
+		if now.Sub(m.openedAt) < m.conf.OpenTimeout {
+			return false
+		}
+		m.setState(BreakerHalfOpen, now)
+		fallthrough
+	case BreakerHalfOpen:
+		if m.probes >= m.conf.Probes {
+			// probes failed before reaching the db are never reported, start over after a while
+			if now.Sub(m.openedAt) < m.conf.OpenTimeout {
+				return false
+			}
+			m.openedAt = now
+			m.probes, m.successes = 0, 0
+		}
+		m.probes++
 	}
 	return true
 }
 
-func (breaker *Breaker) Run() {
-	go func() {
-		granularityStr, exist := configCenter.GetStringWithNamespace(context.TODO(), center.DefaultApolloMysqlNamespace, globalGranularityKey)
-		if !exist {
-			slog.Warnf(context.TODO(), "dbrouter: get granularity from apollo failed, exist: %v", exist)
-			granularityStr = "1s"
+func (m *Breaker) report(now time.Time, err error, dur time.Duration) {
+	failed := isBreakerFailure(err)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conf.ErrorRate <= 0 {
+		return
+	}
+	slow := m.conf.SlowThreshold > 0 && dur >= m.conf.SlowThreshold
+
+	switch m.state {
+	case BreakerClosed:
+		m.advance(now)
+		bucket := &m.buckets[m.bucketIdx]
+		bucket.total++
+		if failed {
+			bucket.failures++
+		}
+		if slow {
+			bucket.slows++
+		}
+
+		var total, failures, slows int
+		for _, b := range m.buckets {
+			total += b.total
+			failures += b.failures
+			slows += b.slows
 		}
-		granularity, err := time.ParseDuration(granularityStr)
+		atomic.StoreInt32(&m.Count, int32(failures))
+		if total < m.conf.MinRequests {
+			return
+		}
+		if failures*100 >= total*m.conf.ErrorRate || (m.conf.SlowRate > 0 && slows*100 >= total*m.conf.SlowRate) {
+			m.setState(BreakerOpen, now)
+		}
+
+	case BreakerHalfOpen:
+		if failed || (m.conf.SlowRate > 0 && slow) {
+			m.setState(BreakerOpen, now)
+			return
+		}
+		m.successes++
+		if m.successes >= m.conf.Probes {
+			m.setState(BreakerClosed, now)
+		}
+	}
+}
+
+// advance rotate buckets so that the window covers [now-Window, now]
+func (m *Breaker) advance(now time.Time) {
+	size := m.conf.Window / breakerBuckets
+	if size <= 0 {
+		size = time.Millisecond
+	}
+	for n := 0; now.Sub(m.bucketStart) >= size; n++ {
+		if n >= breakerBuckets {
+			m.bucketStart = now
+			break
+		}
+		m.bucketIdx = (m.bucketIdx + 1) % breakerBuckets
+		m.buckets[m.bucketIdx] = breakerBucket{}
+		m.bucketStart = m.bucketStart.Add(size)
+	}
+}
+
+func (m *Breaker) setState(state BreakerState, now time.Time) {
+	if m.state == state {
+		return
+	}
+	slog.Warnf(context.TODO(), "Breaker.setState --> cluster:%s table:%s breaker %s -> %s", m.cluster, m.table, m.state, state)
+	m.state = state
+	m.openedAt = now
+	m.probes, m.successes = 0, 0
+	m.buckets = [breakerBuckets]breakerBucket{}
+	m.bucketStart, m.bucketIdx = now, 0
+	var rejected int32
+	if state == BreakerOpen {
+		rejected = 1
+	}
+	atomic.StoreInt32(&m.Rejected, rejected)
+	atomic.StoreInt64(&m.RejectedStart, now.Unix())
+	atomic.StoreInt32(&m.Count, 0)
+	statBreakerState(m.cluster, m.table, state)
+}
+
+func getClusterConfigInt(cc center.ConfigCenter, cluster, key string) (int, bool) {
+	for _, k := range []string{concat(cluster, ".", key), concat("global.", key)} {
+		s, ok := cc.GetStringWithNamespace(context.TODO(), center.DefaultApolloMysqlNamespace, k)
+		if !ok {
+			continue
+		}
+		v, err := strconv.Atoi(strings.TrimSpace(s))
 		if err != nil {
-			slog.Warnf(context.TODO(), "dbrouter: granularity in apollo is invalid, %s", granularityStr)
-			granularity = time.Second * 1
-		}
-		granularityTickC := time.Tick(granularity)
-		checkTickC := time.Tick(checkTick)
-		for {
-			select {
-			case <-granularityTickC:
-				atomic.StoreInt32(&breaker.Count, 0)
-				// check 1s/checkTick times in 1s
-			case <-checkTickC:
-				threshold, exist := configCenter.GetIntWithNamespace(context.TODO(), center.DefaultApolloMysqlNamespace, globalThresholdKey)
-				if !exist {
-					slog.Warnf(context.TODO(), "dbrouter: get threshold from apollo failed, exist: %v", exist)
-					threshold = defaultThreshold
-				}
-				breakerGap, exist := configCenter.GetIntWithNamespace(context.TODO(), center.DefaultApolloMysqlNamespace, globalBreakerGapKey)
-				if !exist {
-					slog.Warnf(context.TODO(), "dbrouter: get breakGap from apollo failed, exist: %v", exist)
-					breakerGap = defaultBreakerGap
-				}
-				if atomic.LoadInt32(&breaker.Count) > int32(threshold) {
-					atomic.StoreInt32(&breaker.Rejected, 1)
-					breaker.RejectedStart = time.Now().Unix()
-				} else {
-					now := time.Now().Unix()
-					if now-breaker.RejectedStart > int64(breakerGap) {
-						atomic.StoreInt32(&breaker.Rejected, 0)
-					}
-				}
-			}
+			slog.Warnf(context.TODO(), "dbrouter: config %s:%s in apollo is invalid", k, s)
+			continue
+		}
+		return v, true
+	}
+	return 0, false
+}
+
+// loadBreakerConfig thresholds of cluster from apollo, defaults for those not configured
+func loadBreakerConfig(cluster string) BreakerConfig {
+	cc := getConfigCenter()
+	if cc == nil {
+		return defaultBreakerConfig()
+	}
+	return breakerConfigFrom(cc, cluster)
+}
+
+func breakerConfigFrom(cc center.ConfigCenter, cluster string) BreakerConfig {
+	conf := defaultBreakerConfig()
+	if v, ok := getClusterConfigInt(cc, cluster, breakerKeyErrorRate); ok {
+		conf.ErrorRate = v
+	}
+	if v, ok := getClusterConfigInt(cc, cluster, breakerKeySlowRate); ok {
+		conf.SlowRate = v
+	}
+	if v, ok := getClusterConfigInt(cc, cluster, breakerKeySlowThreshold); ok && v > 0 {
+		conf.SlowThreshold = time.Duration(v) * time.Millisecond
+	}
+	if v, ok := getClusterConfigInt(cc, cluster, breakerKeyMinRequests); ok {
+		conf.MinRequests = v
+	} else if v, ok := cc.GetIntWithNamespace(context.TODO(), center.DefaultApolloMysqlNamespace, globalThresholdKey); ok && v >= 0 {
+		warnLegacyBreakerKey(globalThresholdKey, breakerKeyMinRequests)
+		conf.MinRequests = v + 1
+	}
+	if v, ok := getClusterConfigInt(cc, cluster, breakerKeyWindow); ok && v > 0 {
+		conf.Window = time.Duration(v) * time.Second
+	} else if s, ok := cc.GetStringWithNamespace(context.TODO(), center.DefaultApolloMysqlNamespace, globalGranularityKey); ok {
+		warnLegacyBreakerKey(globalGranularityKey, breakerKeyWindow)
+		if v, err := time.ParseDuration(strings.TrimSpace(s)); err == nil && v > 0 {
+			conf.Window = v
+		}
+	}
+	if v, ok := getClusterConfigInt(cc, cluster, breakerKeyOpenTimeout); ok && v > 0 {
+		conf.OpenTimeout = time.Duration(v) * time.Second
+	} else if v, ok := cc.GetIntWithNamespace(context.TODO(), center.DefaultApolloMysqlNamespace, globalBreakerGapKey); ok && v > 0 {
+		conf.OpenTimeout = time.Duration(v) * time.Second
+	}
+	if v, ok := getClusterConfigInt(cc, cluster, breakerKeyProbes); ok && v > 0 {
+		conf.Probes = v
+	}
+	return conf
+}
+
+// legacyBreakerWarned warn once per legacy key, the config is reloaded every breakerConfigRefresh
+var legacyBreakerWarned sync.Map
+
+func warnLegacyBreakerKey(key, replacement string) {
+	if _, loaded := legacyBreakerWarned.LoadOrStore(key, true); !loaded {
+		slog.Warnf(context.TODO(), "dbrouter: config %s in apollo is deprecated, use <cluster>.%s or global.%s", key, replacement, replacement)
+	}
+}
+
+// getConfigCenter nil until apollo is inited, it is inited in the background on first use rather
+// than on import, and again every configInitRetry if it failed. Callers use the default config
+// meanwhile, so that no request waits for apollo.
+func getConfigCenter() center.ConfigCenter {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	if configCenter != nil || configIniting || time.Since(configInitAt) < configInitRetry {
+		return configCenter
+	}
+	configIniting = true
+	newCenter := newConfigCenter
+	go func() {
+		cc, err := newCenter()
+
+		configMu.Lock()
+		defer configMu.Unlock()
+		configIniting = false
+		configInitAt = time.Now()
+		if err != nil {
+			slog.Errorf(context.TODO(), "dbrouter: init apollo config failed, use default breaker and slowlog config, err: %v", err)
+			return
 		}
+		configCenter = cc
 	}()
+	return nil
 }
 
-func initConfig() error {
-	var err error
-	configCenter, err = center.NewConfigCenter(center.ApolloConfigCenter)
+func initConfig() (center.ConfigCenter, error) {
+	cc, err := center.NewConfigCenter(center.ApolloConfigCenter)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = configCenter.Init(context.TODO(), center.DefaultApolloMiddlewareService, []string{center.DefaultApolloMysqlNamespace})
+	err = cc.Init(context.TODO(), center.DefaultApolloMiddlewareService, []string{center.DefaultApolloMysqlNamespace})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return cc, nil
 }
 
 func concat(strings ...string) string {
@@ -130,11 +564,3 @@ func concat(strings ...string) string {
 	}
 	return buffer.String()
 }
-
-func init() {
-	bm = &BreakerManager{Breakers: make(map[string]*Breaker)}
-	err := initConfig()
-	if err != nil {
-		slog.Panicf(context.TODO(), "dbrouter: init apollo config failed, err: %v", err)
-	}
-}
@@ -1,24 +1,208 @@
 package dbrouter
 
 import (
+	"context"
+	"database/sql/driver"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/shawnfeng/sutil/sconf/center"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2"
 )
 
 func TestEntry(t *testing.T) {
-	go func() {
-		for {
-			fmt.Printf("Entry: %v\n", Entry("group", "test"))
-			time.Sleep(time.Millisecond * 1000)
-		}
-	}()
+	assert.True(t, Entry("group", "test"))
+	for i := 0; i < defaultBreakerMinRequests; i++ {
+		statBreaker("group", "test", context.DeadlineExceeded, time.Millisecond)
+	}
+	assert.False(t, Entry("group", "test"))
+	assert.Equal(t, BreakerOpen, GetBreakerState("group", "test"))
 
-	go func() {
-		for i := 0; i < 20; i++ {
-			statBreaker("group", "test", errors.New("timeout"))
-		}
+	// the deprecated fields follow the state
+	breaker := defaultBreakerManager().get("group", "test")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&breaker.Rejected))
+	breaker.Run()
+}
+
+func TestGetConfigCenter(t *testing.T) {
+	release := make(chan struct{})
+	configMu.Lock()
+	saved := newConfigCenter
+	newConfigCenter = func() (center.ConfigCenter, error) {
+		<-release
+		return nil, errors.New("apollo unreachable")
+	}
+	configCenter, configIniting, configInitAt = nil, false, time.Time{}
+	configMu.Unlock()
+	defer func() {
+		configMu.Lock()
+		newConfigCenter = saved
+		configMu.Unlock()
 	}()
-	select {}
+
+	// apollo is inited in the background, the default config is used meanwhile
+	assert.Nil(t, getConfigCenter())
+	assert.Equal(t, defaultBreakerConfig(), loadBreakerConfig("trade"))
+	assert.Equal(t, SlowLogConfig{}, loadSlowLogConfig("trade"))
+	close(release)
+	assert.Eventually(t, func() bool {
+		configMu.Lock()
+		defer configMu.Unlock()
+		return !configIniting
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestIsBreakerFailure(t *testing.T) {
+	assert.True(t, isBreakerFailure(context.DeadlineExceeded))
+	assert.True(t, isBreakerFailure(fmt.Errorf("query: %w", driver.ErrBadConn)))
+	assert.True(t, isBreakerFailure(mysql.ErrInvalidConn))
+	assert.True(t, isBreakerFailure(&mysql.MySQLError{Number: 1040}))
+	assert.True(t, isBreakerFailure(&mysql.MySQLError{Number: 9002}))
+	assert.True(t, isBreakerFailure(&pq.Error{Code: "08006"}))
+	assert.True(t, isBreakerFailure(&pq.Error{Code: "57014"}))
+	assert.True(t, isBreakerFailure(errors.New("no reachable servers")))
+	assert.True(t, isBreakerFailure(io.EOF))
+	assert.True(t, isBreakerFailure(&net.OpError{Op: "read", Err: errors.New("i/o timeout")}))
+	assert.True(t, isBreakerFailure(&mgo.QueryError{Code: 50, Message: "operation exceeded time limit"}))
+	assert.True(t, isBreakerFailure(&mgo.LastError{Code: 10107, Err: "not master"}))
+
+	assert.False(t, isBreakerFailure(nil))
+	assert.False(t, isBreakerFailure(context.Canceled))
+	assert.False(t, isBreakerFailure(&mysql.MySQLError{Number: 1062}))
+	assert.False(t, isBreakerFailure(&mysql.MySQLError{Number: 1213}))
+	assert.False(t, isBreakerFailure(&pq.Error{Code: "23505"}))
+	assert.False(t, isBreakerFailure(errors.New("record not found")))
+	assert.False(t, isBreakerFailure(mgo.ErrNotFound))
+	assert.False(t, isBreakerFailure(&mgo.LastError{Code: 11000, Err: "E11000 duplicate key error"}))
+	assert.False(t, isBreakerFailure(&mgo.QueryError{Code: 2, Message: "bad query"}))
+}
+
+func testBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		ErrorRate:     50,
+		SlowRate:      80,
+		SlowThreshold: 100 * time.Millisecond,
+		MinRequests:   4,
+		Window:        time.Second,
+		OpenTimeout:   50 * time.Millisecond,
+		Probes:        2,
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	m := newBreakerManager(func(string) BreakerConfig { return testBreakerConfig() })
+
+	// below MinRequests
+	for i := 0; i < 3; i++ {
+		assert.True(t, m.entry("trade", "order"))
+		m.stat("trade", "order", context.DeadlineExceeded, time.Millisecond)
+	}
+	assert.Equal(t, BreakerClosed, m.get("trade", "order").state)
+
+	assert.True(t, m.entry("trade", "order"))
+	m.stat("trade", "order", nil, time.Millisecond)
+	assert.Equal(t, BreakerOpen, m.get("trade", "order").state)
+	assert.False(t, m.entry("trade", "order"))
+	// other tables are not affected
+	assert.True(t, m.entry("trade", "refund"))
+
+	// half open, probes limited
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, m.entry("trade", "order"))
+	assert.True(t, m.entry("trade", "order"))
+	assert.False(t, m.entry("trade", "order"))
+	assert.Equal(t, BreakerHalfOpen, m.get("trade", "order").state)
+
+	// a failed probe opens it again
+	m.stat("trade", "order", driver.ErrBadConn, time.Millisecond)
+	assert.Equal(t, BreakerOpen, m.get("trade", "order").state)
+
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		assert.True(t, m.entry("trade", "order"))
+		m.stat("trade", "order", nil, time.Millisecond)
+	}
+	assert.Equal(t, BreakerClosed, m.get("trade", "order").state)
+}
+
+func TestBreaker_Slow(t *testing.T) {
+	m := newBreakerManager(func(string) BreakerConfig { return testBreakerConfig() })
+
+	for i := 0; i < 4; i++ {
+		m.stat("trade", "order", nil, 200*time.Millisecond)
+	}
+	assert.Equal(t, BreakerOpen, m.get("trade", "order").state)
+}
+
+func TestBreaker_Window(t *testing.T) {
+	conf := testBreakerConfig()
+	conf.Window = 100 * time.Millisecond
+	m := newBreakerManager(func(string) BreakerConfig { return conf })
+
+	for i := 0; i < 3; i++ {
+		m.stat("trade", "order", context.DeadlineExceeded, time.Millisecond)
+	}
+	// the failures slid out of the window
+	time.Sleep(120 * time.Millisecond)
+	for i := 0; i < 4; i++ {
+		m.stat("trade", "order", nil, time.Millisecond)
+	}
+	m.stat("trade", "order", context.DeadlineExceeded, time.Millisecond)
+	assert.Equal(t, BreakerClosed, m.get("trade", "order").state)
+}
+
+func TestBreaker_Disabled(t *testing.T) {
+	m := newBreakerManager(func(string) BreakerConfig { return BreakerConfig{} })
+	for i := 0; i < 100; i++ {
+		m.stat("trade", "order", context.DeadlineExceeded, time.Millisecond)
+	}
+	assert.True(t, m.entry("trade", "order"))
+}
+
+// legacyConfigCenter apollo with the keys of the old breaker only
+type legacyConfigCenter struct {
+	center.ConfigCenter
+	values map[string]string
+}
+
+func (m *legacyConfigCenter) GetStringWithNamespace(ctx context.Context, namespace, key string) (string, bool) {
+	v, ok := m.values[key]
+	return v, ok
+}
+
+func (m *legacyConfigCenter) GetIntWithNamespace(ctx context.Context, namespace, key string) (int, bool) {
+	v, ok := m.values[key]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(v)
+	return n, err == nil
+}
+
+func TestBreakerConfigFrom_Legacy(t *testing.T) {
+	cc := &legacyConfigCenter{values: map[string]string{
+		"global.threshold":   "10",
+		"global.granularity": "2s",
+		"global.breakergap":  "5",
+	}}
+	conf := breakerConfigFrom(cc, "trade")
+	assert.Equal(t, 11, conf.MinRequests)
+	assert.Equal(t, 2*time.Second, conf.Window)
+	assert.Equal(t, 5*time.Second, conf.OpenTimeout)
+
+	// the new keys win
+	cc.values["trade.breaker.minrequests"] = "30"
+	cc.values["global.breaker.window"] = "20"
+	conf = breakerConfigFrom(cc, "trade")
+	assert.Equal(t, 30, conf.MinRequests)
+	assert.Equal(t, 20*time.Second, conf.Window)
 }
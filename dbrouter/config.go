@@ -24,6 +24,8 @@ const (
 const (
 	CONFIG_TYPE_SIMPLE = iota
 	CONFIG_TYPE_ETCD
+	CONFIG_TYPE_FILE
+	CONFIG_TYPE_APOLLO
 )
 
 type Config struct {
@@ -32,7 +34,69 @@ type Config struct {
 	DBAddr   []string
 	UserName string
 	PassWord string
-	TimeOut  time.Duration
+	// TimeOut dial timeout
+	TimeOut time.Duration
+	ConnConfig
+
+	// Replicas read only copies of DBAddr[0], used by SqlReadExec and OrmReadExec
+	Replicas []ReplicaConfig
+	// LagProbe query returning the replication lag of a replica in seconds, replicas lagging
+	// more than MaxLag are ejected until they catch up. Empty only checks connectivity.
+	LagProbe string
+	MaxLag   time.Duration
+}
+
+// ConnConfig pool and DSN options of an instance, zero values are the defaults
+type ConnConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	// TLS tls param of mysql, sslmode of postgres
+	TLS string
+	// Params extra DSN params, override the defaults
+	Params map[string]string
+}
+
+type ReplicaConfig struct {
+	Addr   string
+	Weight int
+}
+
+func newConfig(info *dbInsInfo) *Config {
+	config := &Config{
+		DBType:   info.DBType,
+		DBAddr:   info.DBAddr,
+		DBName:   info.DBName,
+		UserName: info.UserName,
+		PassWord: info.PassWord,
+		TimeOut:  3 * time.Second,
+		ConnConfig: ConnConfig{
+			MaxOpenConns:    info.MaxOpenConns,
+			MaxIdleConns:    info.MaxIdleConns,
+			ConnMaxLifetime: seconds(info.MaxLifetime),
+			ConnMaxIdleTime: seconds(info.MaxIdleTime),
+			ReadTimeout:     seconds(info.ReadTimeout),
+			WriteTimeout:    seconds(info.WriteTimeout),
+			TLS:             info.TLS,
+			Params:          info.Params,
+		},
+		LagProbe: info.LagProbe,
+		MaxLag:   seconds(info.MaxLag),
+	}
+	if info.DialTimeout > 0 {
+		config.TimeOut = seconds(info.DialTimeout)
+	}
+	for _, r := range info.Replicas {
+		config.Replicas = append(config.Replicas, ReplicaConfig{Addr: r.Addr, Weight: r.Weight})
+	}
+	return config
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
 }
 
 type Configer interface {
@@ -42,6 +106,18 @@ type Configer interface {
 	GetGroups(ctx context.Context) []string
 }
 
+// ShardConfiger a Configer of hash and range sharded tables, required by SqlExecByKey
+type ShardConfiger interface {
+	// GetShardInstance instance and physical table of shardKey in a hash or range sharded table
+	GetShardInstance(ctx context.Context, cluster, table string, shardKey interface{}) (instance, physical string, err error)
+}
+
+// TableConfiger a Configer listing the physical tables of a cluster, required by SqlScatter
+type TableConfiger interface {
+	// GetTables physical tables of full and shard entries of cluster
+	GetTables(ctx context.Context, cluster string) []PhysicalTable
+}
+
 func NewConfiger(configType int, data []byte, dbChangeChan chan dbConfigChange) (Configer, error) {
 
 	switch configType {
@@ -71,26 +147,12 @@ func NewSimpleConfiger(data []byte) (Configer, error) {
 func (m *SimpleConfig) GetConfig(ctx context.Context, instance string) *Config {
 	group := scontext.GetControlRouteGroupWithDefault(ctx, DefaultGroup)
 	info := m.parser.GetConfig(instance, group)
-	return &Config{
-		DBType:   info.DBType,
-		DBAddr:   info.DBAddr,
-		DBName:   info.DBName,
-		UserName: info.UserName,
-		PassWord: info.PassWord,
-		TimeOut:  3 * time.Second,
-	}
+	return newConfig(info)
 }
 
 func (m *SimpleConfig) GetConfigByGroup(ctx context.Context, instance, group string) *Config {
 	info := m.parser.GetConfig(instance, group)
-	return &Config{
-		DBType:   info.DBType,
-		DBAddr:   info.DBAddr,
-		DBName:   info.DBName,
-		UserName: info.UserName,
-		PassWord: info.PassWord,
-		TimeOut:  3 * time.Second,
-	}
+	return newConfig(info)
 }
 
 func (m *SimpleConfig) GetInstance(ctx context.Context, cluster, table string) (instance string) {
@@ -98,6 +160,14 @@ func (m *SimpleConfig) GetInstance(ctx context.Context, cluster, table string) (
 	return instance
 }
 
+func (m *SimpleConfig) GetShardInstance(ctx context.Context, cluster, table string, shardKey interface{}) (instance, physical string, err error) {
+	return m.parser.GetShard(cluster, table, shardKey)
+}
+
+func (m *SimpleConfig) GetTables(ctx context.Context, cluster string) []PhysicalTable {
+	return m.parser.GetTables(cluster)
+}
+
 func (m *SimpleConfig) GetGroups(ctx context.Context) []string {
 	var groups []string
 	for group, _ := range m.parser.dbIns {
@@ -106,19 +176,103 @@ func (m *SimpleConfig) GetGroups(ctx context.Context) []string {
 	return groups
 }
 
+// watchConfig Configer of a parser replaced on config change, instances changed are sent to
+// the router to be closed
+type watchConfig struct {
+	parserMu sync.RWMutex
+	parser   *Parser
+	changeCh chan dbConfigChange
+}
+
+// configNotifier configers of config changing at runtime
+type configNotifier interface {
+	notifyChanges(ch chan dbConfigChange)
+}
+
+func (m *watchConfig) notifyChanges(ch chan dbConfigChange) {
+	m.parserMu.Lock()
+	defer m.parserMu.Unlock()
+
+	m.changeCh = ch
+}
+
+func (m *watchConfig) getParser(ctx context.Context) *Parser {
+	m.parserMu.RLock()
+	defer m.parserMu.RUnlock()
+
+	return m.parser
+}
+
+func (m *watchConfig) setParser(ctx context.Context, parser *Parser) {
+	m.parserMu.Lock()
+	oldParser, ch := m.parser, m.changeCh
+	m.parser = parser
+	m.parserMu.Unlock()
+
+	if oldParser != nil && ch != nil {
+		dbConfigChange := compareParsers(*oldParser, *parser)
+		slog.Infof(ctx, "parser changes: %+v", dbConfigChange)
+		ch <- dbConfigChange
+	}
+}
+
+func (m *watchConfig) GetConfig(ctx context.Context, instance string) *Config {
+	group := scontext.GetControlRouteGroupWithDefault(ctx, DefaultGroup)
+	parser := m.getParser(ctx)
+	info := parser.GetConfig(instance, group)
+	return newConfig(info)
+}
+
+func (m *watchConfig) GetConfigByGroup(ctx context.Context, instance, group string) *Config {
+	parser := m.getParser(ctx)
+	info := parser.GetConfig(instance, group)
+	return newConfig(info)
+}
+
+func (m *watchConfig) GetInstance(ctx context.Context, cluster, table string) (instance string) {
+	parser := m.getParser(ctx)
+	return parser.GetInstance(cluster, table)
+}
+
+func (m *watchConfig) GetShardInstance(ctx context.Context, cluster, table string, shardKey interface{}) (instance, physical string, err error) {
+	parser := m.getParser(ctx)
+	return parser.GetShard(cluster, table, shardKey)
+}
+
+func (m *watchConfig) GetTables(ctx context.Context, cluster string) []PhysicalTable {
+	parser := m.getParser(ctx)
+	return parser.GetTables(cluster)
+}
+
+func (m *watchConfig) GetGroups(ctx context.Context) []string {
+	var groups []string
+	parser := m.getParser(ctx)
+
+	for group, _ := range parser.dbIns {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
 type EtcdConfig struct {
+	watchConfig
 	etcdAddr []string
-	parser   *Parser
-	parserMu sync.RWMutex
 }
 
+// TODO etcd address如何获取
+var defaultEtcdAddrs = []string{"http://infra0.etcd.ibanyu.com:20002", "http://infra1.etcd.ibanyu.com:20002", "http://infra2.etcd.ibanyu.com:20002", "http://infra3.etcd.ibanyu.com:20002", "http://infra4.etcd.ibanyu.com:20002", "http://old0.etcd.ibanyu.com:20002", "http://old1.etcd.ibanyu.com:20002", "http://old2.etcd.ibanyu.com:20002"}
+
 func NewEtcdConfiger(ctx context.Context, dbChangeChan chan dbConfigChange) (Configer, error) {
+	return newEtcdConfiger(ctx, defaultEtcdAddrs, dbChangeChan)
+}
+
+func newEtcdConfiger(ctx context.Context, etcdAddr []string, dbChangeChan chan dbConfigChange) (*EtcdConfig, error) {
 	fun := "NewEtcdConfiger -->"
 	etcdConfig := &EtcdConfig{
-		// TODO etcd address如何获取
-		etcdAddr: []string{"http://infra0.etcd.ibanyu.com:20002", "http://infra1.etcd.ibanyu.com:20002", "http://infra2.etcd.ibanyu.com:20002", "http://infra3.etcd.ibanyu.com:20002", "http://infra4.etcd.ibanyu.com:20002", "http://old0.etcd.ibanyu.com:20002", "http://old1.etcd.ibanyu.com:20002", "http://old2.etcd.ibanyu.com:20002"},
+		watchConfig: watchConfig{changeCh: dbChangeChan},
+		etcdAddr:    etcdAddr,
 	}
-	err := etcdConfig.init(ctx, dbChangeChan)
+	err := etcdConfig.init(ctx)
 	if err != nil {
 		slog.Errorf(ctx, "%s init etcd configer err: %s", fun, err.Error())
 		return nil, err
@@ -126,7 +280,7 @@ func NewEtcdConfiger(ctx context.Context, dbChangeChan chan dbConfigChange) (Con
 	return etcdConfig, nil
 }
 
-func (m *EtcdConfig) init(ctx context.Context, dbChangeChan chan dbConfigChange) error {
+func (m *EtcdConfig) init(ctx context.Context) error {
 	fun := "EtcdConfig.init -->"
 	etcdInstance, err := setcd.NewEtcdInstance(m.etcdAddr)
 	if err != nil {
@@ -142,15 +296,7 @@ func (m *EtcdConfig) init(ctx context.Context, dbChangeChan chan dbConfigChange)
 			slog.Errorf(ctx, "%s init db parser err: ", fun, er.Error())
 		} else {
 			slog.Infof(ctx, "succeed to init new parser")
-
-			if oldParser := m.getParser(ctx); oldParser != nil {
-				dbConfigChange := compareParsers(*oldParser, *parser)
-				slog.Infof(ctx, "parser changes: %+v", dbConfigChange)
-				m.setParser(ctx, parser)
-				dbChangeChan <- dbConfigChange
-			} else {
-				m.setParser(ctx, parser)
-			}
+			m.setParser(ctx, parser)
 		}
 
 		initOnce.Do(func() {
@@ -162,59 +308,3 @@ func (m *EtcdConfig) init(ctx context.Context, dbChangeChan chan dbConfigChange)
 	close(initCh)
 	return err
 }
-
-func (m *EtcdConfig) getParser(ctx context.Context) *Parser {
-	m.parserMu.RLock()
-	defer m.parserMu.RUnlock()
-
-	return m.parser
-}
-
-func (m *EtcdConfig) setParser(ctx context.Context, parser *Parser) {
-	m.parserMu.Lock()
-	defer m.parserMu.Unlock()
-
-	m.parser = parser
-}
-
-func (m *EtcdConfig) GetConfig(ctx context.Context, instance string) *Config {
-	group := scontext.GetControlRouteGroupWithDefault(ctx, DefaultGroup)
-	parser := m.getParser(ctx)
-	info := parser.GetConfig(instance, group)
-	return &Config{
-		DBType:   info.DBType,
-		DBAddr:   info.DBAddr,
-		DBName:   info.DBName,
-		UserName: info.UserName,
-		PassWord: info.PassWord,
-		TimeOut:  3 * time.Second,
-	}
-}
-
-func (m *EtcdConfig) GetConfigByGroup(ctx context.Context, instance, group string) *Config {
-	parser := m.getParser(ctx)
-	info := parser.GetConfig(instance, group)
-	return &Config{
-		DBType:   info.DBType,
-		DBAddr:   info.DBAddr,
-		DBName:   info.DBName,
-		UserName: info.UserName,
-		PassWord: info.PassWord,
-		TimeOut:  3 * time.Second,
-	}
-}
-
-func (m *EtcdConfig) GetInstance(ctx context.Context, cluster, table string) (instance string) {
-	parser := m.getParser(ctx)
-	return parser.GetInstance(cluster, table)
-}
-
-func (m *EtcdConfig) GetGroups(ctx context.Context) []string {
-	var groups []string
-	parser := m.getParser(ctx)
-
-	for group, _ := range parser.dbIns {
-		groups = append(groups, group)
-	}
-	return groups
-}
@@ -0,0 +1,151 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/shawnfeng/sutil/sconf/center"
+	"github.com/shawnfeng/sutil/slog/slog"
+)
+
+const defaultFileCheckInterval = 10 * time.Second
+
+// FileConfig route config of a local json file, reloaded when the file is modified
+type FileConfig struct {
+	watchConfig
+	path    string
+	modTime time.Time
+}
+
+// NewFileConfiger the file is checked every interval until ctx is done, a modified file failing
+// to parse is logged and the config in use is kept
+func NewFileConfiger(ctx context.Context, path string, interval time.Duration) (Configer, error) {
+	m := &FileConfig{path: path}
+	if err := m.load(ctx); err != nil {
+		return nil, err
+	}
+
+	if interval <= 0 {
+		interval = defaultFileCheckInterval
+	}
+	go m.watch(ctx, interval)
+	return m, nil
+}
+
+func (m *FileConfig) load(ctx context.Context) error {
+	info, err := os.Stat(m.path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(m.path)
+	if err != nil {
+		return err
+	}
+	parser, err := NewParser(data)
+	if err != nil {
+		return fmt.Errorf("parse config file:%s err:%s", m.path, err.Error())
+	}
+
+	m.modTime = info.ModTime()
+	m.setParser(ctx, parser)
+	return nil
+}
+
+func (m *FileConfig) watch(ctx context.Context, interval time.Duration) {
+	fun := "FileConfig.watch -->"
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(m.path)
+		if err != nil {
+			slog.Errorf(ctx, "%s stat config file:%s err:%s", fun, m.path, err.Error())
+			continue
+		}
+		if info.ModTime().Equal(m.modTime) {
+			continue
+		}
+		if err = m.load(ctx); err != nil {
+			slog.Errorf(ctx, "%s reload err:%s", fun, err.Error())
+			continue
+		}
+		slog.Infof(ctx, "%s reloaded config file:%s", fun, m.path)
+	}
+}
+
+// ApolloConfig route config of a key in an apollo namespace, reloaded when the key changes
+type ApolloConfig struct {
+	watchConfig
+	center    center.ConfigCenter
+	namespace string
+	key       string
+}
+
+// NewApolloConfiger cc nil create a config center of namespace in the middleware service
+func NewApolloConfiger(ctx context.Context, cc center.ConfigCenter, namespace, key string) (Configer, error) {
+	if cc == nil {
+		var err error
+		if cc, err = center.NewConfigCenter(center.ApolloConfigCenter); err != nil {
+			return nil, err
+		}
+		if err = cc.Init(ctx, center.DefaultApolloMiddlewareService, []string{namespace}); err != nil {
+			return nil, err
+		}
+	}
+
+	m := &ApolloConfig{
+		center:    cc,
+		namespace: namespace,
+		key:       key,
+	}
+	if err := m.load(ctx); err != nil {
+		return nil, err
+	}
+
+	cc.StartWatchUpdate(ctx)
+	cc.RegisterObserver(ctx, m)
+	return m, nil
+}
+
+func (m *ApolloConfig) load(ctx context.Context) error {
+	data, ok := m.center.GetStringWithNamespace(ctx, m.namespace, m.key)
+	if !ok {
+		return fmt.Errorf("key:%s not found in apollo namespace:%s", m.key, m.namespace)
+	}
+	parser, err := NewParser([]byte(data))
+	if err != nil {
+		return fmt.Errorf("parse apollo namespace:%s key:%s err:%s", m.namespace, m.key, err.Error())
+	}
+	m.setParser(ctx, parser)
+	return nil
+}
+
+// HandleChangeEvent implement center.ConfigObserver
+func (m *ApolloConfig) HandleChangeEvent(event *center.ChangeEvent) {
+	fun := "ApolloConfig.HandleChangeEvent -->"
+	if event.Namespace != m.namespace {
+		return
+	}
+	if _, ok := event.Changes[m.key]; !ok {
+		return
+	}
+
+	ctx := context.TODO()
+	if err := m.load(ctx); err != nil {
+		slog.Errorf(ctx, "%s reload err:%s", fun, err.Error())
+		return
+	}
+	slog.Infof(ctx, "%s reloaded namespace:%s key:%s", fun, m.namespace, m.key)
+}
@@ -0,0 +1,99 @@
+package dbrouter
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const routeConfigA = `{
+	"cluster": {"trade": [{"instance": "trade0", "match": "full", "express": "order"}]},
+	"instances": {
+		"trade0": {"dbtype": "mysql", "dbname": "trade", "dbcfg": {"addrs": ["127.0.0.1:3306"], "user": "u", "passwd": "p"}}
+	}
+}`
+
+const routeConfigB = `{
+	"cluster": {"trade": [{"instance": "trade1", "match": "full", "express": "order"}]},
+	"instances": {
+		"trade1": {"dbtype": "mysql", "dbname": "trade", "dbcfg": {"addrs": ["127.0.0.2:3306"], "user": "u", "passwd": "p"}}
+	}
+}`
+
+func TestFileConfiger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dbrouter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "route.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(routeConfigA), 0644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	configer, err := NewFileConfiger(ctx, path, 10*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, "trade0", configer.GetInstance(ctx, "trade", "order"))
+
+	ch := make(chan dbConfigChange, 1)
+	configer.(configNotifier).notifyChanges(ch)
+
+	// a broken file keeps the config in use
+	assert.NoError(t, ioutil.WriteFile(path, []byte("{"), 0644))
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "trade0", configer.GetInstance(ctx, "trade", "order"))
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte(routeConfigB), 0644))
+	os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second))
+	select {
+	case change := <-ch:
+		assert.Equal(t, []string{"trade0"}, change.dbInstanceChange[DefaultGroup])
+	case <-time.After(time.Second):
+		t.Fatal("no config change")
+	}
+	assert.Equal(t, "trade1", configer.GetInstance(ctx, "trade", "order"))
+	assert.Equal(t, []string{"127.0.0.2:3306"}, configer.GetConfig(ctx, "trade1").DBAddr)
+
+	_, err = NewFileConfiger(ctx, filepath.Join(dir, "none.json"), 0)
+	assert.Error(t, err)
+}
+
+func TestNewRouterWithOptions(t *testing.T) {
+	ctx := context.Background()
+	router, err := NewRouterWithOptions(ctx, RouterOptions{
+		ConfigType: CONFIG_TYPE_SIMPLE,
+		Data:       []byte(routeConfigA),
+		BreakerConfig: func(cluster string) BreakerConfig {
+			conf := testBreakerConfig()
+			conf.MinRequests = 1
+			return conf
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "trade0", router.configer.GetInstance(ctx, "trade", "order"))
+
+	// breakers of the router are its own
+	router.breakers.stat("trade", "order", context.DeadlineExceeded, time.Millisecond)
+	assert.Equal(t, BreakerOpen, router.GetBreakerState("trade", "order"))
+	assert.Equal(t, BreakerClosed, GetBreakerState("trade", "order"))
+	err = router.SqlExec(ctx, "trade", func(*DB, []interface{}) error { return nil }, "order")
+	assert.Equal(t, ErrBreakerOpen, err)
+	// reads on replicas have their own breakers
+	err = router.SqlReadExec(ctx, "trade", func(*DB, []interface{}) error { return nil }, "order")
+	assert.NotEqual(t, ErrBreakerOpen, err)
+	assert.Equal(t, BreakerClosed, router.GetBreakerState("trade", "order"+readBreakerSuffix))
+
+	_, err = NewRouterWithOptions(ctx, RouterOptions{ConfigType: CONFIG_TYPE_SIMPLE, Data: []byte("{")})
+	assert.Error(t, err)
+	_, err = NewRouterWithOptions(ctx, RouterOptions{ConfigType: 100})
+	assert.Error(t, err)
+
+	// data of NewRouter is the simple config
+	router, err = NewRouter([]byte(routeConfigB))
+	assert.NoError(t, err)
+	assert.Equal(t, "trade1", router.configer.GetInstance(ctx, "trade", "order"))
+}
@@ -8,9 +8,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/log"
+	"github.com/shawnfeng/sutil/sconf/center"
 	"github.com/shawnfeng/sutil/slog/slog"
 	"github.com/shawnfeng/sutil/stat"
 	"github.com/shawnfeng/sutil/stime"
@@ -26,6 +28,8 @@ type Router struct {
 	configer  Configer
 	instances *InstanceManager
 	report    *stat.StatReport
+	breakers  *BreakerManager
+	slowlog   *slowLogManager
 }
 
 type dbConfigChange struct {
@@ -33,10 +37,42 @@ type dbConfigChange struct {
 	dbGroups         []string
 }
 
+type RouterOptions struct {
+	// ConfigType CONFIG_TYPE_SIMPLE, CONFIG_TYPE_FILE, CONFIG_TYPE_ETCD or CONFIG_TYPE_APOLLO, ignored if Configer is set
+	ConfigType int
+	// Data json route config of CONFIG_TYPE_SIMPLE
+	Data []byte
+	// File json route config file of CONFIG_TYPE_FILE, checked for modification every FileCheckInterval, default 10s
+	File              string
+	FileCheckInterval time.Duration
+	// EtcdAddrs of CONFIG_TYPE_ETCD, default the etcd of NewRouter
+	EtcdAddrs []string
+	// ApolloNamespace and ApolloKey of the json route config of CONFIG_TYPE_APOLLO, namespace default
+	// center.DefaultApolloMysqlNamespace
+	ApolloNamespace string
+	ApolloKey       string
+	// Configer use this configer instead of one of ConfigType
+	Configer Configer
+
+	// BreakerConfig thresholds of breakers of a cluster, default read from apollo on first use,
+	// see loadBreakerConfig
+	BreakerConfig func(cluster string) BreakerConfig
+	// SlowLogConfig slow query log of a cluster, default read from apollo, see loadSlowLogConfig
+	SlowLogConfig func(cluster string) SlowLogConfig
+}
+
+// NewRouter route config of data in json, or from etcd if data is empty, see NewRouterWithOptions
 func NewRouter(data []byte) (*Router, error) {
-	// TODO config type由哪里决定
+	if len(data) > 0 {
+		return NewRouterWithOptions(context.TODO(), RouterOptions{ConfigType: CONFIG_TYPE_SIMPLE, Data: data})
+	}
+	return NewRouterWithOptions(context.TODO(), RouterOptions{ConfigType: CONFIG_TYPE_ETCD})
+}
+
+// NewRouterWithOptions nothing but the config of opts is loaded until the first request
+func NewRouterWithOptions(ctx context.Context, opts RouterOptions) (*Router, error) {
 	var dbChangeChan = make(chan dbConfigChange)
-	configer, err := NewConfiger(CONFIG_TYPE_ETCD, data, dbChangeChan)
+	configer, err := newConfigerWithOptions(ctx, opts, dbChangeChan)
 	if err != nil {
 		return nil, err
 	}
@@ -47,22 +83,87 @@ func NewRouter(data []byte) (*Router, error) {
 		}
 	}(configer)
 
+	breakers := defaultBreakerManager()
+	if opts.BreakerConfig != nil {
+		breakers = newBreakerManager(opts.BreakerConfig)
+	}
+	slowlog := newSlowLogManager(loadSlowLogConfig)
+	if opts.SlowLogConfig != nil {
+		slowlog = newSlowLogManager(opts.SlowLogConfig)
+	}
+
 	return &Router{
 		configer:  configer,
-		instances: NewInstanceManager(factory, dbChangeChan, configer.GetGroups(context.TODO())),
+		instances: NewInstanceManager(factory, dbChangeChan, configer.GetGroups(ctx)),
 		report:    stat.NewStat(),
+		breakers:  breakers,
+		slowlog:   slowlog,
 	}, nil
 }
 
+func newConfigerWithOptions(ctx context.Context, opts RouterOptions, dbChangeChan chan dbConfigChange) (Configer, error) {
+	var configer Configer
+	var err error
+	switch {
+	case opts.Configer != nil:
+		configer = opts.Configer
+	case opts.ConfigType == CONFIG_TYPE_SIMPLE:
+		configer, err = NewSimpleConfiger(opts.Data)
+	case opts.ConfigType == CONFIG_TYPE_FILE:
+		configer, err = NewFileConfiger(ctx, opts.File, opts.FileCheckInterval)
+	case opts.ConfigType == CONFIG_TYPE_ETCD:
+		addrs := opts.EtcdAddrs
+		if len(addrs) == 0 {
+			addrs = defaultEtcdAddrs
+		}
+		return newEtcdConfiger(ctx, addrs, dbChangeChan)
+	case opts.ConfigType == CONFIG_TYPE_APOLLO:
+		namespace := opts.ApolloNamespace
+		if namespace == "" {
+			namespace = center.DefaultApolloMysqlNamespace
+		}
+		configer, err = NewApolloConfiger(ctx, nil, namespace, opts.ApolloKey)
+	default:
+		return nil, fmt.Errorf("configType %d error", opts.ConfigType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if notifier, ok := configer.(configNotifier); ok {
+		notifier.notifyChanges(dbChangeChan)
+	} else {
+		close(dbChangeChan)
+	}
+	return configer, nil
+}
+
 func (m *Router) StatInfo() []*stat.QueryStat {
 	return m.report.StatInfo()
 }
 
-func (m *Router) sqlPrepare(ctx context.Context, cluster, table string) (db *DB, err error) {
+// statQuery feed both StatInfo and the latency histogram
+func (m *Router) statQuery(op, cluster, table string, dur time.Duration, err error) {
+	m.report.IncQuery(cluster, table, dur)
+	statReqDuration(op, cluster, table, dur, err)
+}
+
+// GetBreakerState 熔断器状态，没有请求过的cluster和table为BreakerClosed，
+// SqlReadExec和OrmReadExec的熔断器table为 table+":read"
+func (m *Router) GetBreakerState(cluster, table string) BreakerState {
+	return m.breakers.state(cluster, table)
+}
+
+func (m *Router) sqlPrepare(ctx context.Context, cluster, table string, read bool) (db *DB, err error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "dbrouter.sqlPrepare")
 	defer span.Finish()
 
 	instance := m.configer.GetInstance(ctx, cluster, table)
+	return m.sqlPrepareInstance(ctx, cluster, table, instance, read)
+}
+
+// sqlPrepareInstance read: a replica of instance if any, otherwise the primary
+func (m *Router) sqlPrepareInstance(ctx context.Context, cluster, table, instance string, read bool) (db *DB, err error) {
 	in := m.instances.Get(ctx, generateKey(instance))
 	if in == nil {
 		err = fmt.Errorf("db instance not find: cluster:%s table:%s instance:%s", cluster, table, instance)
@@ -75,14 +176,39 @@ func (m *Router) sqlPrepare(ctx context.Context, cluster, table string) (db *DB,
 		return
 	}
 
-	db = dbsql.getDB()
+	if read {
+		db = dbsql.getReadDB(ctx)
+	} else {
+		db = dbsql.getDB()
+	}
 	return
 }
 
 func (m *Router) SqlExec(ctx context.Context, cluster string, query func(*DB, []interface{}) error, tables ...string) error {
-	fun := "Router.SqlExec -->"
+	return m.sqlExec(ctx, "SqlExec", cluster, false, query, tables...)
+}
 
-	span, ctx := opentracing.StartSpanFromContext(ctx, "dbrouter.SqlExec")
+// SqlReadExec 同SqlExec，但在实例的健康副本上执行，没有副本或副本都不可用时在主库执行，
+// 见WithPrimary和WithStickyPrimary
+func (m *Router) SqlReadExec(ctx context.Context, cluster string, query func(*DB, []interface{}) error, tables ...string) error {
+	return m.sqlExec(ctx, "SqlReadExec", cluster, true, query, tables...)
+}
+
+// readBreakerSuffix replicas fail independently of the primary, reads have breakers of their
+// own, e.g. GetBreakerState(cluster, table+readBreakerSuffix)
+const readBreakerSuffix = ":read"
+
+func breakerTable(table string, read bool) string {
+	if read {
+		return table + readBreakerSuffix
+	}
+	return table
+}
+
+func (m *Router) sqlExec(ctx context.Context, op, cluster string, read bool, query func(*DB, []interface{}) error, tables ...string) error {
+	fun := "Router." + op + " -->"
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, "dbrouter."+op)
 	defer span.Finish()
 
 	st := stime.NewTimeStat()
@@ -97,19 +223,21 @@ func (m *Router) SqlExec(ctx context.Context, cluster string, query func(*DB, []
 		log.String(spanLogKeyTable, table))
 
 	// check breaker
-	if !Entry(cluster, table){
-		slog.Errorf(ctx, "%s trigger tidb breaker, because too many timeout sqls, cluster: %s, table: %s", fun, cluster, table)
-		return errors.New("sql cause breaker, because too many timeout")
+	breaker := breakerTable(table, read)
+	if !m.breakers.entry(cluster, breaker) {
+		slog.Errorf(ctx, "%s breaker is open, cluster: %s, table: %s", fun, cluster, breaker)
+		return ErrBreakerOpen
 	}
 
-	db, err := m.sqlPrepare(ctx, cluster, table)
+	db, err := m.sqlPrepare(ctx, cluster, table, read)
 	if err != nil {
 		return err
 	}
+	db = db.withTrace(m.newTrace(ctx, cluster, table))
 
 	defer func() {
 		dur := st.Duration()
-		m.report.IncQuery(cluster, table, st.Duration())
+		m.statQuery(op, cluster, table, dur, err)
 		slog.Tracef(ctx, "%s cls:%s table:%s dur:%d", fun, cluster, table, dur)
 	}()
 
@@ -120,11 +248,60 @@ func (m *Router) SqlExec(ctx context.Context, cluster string, query func(*DB, []
 	err = query(db, tmptables)
 	statReqErr(cluster, table, err)
 	// record breaker
-	statBreaker(cluster, table, err)
+	m.breakers.stat(cluster, breaker, err, st.Duration())
+	return err
+}
+
+// SqlExecByKey table是hash或range分表的逻辑表名，按shardKey找到实例和物理表名传给query，
+// 未分表的table按full和regex规则查找，物理表名即table
+func (m *Router) SqlExecByKey(ctx context.Context, cluster, table string, shardKey interface{}, query func(db *DB, table string) error) error {
+	fun := "Router.SqlExecByKey -->"
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, "dbrouter.SqlExecByKey")
+	defer span.Finish()
+
+	st := stime.NewTimeStat()
+
+	sc, ok := m.configer.(ShardConfiger)
+	if !ok {
+		return fmt.Errorf("configer %T doesn't support shard tables", m.configer)
+	}
+	instance, physical, err := sc.GetShardInstance(ctx, cluster, table, shardKey)
+	if err != nil {
+		slog.Errorf(ctx, "%s shard key:%v err:%s", fun, shardKey, err.Error())
+		return err
+	}
+
+	span.LogFields(
+		log.String(spanLogKeyCluster, cluster),
+		log.String(spanLogKeyTable, physical))
+
+	// check breaker
+	if !m.breakers.entry(cluster, physical) {
+		slog.Errorf(ctx, "%s breaker is open, cluster: %s, table: %s", fun, cluster, physical)
+		return ErrBreakerOpen
+	}
+
+	db, err := m.sqlPrepareInstance(ctx, cluster, physical, instance, false)
+	if err != nil {
+		return err
+	}
+	db = db.withTrace(m.newTrace(ctx, cluster, physical))
+
+	defer func() {
+		dur := st.Duration()
+		m.statQuery("SqlExecByKey", cluster, table, dur, err)
+		slog.Tracef(ctx, "%s cls:%s table:%s physical:%s dur:%d", fun, cluster, table, physical, dur)
+	}()
+
+	err = query(db, physical)
+	statReqErr(cluster, table, err)
+	// record breaker
+	m.breakers.stat(cluster, physical, err, st.Duration())
 	return err
 }
 
-func (m *Router) ormPrepare(ctx context.Context, cluster, table string) (db *GormDB, err error) {
+func (m *Router) ormPrepare(ctx context.Context, cluster, table string, read bool) (db *GormDB, err error) {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "dbrouter.ormPrepare")
 	defer span.Finish()
 
@@ -141,14 +318,27 @@ func (m *Router) ormPrepare(ctx context.Context, cluster, table string) (db *Gor
 		return
 	}
 
-	db = dbsql.getGormDB()
+	if read {
+		db = dbsql.getReadGormDB(ctx)
+	} else {
+		db = dbsql.getGormDB()
+	}
 	return
 }
 
 func (m *Router) OrmExec(ctx context.Context, cluster string, query func(*GormDB, []interface{}) error, tables ...string) error {
-	fun := "Router.OrmExec -->"
+	return m.ormExec(ctx, "OrmExec", cluster, false, query, tables...)
+}
+
+// OrmReadExec 同OrmExec，但在实例的健康副本上执行，见SqlReadExec
+func (m *Router) OrmReadExec(ctx context.Context, cluster string, query func(*GormDB, []interface{}) error, tables ...string) error {
+	return m.ormExec(ctx, "OrmReadExec", cluster, true, query, tables...)
+}
+
+func (m *Router) ormExec(ctx context.Context, op, cluster string, read bool, query func(*GormDB, []interface{}) error, tables ...string) error {
+	fun := "Router." + op + " -->"
 
-	span, ctx := opentracing.StartSpanFromContext(ctx, "dbrouter.OrmExec")
+	span, ctx := opentracing.StartSpanFromContext(ctx, "dbrouter."+op)
 	defer span.Finish()
 
 	st := stime.NewTimeStat()
@@ -163,19 +353,21 @@ func (m *Router) OrmExec(ctx context.Context, cluster string, query func(*GormDB
 		log.String(spanLogKeyTable, table))
 
 	// check breaker
-	if !Entry(cluster, table){
-		slog.Errorf(ctx, "%s trigger tidb breaker, because too many timeout sqls, cluster: %s, table: %s", fun, cluster, table)
-		return errors.New("sql cause breaker, because too many timeout")
+	breaker := breakerTable(table, read)
+	if !m.breakers.entry(cluster, breaker) {
+		slog.Errorf(ctx, "%s breaker is open, cluster: %s, table: %s", fun, cluster, breaker)
+		return ErrBreakerOpen
 	}
 
-	db, err := m.ormPrepare(ctx, cluster, table)
+	db, err := m.ormPrepare(ctx, cluster, table, read)
 	if err != nil {
 		return err
 	}
+	db = db.withTrace(m.newTrace(ctx, cluster, table))
 
 	defer func() {
 		dur := st.Duration()
-		m.report.IncQuery(cluster, table, st.Duration())
+		m.statQuery(op, cluster, table, dur, err)
 		slog.Tracef(ctx, "%s cls:%s table:%s dur:%d", fun, cluster, table, dur)
 	}()
 
@@ -186,7 +378,7 @@ func (m *Router) OrmExec(ctx context.Context, cluster string, query func(*GormDB
 	err = query(db, tmptables)
 	statReqErr(cluster, table, err)
 	// stat breaker
-	statBreaker(cluster, table, err)
+	m.breakers.stat(cluster, breaker, err, st.Duration())
 	return err
 }
 
@@ -235,7 +427,7 @@ func (m *Router) mongoPrepare(ctx context.Context, consistency mode, cluster, ta
 
 func (m *Router) mongoExec(ctx context.Context, consistency mode, cluster, table string, query func(*mgo.Collection) error) error {
 	fun := "Router.mongoExec -->"
-	if !Entry(cluster, table){
+	if !m.breakers.entry(cluster, table) {
 		slog.Errorf(ctx, "%s trigger mongodb breaker, because too many timeout query, cluster: %s, table: %s", fun, cluster, table)
 		return errors.New("mongo query cause breaker, because too many timeout")
 	}
@@ -257,11 +449,11 @@ func (m *Router) mongoExec(ctx context.Context, consistency mode, cluster, table
 
 	defer func() {
 		dur := st.Duration()
-		m.report.IncQuery(cluster, table, st.Duration())
+		m.statQuery("MongoExec", cluster, table, dur, err)
 		slog.Tracef(ctx, "%s const:%d cls:%s table:%s dur:%d", fun, consistency, cluster, table, dur)
 	}()
 	err = query(coll)
 	statReqErr(cluster, table, err)
-	statBreaker(cluster, table, err)
+	m.breakers.stat(cluster, table, err, st.Duration())
 	return err
 }
@@ -12,6 +12,8 @@ import (
 type clsEntry struct {
 	full  map[string]*dbExpress
 	regex map[string]*dbExpress
+	// logical table -> hash or range shards
+	shard map[string]*shardTable
 }
 
 type dbCluster struct {
@@ -32,18 +34,19 @@ func (m *dbCluster) addInstance(cluster string, lcfg *dbLookupCfg) error {
 		m.clusters[cluster] = &clsEntry{
 			full:  make(map[string]*dbExpress),
 			regex: make(map[string]*dbExpress),
+			shard: make(map[string]*shardTable),
 		}
 	}
 
 	match := lcfg.Match
-	if match == "full" {
+	if match == MATCH_FULL {
 		if m.clusters[cluster].full[lcfg.Express] != nil {
 			return fmt.Errorf("dup match full in cluster:%s express:%s", cluster, lcfg.Express)
 		}
 
 		m.clusters[cluster].full[lcfg.Express] = &dbExpress{lookup: lcfg}
 
-	} else if match == "regex" {
+	} else if match == MATCH_REGEX {
 		if m.clusters[cluster].regex[lcfg.Express] != nil {
 			return fmt.Errorf("dup match regex in cluster:%s express:%s", cluster, lcfg.Express)
 		}
@@ -55,6 +58,9 @@ func (m *dbCluster) addInstance(cluster string, lcfg *dbLookupCfg) error {
 
 		m.clusters[cluster].regex[lcfg.Express] = &dbExpress{lookup: lcfg, reg: reg}
 
+	} else if match == MATCH_HASH || match == MATCH_RANGE {
+		return m.addShard(cluster, lcfg)
+
 	} else {
 		return fmt.Errorf("match type:%s not support", match)
 	}
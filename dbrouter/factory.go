@@ -44,7 +44,15 @@ func Factory(ctx context.Context, key, group string, configer Configer) (in Inst
 		fallthrough
 
 	case DB_TYPE_POSTGRES:
-		return NewSql(config.DBType, config.DBName, config.DBAddr[0], config.UserName, config.PassWord, config.TimeOut)
+		db, err := newSql(config, config.DBAddr[0])
+		if err != nil {
+			return nil, err
+		}
+		db.instance, db.group = instance, group
+		if len(config.Replicas) > 0 {
+			db.replicas = newSqlReplicaSet(db, config)
+		}
+		return db, nil
 
 	default:
 		return nil, fmt.Errorf("dbType err, key: %s", key)
@@ -6,11 +6,18 @@ package dbrouter
 
 import (
 	"context"
-	"fmt"
+	"time"
+
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
+	"github.com/opentracing/opentracing-go"
 	"github.com/shawnfeng/sutil/slog/slog"
-	"time"
+)
+
+const (
+	// gorm settings of the trace of a request and of a statement in progress
+	gormTraceKey     = "dbrouter:trace"
+	gormStatementKey = "dbrouter:statement"
 )
 
 type GormDB struct {
@@ -24,25 +31,77 @@ func NewGormDB(gormdb *gorm.DB) *GormDB {
 	return db
 }
 
+// withTrace a copy of db of the request of trace, read by the callbacks of registerGormCallbacks
+func (db *GormDB) withTrace(trace *queryTrace) *GormDB {
+	return NewGormDB(db.DB.Set(gormTraceKey, trace.forDriver(db.Dialect().GetName())))
+}
+
 func dialByGorm(info *Sql) (db *gorm.DB, err error) {
 	fun := "dialByGorm -->"
 
-	var dataSourceName string
-	if info.dbType == DB_TYPE_MYSQL { // timeout: 3s readTimeout: 5s writeTimeout: 5s, TODO: dynamic config
-		dataSourceName = fmt.Sprintf("%s:%s@tcp(%s)/%s?parseTime=True&loc=Local&charset=utf8mb4&collation=utf8mb4_unicode_ci&timeout=3s&readTimeout=5s&writeTimeout=5s", info.userName, info.passWord, info.dbAddr, info.dbName)
-
-	} else if info.dbType == DB_TYPE_POSTGRES {
-		dataSourceName = fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=disable",
-			info.userName, info.passWord, info.dbAddr, info.dbName)
-	}
-
-	slog.Infof(context.TODO(), "%s dbtype:%s datasourcename:%s", fun, info.dbType, dataSourceName)
+	dataSourceName := dataSourceName(info, true)
+	slog.Infof(context.TODO(), "%s dbtype:%s datasourcename:%s", fun, info.dbType, redactDSN(info, true))
 	gormdb, err := gorm.Open(info.dbType, dataSourceName)
 	if err == nil {
-		gormdb.DB().SetMaxIdleConns(8)
-		gormdb.DB().SetMaxOpenConns(128)
-		gormdb.DB().SetConnMaxLifetime(time.Hour*6)
+		setPool(gormdb.DB(), info.conn, 8)
+		registerGormCallbacks(gormdb)
 	}
 
 	return gormdb, err
 }
+
+type gormStatement struct {
+	span  opentracing.Span
+	ctx   context.Context
+	start time.Time
+}
+
+// registerGormCallbacks instrument the statements of gormdb as those of DB, see queryTrace
+func registerGormCallbacks(gormdb *gorm.DB) {
+	cb := gormdb.Callback()
+	cb.Create().Before("gorm:create").Register("dbrouter:before_create", gormBefore("create"))
+	cb.Create().After("gorm:create").Register("dbrouter:after_create", gormAfter("create"))
+	cb.Query().Before("gorm:query").Register("dbrouter:before_query", gormBefore("query"))
+	cb.Query().After("gorm:query").Register("dbrouter:after_query", gormAfter("query"))
+	cb.Update().Before("gorm:update").Register("dbrouter:before_update", gormBefore("update"))
+	cb.Update().After("gorm:update").Register("dbrouter:after_update", gormAfter("update"))
+	cb.Delete().Before("gorm:delete").Register("dbrouter:before_delete", gormBefore("delete"))
+	cb.Delete().After("gorm:delete").Register("dbrouter:after_delete", gormAfter("delete"))
+	cb.RowQuery().Before("gorm:row_query").Register("dbrouter:before_row_query", gormBefore("row_query"))
+	cb.RowQuery().After("gorm:row_query").Register("dbrouter:after_row_query", gormAfter("row_query"))
+}
+
+func gormTrace(scope *gorm.Scope) *queryTrace {
+	v, _ := scope.Get(gormTraceKey)
+	trace, _ := v.(*queryTrace)
+	return trace
+}
+
+func gormBefore(op string) func(*gorm.Scope) {
+	return func(scope *gorm.Scope) {
+		trace := gormTrace(scope)
+		if trace == nil {
+			return
+		}
+		span, ctx := trace.start(context.Background(), "GormDB."+op)
+		scope.InstanceSet(gormStatementKey, &gormStatement{span: span, ctx: ctx, start: time.Now()})
+	}
+}
+
+func gormAfter(op string) func(*gorm.Scope) {
+	return func(scope *gorm.Scope) {
+		trace := gormTrace(scope)
+		v, _ := scope.InstanceGet(gormStatementKey)
+		st, ok := v.(*gormStatement)
+		if trace == nil || !ok {
+			return
+		}
+
+		rows := scope.DB().RowsAffected
+		if op == "row_query" {
+			// rows are not read yet
+			rows = -1
+		}
+		trace.finish(st.ctx, st.span, "GormDB."+op, scope.SQL, len(scope.SQLVars), rows, scope.DB().Error, time.Since(st.start))
+	}
+}
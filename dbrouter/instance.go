@@ -9,9 +9,17 @@ import (
 	"fmt"
 	"github.com/shawnfeng/sutil/scontext"
 	"github.com/shawnfeng/sutil/slog/slog"
+	"gopkg.in/mgo.v2"
 	"sync"
+	"time"
 )
 
+const poolStatsInterval = 15 * time.Second
+
+// instanceCloseDelay an instance replaced on config change is closed after this, so that
+// requests which already got it finish on it, new requests get the rebuilt one
+var instanceCloseDelay = 30 * time.Second
+
 //var DefaultInstanceManager = NewInstanceManager(Factory)
 
 type Instancer interface {
@@ -27,6 +35,7 @@ type InstanceManager struct {
 	instances  map[string]Instancer
 	factory    FactoryFunc
 	groups     []string
+	statsOnce  sync.Once
 }
 
 func NewInstanceManager(factory FactoryFunc, dbChangeChan chan dbConfigChange, groups []string) *InstanceManager {
@@ -120,9 +129,42 @@ func (m *InstanceManager) buildInstance(ctx context.Context, instance, group str
 	}
 
 	m.instances[key] = in
+	m.statsOnce.Do(func() { go m.statLoop() })
 	return in, nil
 }
 
+// statLoop export pool stats of instances until the process exits
+func (m *InstanceManager) statLoop() {
+	ticker := time.NewTicker(poolStatsInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.stat()
+	}
+}
+
+func (m *InstanceManager) stat() {
+	m.instanceMu.RLock()
+	instances := make([]Instancer, 0, len(m.instances))
+	for _, in := range m.instances {
+		instances = append(instances, in)
+	}
+	m.instanceMu.RUnlock()
+
+	hasMongo := false
+	for _, in := range instances {
+		switch t := in.(type) {
+		case *Sql:
+			t.statPool()
+		case *dbMongo:
+			hasMongo = true
+		}
+	}
+	if hasMongo {
+		enableMongoStats()
+		statMongo(mgo.GetStats())
+	}
+}
+
 func (m *InstanceManager) Close() {
 	fun := "InstanceManager.Close -->"
 	m.instanceMu.Lock()
@@ -169,6 +211,7 @@ func (m *InstanceManager) closeDbInstance(ctx context.Context, insName, group st
 	if in, ok := m.instances[key]; ok {
 		delete(m.instances, key)
 		go func() {
+			time.Sleep(instanceCloseDelay)
 			if err := in.Close(); err == nil {
 				slog.Infof(ctx, "%s succeed to close db instance: %s group: %s", fun, insName, group)
 			} else {
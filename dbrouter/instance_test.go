@@ -3,29 +3,50 @@ package dbrouter
 import (
 	"context"
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 )
 
-func TestQueryTimeout(t *testing.T) {
-	ctx := context.TODO()
-	router, err := NewRouter(nil)
-	if err != nil {
-		t.Errorf("init router failed, err: %v", err)
+// newEtcdTestRouter router of the etcd config, the test is skipped if etcd is unreachable
+func newEtcdTestRouter(t *testing.T) *Router {
+	ch := make(chan *Router, 1)
+	go func() {
+		router, err := NewRouter(nil)
+		if err != nil {
+			fmt.Printf("init router failed, err: %v\n", err)
+		}
+		ch <- router
+	}()
+	select {
+	case router := <-ch:
+		if router == nil {
+			t.Skip("init router failed")
+		}
+		return router
+	case <-time.After(3 * time.Second):
+		t.Skip("etcd is unreachable")
+		return nil
 	}
-	for i:=0;i<16;i++ {
+}
+
+func TestQueryTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.TODO(), 3*time.Second)
+	defer cancel()
+	router := newEtcdTestRouter(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
 		go func() {
-			for {
-				err = router.SqlExec(ctx, "COURSEWAREX", func(db *DB, tables []interface{}) (err error) {
-					_, err = db.Query("select sleep(10)")
-					return err
-				}, "coursewarex_1")
-				if err != nil {
-					fmt.Printf("router exec failed, %v", err)
-				}
-				time.Sleep(time.Millisecond * 50)
+			defer wg.Done()
+			err := router.SqlExec(ctx, "COURSEWAREX", func(db *DB, tables []interface{}) (err error) {
+				_, err = db.QueryContext(ctx, "select sleep(10)")
+				return err
+			}, "coursewarex_1")
+			if err != nil {
+				fmt.Printf("router exec failed, %v\n", err)
 			}
 		}()
 	}
-	select{}
+	wg.Wait()
 }
@@ -1,7 +1,14 @@
 package dbrouter
 
 import (
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 	"gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+	"gopkg.in/mgo.v2"
 )
 
 const (
@@ -10,6 +17,16 @@ const (
 )
 
 var (
+	buckets = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+	_metricReqDuration = xprometheus.NewHistogram(&xprometheus.HistogramVecOpts{
+		Namespace:  namespace,
+		Subsystem:  subsystem,
+		Name:       "request_duration_ms",
+		Help:       "db request duration(ms)",
+		LabelNames: []string{"cluster", "table", "op", "result"},
+		Buckets:    buckets,
+	})
 	_metricReqErr = xprometheus.NewCounter(&xprometheus.CounterVecOpts{
 		Namespace:  namespace,
 		Subsystem:  subsystem,
@@ -17,6 +34,43 @@ var (
 		Help:       "db request err total",
 		LabelNames: []string{xprometheus.LabelSource},
 	})
+	_metricBreakerState = xprometheus.NewGauge(&xprometheus.GaugeVecOpts{
+		Namespace:  namespace,
+		Subsystem:  subsystem,
+		Name:       "breaker_state",
+		Help:       "circuit breaker state, 0 closed, 1 open, 2 half open",
+		LabelNames: []string{xprometheus.LabelSource},
+	})
+	_metricBreakerRejected = xprometheus.NewCounter(&xprometheus.CounterVecOpts{
+		Namespace:  namespace,
+		Subsystem:  subsystem,
+		Name:       "breaker_rejected_total",
+		Help:       "db requests rejected by the circuit breaker",
+		LabelNames: []string{xprometheus.LabelSource},
+	})
+	_metricBreakerTransitions = xprometheus.NewCounter(&xprometheus.CounterVecOpts{
+		Namespace:  namespace,
+		Subsystem:  subsystem,
+		Name:       "breaker_transitions_total",
+		Help:       "circuit breaker state transitions",
+		LabelNames: []string{xprometheus.LabelSource, "state"},
+	})
+
+	// mgo keeps stats of the process only
+	_metricMongoSockets = xprometheus.NewGauge(&xprometheus.GaugeVecOpts{
+		Namespace:  namespace,
+		Subsystem:  subsystem,
+		Name:       "mongo_sockets",
+		Help:       "mongo sockets of the process, by state alive and in_use",
+		LabelNames: []string{"state"},
+	})
+	_metricMongoConns = xprometheus.NewGauge(&xprometheus.GaugeVecOpts{
+		Namespace:  namespace,
+		Subsystem:  subsystem,
+		Name:       "mongo_conns",
+		Help:       "mongo connections of the process, by role master and slave",
+		LabelNames: []string{"role"},
+	})
 )
 
 func statReqErr(cluster, table string, err error) {
@@ -26,3 +80,103 @@ func statReqErr(cluster, table string, err error) {
 	}
 	return
 }
+
+func statReqDuration(op, cluster, table string, dur time.Duration, err error) {
+	result := "ok"
+	if err != nil {
+		result = "err"
+	}
+	_metricReqDuration.With("cluster", cluster, "table", table, "op", op, "result", result).Observe(float64(dur) / float64(time.Millisecond))
+}
+
+func statBreakerState(cluster, table string, state BreakerState) {
+	source := cluster + "." + table
+	_metricBreakerState.With(xprometheus.LabelSource, source).Set(float64(state))
+	_metricBreakerTransitions.With(xprometheus.LabelSource, source, "state", state.String()).Inc()
+}
+
+func statBreakerReject(cluster, table string) {
+	source := cluster + "." + table
+	_metricBreakerRejected.With(xprometheus.LabelSource, source).Inc()
+}
+
+// sql.DBStats of the primary and replicas of every instance. They are vecs of client_golang
+// rather than xprometheus, so that the series of an instance closed can be deleted.
+var (
+	poolLabels = []string{"instance", "group", "addr", "client"}
+
+	_metricPoolOpenConns    = newPoolGauge("pool_open_conns", "number of open connections in the pool")
+	_metricPoolInUseConns   = newPoolGauge("pool_in_use_conns", "number of connections in use")
+	_metricPoolIdleConns    = newPoolGauge("pool_idle_conns", "number of idle connections in the pool")
+	_metricPoolWaitCount    = newPoolCounter("pool_wait_total", "number of connections waited for")
+	_metricPoolWaitDuration = newPoolCounter("pool_wait_duration_ms_total", "time(ms) blocked waiting for a connection")
+
+	// WaitCount and WaitDuration of sql.DBStats are totals since the pool was opened, the last
+	// ones stated by labels, so that the counters are added the increase only
+	poolMu       sync.Mutex
+	poolWaitLast = make(map[string]sql.DBStats)
+	// the pool stating labels last, a hot reload opens a new instance with the same labels
+	// before the old one is closed, the old one must not delete the series of the new one
+	poolOwners = make(map[string]interface{})
+)
+
+func newPoolGauge(name, help string) *prometheus.GaugeVec {
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Subsystem: subsystem, Name: name, Help: help}, poolLabels)
+	prometheus.MustRegister(vec)
+	return vec
+}
+
+func newPoolCounter(name, help string) *prometheus.CounterVec {
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Subsystem: subsystem, Name: name, Help: help}, poolLabels)
+	prometheus.MustRegister(vec)
+	return vec
+}
+
+// statPool client is sqlx or gorm, each of which has its own pool, owner is the pool
+func statPool(owner interface{}, instance, group, addr, client string, stats sql.DBStats) {
+	labels := []string{instance, group, addr, client}
+	key := strings.Join(labels, "|")
+
+	poolMu.Lock()
+	defer poolMu.Unlock()
+	prev := poolOwners[key]
+	poolOwners[key] = owner
+	_metricPoolOpenConns.WithLabelValues(labels...).Set(float64(stats.OpenConnections))
+	_metricPoolInUseConns.WithLabelValues(labels...).Set(float64(stats.InUse))
+	_metricPoolIdleConns.WithLabelValues(labels...).Set(float64(stats.Idle))
+
+	last, ok := poolWaitLast[key]
+	poolWaitLast[key] = stats
+	// a pool opened again under the same labels starts over
+	if !ok || prev != owner || stats.WaitCount < last.WaitCount || stats.WaitDuration < last.WaitDuration {
+		last = sql.DBStats{}
+	}
+	_metricPoolWaitCount.WithLabelValues(labels...).Add(float64(stats.WaitCount - last.WaitCount))
+	_metricPoolWaitDuration.WithLabelValues(labels...).Add(float64((stats.WaitDuration - last.WaitDuration).Milliseconds()))
+}
+
+// deletePool delete the series of a pool closed, unless they are stated by another pool now
+func deletePool(owner interface{}, instance, group, addr, client string) {
+	labels := []string{instance, group, addr, client}
+	key := strings.Join(labels, "|")
+
+	poolMu.Lock()
+	defer poolMu.Unlock()
+	if o, ok := poolOwners[key]; ok && o != owner {
+		return
+	}
+	delete(poolOwners, key)
+	delete(poolWaitLast, key)
+	_metricPoolOpenConns.DeleteLabelValues(labels...)
+	_metricPoolInUseConns.DeleteLabelValues(labels...)
+	_metricPoolIdleConns.DeleteLabelValues(labels...)
+	_metricPoolWaitCount.DeleteLabelValues(labels...)
+	_metricPoolWaitDuration.DeleteLabelValues(labels...)
+}
+
+func statMongo(stats mgo.Stats) {
+	_metricMongoSockets.With("state", "alive").Set(float64(stats.SocketsAlive))
+	_metricMongoSockets.With("state", "in_use").Set(float64(stats.SocketsInUse))
+	_metricMongoConns.With("role", "master").Set(float64(stats.MasterConns))
+	_metricMongoConns.With("role", "slave").Set(float64(stats.SlaveConns))
+}
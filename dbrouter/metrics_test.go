@@ -0,0 +1,86 @@
+package dbrouter
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jinzhu/gorm"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shawnfeng/sutil/stat"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouter_StatQuery(t *testing.T) {
+	router := &Router{report: stat.NewStat()}
+	router.statQuery("SqlExec", "trade", "order", 2*time.Millisecond, nil)
+	router.statQuery("SqlReadExec", "trade", "order", 4*time.Millisecond, errors.New("err"))
+
+	infos := router.StatInfo()
+	assert.Len(t, infos, 1)
+	assert.Equal(t, "trade.order", infos[0].ClusterTable)
+	assert.Equal(t, int64(2), infos[0].Count)
+	assert.Equal(t, int64(6000), infos[0].Sum)
+}
+
+func TestInstanceManager_Stat(t *testing.T) {
+	newSql := func() (*DB, *GormDB) {
+		db, _, err := sqlmock.New()
+		assert.NoError(t, err)
+		gormdb, err := gorm.Open(DB_TYPE_MYSQL, db)
+		assert.NoError(t, err)
+		sqlxdb, _ := newMockDB(t)
+		return sqlxdb, NewGormDB(gormdb)
+	}
+
+	db, gormdb := newSql()
+	replica, replicaGorm := newSql()
+	in := &Sql{instance: "trade0", group: DefaultGroup, dbAddr: "master", db: db, gormdb: gormdb}
+	in.replicas = &sqlReplicaSet{replicas: []*sqlReplica{{addr: "slave0", db: replica, gormdb: replicaGorm}}}
+
+	m := &InstanceManager{instances: map[string]Instancer{
+		"default-trade0": in,
+		"default-mongo0": &dbMongo{},
+	}}
+	assert.NotPanics(t, m.stat)
+}
+
+func TestStatPool(t *testing.T) {
+	labels := []string{"stat0", DefaultGroup, "master", "sqlx"}
+	in := &Sql{instance: "stat0", group: DefaultGroup, dbAddr: "master"}
+	statPool(in, "stat0", DefaultGroup, "master", "sqlx", sql.DBStats{OpenConnections: 3, WaitCount: 5, WaitDuration: 10 * time.Millisecond})
+	statPool(in, "stat0", DefaultGroup, "master", "sqlx", sql.DBStats{OpenConnections: 2, WaitCount: 7, WaitDuration: 30 * time.Millisecond})
+	assert.Equal(t, float64(2), testutil.ToFloat64(_metricPoolOpenConns.WithLabelValues(labels...)))
+	// counters of the totals of the pool
+	assert.Equal(t, float64(7), testutil.ToFloat64(_metricPoolWaitCount.WithLabelValues(labels...)))
+	assert.Equal(t, float64(30), testutil.ToFloat64(_metricPoolWaitDuration.WithLabelValues(labels...)))
+
+	// a pool opened again starts over
+	statPool(in, "stat0", DefaultGroup, "master", "sqlx", sql.DBStats{WaitCount: 1})
+	assert.Equal(t, float64(8), testutil.ToFloat64(_metricPoolWaitCount.WithLabelValues(labels...)))
+
+	// the instance replaced by a hot reload keeps the series of the new one on close
+	reloaded := &Sql{instance: "stat0", group: DefaultGroup, dbAddr: "master"}
+	statPool(reloaded, "stat0", DefaultGroup, "master", "sqlx", sql.DBStats{OpenConnections: 1, WaitCount: 2})
+	assert.Equal(t, float64(10), testutil.ToFloat64(_metricPoolWaitCount.WithLabelValues(labels...)))
+	open, waits := collectCount(_metricPoolOpenConns), collectCount(_metricPoolWaitCount)
+	in.deletePool()
+	assert.Equal(t, open, collectCount(_metricPoolOpenConns))
+	assert.Equal(t, waits, collectCount(_metricPoolWaitCount))
+	statPool(reloaded, "stat0", DefaultGroup, "master", "sqlx", sql.DBStats{OpenConnections: 1, WaitCount: 3})
+	assert.Equal(t, float64(11), testutil.ToFloat64(_metricPoolWaitCount.WithLabelValues(labels...)))
+
+	reloaded.deletePool()
+	assert.Equal(t, open-1, collectCount(_metricPoolOpenConns))
+	assert.Equal(t, waits-1, collectCount(_metricPoolWaitCount))
+}
+
+func collectCount(c prometheus.Collector) int {
+	ch := make(chan prometheus.Metric, 64)
+	c.Collect(ch)
+	close(ch)
+	return len(ch)
+}
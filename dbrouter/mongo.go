@@ -18,6 +18,13 @@ const (
 	defaultDialTimeout   = time.Second * 5
 )
 
+// mgo collects stats only if enabled, and GetStats panics if not
+var mongoStatsOnce sync.Once
+
+func enableMongoStats() {
+	mongoStatsOnce.Do(func() { mgo.SetStats(true) })
+}
+
 type dbMongo struct {
 	dbType   string
 	dbName   string
@@ -36,6 +43,7 @@ func NewMongo(dbtype, dbname, user, passwd string, addrs []string, timeout time.
 	if timeout == 0 {
 		timeout = defaultDialTimeout
 	}
+	enableMongoStats()
 
 	info := &mgo.DialInfo{
 		Addrs:     addrs,
@@ -3,6 +3,7 @@ package dbrouter
 import (
 	"context"
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -10,27 +11,24 @@ import (
 )
 
 func TestMongoTimeout(t *testing.T) {
-	ctx := context.TODO()
-	router, err := NewRouter(nil)
-	if err != nil {
-		t.Errorf("init router failed, err: %v", err)
-	}
+	ctx, cancel := context.WithTimeout(context.TODO(), 3*time.Second)
+	defer cancel()
+	router := newEtcdTestRouter(t)
 	query := func(c *mgo.Collection) error {
 		n, err := c.Count()
 		fmt.Println(n)
 		return err
 	}
+	var wg sync.WaitGroup
 	for i := 0; i < 16; i++ {
+		wg.Add(1)
 		go func() {
-			for {
-				err = router.MongoExecEventual(ctx, "STAT", "dbrouter_oprecord", query)
-				if err != nil {
-					fmt.Printf("router exec failed, %v", err)
-				}
-				time.Sleep(time.Millisecond * 50)
+			defer wg.Done()
+			err := router.MongoExecEventual(ctx, "STAT", "dbrouter_oprecord", query)
+			if err != nil {
+				fmt.Printf("router exec failed, %v\n", err)
 			}
 		}()
-
 	}
-	select{}
+	wg.Wait()
 }
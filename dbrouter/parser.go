@@ -20,10 +20,26 @@ type dbLookupCfg struct {
 	Instance string `json:"instance"`
 	Match    string `json:"match"`
 	Express  string `json:"express"`
+
+	// hash和range：物理表名格式，参数为分表序号，默认 express_%d
+	Table string `json:"table"`
+	// hash：分表数，mod或consistent，本实例持有的分表序号如 "0-31,40"，空为全部
+	Shards int    `json:"shards"`
+	Hash   string `json:"hash"`
+	Slots  string `json:"slots"`
+	// range：本实例持有的shard key区间
+	Ranges []*shardRange `json:"ranges"`
 }
 
 func (m *dbLookupCfg) String() string {
-	return fmt.Sprintf("ins:%s exp:%s match:%s", m.Instance, m.Express, m.Match)
+	switch m.Match {
+	case MATCH_HASH:
+		return fmt.Sprintf("ins:%s exp:%s match:%s table:%s shards:%d hash:%s slots:%s", m.Instance, m.Express, m.Match, m.Table, m.Shards, m.Hash, m.Slots)
+	case MATCH_RANGE:
+		return fmt.Sprintf("ins:%s exp:%s match:%s table:%s ranges:%d", m.Instance, m.Express, m.Match, m.Table, len(m.Ranges))
+	default:
+		return fmt.Sprintf("ins:%s exp:%s match:%s", m.Instance, m.Express, m.Match)
+	}
 }
 
 type dbInsCfg struct {
@@ -47,6 +63,34 @@ type dbInsInfo struct {
 	DBAddr   []string `json:"addrs"`
 	UserName string   `json:"user"`
 	PassWord string   `json:"passwd"`
+
+	connInfo
+
+	// 只读副本，addrs[0]为主库
+	Replicas []*replicaInfo `json:"replicas"`
+	// 返回复制延迟秒数的探测sql，延迟超过maxlag秒的副本被摘除
+	LagProbe string  `json:"lagprobe"`
+	MaxLag   float64 `json:"maxlag"`
+}
+
+// connInfo 连接池和DSN参数，时间单位: 秒，0为默认值
+type connInfo struct {
+	MaxOpenConns int     `json:"maxopen"`
+	MaxIdleConns int     `json:"maxidle"`
+	MaxLifetime  float64 `json:"maxlifetime"`
+	MaxIdleTime  float64 `json:"maxidletime"`
+	DialTimeout  float64 `json:"timeout"`
+	ReadTimeout  float64 `json:"readtimeout"`
+	WriteTimeout float64 `json:"writetimeout"`
+	// mysql的tls参数，postgres的sslmode
+	TLS string `json:"tls"`
+	// 其他DSN参数，覆盖默认值
+	Params map[string]string `json:"params"`
+}
+
+type replicaInfo struct {
+	Addr   string `json:"addr"`
+	Weight int    `json:"weight"`
 }
 
 type routeConfig struct {
@@ -68,6 +112,14 @@ func (m *Parser) GetInstance(cluster, table string) string {
 	return instance
 }
 
+func (m *Parser) GetShard(cluster, table string, shardKey interface{}) (instance, physical string, err error) {
+	return m.dbCls.getShard(cluster, table, shardKey)
+}
+
+func (m *Parser) GetTables(cluster string) []PhysicalTable {
+	return m.dbCls.getTables(cluster)
+}
+
 func (m *Parser) getConfig(instance, group string) *dbInsInfo {
 	if infoMap, ok := m.dbIns[group]; ok {
 		if info, ok := infoMap[instance]; ok {
@@ -163,6 +215,9 @@ func NewParser(jscfg []byte) (*Parser, error) {
 			}
 		}
 	}
+	if err := r.dbCls.check(); err != nil {
+		return nil, fmt.Errorf("load instance lookup rule err:%s", err.Error())
+	}
 
 	inss := cfg.Instances
 	for ins, db := range inss {
@@ -289,7 +344,39 @@ func compareDbInstances(originDbInstances map[string]*dbInsInfo, newDbInstances
 
 func compareDbInfo(dbInsInfo1 *dbInsInfo, dbInsInfo2 *dbInsInfo) bool {
 	return dbInsInfo1.DBName == dbInsInfo2.DBName && dbInsInfo1.UserName == dbInsInfo2.UserName &&
-		dbInsInfo1.PassWord == dbInsInfo2.PassWord && compareStringList(dbInsInfo1.DBAddr, dbInsInfo2.DBAddr)
+		dbInsInfo1.PassWord == dbInsInfo2.PassWord && compareStringList(dbInsInfo1.DBAddr, dbInsInfo2.DBAddr) &&
+		compareReplicas(dbInsInfo1, dbInsInfo2) && compareConn(&dbInsInfo1.connInfo, &dbInsInfo2.connInfo)
+}
+
+func compareConn(conn1 *connInfo, conn2 *connInfo) bool {
+	if conn1.MaxOpenConns != conn2.MaxOpenConns || conn1.MaxIdleConns != conn2.MaxIdleConns ||
+		conn1.MaxLifetime != conn2.MaxLifetime || conn1.MaxIdleTime != conn2.MaxIdleTime ||
+		conn1.DialTimeout != conn2.DialTimeout || conn1.ReadTimeout != conn2.ReadTimeout ||
+		conn1.WriteTimeout != conn2.WriteTimeout || conn1.TLS != conn2.TLS ||
+		len(conn1.Params) != len(conn2.Params) {
+		return false
+	}
+	for k, v := range conn1.Params {
+		if v2, ok := conn2.Params[k]; !ok || v2 != v {
+			return false
+		}
+	}
+	return true
+}
+
+func compareReplicas(dbInsInfo1 *dbInsInfo, dbInsInfo2 *dbInsInfo) bool {
+	if dbInsInfo1.LagProbe != dbInsInfo2.LagProbe || dbInsInfo1.MaxLag != dbInsInfo2.MaxLag ||
+		len(dbInsInfo1.Replicas) != len(dbInsInfo2.Replicas) {
+		return false
+	}
+
+	for index := range dbInsInfo1.Replicas {
+		if *dbInsInfo1.Replicas[index] != *dbInsInfo2.Replicas[index] {
+			return false
+		}
+	}
+
+	return true
 }
 
 func compareStringList(stringList1 []string, stringList2 []string) bool {
@@ -0,0 +1,311 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shawnfeng/sutil/slog/slog"
+)
+
+const (
+	replicaProbeInterval = 2 * time.Second
+	replicaProbeTimeout  = time.Second
+	defaultMaxLag        = 10 * time.Second
+)
+
+var (
+	errReplicationStopped = errors.New("replication lag is null, replication stopped")
+	errReplicaClosed      = errors.New("replica closed")
+)
+
+type replicaLagError struct {
+	lag float64
+	max time.Duration
+}
+
+func (e *replicaLagError) Error() string {
+	return fmt.Sprintf("replication lag %.1fs exceeds %s", e.lag, e.max)
+}
+
+type primaryKey struct{}
+
+type stickyKey struct{}
+
+// stickyState last write through a sticky ctx, shared by every copy of the ctx
+type stickyState struct {
+	d         time.Duration
+	lastWrite int64
+}
+
+// WithPrimary force SqlReadExec and OrmReadExec with the returned ctx to the primary
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+// WithStickyPrimary reads with the returned ctx go to the primary for d after a write with it,
+// so that they see the write. Statements of the router other than reads count as writes, see
+// isWriteSQL.
+func WithStickyPrimary(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, stickyKey{}, &stickyState{d: d})
+}
+
+func markWrite(ctx context.Context) {
+	if st, ok := ctx.Value(stickyKey{}).(*stickyState); ok {
+		atomic.StoreInt64(&st.lastWrite, time.Now().UnixNano())
+	}
+}
+
+var readStatements = map[string]bool{
+	"SELECT": true, "SHOW": true, "DESC": true, "DESCRIBE": true, "EXPLAIN": true, "WITH": true,
+	"SET": true, "USE": true, "BEGIN": true, "START": true, "COMMIT": true, "ROLLBACK": true,
+}
+
+// isWriteSQL query doesn't start with a keyword of reads or of the session, e.g. SELECT or SET
+func isWriteSQL(query string) bool {
+	query = strings.TrimLeft(query, " \t\r\n(")
+	end := strings.IndexAny(query, " \t\r\n(")
+	if end < 0 {
+		end = len(query)
+	}
+	return end > 0 && !readStatements[strings.ToUpper(query[:end])]
+}
+
+func readFromPrimary(ctx context.Context) bool {
+	if forced, _ := ctx.Value(primaryKey{}).(bool); forced {
+		return true
+	}
+	st, ok := ctx.Value(stickyKey{}).(*stickyState)
+	if !ok {
+		return false
+	}
+	last := atomic.LoadInt64(&st.lastWrite)
+	return last > 0 && time.Since(time.Unix(0, last)) < st.d
+}
+
+type sqlReplica struct {
+	addr    string
+	weight  int
+	healthy int32
+	// info to dial the replica, the credentials of the primary
+	info *Sql
+
+	// mu guards db and gormdb, nil until dialed by check
+	mu     sync.Mutex
+	db     *DB
+	gormdb *GormDB
+	closed bool
+}
+
+// dbs nil if not dialed yet
+func (r *sqlReplica) dbs() (*DB, *GormDB) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.db, r.gormdb
+}
+
+// dial if not dialed yet
+func (r *sqlReplica) dial() error {
+	if db, _ := r.dbs(); db != nil {
+		return nil
+	}
+	db, gormdb, err := dial(r.info)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		db.Close()
+		gormdb.Close()
+		return errReplicaClosed
+	}
+	r.db, r.gormdb = db, gormdb
+	return nil
+}
+
+func (r *sqlReplica) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.db == nil {
+		return nil
+	}
+	err1 := r.db.Close()
+	err2 := r.gormdb.Close()
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
+
+type sqlReplicaSet struct {
+	dbName   string
+	probe    string
+	maxLag   time.Duration
+	replicas []*sqlReplica
+	done     chan struct{}
+	once     sync.Once
+}
+
+// newSqlReplicaSet replicas with the credentials of primary, they are dialed and probed in the
+// background and used once healthy, replicas failing to dial are dialed again by the next probe
+func newSqlReplicaSet(primary *Sql, config *Config) *sqlReplicaSet {
+	m := &sqlReplicaSet{
+		dbName: primary.dbName,
+		probe:  config.LagProbe,
+		maxLag: config.MaxLag,
+		done:   make(chan struct{}),
+	}
+	if m.maxLag <= 0 {
+		m.maxLag = defaultMaxLag
+	}
+
+	for _, rc := range config.Replicas {
+		info := *primary
+		info.dbAddr = rc.Addr
+		info.replicas = nil
+		weight := rc.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		m.replicas = append(m.replicas, &sqlReplica{
+			addr:   rc.Addr,
+			weight: weight,
+			info:   &info,
+		})
+	}
+
+	go m.checkLoop()
+	return m
+}
+
+// pick weighted random healthy replica, nil if none
+func (m *sqlReplicaSet) pick() *sqlReplica {
+	total := 0
+	for _, r := range m.replicas {
+		if atomic.LoadInt32(&r.healthy) == 1 {
+			total += r.weight
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	n := rand.Intn(total)
+	for _, r := range m.replicas {
+		if atomic.LoadInt32(&r.healthy) == 0 {
+			continue
+		}
+		if n < r.weight {
+			return r
+		}
+		n -= r.weight
+	}
+	return nil
+}
+
+func (m *sqlReplicaSet) checkLoop() {
+	m.check()
+	ticker := time.NewTicker(replicaProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			m.check()
+		}
+	}
+}
+
+// check eject replicas which fail to dial, are unreachable or lag behind more than maxLag
+func (m *sqlReplicaSet) check() {
+	fun := "sqlReplicaSet.check -->"
+	for _, r := range m.replicas {
+		err := r.dial()
+		if err == nil {
+			err = m.probeLag(r)
+		}
+		if err != nil {
+			if atomic.SwapInt32(&r.healthy, 0) == 1 {
+				slog.Warnf(context.TODO(), "%s db:%s replica:%s ejected, err:%s", fun, m.dbName, r.addr, err.Error())
+			}
+			continue
+		}
+		if atomic.SwapInt32(&r.healthy, 1) == 0 {
+			slog.Infof(context.TODO(), "%s db:%s replica:%s healthy", fun, m.dbName, r.addr)
+		}
+	}
+}
+
+func (m *sqlReplicaSet) probeLag(r *sqlReplica) error {
+	ctx, cancel := context.WithTimeout(context.Background(), replicaProbeTimeout)
+	defer cancel()
+
+	db, _ := r.dbs()
+	if m.probe == "" {
+		return db.PingContext(ctx)
+	}
+
+	var lag sql.NullFloat64
+	if err := db.QueryRowContext(ctx, m.probe).Scan(&lag); err != nil {
+		return err
+	}
+	// e.g. Seconds_Behind_Master is NULL when replication is stopped
+	if !lag.Valid {
+		return errReplicationStopped
+	}
+	if time.Duration(lag.Float64*float64(time.Second)) > m.maxLag {
+		return &replicaLagError{lag: lag.Float64, max: m.maxLag}
+	}
+	return nil
+}
+
+func (m *sqlReplicaSet) close() error {
+	m.once.Do(func() { close(m.done) })
+	var err error
+	for _, r := range m.replicas {
+		if e := r.close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// getReadDB return the db of reads: a healthy replica, or the primary if forced by ctx, sticky
+// after a write, or no replica is available
+func (m *Sql) getReadDB(ctx context.Context) *DB {
+	if m.replicas == nil || readFromPrimary(ctx) {
+		return m.db
+	}
+	if r := m.replicas.pick(); r != nil {
+		if db, _ := r.dbs(); db != nil {
+			return db
+		}
+	}
+	return m.db
+}
+
+func (m *Sql) getReadGormDB(ctx context.Context) *GormDB {
+	if m.replicas == nil || readFromPrimary(ctx) {
+		return m.gormdb
+	}
+	if r := m.replicas.pick(); r != nil {
+		if _, gormdb := r.dbs(); gormdb != nil {
+			return gormdb
+		}
+	}
+	return m.gormdb
+}
@@ -0,0 +1,180 @@
+package dbrouter
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+const replicaConfig = `{
+	"cluster": {"trade": [{"instance": "trade0", "match": "full", "express": "order"}]},
+	"instances": {
+		"trade0": {
+			"dbtype": "mysql",
+			"dbname": "trade",
+			"dbcfg": {
+				"addrs": ["master:3306"], "user": "u", "passwd": "p",
+				"replicas": [{"addr": "slave0:3306", "weight": 3}, {"addr": "slave1:3306"}],
+				"lagprobe": "SELECT lag FROM heartbeat", "maxlag": 1.5
+			}
+		}
+	}
+}`
+
+func TestParser_Replicas(t *testing.T) {
+	parser, err := NewParser([]byte(replicaConfig))
+	assert.NoError(t, err)
+
+	info := parser.GetConfig("trade0", DefaultGroup)
+	assert.NotNil(t, info)
+	config := newConfig(info)
+	assert.Equal(t, []ReplicaConfig{{Addr: "slave0:3306", Weight: 3}, {Addr: "slave1:3306"}}, config.Replicas)
+	assert.Equal(t, "SELECT lag FROM heartbeat", config.LagProbe)
+	assert.Equal(t, 1500*time.Millisecond, config.MaxLag)
+
+	changed := *info
+	changed.Replicas = []*replicaInfo{{Addr: "slave0:3306", Weight: 1}, {Addr: "slave1:3306"}}
+	assert.True(t, compareDbInfo(info, info))
+	assert.False(t, compareDbInfo(info, &changed))
+}
+
+func TestReadFromPrimary(t *testing.T) {
+	ctx := context.Background()
+	assert.False(t, readFromPrimary(ctx))
+	assert.True(t, readFromPrimary(WithPrimary(ctx)))
+
+	ctx = WithStickyPrimary(ctx, 50*time.Millisecond)
+	assert.False(t, readFromPrimary(ctx))
+	markWrite(ctx)
+	// a ctx derived after the write is sticky too
+	derived, cancel := context.WithCancel(ctx)
+	defer cancel()
+	assert.True(t, readFromPrimary(derived))
+
+	time.Sleep(60 * time.Millisecond)
+	assert.False(t, readFromPrimary(ctx))
+}
+
+func TestSqlReplicaSet_Pick(t *testing.T) {
+	set := &sqlReplicaSet{
+		replicas: []*sqlReplica{
+			{addr: "slave0", weight: 3, healthy: 1},
+			{addr: "slave1", weight: 1, healthy: 1},
+			{addr: "slave2", weight: 100},
+		},
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		counts[set.pick().addr]++
+	}
+	assert.Equal(t, 0, counts["slave2"])
+	assert.InDelta(t, 3000, counts["slave0"], 300)
+	assert.InDelta(t, 1000, counts["slave1"], 300)
+
+	set.replicas[0].healthy = 0
+	set.replicas[1].healthy = 0
+	assert.Nil(t, set.pick())
+}
+
+func TestSqlReplicaSet_Check(t *testing.T) {
+	newReplica := func(addr string) (*sqlReplica, sqlmock.Sqlmock) {
+		db, mock, err := sqlmock.New()
+		assert.NoError(t, err)
+		return &sqlReplica{addr: addr, weight: 1, db: NewDB(sqlx.NewDb(db, DB_TYPE_MYSQL))}, mock
+	}
+
+	r0, mock0 := newReplica("slave0")
+	r1, mock1 := newReplica("slave1")
+	r2, mock2 := newReplica("slave2")
+	set := &sqlReplicaSet{
+		dbName:   "trade",
+		probe:    "SELECT lag FROM heartbeat",
+		maxLag:   time.Second,
+		replicas: []*sqlReplica{r0, r1, r2},
+	}
+
+	mock0.ExpectQuery("SELECT lag").WillReturnRows(sqlmock.NewRows([]string{"lag"}).AddRow(0.2))
+	mock1.ExpectQuery("SELECT lag").WillReturnRows(sqlmock.NewRows([]string{"lag"}).AddRow(3))
+	mock2.ExpectQuery("SELECT lag").WillReturnRows(sqlmock.NewRows([]string{"lag"}).AddRow(nil))
+	set.check()
+	assert.Equal(t, int32(1), r0.healthy)
+	assert.Equal(t, int32(0), r1.healthy)
+	assert.Equal(t, int32(0), r2.healthy)
+	assert.Equal(t, r0, set.pick())
+
+	// caught up again
+	mock1.ExpectQuery("SELECT lag").WillReturnRows(sqlmock.NewRows([]string{"lag"}).AddRow(0))
+	err := set.probeLag(r1)
+	assert.NoError(t, err)
+	mock2.ExpectQuery("SELECT lag").WillReturnRows(sqlmock.NewRows([]string{"lag"}).AddRow(nil))
+	assert.Equal(t, errReplicationStopped, set.probeLag(r2))
+
+	for _, mock := range []sqlmock.Sqlmock{mock0, mock1, mock2} {
+		assert.NoError(t, mock.ExpectationsWereMet())
+	}
+}
+
+func TestSql_GetReadDB(t *testing.T) {
+	primary := &DB{}
+	replica := &DB{}
+	db := &Sql{db: primary}
+	ctx := context.Background()
+	assert.Equal(t, primary, db.getReadDB(ctx))
+
+	db.replicas = &sqlReplicaSet{replicas: []*sqlReplica{{addr: "slave0", weight: 1, db: replica}}}
+	// no healthy replica
+	assert.True(t, primary == db.getReadDB(ctx))
+
+	db.replicas.replicas[0].healthy = 1
+	assert.True(t, replica == db.getReadDB(ctx))
+	assert.True(t, primary == db.getReadDB(WithPrimary(ctx)))
+}
+
+func TestIsWriteSQL(t *testing.T) {
+	for _, query := range []string{"UPDATE t SET a = 1", " insert into t values (1)", "DELETE FROM t", "REPLACE INTO t VALUES (1)"} {
+		assert.True(t, isWriteSQL(query), query)
+	}
+	for _, query := range []string{"SELECT 1", "(SELECT 1) UNION (SELECT 2)", "\n\tselect * from t", "SHOW TABLES", "SET NAMES utf8mb4", ""} {
+		assert.False(t, isWriteSQL(query), query)
+	}
+}
+
+func TestStickyPrimary_Write(t *testing.T) {
+	ctx := WithStickyPrimary(context.Background(), time.Minute)
+	db, mock := newMockDB(t)
+	db = db.withTrace(newTestTrace(ctx, SlowLogConfig{Threshold: -1}))
+
+	// reads don't stick
+	mock.ExpectQuery("SELECT").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	var ids []int
+	assert.NoError(t, db.Select(&ids, "SELECT id FROM t"))
+	assert.False(t, readFromPrimary(ctx))
+
+	mock.ExpectExec("UPDATE").WillReturnResult(sqlmock.NewResult(0, 1))
+	_, err := db.Exec("UPDATE t SET state = 1")
+	assert.NoError(t, err)
+	assert.True(t, readFromPrimary(ctx))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSqlReplicaSet_Dial(t *testing.T) {
+	primary := &Sql{dbType: DB_TYPE_MYSQL, dbName: "trade", dbAddr: "master:3306", timeOut: 100 * time.Millisecond}
+	set := newSqlReplicaSet(primary, &Config{Replicas: []ReplicaConfig{{Addr: "127.0.0.1:1"}}})
+	defer set.close()
+
+	// kept unhealthy while it fails to dial, and dialed again by the probes
+	assert.Len(t, set.replicas, 1)
+	set.check()
+	db, _ := set.replicas[0].dbs()
+	assert.Nil(t, db)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&set.replicas[0].healthy))
+	assert.Nil(t, set.pick())
+	primaryDB := &DB{}
+	assert.True(t, primaryDB == (&Sql{db: primaryDB, replicas: set}).getReadDB(context.Background()))
+}
@@ -0,0 +1,315 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/shawnfeng/sutil/slog/slog"
+	"github.com/shawnfeng/sutil/stime"
+)
+
+const defaultScatterConcurrency = 8
+
+// ScatterOptions of SqlScatter, nil is 8 shards at a time on the primaries without timeout
+type ScatterOptions struct {
+	// Concurrency shards queried at the same time, 0 is 8
+	Concurrency int
+	// ShardTimeout of the query of a shard, 0 is the deadline of ctx only
+	ShardTimeout time.Duration
+	// Read query the replicas of the instances, see SqlReadExec
+	Read bool
+	// MaxRows rows kept of a shard at most, 0 keeps all. A merge of limit n sorted by the query
+	// needs n rows of every shard only, set it with a LIMIT in the query as well, so that the
+	// shards stop early instead of sending the rows dropped here
+	MaxRows int
+}
+
+func (m *ScatterOptions) concurrency() int {
+	if m == nil || m.Concurrency <= 0 {
+		return defaultScatterConcurrency
+	}
+	return m.Concurrency
+}
+
+func (m *ScatterOptions) shardTimeout() time.Duration {
+	if m == nil {
+		return 0
+	}
+	return m.ShardTimeout
+}
+
+func (m *ScatterOptions) read() bool {
+	return m != nil && m.Read
+}
+
+func (m *ScatterOptions) maxRows() int {
+	if m == nil || m.MaxRows <= 0 {
+		return 0
+	}
+	return m.MaxRows
+}
+
+// ScatterRow column -> value of a row, []byte values are converted to string
+type ScatterRow map[string]interface{}
+
+// ShardResult rows of a shard, or the error of it
+type ShardResult struct {
+	Instance string
+	Table    string
+	Rows     []ScatterRow
+	Err      error
+
+	// index of the table in the tables of the scatter
+	index int
+}
+
+// ScatterError shards failed of a scatter query
+type ScatterError struct {
+	Shards []*ShardResult
+}
+
+func (e *ScatterError) Error() string {
+	msgs := make([]string, 0, len(e.Shards))
+	for _, s := range e.Shards {
+		msgs = append(msgs, fmt.Sprintf("table:%s instance:%s err:%s", s.Table, s.Instance, s.Err.Error()))
+	}
+	return fmt.Sprintf("%d shards failed: %s", len(e.Shards), strings.Join(msgs, "; "))
+}
+
+// SqlScatter 在cluster中物理表名匹配tablePattern(path.Match的通配符，如 order_*)的所有表上执行query，
+// query中的表名写作{{table}}，见expandTables。Concurrency个worker依次取分表执行，每个分表的结果或错误在
+// 完成时写入返回的channel，全部完成后channel关闭，channel有足够的缓冲，不读取也不会阻塞分表的查询。
+// 每个分表的结果全部读入内存，内存占用为所有分表的行数之和，大表请在query中加LIMIT并设置MaxRows。
+// 分表来自路由配置中的full和hash/range分表，regex配置的表无法枚举，不会被查询
+func (m *Router) SqlScatter(ctx context.Context, cluster, tablePattern, query string, opts *ScatterOptions, args ...interface{}) (<-chan *ShardResult, error) {
+	if _, err := path.Match(tablePattern, ""); err != nil {
+		return nil, fmt.Errorf("table pattern:%s err:%s", tablePattern, err.Error())
+	}
+	tc, ok := m.configer.(TableConfiger)
+	if !ok {
+		return nil, fmt.Errorf("configer %T doesn't list tables", m.configer)
+	}
+
+	var tables []PhysicalTable
+	for _, t := range tc.GetTables(ctx, cluster) {
+		if ok, _ := path.Match(tablePattern, t.Table); ok {
+			tables = append(tables, t)
+		}
+	}
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("no table of cluster:%s matches %s", cluster, tablePattern)
+	}
+
+	jobs := make(chan int, len(tables))
+	for i := range tables {
+		jobs <- i
+	}
+	close(jobs)
+
+	workers := opts.concurrency()
+	if workers > len(tables) {
+		workers = len(tables)
+	}
+	results := make(chan *ShardResult, len(tables))
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				t := tables[index]
+				result := &ShardResult{Instance: t.Instance, Table: t.Table, index: index}
+				if err := ctx.Err(); err != nil {
+					result.Err = err
+				} else {
+					result.Rows, result.Err = m.scatterShard(ctx, cluster, t, query, opts, args)
+				}
+				results <- result
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results, nil
+}
+
+func (m *Router) scatterShard(ctx context.Context, cluster string, t PhysicalTable, query string, opts *ScatterOptions, args []interface{}) (rows []ScatterRow, err error) {
+	fun := "Router.SqlScatter -->"
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, "dbrouter.SqlScatter")
+	defer span.Finish()
+
+	span.LogFields(
+		log.String(spanLogKeyCluster, cluster),
+		log.String(spanLogKeyTable, t.Table))
+
+	if timeout := opts.shardTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	st := stime.NewTimeStat()
+
+	// check breaker
+	if !m.breakers.entry(cluster, t.Table) {
+		slog.Errorf(ctx, "%s breaker is open, cluster: %s, table: %s", fun, cluster, t.Table)
+		return nil, ErrBreakerOpen
+	}
+
+	db, err := m.sqlPrepareInstance(ctx, cluster, t.Table, t.Instance, opts.read())
+	if err != nil {
+		return nil, err
+	}
+	db = db.withTrace(m.newTrace(ctx, cluster, t.Table))
+
+	defer func() {
+		dur := st.Duration()
+		m.statQuery("SqlScatter", cluster, t.Table, dur, err)
+		slog.Tracef(ctx, "%s cls:%s table:%s rows:%d dur:%d", fun, cluster, t.Table, len(rows), dur)
+	}()
+
+	rows, err = scanShard(ctx, db, t.Table, query, args, opts.maxRows())
+	statReqErr(cluster, t.Table, err)
+	// record breaker
+	m.breakers.stat(cluster, t.Table, err, st.Duration())
+	return rows, err
+}
+
+// scanShard maxRows >0 stop scanning after maxRows rows
+func scanShard(ctx context.Context, db *DB, table, query string, args []interface{}, maxRows int) ([]ScatterRow, error) {
+	rows, err := db.QueryxTemplate(ctx, []interface{}{table}, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []ScatterRow
+	for (maxRows <= 0 || len(result) < maxRows) && rows.Next() {
+		row := make(map[string]interface{})
+		if err := rows.MapScan(row); err != nil {
+			return nil, err
+		}
+		for k, v := range row {
+			if b, ok := v.([]byte); ok {
+				row[k] = string(b)
+			}
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// MergeRows wait for all shards of results and merge their rows by less, the rows of every shard
+// must be sorted by less, e.g. by the ORDER BY of the query, rows equal by less are in the order
+// of the tables. less nil concatenate the rows in the order of the tables. limit >0 keep the
+// first limit rows only, the rows of all shards are held until then, see ScatterOptions.MaxRows.
+// The rows of shards succeeded are returned along with a *ScatterError of the shards failed, if any.
+func MergeRows(results <-chan *ShardResult, less func(a, b ScatterRow) bool, limit int) ([]ScatterRow, error) {
+	var shards, failed []*ShardResult
+	for r := range results {
+		if r.Err != nil {
+			failed = append(failed, r)
+			continue
+		}
+		shards = append(shards, r)
+	}
+	sort.Slice(shards, func(i, j int) bool { return shards[i].index < shards[j].index })
+	sort.Slice(failed, func(i, j int) bool { return failed[i].index < failed[j].index })
+
+	var rows []ScatterRow
+	if less == nil {
+		for _, s := range shards {
+			rows = append(rows, s.Rows...)
+		}
+		if limit > 0 && len(rows) > limit {
+			rows = rows[:limit]
+		}
+	} else {
+		rows = mergeSorted(shards, less, limit)
+	}
+
+	if len(failed) > 0 {
+		return rows, &ScatterError{Shards: failed}
+	}
+	return rows, nil
+}
+
+type rowCursor struct {
+	rows  []ScatterRow
+	pos   int
+	index int
+}
+
+// rowHeap the cursor of the least head row on top
+type rowHeap struct {
+	cursors []*rowCursor
+	less    func(a, b ScatterRow) bool
+}
+
+func (h *rowHeap) Len() int { return len(h.cursors) }
+
+func (h *rowHeap) Less(i, j int) bool {
+	a, b := h.cursors[i], h.cursors[j]
+	ra, rb := a.rows[a.pos], b.rows[b.pos]
+	if h.less(ra, rb) {
+		return true
+	}
+	if h.less(rb, ra) {
+		return false
+	}
+	return a.index < b.index
+}
+
+func (h *rowHeap) Swap(i, j int) { h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i] }
+
+func (h *rowHeap) Push(x interface{}) { h.cursors = append(h.cursors, x.(*rowCursor)) }
+
+func (h *rowHeap) Pop() interface{} {
+	n := len(h.cursors)
+	c := h.cursors[n-1]
+	h.cursors = h.cursors[:n-1]
+	return c
+}
+
+func mergeSorted(shards []*ShardResult, less func(a, b ScatterRow) bool, limit int) []ScatterRow {
+	h := &rowHeap{less: less}
+	total := 0
+	for _, s := range shards {
+		if len(s.Rows) > 0 {
+			h.cursors = append(h.cursors, &rowCursor{rows: s.Rows, index: s.index})
+			total += len(s.Rows)
+		}
+	}
+	if limit > 0 && limit < total {
+		total = limit
+	}
+	heap.Init(h)
+
+	rows := make([]ScatterRow, 0, total)
+	for h.Len() > 0 && len(rows) < total {
+		c := h.cursors[0]
+		rows = append(rows, c.rows[c.pos])
+		c.pos++
+		if c.pos == len(c.rows) {
+			heap.Pop(h)
+		} else {
+			heap.Fix(h, 0)
+		}
+	}
+	return rows
+}
@@ -0,0 +1,173 @@
+package dbrouter
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/shawnfeng/sutil/stat"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParser_GetTables(t *testing.T) {
+	parser, err := NewParser([]byte(shardConfig))
+	assert.NoError(t, err)
+
+	tables := parser.GetTables("trade")
+	assert.Len(t, tables, 2+64+8+1)
+	assert.Equal(t, PhysicalTable{Instance: "trade0", Table: "bill_0"}, tables[0])
+	assert.Equal(t, PhysicalTable{Instance: "trade1", Table: "bill_1"}, tables[1])
+	assert.Equal(t, PhysicalTable{Instance: "trade0", Table: "order_00"}, tables[2])
+	assert.Equal(t, PhysicalTable{Instance: "trade1", Table: "order_63"}, tables[65])
+	assert.Equal(t, PhysicalTable{Instance: "trade0", Table: "refund_7"}, tables[73])
+	assert.Equal(t, PhysicalTable{Instance: "trade0", Table: "config"}, tables[74])
+
+	assert.Nil(t, parser.GetTables("unknown"))
+}
+
+func shardResults(results ...*ShardResult) <-chan *ShardResult {
+	ch := make(chan *ShardResult, len(results))
+	for i, r := range results {
+		r.index = i
+		ch <- r
+	}
+	close(ch)
+	return ch
+}
+
+func rowIDs(rows []ScatterRow) []int {
+	var ids []int
+	for _, row := range rows {
+		ids = append(ids, row["id"].(int))
+	}
+	return ids
+}
+
+func TestMergeRows(t *testing.T) {
+	newResults := func() <-chan *ShardResult {
+		return shardResults(
+			&ShardResult{Table: "order_0", Rows: []ScatterRow{{"id": 1}, {"id": 4, "table": 0}, {"id": 9}}},
+			&ShardResult{Table: "order_1", Err: errors.New("timeout")},
+			&ShardResult{Table: "order_2", Rows: []ScatterRow{{"id": 2}, {"id": 4, "table": 2}, {"id": 5}}},
+			&ShardResult{Table: "order_3"},
+		)
+	}
+	less := func(a, b ScatterRow) bool { return a["id"].(int) < b["id"].(int) }
+
+	rows, err := MergeRows(newResults(), less, 0)
+	assert.Equal(t, []int{1, 2, 4, 4, 5, 9}, rowIDs(rows))
+	// equal rows are in the order of the tables
+	assert.Equal(t, 0, rows[2]["table"])
+	assert.Equal(t, 2, rows[3]["table"])
+	scatterErr, ok := err.(*ScatterError)
+	assert.True(t, ok)
+	assert.Len(t, scatterErr.Shards, 1)
+	assert.Equal(t, "order_1", scatterErr.Shards[0].Table)
+	assert.Contains(t, err.Error(), "timeout")
+
+	rows, _ = MergeRows(newResults(), less, 4)
+	assert.Equal(t, []int{1, 2, 4, 4}, rowIDs(rows))
+
+	rows, _ = MergeRows(newResults(), nil, 5)
+	assert.Equal(t, []int{1, 4, 9, 2, 4}, rowIDs(rows))
+
+	rows, err = MergeRows(shardResults(&ShardResult{Table: "order_0", Rows: []ScatterRow{{"id": 1}}}), less, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1}, rowIDs(rows))
+}
+
+const scatterConfig = `{
+	"cluster": {
+		"trade": [
+			{"instance": "trade0", "match": "hash", "express": "order", "shards": 4, "slots": "0-1"},
+			{"instance": "trade1", "match": "hash", "express": "order", "shards": 4, "slots": "2-3"},
+			{"instance": "trade0", "match": "full", "express": "config"}
+		]
+	}
+}`
+
+func TestRouter_SqlScatter(t *testing.T) {
+	configer, err := NewSimpleConfiger([]byte(scatterConfig))
+	assert.NoError(t, err)
+
+	instances := &InstanceManager{instances: make(map[string]Instancer)}
+	mocks := make(map[string]sqlmock.Sqlmock)
+	for _, name := range []string{"trade0", "trade1"} {
+		sqldb, mock, err := sqlmock.New()
+		assert.NoError(t, err)
+		mock.MatchExpectationsInOrder(false)
+		mocks[name] = mock
+		instances.instances[instances.buildKey(name, DefaultGroup)] = &Sql{
+			instance: name,
+			dbType:   DB_TYPE_MYSQL,
+			db:       NewDB(sqlx.NewDb(sqldb, DB_TYPE_MYSQL)),
+		}
+	}
+	router := &Router{
+		configer:  configer,
+		instances: instances,
+		report:    stat.NewStat(),
+		breakers:  newBreakerManager(func(string) BreakerConfig { return BreakerConfig{} }),
+		slowlog:   newSlowLogManager(func(string) SlowLogConfig { return SlowLogConfig{Threshold: -1} }),
+	}
+
+	query := "SELECT id, state FROM {{table}} WHERE state = ? ORDER BY id LIMIT 2"
+	expect := func(instance, table string) *sqlmock.ExpectedQuery {
+		return mocks[instance].ExpectQuery(regexp.QuoteMeta("FROM `" + table + "`")).WithArgs(1)
+	}
+	newRows := func(ids ...int64) *sqlmock.Rows {
+		rows := sqlmock.NewRows([]string{"id", "state"})
+		for _, id := range ids {
+			rows.AddRow(id, []byte("paid"))
+		}
+		return rows
+	}
+	expect("trade0", "order_0").WillReturnRows(newRows(4, 8))
+	expect("trade0", "order_1").WillReturnRows(newRows(1, 5))
+	expect("trade1", "order_2").WillReturnError(errors.New("too many connections"))
+	expect("trade1", "order_3").WillReturnRows(newRows(3))
+
+	results, err := router.SqlScatter(context.Background(), "trade", "order_*", query, &ScatterOptions{Concurrency: 2, ShardTimeout: time.Second}, 1)
+	assert.NoError(t, err)
+	rows, err := MergeRows(results, func(a, b ScatterRow) bool { return a["id"].(int64) < b["id"].(int64) }, 3)
+	assert.Len(t, rows, 3)
+	assert.Equal(t, ScatterRow{"id": int64(1), "state": "paid"}, rows[0])
+	assert.Equal(t, int64(3), rows[1]["id"])
+	assert.Equal(t, int64(4), rows[2]["id"])
+	assert.Error(t, err)
+	assert.Equal(t, "order_2", err.(*ScatterError).Shards[0].Table)
+	for _, mock := range mocks {
+		assert.NoError(t, mock.ExpectationsWereMet())
+	}
+
+	_, err = router.SqlScatter(context.Background(), "trade", "refund_*", query, nil, 1)
+	assert.Error(t, err)
+	_, err = router.SqlScatter(context.Background(), "trade", "order_[", query, nil, 1)
+	assert.Error(t, err)
+	_, err = (&Router{configer: plainConfiger{configer}}).SqlScatter(context.Background(), "trade", "order_*", query, nil, 1)
+	assert.Error(t, err)
+
+	// MaxRows rows of a shard at most
+	expect("trade0", "order_0").WillReturnRows(newRows(4, 8))
+	results, err = router.SqlScatter(context.Background(), "trade", "order_0", query, &ScatterOptions{MaxRows: 1}, 1)
+	assert.NoError(t, err)
+	rows, err = MergeRows(results, nil, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []ScatterRow{{"id": int64(4), "state": "paid"}}, rows)
+
+	// shards not started are failed once ctx is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, err = router.SqlScatter(ctx, "trade", "*", query, &ScatterOptions{Concurrency: 1}, 1)
+	assert.NoError(t, err)
+	n := 0
+	for r := range results {
+		n++
+		assert.Error(t, r.Err)
+	}
+	assert.Equal(t, 5, n)
+}
@@ -0,0 +1,388 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/shawnfeng/sutil/shash"
+)
+
+const (
+	MATCH_FULL  = "full"
+	MATCH_REGEX = "regex"
+	// express是逻辑表名，按shard key取模或一致性hash到 0..shards-1
+	MATCH_HASH = "hash"
+	// express是逻辑表名，按shard key所在区间路由
+	MATCH_RANGE = "range"
+
+	SHARD_HASH_MOD        = "mod"
+	SHARD_HASH_CONSISTENT = "consistent"
+)
+
+// shardRange [Min, Max) of shard keys in the physical table of Index
+type shardRange struct {
+	Min   int64 `json:"min"`
+	Max   int64 `json:"max"`
+	Index int   `json:"index"`
+}
+
+type rangeLookup struct {
+	*shardRange
+	lookup *dbLookupCfg
+}
+
+// shardTable lookup of a logical table merged from all hash or range entries of it
+type shardTable struct {
+	match string
+	// physical table name format of shard index
+	table string
+
+	// hash
+	shards int
+	hash   string
+	ring   *shash.Ring
+	slots  []*dbLookupCfg
+
+	// range, sorted by Min
+	ranges []*rangeLookup
+}
+
+func (m *dbLookupCfg) physicalFormat() string {
+	if m.Table != "" {
+		return m.Table
+	}
+	return m.Express + "_%d"
+}
+
+func newShardTable(lcfg *dbLookupCfg) (*shardTable, error) {
+	t := &shardTable{
+		match: lcfg.Match,
+		table: lcfg.physicalFormat(),
+	}
+	if strings.Count(t.table, "%") != 1 {
+		return nil, fmt.Errorf("table format:%s must have one verb of shard index", t.table)
+	}
+
+	if t.match == MATCH_HASH {
+		if lcfg.Shards <= 0 {
+			return nil, fmt.Errorf("hash shards:%d of express:%s invalid", lcfg.Shards, lcfg.Express)
+		}
+		t.shards = lcfg.Shards
+		t.hash = lcfg.Hash
+		if t.hash == "" {
+			t.hash = SHARD_HASH_MOD
+		}
+		switch t.hash {
+		case SHARD_HASH_MOD:
+		case SHARD_HASH_CONSISTENT:
+			t.ring = shash.NewRing(shash.Options{})
+			for i := 0; i < t.shards; i++ {
+				t.ring.Add(strconv.Itoa(i), 1)
+			}
+		default:
+			return nil, fmt.Errorf("shard hash:%s not support", t.hash)
+		}
+		t.slots = make([]*dbLookupCfg, t.shards)
+	}
+	return t, nil
+}
+
+func (m *shardTable) add(lcfg *dbLookupCfg) error {
+	if lcfg.Match != m.match || lcfg.physicalFormat() != m.table {
+		return fmt.Errorf("express:%s match:%s table:%s differ from other entries", lcfg.Express, lcfg.Match, lcfg.physicalFormat())
+	}
+
+	if m.match == MATCH_RANGE {
+		if len(lcfg.Ranges) == 0 {
+			return fmt.Errorf("empty ranges of express:%s instance:%s", lcfg.Express, lcfg.Instance)
+		}
+		for _, r := range lcfg.Ranges {
+			if r.Min >= r.Max {
+				return fmt.Errorf("range [%d, %d) of express:%s invalid", r.Min, r.Max, lcfg.Express)
+			}
+			// a physical table is in one instance
+			for _, other := range m.ranges {
+				if other.Index == r.Index && other.lookup.Instance != lcfg.Instance {
+					return fmt.Errorf("dup range index:%d of express:%s in instance:%s and %s", r.Index, lcfg.Express, other.lookup.Instance, lcfg.Instance)
+				}
+			}
+			m.ranges = append(m.ranges, &rangeLookup{shardRange: r, lookup: lcfg})
+		}
+		sort.Slice(m.ranges, func(i, j int) bool { return m.ranges[i].Min < m.ranges[j].Min })
+		for i := 1; i < len(m.ranges); i++ {
+			if m.ranges[i].Min < m.ranges[i-1].Max {
+				return fmt.Errorf("range [%d, %d) overlap [%d, %d) of express:%s", m.ranges[i].Min, m.ranges[i].Max,
+					m.ranges[i-1].Min, m.ranges[i-1].Max, lcfg.Express)
+			}
+		}
+		return nil
+	}
+
+	hash := lcfg.Hash
+	if hash == "" {
+		hash = SHARD_HASH_MOD
+	}
+	if lcfg.Shards != m.shards || hash != m.hash {
+		return fmt.Errorf("express:%s shards:%d hash:%s differ from other entries", lcfg.Express, lcfg.Shards, hash)
+	}
+	slots, err := parseSlots(lcfg.Slots, m.shards)
+	if err != nil {
+		return fmt.Errorf("slots of express:%s instance:%s err:%s", lcfg.Express, lcfg.Instance, err)
+	}
+	for _, slot := range slots {
+		if m.slots[slot] != nil {
+			return fmt.Errorf("dup slot:%d of express:%s in instance:%s and %s", slot, lcfg.Express, m.slots[slot].Instance, lcfg.Instance)
+		}
+		m.slots[slot] = lcfg
+	}
+	return nil
+}
+
+// check every hash slot has an instance
+func (m *shardTable) check(express string) error {
+	for i, lk := range m.slots {
+		if lk == nil {
+			return fmt.Errorf("slot:%d of express:%s has no instance", i, express)
+		}
+	}
+	return nil
+}
+
+func (m *shardTable) lookup(key interface{}) (*dbLookupCfg, string, error) {
+	var index int
+	var lk *dbLookupCfg
+
+	if m.match == MATCH_RANGE {
+		n, ok := shardKeyInt(key)
+		if !ok {
+			if _, ok := shardKeyUint(key); ok {
+				return nil, "", fmt.Errorf("shard key:%v out of ranges", key)
+			}
+			return nil, "", fmt.Errorf("range shard key:%v must be an integer", key)
+		}
+		i := sort.Search(len(m.ranges), func(i int) bool { return m.ranges[i].Max > n })
+		if i == len(m.ranges) || m.ranges[i].Min > n {
+			return nil, "", fmt.Errorf("shard key:%d out of ranges", n)
+		}
+		index, lk = m.ranges[i].Index, m.ranges[i].lookup
+
+	} else {
+		if m.ring != nil {
+			index, _ = strconv.Atoi(m.ring.Get(fmt.Sprint(key)))
+		} else if u, ok := shardKeyUint(key); ok {
+			index = int(u % uint64(m.shards))
+		} else if n, ok := shardKeyInt(key); ok {
+			index = int(((n % int64(m.shards)) + int64(m.shards)) % int64(m.shards))
+		} else if s, ok := key.(string); ok {
+			h := fnv.New32a()
+			h.Write([]byte(s))
+			index = int(h.Sum32() % uint32(m.shards))
+		} else {
+			return nil, "", fmt.Errorf("shard key:%v of type %T not support", key, key)
+		}
+		lk = m.slots[index]
+	}
+
+	return lk, fmt.Sprintf(m.table, index), nil
+}
+
+// parseSlots "0-31,40" -> [0..31, 40], empty means all shards
+func parseSlots(s string, shards int) ([]int, error) {
+	var slots []int
+	if strings.TrimSpace(s) == "" {
+		for i := 0; i < shards; i++ {
+			slots = append(slots, i)
+		}
+		return slots, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		from, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+		if from < 0 || to >= shards || from > to {
+			return nil, fmt.Errorf("slots %s out of [0, %d)", part, shards)
+		}
+		for i := from; i <= to; i++ {
+			slots = append(slots, i)
+		}
+	}
+	return slots, nil
+}
+
+// shardKeyInt integer keys, unsigned keys above MaxInt64 are not
+func shardKeyInt(key interface{}) (int64, bool) {
+	switch t := key.(type) {
+	case int:
+		return int64(t), true
+	case int8:
+		return int64(t), true
+	case int16:
+		return int64(t), true
+	case int32:
+		return int64(t), true
+	case int64:
+		return t, true
+	}
+	if u, ok := shardKeyUint(key); ok && u <= math.MaxInt64 {
+		return int64(u), true
+	}
+	return 0, false
+}
+
+func shardKeyUint(key interface{}) (uint64, bool) {
+	switch t := key.(type) {
+	case uint:
+		return uint64(t), true
+	case uint8:
+		return uint64(t), true
+	case uint16:
+		return uint64(t), true
+	case uint32:
+		return uint64(t), true
+	case uint64:
+		return t, true
+	default:
+		return 0, false
+	}
+}
+
+func (m *dbCluster) addShard(cluster string, lcfg *dbLookupCfg) error {
+	entry := m.clusters[cluster]
+	if t, ok := entry.shard[lcfg.Express]; ok {
+		return t.add(lcfg)
+	}
+
+	t, err := newShardTable(lcfg)
+	if err != nil {
+		return err
+	}
+	if err = t.add(lcfg); err != nil {
+		return err
+	}
+	entry.shard[lcfg.Express] = t
+	return nil
+}
+
+func (m *dbCluster) check() error {
+	for cluster, entry := range m.clusters {
+		for express, t := range entry.shard {
+			if err := t.check(express); err != nil {
+				return fmt.Errorf("cluster:%s %s", cluster, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// getShard instance and physical table of shardKey in the logical table, tables not sharded
+// are looked up by full and regex match, and are their own physical table
+func (m *dbCluster) getShard(cluster, table string, shardKey interface{}) (instance, physical string, err error) {
+	exp := m.clusters[cluster]
+	if exp == nil {
+		return "", "", fmt.Errorf("cluster:%s not found", cluster)
+	}
+
+	t := exp.shard[table]
+	if t == nil {
+		if instance = m.getInstance(cluster, table); instance == "" {
+			return "", "", fmt.Errorf("table:%s not found in cluster:%s", table, cluster)
+		}
+		return instance, table, nil
+	}
+
+	lk, physical, err := t.lookup(shardKey)
+	if err != nil {
+		return "", "", fmt.Errorf("cluster:%s table:%s err:%s", cluster, table, err.Error())
+	}
+	return lk.Instance, physical, nil
+}
+
+// PhysicalTable a physical table and the instance of it
+type PhysicalTable struct {
+	Instance string
+	Table    string
+}
+
+// tables physical tables in shard index order
+func (m *shardTable) tables() []PhysicalTable {
+	var tables []PhysicalTable
+	if m.match == MATCH_RANGE {
+		seen := make(map[int]bool)
+		var indexes []int
+		instances := make(map[int]string)
+		for _, r := range m.ranges {
+			// ranges of an index are in one instance, see add
+			if !seen[r.Index] {
+				seen[r.Index] = true
+				indexes = append(indexes, r.Index)
+				instances[r.Index] = r.lookup.Instance
+			}
+		}
+		sort.Ints(indexes)
+		for _, index := range indexes {
+			tables = append(tables, PhysicalTable{Instance: instances[index], Table: fmt.Sprintf(m.table, index)})
+		}
+		return tables
+	}
+
+	for index, lk := range m.slots {
+		tables = append(tables, PhysicalTable{Instance: lk.Instance, Table: fmt.Sprintf(m.table, index)})
+	}
+	return tables
+}
+
+// getTables physical tables of shard entries by logical table, then of full entries by name.
+// Tables of regex entries are not known and not included.
+func (m *dbCluster) getTables(cluster string) []PhysicalTable {
+	exp := m.clusters[cluster]
+	if exp == nil {
+		return nil
+	}
+
+	var tables []PhysicalTable
+	seen := make(map[string]bool)
+	add := func(t PhysicalTable) {
+		if !seen[t.Table] {
+			seen[t.Table] = true
+			tables = append(tables, t)
+		}
+	}
+
+	var names []string
+	for name := range exp.shard {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, t := range exp.shard[name].tables() {
+			add(t)
+		}
+	}
+
+	names = names[:0]
+	for name := range exp.full {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(PhysicalTable{Instance: exp.full[name].lookup.Instance, Table: name})
+	}
+	return tables
+}
@@ -0,0 +1,119 @@
+package dbrouter
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const shardConfig = `{
+	"cluster": {
+		"trade": [
+			{"instance": "trade0", "match": "hash", "express": "order", "table": "order_%02d", "shards": 64, "slots": "0-31"},
+			{"instance": "trade1", "match": "hash", "express": "order", "table": "order_%02d", "shards": 64, "slots": "32-63"},
+			{"instance": "trade0", "match": "hash", "express": "refund", "shards": 8, "hash": "consistent"},
+			{"instance": "trade0", "match": "range", "express": "bill", "ranges": [{"min": 0, "max": 1000, "index": 0}]},
+			{"instance": "trade1", "match": "range", "express": "bill", "ranges": [{"min": 1000, "max": 2000, "index": 1}]},
+			{"instance": "trade0", "match": "full", "express": "config"}
+		]
+	}
+}`
+
+func TestParser_GetShard(t *testing.T) {
+	parser, err := NewParser([]byte(shardConfig))
+	assert.NoError(t, err)
+
+	instance, table, err := parser.GetShard("trade", "order", 130)
+	assert.NoError(t, err)
+	assert.Equal(t, "trade0", instance)
+	assert.Equal(t, "order_02", table)
+
+	instance, table, err = parser.GetShard("trade", "order", int64(40))
+	assert.NoError(t, err)
+	assert.Equal(t, "trade1", instance)
+	assert.Equal(t, "order_40", table)
+
+	// unsigned keys above MaxInt64 don't wrap, MaxUint64 % 64 is 63
+	instance, table, err = parser.GetShard("trade", "order", uint64(math.MaxUint64))
+	assert.NoError(t, err)
+	assert.Equal(t, "trade1", instance)
+	assert.Equal(t, "order_63", table)
+
+	instance, table, err = parser.GetShard("trade", "order", "user")
+	assert.NoError(t, err)
+	assert.Contains(t, table, "order_")
+
+	// the same key always goes to the same shard
+	_, table, err = parser.GetShard("trade", "refund", 12345)
+	assert.NoError(t, err)
+	_, again, _ := parser.GetShard("trade", "refund", 12345)
+	assert.Equal(t, table, again)
+	assert.Contains(t, table, "refund_")
+
+	instance, table, err = parser.GetShard("trade", "bill", 1500)
+	assert.NoError(t, err)
+	assert.Equal(t, "trade1", instance)
+	assert.Equal(t, "bill_1", table)
+	_, _, err = parser.GetShard("trade", "bill", 2000)
+	assert.Error(t, err)
+	_, _, err = parser.GetShard("trade", "bill", "abc")
+	assert.Error(t, err)
+	_, _, err = parser.GetShard("trade", "bill", uint64(math.MaxUint64))
+	assert.Error(t, err)
+	instance, table, err = parser.GetShard("trade", "bill", uint64(1500))
+	assert.NoError(t, err)
+	assert.Equal(t, "bill_1", table)
+
+	// not sharded
+	instance, table, err = parser.GetShard("trade", "config", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "trade0", instance)
+	assert.Equal(t, "config", table)
+	_, _, err = parser.GetShard("trade", "unknown", 1)
+	assert.Error(t, err)
+	_, _, err = parser.GetShard("unknown", "order", 1)
+	assert.Error(t, err)
+}
+
+func TestParser_ShardConfigErr(t *testing.T) {
+	for _, lookups := range []string{
+		// slot 63 has no instance
+		`{"instance": "a", "match": "hash", "express": "order", "shards": 64, "slots": "0-62"}`,
+		// dup slot
+		`{"instance": "a", "match": "hash", "express": "order", "shards": 4},
+		 {"instance": "b", "match": "hash", "express": "order", "shards": 4, "slots": "3"}`,
+		// shards differ
+		`{"instance": "a", "match": "hash", "express": "order", "shards": 4, "slots": "0-1"},
+		 {"instance": "b", "match": "hash", "express": "order", "shards": 8, "slots": "2-3"}`,
+		// overlapping ranges
+		`{"instance": "a", "match": "range", "express": "bill", "ranges": [{"min": 0, "max": 100}]},
+		 {"instance": "b", "match": "range", "express": "bill", "ranges": [{"min": 50, "max": 200, "index": 1}]}`,
+		// index 1 in two instances
+		`{"instance": "a", "match": "range", "express": "bill", "ranges": [{"min": 0, "max": 100, "index": 1}]},
+		 {"instance": "b", "match": "range", "express": "bill", "ranges": [{"min": 100, "max": 200, "index": 1}]}`,
+		`{"instance": "a", "match": "hash", "express": "order", "shards": 4, "hash": "crc"}`,
+		`{"instance": "a", "match": "hash", "express": "order", "shards": 4, "table": "order"}`,
+	} {
+		_, err := NewParser([]byte(`{"cluster": {"trade": [` + lookups + `]}}`))
+		assert.Error(t, err, lookups)
+	}
+}
+
+// plainConfiger a Configer of the required methods only
+type plainConfiger struct {
+	Configer
+}
+
+func TestRouter_SqlExecByKey_Configer(t *testing.T) {
+	configer, err := NewSimpleConfiger([]byte(shardConfig))
+	assert.NoError(t, err)
+	_, ok := configer.(ShardConfiger)
+	assert.True(t, ok)
+
+	router := &Router{configer: plainConfiger{configer}}
+	err = router.SqlExecByKey(context.Background(), "trade", "order", 1, func(*DB, string) error { return nil })
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "doesn't support shard tables")
+}
@@ -6,39 +6,65 @@ package dbrouter
 
 import (
 	"context"
-	//	"database/sql"
+	"database/sql"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	_ "github.com/lib/pq"
 	"github.com/shawnfeng/sutil/slog/slog"
+	"net/url"
 	"time"
 )
 
+const (
+	defaultMaxOpenConns    = 128
+	defaultConnMaxLifetime = 6 * time.Hour
+	defaultReadTimeout     = 5 * time.Second
+	defaultWriteTimeout    = 5 * time.Second
+)
+
 type Sql struct {
+	// instance and group of the config, labels of metrics
+	instance string
+	group    string
 	dbType   string
 	dbName   string
 	dbAddr   string
 	timeOut  time.Duration
 	userName string
 	passWord string
+	conn     ConnConfig
 	db       *DB
 	gormdb   *GormDB
+	// nil if the instance has no replica
+	replicas *sqlReplicaSet
 }
 
 func NewSql(dbtype, dbname, addr, userName, passWord string, timeout time.Duration) (*Sql, error) {
+	return newSql(&Config{
+		DBType:   dbtype,
+		DBName:   dbname,
+		UserName: userName,
+		PassWord: passWord,
+		TimeOut:  timeout,
+	}, addr)
+}
+
+func newSql(config *Config, addr string) (*Sql, error) {
 	fun := "NewSql-->"
 
+	timeout := config.TimeOut
 	if timeout == 0 {
 		timeout = 3 * time.Second
 	}
 
 	info := &Sql{
-		dbType:   dbtype,
-		dbName:   dbname,
+		dbType:   config.DBType,
+		dbName:   config.DBName,
 		dbAddr:   addr,
 		timeOut:  timeout,
-		userName: userName,
-		passWord: passWord,
+		userName: config.UserName,
+		passWord: config.PassWord,
+		conn:     config.ConnConfig,
 	}
 
 	var err error
@@ -62,6 +88,7 @@ func dial(info *Sql) (*DB, *GormDB, error) {
 	gormdb, err := dialByGorm(info)
 	if err != nil {
 		slog.Errorf(context.TODO(), "%s info:%v, dialByGorm err:%s", fun, *info, err.Error())
+		sqlxdb.Close()
 		return nil, nil, err
 	}
 
@@ -81,6 +108,12 @@ func (m *Sql) GetType() string {
 }
 
 func (m *Sql) Close() error {
+	m.deletePool()
+	if m.replicas != nil {
+		if err := m.replicas.close(); err != nil {
+			slog.Warnf(context.TODO(), "Sql.Close --> close replicas of db:%s err:%s", m.dbName, err.Error())
+		}
+	}
 	err1 := m.db.Close()
 	err2 := m.gormdb.Close()
 
@@ -90,3 +123,106 @@ func (m *Sql) Close() error {
 
 	return nil
 }
+
+func (m *Sql) statPool() {
+	statPool(m, m.instance, m.group, m.dbAddr, "sqlx", m.db.Stats())
+	statPool(m, m.instance, m.group, m.dbAddr, "gorm", m.gormdb.DB.DB().Stats())
+	if m.replicas == nil {
+		return
+	}
+	for _, r := range m.replicas.replicas {
+		db, gormdb := r.dbs()
+		if db == nil {
+			continue
+		}
+		statPool(m, m.instance, m.group, r.addr, "sqlx", db.Stats())
+		statPool(m, m.instance, m.group, r.addr, "gorm", gormdb.DB.DB().Stats())
+	}
+}
+
+// deletePool delete the pool stats of the primary and replicas, see statPool
+func (m *Sql) deletePool() {
+	addrs := []string{m.dbAddr}
+	if m.replicas != nil {
+		for _, r := range m.replicas.replicas {
+			addrs = append(addrs, r.addr)
+		}
+	}
+	for _, addr := range addrs {
+		deletePool(m, m.instance, m.group, addr, "sqlx")
+		deletePool(m, m.instance, m.group, addr, "gorm")
+	}
+}
+
+// dataSourceName parseTime: mysql time columns scanned into time.Time in local time, as gorm
+// expects; params of the instance override the defaults
+func dataSourceName(info *Sql, parseTime bool) string {
+	params := url.Values{}
+	readTimeout, writeTimeout := info.conn.ReadTimeout, info.conn.WriteTimeout
+	if readTimeout <= 0 {
+		readTimeout = defaultReadTimeout
+	}
+	if writeTimeout <= 0 {
+		writeTimeout = defaultWriteTimeout
+	}
+
+	if info.dbType == DB_TYPE_POSTGRES {
+		sslmode := info.conn.TLS
+		if sslmode == "" {
+			sslmode = "disable"
+		}
+		params.Set("sslmode", sslmode)
+		params.Set("connect_timeout", fmt.Sprint(int((info.timeOut+time.Second-1)/time.Second)))
+	} else {
+		params.Set("charset", "utf8mb4")
+		params.Set("collation", "utf8mb4_unicode_ci")
+		params.Set("timeout", info.timeOut.String())
+		params.Set("readTimeout", readTimeout.String())
+		params.Set("writeTimeout", writeTimeout.String())
+		if parseTime {
+			params.Set("parseTime", "True")
+			params.Set("loc", "Local")
+		}
+		if info.conn.TLS != "" {
+			params.Set("tls", info.conn.TLS)
+		}
+	}
+	for k, v := range info.conn.Params {
+		params.Set(k, v)
+	}
+
+	if info.dbType == DB_TYPE_POSTGRES {
+		return fmt.Sprintf("postgres://%s@%s/%s?%s", url.UserPassword(info.userName, info.passWord).String(),
+			info.dbAddr, info.dbName, params.Encode())
+	}
+	return fmt.Sprintf("%s:%s@tcp(%s)/%s?%s", info.userName, info.passWord, info.dbAddr, info.dbName, params.Encode())
+}
+
+// redactDSN dsn of info with the password masked, for logs
+func redactDSN(info *Sql, parseTime bool) string {
+	masked := *info
+	if masked.passWord != "" {
+		masked.passWord = "***"
+	}
+	return dataSourceName(&masked, parseTime)
+}
+
+// setPool idle default to defaultIdle as before, sqlx and gorm have different ones
+func setPool(db *sql.DB, conn ConnConfig, defaultIdle int) {
+	maxOpen, maxIdle, lifetime := conn.MaxOpenConns, conn.MaxIdleConns, conn.ConnMaxLifetime
+	if maxOpen <= 0 {
+		maxOpen = defaultMaxOpenConns
+	}
+	if maxIdle <= 0 {
+		maxIdle = defaultIdle
+	}
+	if lifetime <= 0 {
+		lifetime = defaultConnMaxLifetime
+	}
+	db.SetMaxIdleConns(maxIdle)
+	db.SetMaxOpenConns(maxOpen)
+	db.SetConnMaxLifetime(lifetime)
+	if conn.ConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(conn.ConnMaxIdleTime)
+	}
+}
@@ -0,0 +1,111 @@
+package dbrouter
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDataSourceName(t *testing.T) {
+	info := &Sql{
+		dbType:   DB_TYPE_MYSQL,
+		dbName:   "trade",
+		dbAddr:   "127.0.0.1:3306",
+		timeOut:  3 * time.Second,
+		userName: "u",
+		passWord: "p",
+	}
+	assert.Equal(t, "u:p@tcp(127.0.0.1:3306)/trade?charset=utf8mb4&collation=utf8mb4_unicode_ci&readTimeout=5s&timeout=3s&writeTimeout=5s",
+		dataSourceName(info, false))
+	assert.Equal(t, "u:***@tcp(127.0.0.1:3306)/trade?charset=utf8mb4&collation=utf8mb4_unicode_ci&loc=Local&parseTime=True&readTimeout=5s&timeout=3s&writeTimeout=5s",
+		redactDSN(info, true))
+
+	info.conn = ConnConfig{
+		ReadTimeout: time.Second,
+		TLS:         "skip-verify",
+		Params:      map[string]string{"charset": "utf8", "interpolateParams": "true"},
+	}
+	assert.Equal(t, "u:p@tcp(127.0.0.1:3306)/trade?charset=utf8&collation=utf8mb4_unicode_ci&interpolateParams=true&readTimeout=1s&timeout=3s&tls=skip-verify&writeTimeout=5s",
+		dataSourceName(info, false))
+
+	info = &Sql{dbType: DB_TYPE_POSTGRES, dbName: "trade", dbAddr: "pg:5432", timeOut: 1500 * time.Millisecond, userName: "u", passWord: "p@ss"}
+	assert.Equal(t, "postgres://u:p%40ss@pg:5432/trade?connect_timeout=2&sslmode=disable", dataSourceName(info, false))
+	info.conn.TLS = "verify-full"
+	assert.Equal(t, "postgres://u:p%40ss@pg:5432/trade?connect_timeout=2&sslmode=verify-full", dataSourceName(info, false))
+}
+
+func TestParser_Conn(t *testing.T) {
+	parser, err := NewParser([]byte(`{
+		"cluster": {"trade": [{"instance": "trade0", "match": "full", "express": "order"}]},
+		"instances": {
+			"trade0": {
+				"dbtype": "mysql",
+				"dbname": "trade",
+				"dbcfg": {
+					"addrs": ["master:3306"], "user": "u", "passwd": "p",
+					"maxopen": 64, "maxidle": 4, "maxlifetime": 3600, "maxidletime": 60.5,
+					"timeout": 1, "readtimeout": 2, "writetimeout": 3,
+					"tls": "true", "params": {"interpolateParams": "true"}
+				}
+			}
+		}
+	}`))
+	assert.NoError(t, err)
+
+	info := parser.GetConfig("trade0", DefaultGroup)
+	config := newConfig(info)
+	assert.Equal(t, time.Second, config.TimeOut)
+	assert.Equal(t, ConnConfig{
+		MaxOpenConns:    64,
+		MaxIdleConns:    4,
+		ConnMaxLifetime: time.Hour,
+		ConnMaxIdleTime: 60500 * time.Millisecond,
+		ReadTimeout:     2 * time.Second,
+		WriteTimeout:    3 * time.Second,
+		TLS:             "true",
+		Params:          map[string]string{"interpolateParams": "true"},
+	}, config.ConnConfig)
+
+	changed := *info
+	assert.True(t, compareDbInfo(info, &changed))
+	changed.MaxOpenConns = 32
+	assert.False(t, compareDbInfo(info, &changed))
+	changed = *info
+	changed.Params = map[string]string{"interpolateParams": "false"}
+	assert.False(t, compareDbInfo(info, &changed))
+}
+
+type closeCounter struct {
+	closed int32
+}
+
+func (m *closeCounter) GetType() string {
+	return DB_TYPE_MYSQL
+}
+
+func (m *closeCounter) Close() error {
+	atomic.AddInt32(&m.closed, 1)
+	return nil
+}
+
+func TestInstanceManager_CloseDelay(t *testing.T) {
+	delay := instanceCloseDelay
+	instanceCloseDelay = 50 * time.Millisecond
+	defer func() { instanceCloseDelay = delay }()
+
+	in := &closeCounter{}
+	m := &InstanceManager{instances: make(map[string]Instancer)}
+	m.instances[m.buildKey("trade0", DefaultGroup)] = in
+
+	m.handleDbInsChange(context.Background(), map[string][]string{DefaultGroup: {"trade0"}})
+	_, ok := m.getInstance(context.Background(), m.buildKey("trade0", DefaultGroup))
+	assert.False(t, ok)
+	// still usable by requests which got it before the change
+	assert.Equal(t, int32(0), atomic.LoadInt32(&in.closed))
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&in.closed))
+}
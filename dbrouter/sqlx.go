@@ -8,77 +8,296 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"reflect"
+
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 	"github.com/shawnfeng/sutil/slog/slog"
-	"time"
 )
 
 type DB struct {
 	*sqlx.DB
+	// trace of the request of the router, nil if the db is not from the router
+	trace *queryTrace
 }
 
 func NewDB(sqlxdb *sqlx.DB) *DB {
 	db := &DB{
-		sqlxdb,
+		DB: sqlxdb,
 	}
 	return db
 }
 
-func dialBySqlx(info *Sql) (db *sqlx.DB, err error) {
-	fun := "dialBySqlx -->"
+// withTrace a copy of db of the request of trace
+func (db *DB) withTrace(trace *queryTrace) *DB {
+	return &DB{
+		DB:    db.DB,
+		trace: trace.forDriver(db.DriverName()),
+	}
+}
 
-	var dataSourceName string
-	if info.dbType == DB_TYPE_MYSQL { // timeout: 3s readTimeout: 5s writeTimeout: 5s, TODO: dynamic config
-		dataSourceName = fmt.Sprintf("%s:%s@tcp(%s)/%s?charset=utf8mb4&collation=utf8mb4_unicode_ci&timeout=3s&readTimeout=5s&writeTimeout=5s", info.userName, info.passWord, info.dbAddr, info.dbName)
+func (db *DB) statements() tracedExt {
+	return tracedExt{ext: db.DB, trace: db.trace, kind: "DB"}
+}
 
-	} else if info.dbType == DB_TYPE_POSTGRES {
-		dataSourceName = fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=disable",
-			info.userName, info.passWord, info.dbAddr, info.dbName)
-	}
+func dialBySqlx(info *Sql) (db *sqlx.DB, err error) {
+	fun := "dialBySqlx -->"
 
-	slog.Infof(context.TODO(), "%s dbtype:%s datasourcename:%s", fun, info.dbType, dataSourceName)
+	dataSourceName := dataSourceName(info, false)
+	slog.Infof(context.TODO(), "%s dbtype:%s datasourcename:%s", fun, info.dbType, redactDSN(info, false))
 	sqlxdb, err := sqlx.Connect(info.dbType, dataSourceName)
 	if err == nil {
-		sqlxdb.SetMaxIdleConns(16)
-		sqlxdb.SetMaxOpenConns(128)
-		sqlxdb.SetConnMaxLifetime(time.Hour * 6)
+		setPool(sqlxdb.DB, info.conn, 16)
 	}
 	return sqlxdb, err
 }
 
 func (db *DB) NamedExecWrapper(tables []interface{}, query string, arg interface{}) (sql.Result, error) {
 	query = fmt.Sprintf(query, tables...)
-	return db.DB.NamedExec(query, arg)
+	return db.statements().namedExec(context.Background(), query, arg)
 }
 
 func (db *DB) NamedQueryWrapper(tables []interface{}, query string, arg interface{}) (*sqlx.Rows, error) {
 	query = fmt.Sprintf(query, tables...)
-	return db.DB.NamedQuery(query, arg)
+	return db.statements().namedQuery(context.Background(), query, arg)
 }
 
 func (db *DB) SelectWrapper(tables []interface{}, dest interface{}, query string, args ...interface{}) error {
 	query = fmt.Sprintf(query, tables...)
-	return db.DB.Select(dest, query, args...)
+	return db.statements().selectx(context.Background(), dest, query, args...)
 }
 
 func (db *DB) ExecWrapper(tables []interface{}, query string, args ...interface{}) (sql.Result, error) {
 	query = fmt.Sprintf(query, tables...)
-	return db.DB.Exec(query, args...)
+	return db.statements().exec(context.Background(), query, args...)
 }
 
 func (db *DB) QueryRowxWrapper(tables []interface{}, query string, args ...interface{}) *sqlx.Row {
 	query = fmt.Sprintf(query, tables...)
-	return db.DB.QueryRowx(query, args...)
+	return db.statements().queryRowx(context.Background(), query, args...)
 }
 
 func (db *DB) QueryxWrapper(tables []interface{}, query string, args ...interface{}) (*sqlx.Rows, error) {
 	query = fmt.Sprintf(query, tables...)
-	return db.DB.Queryx(query, args...)
+	return db.statements().queryx(context.Background(), query, args...)
 }
 
 func (db *DB) GetWrapper(tables []interface{}, dest interface{}, query string, args ...interface{}) error {
 	query = fmt.Sprintf(query, tables...)
-	return db.DB.Get(dest, query, args...)
+	return db.statements().get(context.Background(), dest, query, args...)
+}
+
+// the Context wrappers pass ctx to the statement, so that deadlines and cancellation of the request apply
+
+func (db *DB) NamedExecContextWrapper(ctx context.Context, tables []interface{}, query string, arg interface{}) (sql.Result, error) {
+	query = fmt.Sprintf(query, tables...)
+	return db.statements().namedExec(ctx, query, arg)
+}
+
+func (db *DB) NamedQueryContextWrapper(ctx context.Context, tables []interface{}, query string, arg interface{}) (*sqlx.Rows, error) {
+	query = fmt.Sprintf(query, tables...)
+	return db.statements().namedQuery(ctx, query, arg)
+}
+
+func (db *DB) SelectContextWrapper(ctx context.Context, tables []interface{}, dest interface{}, query string, args ...interface{}) error {
+	query = fmt.Sprintf(query, tables...)
+	return db.statements().selectx(ctx, dest, query, args...)
+}
+
+func (db *DB) ExecContextWrapper(ctx context.Context, tables []interface{}, query string, args ...interface{}) (sql.Result, error) {
+	query = fmt.Sprintf(query, tables...)
+	return db.statements().exec(ctx, query, args...)
+}
+
+func (db *DB) QueryRowxContextWrapper(ctx context.Context, tables []interface{}, query string, args ...interface{}) *sqlx.Row {
+	query = fmt.Sprintf(query, tables...)
+	return db.statements().queryRowx(ctx, query, args...)
+}
+
+func (db *DB) QueryxContextWrapper(ctx context.Context, tables []interface{}, query string, args ...interface{}) (*sqlx.Rows, error) {
+	query = fmt.Sprintf(query, tables...)
+	return db.statements().queryx(ctx, query, args...)
+}
+
+func (db *DB) GetContextWrapper(ctx context.Context, tables []interface{}, dest interface{}, query string, args ...interface{}) error {
+	query = fmt.Sprintf(query, tables...)
+	return db.statements().get(ctx, dest, query, args...)
+}
+
+// the sqlx and database/sql methods promoted from sqlx.DB are instrumented as the wrappers,
+// prepared statements, MustExec and txs begun on the DB are not
+
+func (db *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.statements().exec(context.Background(), query, args...)
+}
+
+func (db *DB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return db.statements().exec(ctx, query, args...)
+}
+
+func (db *DB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.statements().query(context.Background(), query, args...)
+}
+
+func (db *DB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return db.statements().query(ctx, query, args...)
+}
+
+func (db *DB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.statements().queryRow(context.Background(), query, args...)
+}
+
+func (db *DB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return db.statements().queryRow(ctx, query, args...)
+}
+
+func (db *DB) Queryx(query string, args ...interface{}) (*sqlx.Rows, error) {
+	return db.statements().queryx(context.Background(), query, args...)
+}
+
+func (db *DB) QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error) {
+	return db.statements().queryx(ctx, query, args...)
+}
+
+func (db *DB) QueryRowx(query string, args ...interface{}) *sqlx.Row {
+	return db.statements().queryRowx(context.Background(), query, args...)
+}
+
+func (db *DB) QueryRowxContext(ctx context.Context, query string, args ...interface{}) *sqlx.Row {
+	return db.statements().queryRowx(ctx, query, args...)
+}
+
+func (db *DB) Select(dest interface{}, query string, args ...interface{}) error {
+	return db.statements().selectx(context.Background(), dest, query, args...)
+}
+
+func (db *DB) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return db.statements().selectx(ctx, dest, query, args...)
+}
+
+func (db *DB) Get(dest interface{}, query string, args ...interface{}) error {
+	return db.statements().get(context.Background(), dest, query, args...)
+}
+
+func (db *DB) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return db.statements().get(ctx, dest, query, args...)
+}
+
+func (db *DB) NamedExec(query string, arg interface{}) (sql.Result, error) {
+	return db.statements().namedExec(context.Background(), query, arg)
+}
+
+func (db *DB) NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error) {
+	return db.statements().namedExec(ctx, query, arg)
+}
+
+func (db *DB) NamedQuery(query string, arg interface{}) (*sqlx.Rows, error) {
+	return db.statements().namedQuery(context.Background(), query, arg)
+}
+
+func (db *DB) NamedQueryContext(ctx context.Context, query string, arg interface{}) (*sqlx.Rows, error) {
+	return db.statements().namedQuery(ctx, query, arg)
+}
+
+// extContext sqlx.DB or sqlx.Tx
+type extContext interface {
+	sqlx.ExtContext
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// tracedExt statements of a DB or Tx, instrumented by the trace of the request if any.
+// Statements returning rows are timed until the rows are returned rather than read.
+type tracedExt struct {
+	ext   extContext
+	trace *queryTrace
+	// DB or Tx
+	kind string
+}
+
+// named statements have args of unknown count, -1
+
+func (m tracedExt) namedExec(ctx context.Context, query string, arg interface{}) (res sql.Result, err error) {
+	err = m.trace.observe(ctx, m.kind+".NamedExec", query, -1, func() (int64, error) {
+		res, err = sqlx.NamedExecContext(ctx, m.ext, query, arg)
+		return rowsAffected(res), err
+	})
+	return
+}
+
+func (m tracedExt) namedQuery(ctx context.Context, query string, arg interface{}) (rows *sqlx.Rows, err error) {
+	err = m.trace.observe(ctx, m.kind+".NamedQuery", query, -1, func() (int64, error) {
+		rows, err = sqlx.NamedQueryContext(ctx, m.ext, query, arg)
+		return -1, err
+	})
+	return
+}
+
+func (m tracedExt) selectx(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return m.trace.observe(ctx, m.kind+".Select", query, len(args), func() (int64, error) {
+		err := sqlx.SelectContext(ctx, m.ext, dest, query, args...)
+		return sliceLen(dest), err
+	})
+}
+
+func (m tracedExt) exec(ctx context.Context, query string, args ...interface{}) (res sql.Result, err error) {
+	err = m.trace.observe(ctx, m.kind+".Exec", query, len(args), func() (int64, error) {
+		res, err = m.ext.ExecContext(ctx, query, args...)
+		return rowsAffected(res), err
+	})
+	return
+}
+
+func (m tracedExt) query(ctx context.Context, query string, args ...interface{}) (rows *sql.Rows, err error) {
+	err = m.trace.observe(ctx, m.kind+".Query", query, len(args), func() (int64, error) {
+		rows, err = m.ext.QueryContext(ctx, query, args...)
+		return -1, err
+	})
+	return
+}
+
+func (m tracedExt) queryRow(ctx context.Context, query string, args ...interface{}) (row *sql.Row) {
+	m.trace.observe(ctx, m.kind+".QueryRow", query, len(args), func() (int64, error) {
+		row = m.ext.QueryRowContext(ctx, query, args...)
+		return -1, row.Err()
+	})
+	return
+}
+
+func (m tracedExt) queryRowx(ctx context.Context, query string, args ...interface{}) (row *sqlx.Row) {
+	m.trace.observe(ctx, m.kind+".QueryRowx", query, len(args), func() (int64, error) {
+		row = m.ext.QueryRowxContext(ctx, query, args...)
+		return -1, row.Err()
+	})
+	return
+}
+
+func (m tracedExt) queryx(ctx context.Context, query string, args ...interface{}) (rows *sqlx.Rows, err error) {
+	err = m.trace.observe(ctx, m.kind+".Queryx", query, len(args), func() (int64, error) {
+		rows, err = m.ext.QueryxContext(ctx, query, args...)
+		return -1, err
+	})
+	return
+}
+
+func (m tracedExt) get(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return m.trace.observe(ctx, m.kind+".Get", query, len(args), func() (int64, error) {
+		err := sqlx.GetContext(ctx, m.ext, dest, query, args...)
+		if err != nil {
+			return 0, err
+		}
+		return 1, nil
+	})
+}
+
+// sliceLen rows selected into dest, a pointer to a slice
+func sliceLen(dest interface{}) int64 {
+	v := reflect.ValueOf(dest)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Slice {
+		return -1
+	}
+	return int64(v.Len())
 }
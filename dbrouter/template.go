@@ -0,0 +1,190 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// {{table}} is tables[0], {{table.N}} is tables[N]
+var tablePlaceholder = regexp.MustCompile(`\{\{\s*table(?:\.(\d+))?\s*\}\}`)
+
+// quoteTable validate table by checkVarname and quote it for the dialect of driver, a table of
+// schema.table is validated and quoted by part
+func quoteTable(driver, table string) (string, error) {
+	quote := "`"
+	if driver == DB_TYPE_POSTGRES {
+		quote = `"`
+	}
+
+	parts := strings.Split(table, ".")
+	for i, part := range parts {
+		if err := checkVarname(part); err != nil {
+			return "", fmt.Errorf("table name %q %s", table, err.Error())
+		}
+		parts[i] = quote + part + quote
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// expandTables replace the table placeholders of query by the quoted tables, every placeholder
+// must have a table and every table must be used. Anything else in query, e.g. % of a LIKE
+// pattern, is left as is.
+func expandTables(driver, query string, tables []interface{}) (string, error) {
+	quoted := make([]string, len(tables))
+	for i, t := range tables {
+		table, ok := t.(string)
+		if !ok {
+			return "", fmt.Errorf("table %d: %v of type %T is not a string", i, t, t)
+		}
+		q, err := quoteTable(driver, table)
+		if err != nil {
+			return "", err
+		}
+		quoted[i] = q
+	}
+
+	var err error
+	used := make([]bool, len(tables))
+	query = tablePlaceholder.ReplaceAllStringFunc(query, func(placeholder string) string {
+		index := 0
+		if n := tablePlaceholder.FindStringSubmatch(placeholder)[1]; n != "" {
+			index, _ = strconv.Atoi(n)
+		}
+		if index >= len(tables) {
+			if err == nil {
+				err = fmt.Errorf("placeholder %s has no table, %d tables given", placeholder, len(tables))
+			}
+			return placeholder
+		}
+		used[index] = true
+		return quoted[index]
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for i, ok := range used {
+		if !ok {
+			return "", fmt.Errorf("table %d: %v has no placeholder in query, %d tables given", i, tables[i], len(tables))
+		}
+	}
+	return query, nil
+}
+
+// the Template methods take a query of table placeholders, see expandTables, instead of the
+// fmt verbs of the Wrapper methods
+
+func (db *DB) NamedExecTemplate(ctx context.Context, tables []interface{}, query string, arg interface{}) (sql.Result, error) {
+	query, err := expandTables(db.DriverName(), query, tables)
+	if err != nil {
+		return nil, err
+	}
+	return db.statements().namedExec(ctx, query, arg)
+}
+
+func (db *DB) NamedQueryTemplate(ctx context.Context, tables []interface{}, query string, arg interface{}) (*sqlx.Rows, error) {
+	query, err := expandTables(db.DriverName(), query, tables)
+	if err != nil {
+		return nil, err
+	}
+	return db.statements().namedQuery(ctx, query, arg)
+}
+
+func (db *DB) SelectTemplate(ctx context.Context, tables []interface{}, dest interface{}, query string, args ...interface{}) error {
+	query, err := expandTables(db.DriverName(), query, tables)
+	if err != nil {
+		return err
+	}
+	return db.statements().selectx(ctx, dest, query, args...)
+}
+
+func (db *DB) ExecTemplate(ctx context.Context, tables []interface{}, query string, args ...interface{}) (sql.Result, error) {
+	query, err := expandTables(db.DriverName(), query, tables)
+	if err != nil {
+		return nil, err
+	}
+	return db.statements().exec(ctx, query, args...)
+}
+
+// QueryRowxTemplate unlike QueryRowxWrapper, a query failing to expand is returned as error
+func (db *DB) QueryRowxTemplate(ctx context.Context, tables []interface{}, query string, args ...interface{}) (*sqlx.Row, error) {
+	query, err := expandTables(db.DriverName(), query, tables)
+	if err != nil {
+		return nil, err
+	}
+	return db.statements().queryRowx(ctx, query, args...), nil
+}
+
+func (db *DB) QueryxTemplate(ctx context.Context, tables []interface{}, query string, args ...interface{}) (*sqlx.Rows, error) {
+	query, err := expandTables(db.DriverName(), query, tables)
+	if err != nil {
+		return nil, err
+	}
+	return db.statements().queryx(ctx, query, args...)
+}
+
+func (db *DB) GetTemplate(ctx context.Context, tables []interface{}, dest interface{}, query string, args ...interface{}) error {
+	query, err := expandTables(db.DriverName(), query, tables)
+	if err != nil {
+		return err
+	}
+	return db.statements().get(ctx, dest, query, args...)
+}
+
+func (tx *Tx) NamedExecTemplate(tables []interface{}, query string, arg interface{}) (sql.Result, error) {
+	query, err := expandTables(tx.DriverName(), query, tables)
+	if err != nil {
+		return nil, err
+	}
+	return tx.statements().namedExec(tx.ctx, query, arg)
+}
+
+func (tx *Tx) SelectTemplate(tables []interface{}, dest interface{}, query string, args ...interface{}) error {
+	query, err := expandTables(tx.DriverName(), query, tables)
+	if err != nil {
+		return err
+	}
+	return tx.statements().selectx(tx.ctx, dest, query, args...)
+}
+
+func (tx *Tx) ExecTemplate(tables []interface{}, query string, args ...interface{}) (sql.Result, error) {
+	query, err := expandTables(tx.DriverName(), query, tables)
+	if err != nil {
+		return nil, err
+	}
+	return tx.statements().exec(tx.ctx, query, args...)
+}
+
+func (tx *Tx) QueryRowxTemplate(tables []interface{}, query string, args ...interface{}) (*sqlx.Row, error) {
+	query, err := expandTables(tx.DriverName(), query, tables)
+	if err != nil {
+		return nil, err
+	}
+	return tx.statements().queryRowx(tx.ctx, query, args...), nil
+}
+
+func (tx *Tx) QueryxTemplate(tables []interface{}, query string, args ...interface{}) (*sqlx.Rows, error) {
+	query, err := expandTables(tx.DriverName(), query, tables)
+	if err != nil {
+		return nil, err
+	}
+	return tx.statements().queryx(tx.ctx, query, args...)
+}
+
+func (tx *Tx) GetTemplate(tables []interface{}, dest interface{}, query string, args ...interface{}) error {
+	query, err := expandTables(tx.DriverName(), query, tables)
+	if err != nil {
+		return err
+	}
+	return tx.statements().get(tx.ctx, dest, query, args...)
+}
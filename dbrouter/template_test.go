@@ -0,0 +1,71 @@
+package dbrouter
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandTables(t *testing.T) {
+	tables := []interface{}{"order", "shop.user"}
+
+	query, err := expandTables(DB_TYPE_MYSQL, "SELECT * FROM {{table}} o JOIN {{ table.1 }} u ON o.uid=u.id WHERE u.name LIKE '%a%'", tables)
+	assert.NoError(t, err)
+	assert.Equal(t, "SELECT * FROM `order` o JOIN `shop`.`user` u ON o.uid=u.id WHERE u.name LIKE '%a%'", query)
+
+	query, err = expandTables(DB_TYPE_POSTGRES, "DELETE FROM {{table.0}} WHERE id IN (SELECT id FROM {{table.1}}) AND {{x}}", tables)
+	assert.NoError(t, err)
+	assert.Equal(t, `DELETE FROM "order" WHERE id IN (SELECT id FROM "shop"."user") AND {{x}}`, query)
+
+	// a table can be used more than once
+	query, err = expandTables(DB_TYPE_MYSQL, "INSERT INTO {{table}} SELECT * FROM {{table.0}}", tables[:1])
+	assert.NoError(t, err)
+	assert.Equal(t, "INSERT INTO `order` SELECT * FROM `order`", query)
+
+	_, err = expandTables(DB_TYPE_MYSQL, "SELECT * FROM {{table.2}}", tables)
+	assert.Error(t, err)
+	_, err = expandTables(DB_TYPE_MYSQL, "SELECT * FROM {{table}}", tables)
+	assert.Error(t, err)
+	_, err = expandTables(DB_TYPE_MYSQL, "SELECT * FROM {{table}}", nil)
+	assert.Error(t, err)
+	_, err = expandTables(DB_TYPE_MYSQL, "SELECT * FROM {{table}}", []interface{}{1})
+	assert.Error(t, err)
+
+	for _, table := range []string{"", "1order", "order`; DROP TABLE user", `or"der`, "shop.", "order--"} {
+		_, err = expandTables(DB_TYPE_MYSQL, "SELECT * FROM {{table}}", []interface{}{table})
+		assert.Error(t, err, table)
+	}
+}
+
+func TestDB_Template(t *testing.T) {
+	ctx := context.Background()
+	db, mock := newMockDB(t)
+
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE `order` SET state=? WHERE id=?")).
+		WithArgs(1, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	_, err := db.ExecTemplate(ctx, []interface{}{"order"}, "UPDATE {{table}} SET state=? WHERE id=?", 1, 2)
+	assert.NoError(t, err)
+
+	_, err = db.ExecTemplate(ctx, []interface{}{"order;"}, "UPDATE {{table}} SET state=? WHERE id=?", 1, 2)
+	assert.Error(t, err)
+	_, err = db.QueryRowxTemplate(ctx, []interface{}{"order"}, "SELECT * FROM {{table.1}}")
+	assert.Error(t, err)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT count(*) FROM `order`")).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectCommit()
+	err = sqlTxAttempt(ctx, db, nil, func(tx *Tx, tables []interface{}) error {
+		var n int
+		if err := tx.GetTemplate(tables, &n, "SELECT count(*) FROM {{table}}"); err != nil {
+			return err
+		}
+		assert.Equal(t, 3, n)
+		return nil
+	}, []interface{}{"order"})
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,345 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"context"
+	"database/sql"
+	"math/rand"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/shawnfeng/sutil/slog/statlog"
+	"github.com/shawnfeng/sutil/stime"
+)
+
+const (
+	// 慢查询配置, 按cluster配置为 <cluster>.slowlog.xxx, 未配置时取 global.slowlog.xxx
+	slowLogKeyThreshold  = "slowlog.threshold"  // 慢查询耗时, 单位: 毫秒, <0不记录
+	slowLogKeySampleRate = "slowlog.samplerate" // 慢查询记录的百分比
+
+	defaultSlowLogThreshold = 200 * time.Millisecond
+	slowLogConfigRefresh    = 10 * time.Second
+
+	// name of the slow queries in statlog
+	slowLogName = "dbrouter.slowquery"
+	// normalized statements longer than this are truncated
+	maxNormalizedSQL = 2048
+)
+
+// SlowLogConfig statements slower than Threshold are logged to statlog
+type SlowLogConfig struct {
+	// Threshold 0 is 200ms, <0 never log
+	Threshold time.Duration
+	// SampleRate percent of slow statements logged, 0 is 100
+	SampleRate int
+}
+
+func (m SlowLogConfig) isSlow(dur time.Duration) bool {
+	threshold := m.Threshold
+	if threshold < 0 {
+		return false
+	}
+	if threshold == 0 {
+		threshold = defaultSlowLogThreshold
+	}
+	if dur < threshold {
+		return false
+	}
+	return m.SampleRate <= 0 || m.SampleRate >= 100 || rand.Intn(100) < m.SampleRate
+}
+
+// loadSlowLogConfig config of cluster from apollo, default if not configured
+func loadSlowLogConfig(cluster string) SlowLogConfig {
+	var conf SlowLogConfig
+	cc := getConfigCenter()
+	if cc == nil {
+		return conf
+	}
+	if v, ok := getClusterConfigInt(cc, cluster, slowLogKeyThreshold); ok {
+		conf.Threshold = time.Duration(v) * time.Millisecond
+	}
+	if v, ok := getClusterConfigInt(cc, cluster, slowLogKeySampleRate); ok {
+		conf.SampleRate = v
+	}
+	return conf
+}
+
+type slowLogConfigEntry struct {
+	conf     SlowLogConfig
+	loadedAt time.Time
+	// reloading in the background
+	loading bool
+}
+
+// slowLogManager cluster -> config, a cluster is loaded on its first request and reloaded in the
+// background every slowLogConfigRefresh, so that requests don't wait for the config
+type slowLogManager struct {
+	lock       sync.Mutex
+	configs    map[string]*slowLogConfigEntry
+	loadConfig func(cluster string) SlowLogConfig
+}
+
+func newSlowLogManager(loadConfig func(cluster string) SlowLogConfig) *slowLogManager {
+	return &slowLogManager{
+		configs:    make(map[string]*slowLogConfigEntry),
+		loadConfig: loadConfig,
+	}
+}
+
+func (m *slowLogManager) get(cluster string) SlowLogConfig {
+	m.lock.Lock()
+	entry, ok := m.configs[cluster]
+	if ok {
+		if !entry.loading && time.Since(entry.loadedAt) >= slowLogConfigRefresh {
+			entry.loading = true
+			go m.reload(cluster)
+		}
+		conf := entry.conf
+		m.lock.Unlock()
+		return conf
+	}
+	m.lock.Unlock()
+
+	conf := m.loadConfig(cluster)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.configs[cluster]; !ok {
+		m.configs[cluster] = &slowLogConfigEntry{conf: conf, loadedAt: time.Now()}
+	}
+	return conf
+}
+
+func (m *slowLogManager) reload(cluster string) {
+	conf := m.loadConfig(cluster)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.configs[cluster] = &slowLogConfigEntry{conf: conf, loadedAt: time.Now()}
+}
+
+// queryTrace a request of the router, every statement of the DB, Tx or GormDB passed to the
+// query func of the request gets a span under ctx and is logged if slow. Statements of a DB not
+// from the router have no trace and are not instrumented.
+type queryTrace struct {
+	ctx     context.Context
+	cluster string
+	table   string
+	slowlog SlowLogConfig
+	// driver of the statements, see normalizeSQL
+	driver string
+}
+
+func (m *Router) newTrace(ctx context.Context, cluster, table string) *queryTrace {
+	return &queryTrace{
+		ctx:     ctx,
+		cluster: cluster,
+		table:   table,
+		slowlog: m.slowlog.get(cluster),
+	}
+}
+
+// forDriver a copy of t for the statements of driver, nil if t is nil
+func (t *queryTrace) forDriver(driver string) *queryTrace {
+	if t == nil {
+		return nil
+	}
+	trace := *t
+	trace.driver = driver
+	return &trace
+}
+
+// start span of op under ctx, or under the ctx of the request if ctx has no span, e.g. the
+// background ctx of the wrappers without ctx
+func (t *queryTrace) start(ctx context.Context, op string) (opentracing.Span, context.Context) {
+	if opentracing.SpanFromContext(ctx) == nil {
+		ctx = t.ctx
+	}
+	return opentracing.StartSpanFromContext(ctx, "dbrouter."+op)
+}
+
+// finish nargs and rows <0 if unknown, e.g. rows of statements returning *sqlx.Rows
+func (t *queryTrace) finish(ctx context.Context, span opentracing.Span, op, query string, nargs int, rows int64, err error, dur time.Duration) {
+	// reads of a sticky ctx go to the primary after a write, see WithStickyPrimary
+	if isWriteSQL(query) {
+		markWrite(t.ctx)
+	}
+	statement := normalizeSQL(t.driver, query)
+
+	ext.DBType.Set(span, "sql")
+	ext.DBStatement.Set(span, statement)
+	span.LogFields(
+		log.String(spanLogKeyCluster, t.cluster),
+		log.String(spanLogKeyTable, t.table))
+	if nargs >= 0 {
+		span.LogFields(log.Int("args", nargs))
+	}
+	if rows >= 0 {
+		span.LogFields(log.Int64("rows", rows))
+	}
+	errMsg := ""
+	if isStatementErr(err) {
+		errMsg = err.Error()
+		ext.Error.Set(span, true)
+		span.LogFields(log.Error(err))
+	}
+	span.Finish()
+
+	if t.slowlog.isSlow(dur) {
+		statlog.LogKV(ctx, slowLogName,
+			"cluster", t.cluster,
+			"table", t.table,
+			"op", op,
+			"sql", statement,
+			"args", nargs,
+			"rows", rows,
+			"dur", dur.Milliseconds(),
+			"err", errMsg)
+	}
+}
+
+// observe run stmt of op, stmt return the rows affected or returned, <0 if unknown
+func (t *queryTrace) observe(ctx context.Context, op, query string, nargs int, stmt func() (int64, error)) error {
+	if t == nil {
+		_, err := stmt()
+		return err
+	}
+
+	span, ctx := t.start(ctx, op)
+	st := stime.NewTimeStat()
+	rows, err := stmt()
+	t.finish(ctx, span, op, query, nargs, rows, err, st.Duration())
+	return err
+}
+
+// isStatementErr no rows is a result rather than a failure of the statement
+func isStatementErr(err error) bool {
+	return err != nil && err != sql.ErrNoRows && !gorm.IsRecordNotFoundError(err)
+}
+
+func rowsAffected(res sql.Result) int64 {
+	if res == nil {
+		return -1
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+var placeholderList = regexp.MustCompile(`\(\?(?: ?, ?\?)+\)`)
+
+// normalizeSQL strip the literals of query, so that statements differing only in values are the
+// same: strings and numbers become ?, whitespace is collapsed, and lists of ? such as IN (?, ?)
+// become (?). Quoted identifiers and $1 placeholders of postgres are kept. "" quotes a string in
+// mysql but an identifier in postgres, so it is kept for postgres only. A backslash escapes
+// in strings of mysql only, it is a plain char in standard strings of postgres.
+func normalizeSQL(driver, query string) string {
+	identQuote := byte('`')
+	if driver == DB_TYPE_POSTGRES {
+		identQuote = '"'
+	}
+	backslash := driver == DB_TYPE_MYSQL
+
+	b := make([]byte, 0, len(query))
+
+	space := false
+	for i := 0; i < len(query); {
+		c := query[i]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			space = true
+			i++
+			continue
+		}
+		if space && len(b) > 0 {
+			b = append(b, ' ')
+		}
+		space = false
+
+		switch {
+		case c == '\'' || c == '"' && identQuote != '"':
+			i = skipQuoted(query, i, backslash)
+			b = append(b, '?')
+		case c == identQuote:
+			j := skipQuoted(query, i, false)
+			b = append(b, query[i:j]...)
+			i = j
+		case c == '$' || c == '_' || isLetter(c) || c >= 0x80:
+			j := i + 1
+			for j < len(query) && isWordChar(query[j]) {
+				j++
+			}
+			b = append(b, query[i:j]...)
+			i = j
+		case isDigit(c):
+			j := i + 1
+			for j < len(query) && (isWordChar(query[j]) || query[j] == '.') {
+				j++
+			}
+			if isNegative(b) {
+				b = b[:len(b)-1]
+			}
+			b = append(b, '?')
+			i = j
+		default:
+			b = append(b, c)
+			i++
+		}
+	}
+
+	s := placeholderList.ReplaceAllString(string(b), "(?)")
+	if len(s) > maxNormalizedSQL {
+		s = strings.ToValidUTF8(s[:maxNormalizedSQL], "") + "..."
+	}
+	return s
+}
+
+// skipQuoted index after the quoted string starting at i, the quote is escaped by doubling it,
+// or by a backslash if backslash, e.g. in a string literal
+func skipQuoted(query string, i int, backslash bool) int {
+	quote := query[i]
+	for j := i + 1; j < len(query); j++ {
+		switch query[j] {
+		case '\\':
+			if backslash {
+				j++
+			}
+		case quote:
+			if j+1 < len(query) && query[j+1] == quote {
+				j++
+				continue
+			}
+			return j + 1
+		}
+	}
+	return len(query)
+}
+
+// isNegative b ends with the minus sign of a number rather than a subtraction
+func isNegative(b []byte) bool {
+	if len(b) == 0 || b[len(b)-1] != '-' {
+		return false
+	}
+	prev := strings.TrimRight(string(b[:len(b)-1]), " ")
+	return prev == "" || strings.IndexByte("(,=<>+-*/", prev[len(prev)-1]) >= 0
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isWordChar(c byte) bool {
+	return isLetter(c) || isDigit(c) || c == '_' || c == '$' || c >= 0x80
+}
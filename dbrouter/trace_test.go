@@ -0,0 +1,201 @@
+package dbrouter
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jinzhu/gorm"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/shawnfeng/sutil/slog/statlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeSQL(t *testing.T) {
+	cases := map[string]string{
+		"SELECT * FROM `order` WHERE id = 12 AND name = 'it''s \\' a'": "SELECT * FROM `order` WHERE id = ? AND name = ?",
+		"select *\n\tfrom  t1 where price > 1.5e3 and hex = 0x1F":      "select * from t1 where price > ? and hex = ?",
+		"SELECT * FROM t WHERE id IN (1, 2, 3) AND uid IN (?,?,?)":     "SELECT * FROM t WHERE id IN (?) AND uid IN (?)",
+		`SELECT * FROM t WHERE name="alice" OR name = "a\"b"`:          "SELECT * FROM t WHERE name=? OR name = ?",
+		"INSERT INTO t (a, b) VALUES ('x', -1), ('y', 2)":              "INSERT INTO t (a, b) VALUES (?), (?)",
+		"  SELECT 1  ":                       "SELECT ?",
+		"UPDATE t SET n = n-1 WHERE id = -2": "UPDATE t SET n = n-? WHERE id = ?",
+	}
+	for query, normalized := range cases {
+		assert.Equal(t, normalized, normalizeSQL(DB_TYPE_MYSQL, query), query)
+	}
+
+	// "" quotes identifiers in postgres
+	assert.Equal(t, `UPDATE "order_2" SET state = $1 WHERE id = $2 AND name = ?`,
+		normalizeSQL(DB_TYPE_POSTGRES, `UPDATE "order_2" SET state = $1 WHERE id = $2 AND name = 'bob'`))
+	// a backslash doesn't escape in strings of postgres
+	assert.Equal(t, `SELECT * FROM t WHERE path = ? AND id = ?`,
+		normalizeSQL(DB_TYPE_POSTGRES, `SELECT * FROM t WHERE path = 'C:' AND id = 1`))
+}
+
+func TestSlowLogManager(t *testing.T) {
+	var loads int32
+	m := newSlowLogManager(func(string) SlowLogConfig {
+		return SlowLogConfig{SampleRate: int(atomic.AddInt32(&loads, 1))}
+	})
+	assert.Equal(t, 1, m.get("trade").SampleRate)
+	assert.Equal(t, 1, m.get("trade").SampleRate)
+
+	// reloaded in the background, the config loaded is used meanwhile
+	m.lock.Lock()
+	m.configs["trade"].loadedAt = time.Now().Add(-slowLogConfigRefresh)
+	m.lock.Unlock()
+	assert.Equal(t, 1, m.get("trade").SampleRate)
+	assert.Eventually(t, func() bool { return m.get("trade").SampleRate == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&loads))
+}
+
+func TestSlowLogConfig_IsSlow(t *testing.T) {
+	assert.False(t, SlowLogConfig{}.isSlow(100*time.Millisecond))
+	assert.True(t, SlowLogConfig{}.isSlow(defaultSlowLogThreshold))
+	assert.False(t, SlowLogConfig{Threshold: -1}.isSlow(time.Hour))
+	assert.True(t, SlowLogConfig{Threshold: time.Millisecond, SampleRate: 100}.isSlow(time.Millisecond))
+
+	n := 0
+	for i := 0; i < 1000; i++ {
+		if (SlowLogConfig{Threshold: time.Millisecond, SampleRate: 10}).isSlow(time.Second) {
+			n++
+		}
+	}
+	assert.True(t, n > 0 && n < 300, n)
+}
+
+func newTestTrace(ctx context.Context, slowlog SlowLogConfig) *queryTrace {
+	return &queryTrace{ctx: ctx, cluster: "test", table: "order", slowlog: slowlog}
+}
+
+func spanFields(span *mocktracer.MockSpan) map[string]string {
+	fields := map[string]string{}
+	for _, record := range span.Logs() {
+		for _, field := range record.Fields {
+			fields[field.Key] = field.ValueString
+		}
+	}
+	return fields
+}
+
+func TestDB_Trace(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	parent := tracer.StartSpan("parent")
+	ctx := opentracing.ContextWithSpan(context.Background(), parent)
+	db, mock := newMockDB(t)
+
+	// a db not from the router is not instrumented
+	mock.ExpectExec("UPDATE order").WillReturnResult(sqlmock.NewResult(0, 1))
+	_, err := db.ExecWrapper([]interface{}{"order"}, "UPDATE %s SET state=1")
+	assert.NoError(t, err)
+	assert.Len(t, tracer.FinishedSpans(), 0)
+
+	statlog.LogStat()
+	db = db.withTrace(newTestTrace(ctx, SlowLogConfig{Threshold: time.Nanosecond}))
+	mock.ExpectExec("UPDATE order").WithArgs(2, 3).WillReturnResult(sqlmock.NewResult(0, 5))
+	_, err = db.ExecWrapper([]interface{}{"order"}, "UPDATE %s SET state=? WHERE id IN (?, 7)", 2, 3)
+	assert.NoError(t, err)
+
+	spans := tracer.FinishedSpans()
+	assert.Len(t, spans, 1)
+	span := spans[0]
+	assert.Equal(t, "dbrouter.DB.Exec", span.OperationName)
+	assert.Equal(t, parent.Context().(mocktracer.MockSpanContext).SpanID, span.ParentID)
+	assert.Equal(t, "UPDATE order SET state=? WHERE id IN (?)", span.Tag("db.statement"))
+	assert.Nil(t, span.Tag("error"))
+	assert.Equal(t, map[string]string{"cluster": "test", "table": "order", "args": "2", "rows": "5"}, spanFields(span))
+	st, _ := statlog.LogStat()
+	assert.Equal(t, int64(1), st["TOTAL"])
+
+	// a failed statement under the span of its own ctx, not slow
+	tracer.Reset()
+	db = db.withTrace(newTestTrace(ctx, SlowLogConfig{Threshold: -1}))
+	stmtCtx := opentracing.ContextWithSpan(context.Background(), tracer.StartSpan("stmt"))
+	mock.ExpectQuery("SELECT").WillReturnError(errors.New("bad query"))
+	var ids []int
+	err = db.SelectContextWrapper(stmtCtx, []interface{}{"order"}, &ids, "SELECT id FROM %s")
+	assert.Error(t, err)
+	spans = tracer.FinishedSpans()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, "dbrouter.DB.Select", spans[0].OperationName)
+	assert.Equal(t, true, spans[0].Tag("error"))
+	assert.Equal(t, opentracing.SpanFromContext(stmtCtx).Context().(mocktracer.MockSpanContext).SpanID, spans[0].ParentID)
+	st, _ = statlog.LogStat()
+	assert.Equal(t, int64(0), st["TOTAL"])
+
+	// statements of a tx of the router
+	tracer.Reset()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+	mock.ExpectCommit()
+	err = sqlTxAttempt(ctx, db, nil, func(tx *Tx, tables []interface{}) error {
+		return tx.SelectWrapper(tables, &ids, "SELECT id FROM %s")
+	}, []interface{}{"order"})
+	assert.NoError(t, err)
+	spans = tracer.FinishedSpans()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, "dbrouter.Tx.Select", spans[0].OperationName)
+	assert.Equal(t, "2", spanFields(spans[0])["rows"])
+
+	// the promoted sqlx methods
+	tracer.Reset()
+	mock.ExpectQuery("SELECT").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec("DELETE").WillReturnResult(sqlmock.NewResult(0, 1))
+	var id int
+	assert.NoError(t, db.Get(&id, `SELECT id FROM t WHERE name = "alice"`))
+	_, err = db.ExecContext(ctx, "DELETE FROM t WHERE id = ?", id)
+	assert.NoError(t, err)
+	spans = tracer.FinishedSpans()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "dbrouter.DB.Get", spans[0].OperationName)
+	assert.Equal(t, "SELECT id FROM t WHERE name = ?", spans[0].Tag("db.statement"))
+	assert.Equal(t, "dbrouter.DB.Exec", spans[1].OperationName)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGormDB_Trace(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	sqldb, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	gormdb, err := gorm.Open(DB_TYPE_MYSQL, sqldb)
+	assert.NoError(t, err)
+	registerGormCallbacks(gormdb)
+
+	type order struct {
+		ID    int
+		State int
+	}
+	var orders []order
+
+	mock.ExpectQuery("SELECT").WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"id", "state"}).AddRow(1, 2))
+	assert.NoError(t, NewGormDB(gormdb).Table("order").Where("state = ?", 1).Find(&orders).Error)
+	assert.Len(t, tracer.FinishedSpans(), 0)
+
+	db := NewGormDB(gormdb).withTrace(newTestTrace(context.Background(), SlowLogConfig{Threshold: -1}))
+	mock.ExpectQuery("SELECT").WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"id", "state"}).AddRow(1, 2).AddRow(3, 2))
+	assert.NoError(t, db.Table("order").Where("state = ?", 1).Find(&orders).Error)
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE").WithArgs(3).WillReturnError(errors.New("lock wait"))
+	mock.ExpectRollback()
+	assert.Error(t, db.Table("order").Where("id = ?", 3).Delete(&order{}).Error)
+
+	spans := tracer.FinishedSpans()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "dbrouter.GormDB.query", spans[0].OperationName)
+	assert.Equal(t, "SELECT * FROM `order` WHERE (state = ?)", spans[0].Tag("db.statement"))
+	assert.Nil(t, spans[0].Tag("error"))
+	assert.Equal(t, "dbrouter.GormDB.delete", spans[1].OperationName)
+	assert.Equal(t, true, spans[1].Tag("error"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
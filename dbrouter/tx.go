@@ -0,0 +1,365 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+	"github.com/shawnfeng/sutil/slog/slog"
+	"github.com/shawnfeng/sutil/stime"
+)
+
+const (
+	defaultTxRetries = 3
+	defaultTxBackoff = 20 * time.Millisecond
+	maxTxBackoff     = time.Second
+)
+
+// TxOptions of SqlTx and OrmTx, nil is the default isolation level of the db with 3 retries
+type TxOptions struct {
+	Isolation sql.IsolationLevel
+	ReadOnly  bool
+	// MaxRetries of deadlocks and serialization failures, 0 is 3, <0 never retry
+	MaxRetries int
+	// Backoff before the first retry, doubled with jitter on each retry, 0 is 20ms
+	Backoff time.Duration
+}
+
+func (m *TxOptions) sqlOptions() *sql.TxOptions {
+	if m == nil {
+		return nil
+	}
+	return &sql.TxOptions{Isolation: m.Isolation, ReadOnly: m.ReadOnly}
+}
+
+func (m *TxOptions) retries() int {
+	if m == nil || m.MaxRetries == 0 {
+		return defaultTxRetries
+	}
+	if m.MaxRetries < 0 {
+		return 0
+	}
+	return m.MaxRetries
+}
+
+func (m *TxOptions) backoff(retry int) time.Duration {
+	d := defaultTxBackoff
+	if m != nil && m.Backoff > 0 {
+		d = m.Backoff
+	}
+	for i := 1; i < retry && d < maxTxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxTxBackoff {
+		d = maxTxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Tx of SqlTx, the wrappers run with the ctx of SqlTx
+type Tx struct {
+	*sqlx.Tx
+	ctx   context.Context
+	trace *queryTrace
+}
+
+func (tx *Tx) statements() tracedExt {
+	return tracedExt{ext: tx.Tx, trace: tx.trace, kind: "Tx"}
+}
+
+func (tx *Tx) Context() context.Context {
+	return tx.ctx
+}
+
+func (tx *Tx) NamedExecWrapper(tables []interface{}, query string, arg interface{}) (sql.Result, error) {
+	query = fmt.Sprintf(query, tables...)
+	return tx.statements().namedExec(tx.ctx, query, arg)
+}
+
+func (tx *Tx) SelectWrapper(tables []interface{}, dest interface{}, query string, args ...interface{}) error {
+	query = fmt.Sprintf(query, tables...)
+	return tx.statements().selectx(tx.ctx, dest, query, args...)
+}
+
+func (tx *Tx) ExecWrapper(tables []interface{}, query string, args ...interface{}) (sql.Result, error) {
+	query = fmt.Sprintf(query, tables...)
+	return tx.statements().exec(tx.ctx, query, args...)
+}
+
+func (tx *Tx) QueryRowxWrapper(tables []interface{}, query string, args ...interface{}) *sqlx.Row {
+	query = fmt.Sprintf(query, tables...)
+	return tx.statements().queryRowx(tx.ctx, query, args...)
+}
+
+func (tx *Tx) QueryxWrapper(tables []interface{}, query string, args ...interface{}) (*sqlx.Rows, error) {
+	query = fmt.Sprintf(query, tables...)
+	return tx.statements().queryx(tx.ctx, query, args...)
+}
+
+func (tx *Tx) GetWrapper(tables []interface{}, dest interface{}, query string, args ...interface{}) error {
+	query = fmt.Sprintf(query, tables...)
+	return tx.statements().get(tx.ctx, dest, query, args...)
+}
+
+// the sqlx and database/sql methods promoted from sqlx.Tx are instrumented as the wrappers, unlike
+// the wrappers they run with ctx given or none rather than the ctx of SqlTx. Prepared statements
+// and MustExec are not instrumented.
+
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.statements().exec(context.Background(), query, args...)
+}
+
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return tx.statements().exec(ctx, query, args...)
+}
+
+func (tx *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.statements().query(context.Background(), query, args...)
+}
+
+func (tx *Tx) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.statements().query(ctx, query, args...)
+}
+
+func (tx *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.statements().queryRow(context.Background(), query, args...)
+}
+
+func (tx *Tx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return tx.statements().queryRow(ctx, query, args...)
+}
+
+func (tx *Tx) Queryx(query string, args ...interface{}) (*sqlx.Rows, error) {
+	return tx.statements().queryx(context.Background(), query, args...)
+}
+
+func (tx *Tx) QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error) {
+	return tx.statements().queryx(ctx, query, args...)
+}
+
+func (tx *Tx) QueryRowx(query string, args ...interface{}) *sqlx.Row {
+	return tx.statements().queryRowx(context.Background(), query, args...)
+}
+
+func (tx *Tx) QueryRowxContext(ctx context.Context, query string, args ...interface{}) *sqlx.Row {
+	return tx.statements().queryRowx(ctx, query, args...)
+}
+
+func (tx *Tx) Select(dest interface{}, query string, args ...interface{}) error {
+	return tx.statements().selectx(context.Background(), dest, query, args...)
+}
+
+func (tx *Tx) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return tx.statements().selectx(ctx, dest, query, args...)
+}
+
+func (tx *Tx) Get(dest interface{}, query string, args ...interface{}) error {
+	return tx.statements().get(context.Background(), dest, query, args...)
+}
+
+func (tx *Tx) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return tx.statements().get(ctx, dest, query, args...)
+}
+
+func (tx *Tx) NamedExec(query string, arg interface{}) (sql.Result, error) {
+	return tx.statements().namedExec(context.Background(), query, arg)
+}
+
+func (tx *Tx) NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error) {
+	return tx.statements().namedExec(ctx, query, arg)
+}
+
+func (tx *Tx) NamedQuery(query string, arg interface{}) (*sqlx.Rows, error) {
+	return tx.statements().namedQuery(context.Background(), query, arg)
+}
+
+// isRetryableTxErr deadlocks and serialization failures, the whole tx can be retried
+func isRetryableTxErr(err error) bool {
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		// 1213 deadlock, 1205 lock wait timeout
+		return myErr.Number == 1213 || myErr.Number == 1205
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// 40001 serialization_failure, 40P01 deadlock_detected
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+	return false
+}
+
+// retryTx run attempt until it succeeds, fails with an error not retryable, or runs out of retries
+func retryTx(ctx context.Context, fun string, opts *TxOptions, attempt func() error) error {
+	retries := opts.retries()
+	for i := 0; ; i++ {
+		err := attempt()
+		if err == nil || i >= retries || !isRetryableTxErr(err) {
+			return err
+		}
+
+		d := opts.backoff(i + 1)
+		slog.Warnf(ctx, "%s retry:%d after:%s err:%s", fun, i+1, d, err.Error())
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(d):
+		}
+	}
+}
+
+func sqlTxAttempt(ctx context.Context, db *DB, opts *TxOptions, fn func(*Tx, []interface{}) error, tables []interface{}) (err error) {
+	sqltx, err := db.BeginTxx(ctx, opts.sqlOptions())
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			sqltx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			if e := sqltx.Rollback(); e != nil && e != sql.ErrTxDone {
+				slog.Warnf(ctx, "sqlTxAttempt --> rollback err:%s", e.Error())
+			}
+			return
+		}
+		err = sqltx.Commit()
+	}()
+
+	return fn(&Tx{Tx: sqltx, ctx: ctx, trace: db.trace}, tables)
+}
+
+// SqlTx 在tables[0]所在实例的主库上开启事务执行fn，fn返回错误或panic时回滚，否则提交。
+// 死锁和串行化失败时整个事务按退避重试，fn可能被执行多次，不要在fn中做事务外的副作用
+func (m *Router) SqlTx(ctx context.Context, cluster string, opts *TxOptions, fn func(*Tx, []interface{}) error, tables ...string) error {
+	fun := "Router.SqlTx -->"
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, "dbrouter.SqlTx")
+	defer span.Finish()
+
+	st := stime.NewTimeStat()
+
+	if len(tables) <= 0 {
+		return fmt.Errorf("tables is empty")
+	}
+	table := tables[0]
+
+	span.LogFields(
+		log.String(spanLogKeyCluster, cluster),
+		log.String(spanLogKeyTable, table))
+
+	// check breaker
+	if !m.breakers.entry(cluster, table) {
+		slog.Errorf(ctx, "%s breaker is open, cluster: %s, table: %s", fun, cluster, table)
+		return ErrBreakerOpen
+	}
+
+	db, err := m.sqlPrepare(ctx, cluster, table, false)
+	if err != nil {
+		return err
+	}
+	db = db.withTrace(m.newTrace(ctx, cluster, table))
+
+	defer func() {
+		dur := st.Duration()
+		m.statQuery("SqlTx", cluster, table, dur, err)
+		slog.Tracef(ctx, "%s cls:%s table:%s dur:%d", fun, cluster, table, dur)
+	}()
+
+	var tmptables []interface{}
+	for _, item := range tables {
+		tmptables = append(tmptables, item)
+	}
+	err = retryTx(ctx, fun, opts, func() error {
+		return sqlTxAttempt(ctx, db, opts, fn, tmptables)
+	})
+	statReqErr(cluster, table, err)
+	// record breaker
+	m.breakers.stat(cluster, table, err, st.Duration())
+	return err
+}
+
+func ormTxAttempt(ctx context.Context, db *GormDB, opts *TxOptions, fn func(*GormDB, []interface{}) error, tables []interface{}) (err error) {
+	gormtx := db.BeginTx(ctx, opts.sqlOptions())
+	if gormtx.Error != nil {
+		return gormtx.Error
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			gormtx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			if e := gormtx.Rollback().Error; e != nil && e != sql.ErrTxDone {
+				slog.Warnf(ctx, "ormTxAttempt --> rollback err:%s", e.Error())
+			}
+			return
+		}
+		err = gormtx.Commit().Error
+	}()
+
+	return fn(NewGormDB(gormtx), tables)
+}
+
+// OrmTx 同SqlTx，gorm的语句不带ctx，但ctx取消或超时时事务会被回滚，之后的语句都会失败
+func (m *Router) OrmTx(ctx context.Context, cluster string, opts *TxOptions, fn func(*GormDB, []interface{}) error, tables ...string) error {
+	fun := "Router.OrmTx -->"
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, "dbrouter.OrmTx")
+	defer span.Finish()
+
+	st := stime.NewTimeStat()
+
+	if len(tables) <= 0 {
+		return fmt.Errorf("tables is empty")
+	}
+	table := tables[0]
+
+	span.LogFields(
+		log.String(spanLogKeyCluster, cluster),
+		log.String(spanLogKeyTable, table))
+
+	// check breaker
+	if !m.breakers.entry(cluster, table) {
+		slog.Errorf(ctx, "%s breaker is open, cluster: %s, table: %s", fun, cluster, table)
+		return ErrBreakerOpen
+	}
+
+	db, err := m.ormPrepare(ctx, cluster, table, false)
+	if err != nil {
+		return err
+	}
+	db = db.withTrace(m.newTrace(ctx, cluster, table))
+
+	defer func() {
+		dur := st.Duration()
+		m.statQuery("OrmTx", cluster, table, dur, err)
+		slog.Tracef(ctx, "%s cls:%s table:%s dur:%d", fun, cluster, table, dur)
+	}()
+
+	var tmptables []interface{}
+	for _, item := range tables {
+		tmptables = append(tmptables, item)
+	}
+	err = retryTx(ctx, fun, opts, func() error {
+		return ormTxAttempt(ctx, db, opts, fn, tmptables)
+	})
+	statReqErr(cluster, table, err)
+	// stat breaker
+	m.breakers.stat(cluster, table, err, st.Duration())
+	return err
+}
@@ -0,0 +1,208 @@
+package dbrouter
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/shawnfeng/sutil/stat"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsRetryableTxErr(t *testing.T) {
+	assert.True(t, isRetryableTxErr(&mysql.MySQLError{Number: 1213}))
+	assert.True(t, isRetryableTxErr(&mysql.MySQLError{Number: 1205}))
+	assert.True(t, isRetryableTxErr(&pq.Error{Code: "40001"}))
+	assert.True(t, isRetryableTxErr(fmt.Errorf("update: %w", &mysql.MySQLError{Number: 1213})))
+	assert.False(t, isRetryableTxErr(&mysql.MySQLError{Number: 1062}))
+	assert.False(t, isRetryableTxErr(&pq.Error{Code: "23505"}))
+	assert.False(t, isRetryableTxErr(errors.New("Error 1213: Deadlock found")))
+}
+
+func TestTxOptions_Backoff(t *testing.T) {
+	var opts *TxOptions
+	assert.Equal(t, 3, opts.retries())
+	assert.Nil(t, opts.sqlOptions())
+	assert.Equal(t, 0, (&TxOptions{MaxRetries: -1}).retries())
+
+	for retry := 1; retry < 10; retry++ {
+		d := opts.backoff(retry)
+		assert.True(t, d >= defaultTxBackoff/2 && d <= maxTxBackoff, d)
+	}
+	d := (&TxOptions{Backoff: 100 * time.Millisecond}).backoff(3)
+	assert.True(t, d >= 200*time.Millisecond && d <= 400*time.Millisecond, d)
+}
+
+func newMockDB(t *testing.T) (*DB, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	return NewDB(sqlx.NewDb(db, DB_TYPE_MYSQL)), mock
+}
+
+func TestSqlTxAttempt(t *testing.T) {
+	ctx := context.Background()
+	db, mock := newMockDB(t)
+	tables := []interface{}{"order"}
+	opts := &TxOptions{Isolation: sql.LevelSerializable, Backoff: time.Millisecond}
+
+	// deadlock on the first attempt, committed on the second
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE order").WillReturnError(&mysql.MySQLError{Number: 1213})
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE order").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	attempts := 0
+	err := retryTx(ctx, "test", opts, func() error {
+		return sqlTxAttempt(ctx, db, opts, func(tx *Tx, tables []interface{}) error {
+			attempts++
+			_, err := tx.ExecWrapper(tables, "UPDATE %s SET n = n + 1")
+			return err
+		}, tables)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// not retried
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+	errBiz := errors.New("biz")
+	err = retryTx(ctx, "test", opts, func() error {
+		return sqlTxAttempt(ctx, db, opts, func(tx *Tx, tables []interface{}) error {
+			return errBiz
+		}, tables)
+	})
+	assert.Equal(t, errBiz, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// out of retries
+	for i := 0; i < 3; i++ {
+		mock.ExpectBegin()
+		mock.ExpectExec("UPDATE order").WillReturnError(&mysql.MySQLError{Number: 1205})
+		mock.ExpectRollback()
+	}
+	opts.MaxRetries = 2
+	err = retryTx(ctx, "test", opts, func() error {
+		return sqlTxAttempt(ctx, db, opts, func(tx *Tx, tables []interface{}) error {
+			_, err := tx.ExecWrapper(tables, "UPDATE %s SET n = n + 1")
+			return err
+		}, tables)
+	})
+	assert.True(t, isRetryableTxErr(err))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSqlTxAttempt_Panic(t *testing.T) {
+	db, mock := newMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	assert.Panics(t, func() {
+		sqlTxAttempt(context.Background(), db, nil, func(tx *Tx, tables []interface{}) error {
+			panic("boom")
+		}, nil)
+	})
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestOrmTxAttempt(t *testing.T) {
+	sqldb, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	gormdb, err := gorm.Open(DB_TYPE_MYSQL, sqldb)
+	assert.NoError(t, err)
+	db := NewGormDB(gormdb)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE order").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	err = ormTxAttempt(context.Background(), db, nil, func(tx *GormDB, tables []interface{}) error {
+		return tx.Exec(fmt.Sprintf("UPDATE %s SET n = n + 1", tables...)).Error
+	}, []interface{}{"order"})
+	assert.NoError(t, err)
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+	err = ormTxAttempt(context.Background(), db, nil, func(tx *GormDB, tables []interface{}) error {
+		return errors.New("biz")
+	}, nil)
+	assert.EqualError(t, err, "biz")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRouter_SqlTx(t *testing.T) {
+	configer, err := NewSimpleConfiger([]byte(scatterConfig))
+	assert.NoError(t, err)
+	sqldb, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	instances := &InstanceManager{instances: make(map[string]Instancer)}
+	instances.instances[instances.buildKey("trade0", DefaultGroup)] = &Sql{
+		instance: "trade0",
+		dbType:   DB_TYPE_MYSQL,
+		db:       NewDB(sqlx.NewDb(sqldb, DB_TYPE_MYSQL)),
+	}
+	router := &Router{
+		configer:  configer,
+		instances: instances,
+		report:    stat.NewStat(),
+		breakers:  newBreakerManager(func(string) BreakerConfig { return BreakerConfig{} }),
+		slowlog:   newSlowLogManager(func(string) SlowLogConfig { return SlowLogConfig{Threshold: -1} }),
+	}
+
+	attempts := 0
+	update := func(tx *Tx, tables []interface{}) error {
+		attempts++
+		_, err := tx.ExecWrapper(tables, "UPDATE %s SET n = n + 1")
+		return err
+	}
+	expectAttempt := func(err error) {
+		mock.ExpectBegin()
+		if err != nil {
+			mock.ExpectExec("UPDATE config").WillReturnError(err)
+			mock.ExpectRollback()
+			return
+		}
+		mock.ExpectExec("UPDATE config").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+	ctx := context.Background()
+
+	// deadlock and serialization failure are retried, then committed
+	expectAttempt(&mysql.MySQLError{Number: 1213})
+	expectAttempt(&pq.Error{Code: "40001"})
+	expectAttempt(nil)
+	err = router.SqlTx(ctx, "trade", &TxOptions{Backoff: time.Millisecond}, update, "config")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// given up after MaxRetries
+	attempts = 0
+	expectAttempt(&mysql.MySQLError{Number: 1213})
+	expectAttempt(&mysql.MySQLError{Number: 1213})
+	err = router.SqlTx(ctx, "trade", &TxOptions{MaxRetries: 1, Backoff: time.Millisecond}, update, "config")
+	assert.Equal(t, uint16(1213), err.(*mysql.MySQLError).Number)
+	assert.Equal(t, 2, attempts)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// ctx done during the backoff stops retrying
+	attempts = 0
+	expectAttempt(&mysql.MySQLError{Number: 1213})
+	cctx, cancel := context.WithCancel(ctx)
+	time.AfterFunc(20*time.Millisecond, cancel)
+	st := time.Now()
+	err = router.SqlTx(cctx, "trade", &TxOptions{Backoff: time.Second}, update, "config")
+	assert.Equal(t, uint16(1213), err.(*mysql.MySQLError).Number)
+	assert.Equal(t, 1, attempts)
+	assert.True(t, time.Since(st) < 400*time.Millisecond)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
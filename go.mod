@@ -1,9 +1,12 @@
 module github.com/shawnfeng/sutil
 
 require (
+	github.com/DATA-DOG/go-sqlmock v1.3.3
 	github.com/ZhengHe-MD/agollo/v4 v4.1.4
 	github.com/ZhengHe-MD/properties v0.2.2
+	github.com/alicebob/miniredis/v2 v2.17.0
 	github.com/bitly/go-simplejson v0.5.0
+	github.com/cespare/xxhash/v2 v2.1.0
 	github.com/coreos/etcd v3.3.17+incompatible
 	github.com/fzzy/radix v0.4.9-0.20141113025130-a3a55de9c594
 	github.com/go-redis/redis v6.15.1+incompatible
@@ -25,6 +28,7 @@ require (
 	github.com/stretchr/testify v1.4.0
 	github.com/uber/jaeger-client-go v2.20.1+incompatible
 	github.com/ugorji/go v1.1.7 // indirect
+	github.com/ugorji/go/codec v1.1.7
 	github.com/vaughan0/go-ini v0.0.0-20130923145212-a98ad7ee00ec
 	gitlab.pri.ibanyu.com/middleware/delayqueue v0.0.0-20200213090847-cd24af2bd1f2
 	gitlab.pri.ibanyu.com/middleware/seaweed v1.0.20
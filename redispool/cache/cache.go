@@ -35,6 +35,8 @@ type Cache struct {
 	expire int
 	pref string
 	addrs []string
+	// nil: sutil.HashV modulo
+	dist redispool.Distributor
 }
 
 // redis 地址列表，key前缀，过期时间
@@ -46,6 +48,20 @@ func NewCache(addrs []string, pref string, expire int) *Cache {
 	}
 }
 
+// 同NewCache，key按dist分布到addrs，例如 redispool.NewRingDistributor 一致性hash
+func NewCacheWithDistributor(addrs []string, pref string, expire int, dist redispool.Distributor) *Cache {
+	c := NewCache(addrs, pref, expire)
+	c.dist = dist
+	return c
+}
+
+func (m *Cache) addr(key string) string {
+	if m.dist == nil {
+		return sutil.HashV(m.addrs, key)
+	}
+	return m.dist.Pick(m.addrs, key)
+}
+
 func (m *Cache) setData(key string, data CacheData) error {
 	//fun := "Cache.setData -->"
 
@@ -54,7 +70,7 @@ func (m *Cache) setData(key string, data CacheData) error {
 		return fmt.Errorf("data marshal:%s", err)
 	}
 
-	rd := sutil.HashV(m.addrs, key)
+	rd := m.addr(key)
 
 	// 消息id到data的映射
 	rp := redisPool.CmdSingle(
@@ -78,7 +94,7 @@ func (m *Cache) setData(key string, data CacheData) error {
 func (m *Cache) getData(key string, data CacheData) error {
 	//fun := "Cache.getData -->"
 
-	rd := sutil.HashV(m.addrs, key)
+	rd := m.addr(key)
 
 	rp := redisPool.CmdSingle(
 		rd,
@@ -110,6 +126,29 @@ func (m *Cache) getData(key string, data CacheData) error {
 
 }
 
+// 读取key的原始数据，miss时ok为false，例如供 value.Cache 的迁移模式读取旧数据
+func (m *Cache) GetRaw(ctx context.Context, key string) (data []byte, ok bool, err error) {
+	rp := redisPool.CmdSingle(
+		m.addr(key),
+		[]interface{}{
+			"GET",
+			fmt.Sprintf("%s.%s", m.pref, key),
+		},
+	)
+
+	if rp.Type == redis.ErrorReply {
+		return nil, false, fmt.Errorf("get cache err:%s", rp.String())
+	} else if rp.Type == redis.NilReply {
+		return nil, false, nil
+	}
+
+	data, err = rp.Bytes()
+	if err != nil {
+		return nil, false, fmt.Errorf("reply bytes err:%s", err)
+	}
+	return data, true, nil
+}
+
 func (m *Cache) GetCache(key string, data CacheData) error {
 	fun := "Cache.GetCache -->"
 
@@ -166,7 +205,7 @@ func (m *Cache) Set(key string, data CacheData) error {
 
 
 func (m *Cache) Del(key string) error {
-	rd := sutil.HashV(m.addrs, key)
+	rd := m.addr(key)
 
 	rp := redisPool.CmdSingle(
 		rd,
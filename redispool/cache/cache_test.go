@@ -5,6 +5,7 @@ import (
 	"testing"
 	"encoding/json"
 
+	"github.com/shawnfeng/sutil/cache/redis/redistest"
 	"github.com/shawnfeng/sutil/slog/slog"
 )
 
@@ -34,9 +35,15 @@ func (m *testData) Load(key string) error {
 
 func TestCache(t *testing.T) {
 
-	cachet := NewCache([]string{"127.0.0.1:9600"}, "TTT", 60)
+	s, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
 
-	err := cachet.Del("test")
+	cachet := NewCache([]string{s.Addr()}, "TTT", 60)
+
+	err = cachet.Del("test")
 	if err != nil {
 		t.Errorf("%s", err)
 		return
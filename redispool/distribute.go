@@ -0,0 +1,118 @@
+package redispool
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/shawnfeng/sutil/shash"
+)
+
+// Distributor choose the addr of a key among addrs
+type Distributor interface {
+	Pick(addrs []string, key string) string
+}
+
+// ModuloDistributor fnv32a(key) % len(addrs), same as HashRedis, the default. Adding or removing
+// an addr remaps almost every key.
+type ModuloDistributor struct{}
+
+func (ModuloDistributor) Pick(addrs []string, key string) string {
+	if len(addrs) == 0 {
+		return ""
+	}
+	return HashRedis(addrs, key)
+}
+
+// RingDistributor consistent hash, adding or removing an addr only remaps about 1/n of keys.
+// The ring of the current addrs is kept only, it's rebuilt when the addrs given change, so use
+// one RingDistributor per set of addrs.
+type RingDistributor struct {
+	opts    shash.Options
+	weights map[string]int
+
+	mu sync.RWMutex
+	// addrs as given by the last change, and the sorted ones the ring is built of
+	addrs   []string
+	sorted  []string
+	current *shash.Ring
+}
+
+// NewRingDistributor weights of addrs, addrs not in weights have weight 1
+func NewRingDistributor(opts shash.Options, weights map[string]int) *RingDistributor {
+	return &RingDistributor{
+		opts:    opts,
+		weights: weights,
+	}
+}
+
+func (m *RingDistributor) Pick(addrs []string, key string) string {
+	return m.ring(addrs).Get(key)
+}
+
+// PickN up to n distinct addrs of key, e.g. to write replicas
+func (m *RingDistributor) PickN(addrs []string, key string, n int) []string {
+	return m.ring(addrs).GetN(key, n)
+}
+
+func (m *RingDistributor) ring(addrs []string) *shash.Ring {
+	// the same addrs as the last call, no allocation on the hot path
+	m.mu.RLock()
+	r := m.current
+	same := r != nil && equalStrings(m.addrs, addrs)
+	m.mu.RUnlock()
+	if same {
+		return r
+	}
+
+	sorted := append([]string(nil), addrs...)
+	sort.Strings(sorted)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// the same set in another order keeps the ring
+	if m.current != nil && equalStrings(m.sorted, sorted) {
+		return m.current
+	}
+	r = shash.NewRing(m.opts)
+	for _, addr := range sorted {
+		weight, ok := m.weights[addr]
+		if !ok {
+			weight = 1
+		}
+		r.Add(addr, weight)
+	}
+	m.addrs = append([]string(nil), addrs...)
+	m.sorted = sorted
+	m.current = r
+	return r
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// SetDistributor set how Pick distributes keys, nil restores the modulo default
+func (self *RedisPool) SetDistributor(d Distributor) {
+	self.muDist.Lock()
+	defer self.muDist.Unlock()
+	if d == nil {
+		d = ModuloDistributor{}
+	}
+	self.dist = d
+}
+
+// Pick return the addr of key among addrs by the distributor of the pool
+func (self *RedisPool) Pick(addrs []string, key string) string {
+	self.muDist.RLock()
+	d := self.dist
+	self.muDist.RUnlock()
+	return d.Pick(addrs, key)
+}
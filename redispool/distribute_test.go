@@ -0,0 +1,41 @@
+package redispool
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/shawnfeng/sutil/shash"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisPool_Pick(t *testing.T) {
+	addrs := []string{"127.0.0.1:6379", "127.0.0.1:6380", "127.0.0.1:6381"}
+	pool := NewRedisPool(10)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		assert.Equal(t, HashRedis(addrs, key), pool.Pick(addrs, key))
+	}
+
+	ring := NewRingDistributor(shash.Options{Hash: shash.HashKetama}, nil)
+	pool.SetDistributor(ring)
+	more := append([]string{"127.0.0.1:6382"}, addrs...)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		addr := pool.Pick(addrs, key)
+		// the order of addrs doesn't matter, a new addr only takes keys
+		assert.Equal(t, addr, pool.Pick([]string{addrs[2], addrs[1], addrs[0]}, key))
+		if a := pool.Pick(more, key); a != "127.0.0.1:6382" {
+			assert.Equal(t, addr, a)
+		}
+		assert.Equal(t, addr, ring.PickN(addrs, key, 2)[0])
+	}
+
+	// one ring of the current addrs is kept, the same set in another order keeps it
+	r := ring.ring(addrs)
+	assert.True(t, r == ring.ring([]string{addrs[2], addrs[1], addrs[0]}))
+	assert.True(t, r != ring.ring(more))
+	assert.Equal(t, more, ring.addrs)
+
+	pool.SetDistributor(nil)
+	assert.Equal(t, "", pool.Pick(nil, "key"))
+}
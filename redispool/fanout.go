@@ -0,0 +1,246 @@
+package redispool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fzzy/radix/redis"
+
+	"github.com/shawnfeng/sutil/slog/slog"
+)
+
+// SetFanout workers: max addrs Cmd talks to at the same time, timeout: max time Cmd waits
+// for all of them, commands still in flight then are cancelled by closing their connections,
+// 0 means no limit. Defaults are FANOUT_WORKERS and no timeout.
+func (self *RedisPool) SetFanout(workers int, timeout time.Duration) {
+	atomic.StoreInt64(&self.fanoutWorkers, int64(workers))
+	atomic.StoreInt64(&self.fanoutTimeout, int64(timeout))
+}
+
+type fanoutJob struct {
+	addr string
+	cmd  []interface{}
+}
+
+type fanoutResult struct {
+	addr string
+	rp   *redis.Reply
+}
+
+// Cmd 对多个redis并发执行命令，addr -> cmd，超时未返回的addr得到error reply
+func (self *RedisPool) Cmd(multi_args map[string][]interface{}) map[string]*redis.Reply {
+	fun := "RedisPool.Cmd"
+
+	rv := make(map[string]*redis.Reply, len(multi_args))
+	jobs := make(chan fanoutJob, len(multi_args))
+	for k, v := range multi_args {
+		if err := checkCmd(v); err != nil {
+			rv[k] = &redis.Reply{Type: redis.ErrorReply, Err: err}
+			continue
+		}
+		jobs <- fanoutJob{addr: k, cmd: v}
+	}
+	close(jobs)
+
+	workers := int(atomic.LoadInt64(&self.fanoutWorkers))
+	if workers <= 0 || workers > len(jobs) {
+		workers = len(jobs)
+	}
+	timeout := time.Duration(atomic.LoadInt64(&self.fanoutTimeout))
+
+	// buffered so that workers never block after a timeout
+	results := make(chan fanoutResult, len(multi_args))
+	done := make(chan struct{})
+	defer close(done)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range jobs {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				results <- fanoutResult{addr: job.addr, rp: self.cmdUntil(job.addr, job.cmd, done, 0)}
+			}
+		}()
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for len(rv) < len(multi_args) {
+		select {
+		case r := <-results:
+			rv[r.addr] = r.rp
+		case <-expired:
+			for k := range multi_args {
+				if _, ok := rv[k]; !ok {
+					slog.Warnf(context.TODO(), "%s timeout:%s addr:%s", fun, timeout, k)
+					rv[k] = &redis.Reply{Type: redis.ErrorReply, Err: fmt.Errorf("cmd timeout:%s addr:%s", timeout, k)}
+				}
+			}
+			return rv
+		}
+	}
+
+	return rv
+}
+
+// cmdUntil CmdSingleRetry whose connection is closed once done is closed, so that a command in
+// flight when Cmd times out returns at once instead of holding a worker and a connection
+func (self *RedisPool) cmdUntil(addr string, cmd []interface{}, done <-chan struct{}, retrytimes int) *redis.Reply {
+	fun := "RedisPool.cmdUntil"
+	c, err := self.get(addr)
+	if err != nil {
+		es := fmt.Sprintf("get conn retrytimes:%d addr:%s err:%s", retrytimes, addr, err)
+		slog.Infoln(context.TODO(), fun, es)
+		return &redis.Reply{Type: redis.ErrorReply, Err: errors.New(es)}
+	}
+
+	finished := make(chan struct{})
+	cancelled := make(chan bool, 1)
+	go func() {
+		select {
+		case <-done:
+			c.close()
+			cancelled <- true
+		case <-finished:
+			cancelled <- false
+		}
+	}()
+	rp := c.Cmd(cmd)
+	close(finished)
+	if <-cancelled {
+		return rp
+	}
+
+	if rp.Type == redis.ErrorReply {
+		slog.Warnf(context.TODO(), "%s redis Cmd try:%d error %s", fun, retrytimes, rp)
+		if rp.String() == "EOF" && retrytimes == 0 {
+			// redis 连接timeout，重试一次
+			return self.cmdUntil(addr, cmd, done, retrytimes+1)
+		}
+		c.close()
+	} else {
+		self.payback(addr, c)
+	}
+
+	return rp
+}
+
+// readOnlyCmds commands safe to send twice, see pipelineRetry
+var readOnlyCmds = map[string]bool{
+	"PING": true, "EXISTS": true, "TYPE": true, "TTL": true, "PTTL": true,
+	"GET": true, "MGET": true, "STRLEN": true, "GETRANGE": true, "GETBIT": true, "BITCOUNT": true,
+	"HGET": true, "HMGET": true, "HGETALL": true, "HKEYS": true, "HVALS": true, "HLEN": true, "HEXISTS": true,
+	"LINDEX": true, "LLEN": true, "LRANGE": true,
+	"SCARD": true, "SISMEMBER": true, "SMEMBERS": true, "SRANDMEMBER": true,
+	"ZCARD": true, "ZCOUNT": true, "ZRANGE": true, "ZRANGEBYSCORE": true, "ZRANK": true,
+	"ZREVRANGE": true, "ZREVRANGEBYSCORE": true, "ZREVRANK": true, "ZSCORE": true,
+}
+
+func isWriteErr(err error) bool {
+	op, ok := err.(*net.OpError)
+	return ok && op.Op == "write"
+}
+
+// checkCmd a command must start with its name, otherwise it can't be sent
+func checkCmd(cmd []interface{}) error {
+	if len(cmd) == 0 {
+		return errors.New("empty cmd")
+	}
+	if _, ok := cmd[0].(string); !ok {
+		return fmt.Errorf("cmd name should be string: %v", cmd[0])
+	}
+	return nil
+}
+
+func isReadOnly(cmds [][]interface{}) bool {
+	for _, cmd := range cmds {
+		name, _ := cmd[0].(string)
+		if !readOnlyCmds[strings.ToUpper(name)] {
+			return false
+		}
+	}
+	return true
+}
+
+// Pipeline 在一个连接上一次写入多个命令，reply与cmds顺序一致，不合法的命令不发送，得到error reply
+func (self *RedisPool) Pipeline(addr string, cmds [][]interface{}) []*redis.Reply {
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	rps := make([]*redis.Reply, len(cmds))
+	valid := make([][]interface{}, 0, len(cmds))
+	index := make([]int, 0, len(cmds))
+	for i, cmd := range cmds {
+		if err := checkCmd(cmd); err != nil {
+			rps[i] = &redis.Reply{Type: redis.ErrorReply, Err: err}
+			continue
+		}
+		valid = append(valid, cmd)
+		index = append(index, i)
+	}
+
+	for i, rp := range self.pipelineRetry(addr, valid, 0) {
+		rps[index[i]] = rp
+	}
+	return rps
+}
+
+func (self *RedisPool) pipelineRetry(addr string, cmds [][]interface{}, retrytimes int) []*redis.Reply {
+	fun := "RedisPool.Pipeline"
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	rps := make([]*redis.Reply, len(cmds))
+	c, err := self.get(addr)
+	if err != nil {
+		es := fmt.Sprintf("get conn retrytimes:%d addr:%s err:%s", retrytimes, addr, err)
+		slog.Infoln(context.TODO(), fun, es)
+		for i := range rps {
+			rps[i] = &redis.Reply{Type: redis.ErrorReply, Err: errors.New(es)}
+		}
+		return rps
+	}
+
+	for _, cmd := range cmds {
+		c.client.Append(cmd[0].(string), cmd[1:]...)
+	}
+	// error replies of redis leave the connection usable, anything else breaks it
+	broken := false
+	for i := range cmds {
+		rps[i] = c.client.GetReply()
+		if rps[i].Type == redis.ErrorReply {
+			if _, ok := rps[i].Err.(*redis.CmdError); !ok {
+				broken = true
+			}
+		}
+	}
+
+	if !broken {
+		self.payback(addr, c)
+		return rps
+	}
+
+	c.close()
+	slog.Warnf(context.TODO(), "%s redis pipeline try:%d addr:%s error %s", fun, retrytimes, addr, rps[0])
+	// redis 连接timeout，重试一次. A failed write sent nothing, but EOF may come after redis ran
+	// some of the commands, then only read-only batches are safe to send again, e.g. an INCR
+	// would be applied twice
+	if retrytimes == 0 && (isWriteErr(rps[0].Err) || (rps[0].String() == "EOF" && isReadOnly(cmds))) {
+		return self.pipelineRetry(addr, cmds, retrytimes+1)
+	}
+	return rps
+}
@@ -0,0 +1,157 @@
+package redispool
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fzzy/radix/redis"
+	"github.com/shawnfeng/sutil/cache/redis/redistest"
+	"github.com/stretchr/testify/assert"
+)
+
+func startServers(t *testing.T, n int) []*redistest.Server {
+	servers := make([]*redistest.Server, n)
+	for i := range servers {
+		s, err := redistest.NewServer()
+		if err != nil {
+			t.Fatalf("start redis server err:%v", err)
+		}
+		servers[i] = s
+	}
+	return servers
+}
+
+func TestRedisPool_Cmd(t *testing.T) {
+	servers := startServers(t, 4)
+	pool := NewRedisPool(10)
+	args := map[string][]interface{}{}
+	for i, s := range servers {
+		defer s.Close()
+		s.SetLatency(100 * time.Millisecond)
+		args[s.Addr()] = []interface{}{"SET", "key", fmt.Sprintf("v%d", i)}
+	}
+
+	// concurrent, 4 round trips of 100ms take about 100ms
+	st := time.Now()
+	rv := pool.Cmd(args)
+	assert.True(t, time.Since(st) < 300*time.Millisecond)
+	assert.Equal(t, len(servers), len(rv))
+	for i, s := range servers {
+		assert.Equal(t, "OK", rv[s.Addr()].String())
+		v, _ := s.Miniredis().Get("key")
+		assert.Equal(t, fmt.Sprintf("v%d", i), v)
+	}
+
+	// one worker, the rest time out
+	pool.SetFanout(1, 150*time.Millisecond)
+	rv = pool.Cmd(args)
+	assert.Equal(t, len(servers), len(rv))
+	errs := 0
+	for _, rp := range rv {
+		if rp.Type == redis.ErrorReply {
+			errs++
+		}
+	}
+	assert.Equal(t, len(servers)-1, errs)
+
+	// invalid commands are not sent
+	rv = pool.Cmd(map[string][]interface{}{servers[0].Addr(): {}, servers[1].Addr(): {1, "key"}})
+	assert.Equal(t, redis.ErrorReply, rv[servers[0].Addr()].Type)
+	assert.Equal(t, redis.ErrorReply, rv[servers[1].Addr()].Type)
+}
+
+func TestRedisPool_Pipeline(t *testing.T) {
+	s := startServers(t, 1)[0]
+	defer s.Close()
+	pool := NewRedisPool(10)
+
+	rps := pool.Pipeline(s.Addr(), [][]interface{}{
+		{"SET", "key", "1"},
+		{"INCR", "key"},
+		{"HGET", "key", "field"},
+		{"GET", "key"},
+	})
+	assert.Equal(t, 4, len(rps))
+	assert.Equal(t, "OK", rps[0].String())
+	n, _ := rps[1].Int()
+	assert.Equal(t, 2, n)
+	// WRONGTYPE keeps the connection in the pool
+	assert.Equal(t, redis.ErrorReply, rps[2].Type)
+	assert.Equal(t, "2", rps[3].String())
+	assert.Equal(t, 1, len(pool.getPool(s.Addr())))
+
+	assert.Nil(t, pool.Pipeline(s.Addr(), nil))
+
+	// invalid commands get error replies, the rest are sent
+	rps = pool.Pipeline(s.Addr(), [][]interface{}{{}, {"GET", "key"}, {[]byte("GET"), "key"}})
+	assert.Equal(t, 3, len(rps))
+	assert.Equal(t, redis.ErrorReply, rps[0].Type)
+	assert.Equal(t, "2", rps[1].String())
+	assert.Equal(t, redis.ErrorReply, rps[2].Type)
+	assert.Equal(t, 1, len(pool.getPool(s.Addr())))
+}
+
+func TestRedisPool_ConnHealth(t *testing.T) {
+	s := startServers(t, 1)[0]
+	defer s.Close()
+	pool := NewRedisPool(10)
+	addr := s.Addr()
+
+	// connections dropped while idle are found by ping and replaced
+	pool.SetConnHealth(time.Nanosecond, 0)
+	assert.Equal(t, "PONG", pool.CmdSingle(addr, []interface{}{"PING"}).String())
+	s.DropConnections()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, "OK", pool.Pipeline(addr, [][]interface{}{{"SET", "key", "1"}})[0].String())
+	assert.Equal(t, "1", pool.CmdSingle(addr, []interface{}{"GET", "key"}).String())
+
+	// connections over max lifetime are not paid back
+	pool.SetConnHealth(0, time.Nanosecond)
+	assert.Equal(t, "1", pool.CmdSingle(addr, []interface{}{"GET", "key"}).String())
+	assert.Equal(t, 0, len(pool.getPool(addr)))
+}
+
+func TestRedisPool_CmdCancel(t *testing.T) {
+	servers := startServers(t, 2)
+	pool := NewRedisPool(10)
+	args := map[string][]interface{}{}
+	for _, s := range servers {
+		defer s.Close()
+		s.SetLatency(300 * time.Millisecond)
+		args[s.Addr()] = []interface{}{"GET", "key"}
+	}
+
+	// commands in flight at the timeout are cancelled, their connections are closed, not paid back
+	pool.SetFanout(2, 50*time.Millisecond)
+	st := time.Now()
+	rv := pool.Cmd(args)
+	assert.True(t, time.Since(st) < 200*time.Millisecond)
+	for _, rp := range rv {
+		assert.Equal(t, redis.ErrorReply, rp.Type)
+	}
+	time.Sleep(400 * time.Millisecond)
+	for addr := range args {
+		assert.Equal(t, 0, len(pool.getPool(addr)))
+	}
+}
+
+func TestRedisPool_PipelineRetry(t *testing.T) {
+	s := startServers(t, 1)[0]
+	defer s.Close()
+	pool := NewRedisPool(10)
+	addr := s.Addr()
+	assert.Equal(t, "OK", pool.Pipeline(addr, [][]interface{}{{"SET", "key", "1"}})[0].String())
+
+	// the write to a dropped connection fails, nothing was sent, the batch is sent again once
+	s.DropConnections()
+	time.Sleep(10 * time.Millisecond)
+	rps := pool.Pipeline(addr, [][]interface{}{{"INCR", "key"}, {"GET", "key"}})
+	n, _ := rps[0].Int()
+	assert.Equal(t, 2, n)
+	assert.Equal(t, "2", rps[1].String())
+
+	// on EOF only read-only batches are sent again
+	assert.True(t, isReadOnly([][]interface{}{{"GET", "key"}, {"hgetall", "hash"}}))
+	assert.False(t, isReadOnly([][]interface{}{{"GET", "key"}, {"INCR", "key"}}))
+}
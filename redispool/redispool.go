@@ -14,6 +14,7 @@ import (
 
 	//	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 	//	"reflect"
 
@@ -25,12 +26,22 @@ import (
 const (
 	TIMEOUT_INTV int64 = 200
 	POOL_SIZE    int   = 512
+
+	FANOUT_WORKERS = 16
+
+	// suggested values of SetConnHealth and SetFanout, off by default so that connections and
+	// Cmd behave as before unless set explicitly
+	IDLE_CHECK     = time.Minute
+	MAX_LIFETIME   = time.Hour
+	FANOUT_TIMEOUT = 5 * time.Second
 )
 
 type RedisEntry struct {
 	client *redis.Client
 	addr   string
 	stamp  int64
+	// last payback
+	used time.Time
 }
 
 func (self *RedisEntry) String() string {
@@ -68,7 +79,17 @@ type RedisPool struct {
 	muLua sync.RWMutex
 	luas  map[string]*luaScript
 
+	muDist sync.RWMutex
+	dist   Distributor
+
 	poolLen int
+
+	// time.Duration, atomic
+	idleCheck   int64
+	maxLifetime int64
+
+	fanoutWorkers int64
+	fanoutTimeout int64
 }
 
 func (self *RedisPool) add(addr string) (*RedisEntry, error) {
@@ -84,6 +105,7 @@ func (self *RedisPool) add(addr string) (*RedisEntry, error) {
 		client: c,
 		addr:   addr,
 		stamp:  time.Now().Unix(),
+		used:   time.Now(),
 	}
 
 	return en, nil
@@ -116,21 +138,53 @@ func (self *RedisPool) get(addr string) (*RedisEntry, error) {
 
 	po := self.getPool(addr)
 
-	var err error
-	var entry *RedisEntry
-	select {
-	case entry = <-po:
-		//slog.Infof(context.TODO(), "%s get:%s len:%d", fun, addr, len(po))
-	default:
-		entry, err = self.add(addr)
+	for {
+		select {
+		case entry := <-po:
+			//slog.Infof(context.TODO(), "%s get:%s len:%d", fun, addr, len(po))
+			if self.healthy(entry) {
+				return entry, nil
+			}
+			entry.close()
+		default:
+			return self.add(addr)
+		}
 	}
+}
+
+// healthy entries over max lifetime are evicted, entries idle for longer than idle check
+// are pinged before reuse, e.g. closed by redis timeout or a failover in between
+func (self *RedisPool) healthy(re *RedisEntry) bool {
+	fun := "RedisPool.healthy"
+	now := time.Now()
 
-	return entry, err
+	maxLifetime := time.Duration(atomic.LoadInt64(&self.maxLifetime))
+	if maxLifetime > 0 && now.Sub(time.Unix(re.stamp, 0)) >= maxLifetime {
+		slog.Infof(context.TODO(), "%s evict re:%s lifetime:%s", fun, re, maxLifetime)
+		return false
+	}
+
+	idleCheck := time.Duration(atomic.LoadInt64(&self.idleCheck))
+	if idleCheck > 0 && now.Sub(re.used) >= idleCheck {
+		if rp := re.client.Cmd("PING"); rp.Type == redis.ErrorReply {
+			slog.Warnf(context.TODO(), "%s ping idle re:%s err:%s", fun, re, rp)
+			return false
+		}
+	}
+
+	return true
 }
 
 func (self *RedisPool) payback(addr string, re *RedisEntry) {
 	fun := "RedisPool.payback"
 
+	maxLifetime := time.Duration(atomic.LoadInt64(&self.maxLifetime))
+	if maxLifetime > 0 && time.Since(time.Unix(re.stamp, 0)) >= maxLifetime {
+		re.close()
+		return
+	}
+	re.used = time.Now()
+
 	po := self.getPool(addr)
 
 	select {
@@ -142,6 +196,13 @@ func (self *RedisPool) payback(addr string, re *RedisEntry) {
 	}
 }
 
+// SetConnHealth idleCheck: ping a connection idle for longer before reuse, maxLifetime: close
+// connections older than it, 0 disables either, both are disabled by default
+func (self *RedisPool) SetConnHealth(idleCheck, maxLifetime time.Duration) {
+	atomic.StoreInt64(&self.idleCheck, int64(idleCheck))
+	atomic.StoreInt64(&self.maxLifetime, int64(maxLifetime))
+}
+
 // 只对一个redis执行命令
 func (self *RedisPool) CmdSingleRetry(addr string, cmd []interface{}, retrytimes int) *redis.Reply {
 	fun := "RedisPool.CmdSingleRetry"
@@ -248,16 +309,6 @@ func (self *RedisPool) EvalSingle(addr string, key string, cmd_args []interface{
 	return rp
 }
 
-func (self *RedisPool) Cmd(multi_args map[string][]interface{}) map[string]*redis.Reply {
-	rv := make(map[string]*redis.Reply)
-	for k, v := range multi_args {
-		rv[k] = self.CmdSingle(k, v)
-	}
-
-	return rv
-
-}
-
 func HashRedis(addrs []string, key string) string {
 	h := fnv.New32a()
 	h.Write([]byte(key))
@@ -274,7 +325,10 @@ func NewRedisPool(poolLen int) *RedisPool {
 	return &RedisPool{
 		clipool: make(map[string]chan *RedisEntry),
 		luas:    make(map[string]*luaScript),
+		dist:    ModuloDistributor{},
 		poolLen: poolLen,
+
+		fanoutWorkers: FANOUT_WORKERS,
 	}
 }
 
@@ -9,6 +9,7 @@ import (
 	"context"
 	"testing"
 	"github.com/fzzy/radix/redis"
+	"github.com/shawnfeng/sutil/cache/redis/redistest"
 	"github.com/shawnfeng/sutil/slog/slog"
 )
 
@@ -26,7 +27,13 @@ func TestLuaLoad(t *testing.T) {
 		t.Errorf("error here")
 	}
 
-	addr := "localhost:9600"
+	s, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("start redis server err:%v", err)
+	}
+	defer s.Close()
+
+	addr := s.Addr()
     args := []interface{}{
 		2,
 		"key1",
@@ -39,7 +46,7 @@ func TestLuaLoad(t *testing.T) {
 
 	slog.Infoln(context.TODO(), rp)
 
-	if "get lua sha1 add:localhost:9600 key:Nothave err:lua not find" != rp.String() {
+	if "get lua sha1 add:"+addr+" key:Nothave err:lua not find" != rp.String() {
 		t.Errorf("error here")
 	}
 
@@ -21,6 +21,9 @@ const (
 	defaultChangeEventSize      = 32
 )
 
+// agollo的logger是全局变量，已启动的client会读取它，只设置一次
+var setLoggerOnce sync.Once
+
 type apolloConfigCenter struct {
 	conf            *agollo.Conf
 	ag              *agollo.Agollo
@@ -65,7 +68,9 @@ func (ap *apolloConfigCenter) Init(ctx context.Context, serviceName string, name
 
 	fun := "apolloConfigCenter.Init-->"
 
-	agollo.SetLogger(slog.GetLogger())
+	setLoggerOnce.Do(func() {
+		agollo.SetLogger(slog.GetLogger())
+	})
 
 	conf := confFromEnv()
 	conf.AppID = normalizeServiceName(serviceName)
@@ -0,0 +1,83 @@
+// Copyright 2014 The sutil Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package shash consistent hash ring with virtual nodes and weights
+package shash
+
+import (
+	"crypto/md5"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// HashFunc hash function used for both keys and virtual node points
+type HashFunc int
+
+const (
+	// HashFNV fnv32a, the same hash as sutil.HashV and redispool.HashRedis
+	HashFNV HashFunc = iota
+	HashXXHash
+	// HashKetama md5 points compatible with libketama (memcached clients, twemproxy),
+	// a ring of the same nodes and weights maps keys the same way
+	HashKetama
+)
+
+func (h HashFunc) String() string {
+	switch h {
+	case HashFNV:
+		return "fnv"
+	case HashXXHash:
+		return "xxhash"
+	case HashKetama:
+		return "ketama"
+	default:
+		return fmt.Sprintf("HashFunc(%d)", int(h))
+	}
+}
+
+func (h HashFunc) hashKey(key string) uint32 {
+	switch h {
+	case HashXXHash:
+		return uint32(xxhash.Sum64String(key))
+	case HashKetama:
+		d := md5.Sum([]byte(key))
+		return ketamaPoint(d, 0)
+	default:
+		return fnv32a(key)
+	}
+}
+
+// points hash points of the i-th replica group of node, ketama yields 4 points per md5 digest
+func (h HashFunc) points(node string, i int) []uint32 {
+	switch h {
+	case HashXXHash:
+		return []uint32{uint32(xxhash.Sum64String(fmt.Sprintf("%d-%s", i, node)))}
+	case HashKetama:
+		d := md5.Sum([]byte(fmt.Sprintf("%s-%d", node, i)))
+		return []uint32{ketamaPoint(d, 0), ketamaPoint(d, 1), ketamaPoint(d, 2), ketamaPoint(d, 3)}
+	default:
+		// index first, fnv32a barely mixes the last bytes so "node#1", "node#2"... cluster
+		return []uint32{fnv32a(fmt.Sprintf("%d-%s", i, node))}
+	}
+}
+
+// pointsPerGroup number of points returned by each call of points
+func (h HashFunc) pointsPerGroup() int {
+	if h == HashKetama {
+		return 4
+	}
+	return 1
+}
+
+func fnv32a(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func ketamaPoint(d [md5.Size]byte, n int) uint32 {
+	return uint32(d[3+n*4])<<24 | uint32(d[2+n*4])<<16 | uint32(d[1+n*4])<<8 | uint32(d[n*4])
+}
@@ -0,0 +1,163 @@
+// Copyright 2014 The sutil Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package shash
+
+import (
+	"sort"
+	"sync"
+)
+
+// DefaultVirtualNodes points of a node with weight 1, 160 is what libketama uses
+const DefaultVirtualNodes = 160
+
+type Options struct {
+	Hash HashFunc
+	// VirtualNodes points per weight unit, 0 means DefaultVirtualNodes
+	VirtualNodes int
+}
+
+type point struct {
+	hash uint32
+	node string
+}
+
+// Ring consistent hash ring, safe for concurrent use. Adding or removing a node only moves
+// the keys between it and its neighbours on the ring.
+type Ring struct {
+	hash         HashFunc
+	virtualNodes int
+
+	mu      sync.RWMutex
+	weights map[string]int
+	points  []point
+}
+
+// NewRing create a ring with nodes of weight 1
+func NewRing(opts Options, nodes ...string) *Ring {
+	if opts.VirtualNodes <= 0 {
+		opts.VirtualNodes = DefaultVirtualNodes
+	}
+	m := &Ring{
+		hash:         opts.Hash,
+		virtualNodes: opts.VirtualNodes,
+		weights:      make(map[string]int),
+	}
+	for _, node := range nodes {
+		m.weights[node] = 1
+	}
+	m.rebuild()
+	return m
+}
+
+// Add add node with weight, or change the weight of an existing node, weight <= 0 removes it
+func (m *Ring) Add(node string, weight int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if weight <= 0 {
+		delete(m.weights, node)
+	} else {
+		m.weights[node] = weight
+	}
+	m.rebuild()
+}
+
+func (m *Ring) Remove(node string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.weights[node]; !ok {
+		return
+	}
+	delete(m.weights, node)
+	m.rebuild()
+}
+
+// Nodes return the nodes on the ring in no particular order
+func (m *Ring) Nodes() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	nodes := make([]string, 0, len(m.weights))
+	for node := range m.weights {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+func (m *Ring) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.weights)
+}
+
+// Get return the node of key, "" if the ring is empty
+func (m *Ring) Get(key string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.points) == 0 {
+		return ""
+	}
+	return m.points[m.search(m.hash.hashKey(key))].node
+}
+
+// GetN return up to n distinct nodes of key walking clockwise from it, the first is the node
+// returned by Get, the rest are where replicas of key should go
+func (m *Ring) GetN(key string, n int) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if n > len(m.weights) {
+		n = len(m.weights)
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	nodes := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	start := m.search(m.hash.hashKey(key))
+	for i := 0; i < len(m.points) && len(nodes) < n; i++ {
+		node := m.points[(start+i)%len(m.points)].node
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// search index of the first point >= h, wrapping around to 0
+func (m *Ring) search(h uint32) int {
+	i := sort.Search(len(m.points), func(i int) bool { return m.points[i].hash >= h })
+	if i == len(m.points) {
+		return 0
+	}
+	return i
+}
+
+func (m *Ring) rebuild() {
+	per := m.hash.pointsPerGroup()
+	points := make([]point, 0, len(m.points))
+	for node, weight := range m.weights {
+		groups := m.virtualNodes * weight / per
+		for i := 0; i < groups; i++ {
+			for _, h := range m.hash.points(node, i) {
+				points = append(points, point{hash: h, node: node})
+			}
+		}
+	}
+	// on collision the smaller node wins whatever the order nodes were added
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].node < points[j].node
+	})
+	uniq := points[:0]
+	for _, p := range points {
+		if len(uniq) > 0 && p.hash == uniq[len(uniq)-1].hash {
+			continue
+		}
+		uniq = append(uniq, p)
+	}
+	m.points = uniq
+}
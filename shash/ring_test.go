@@ -0,0 +1,87 @@
+package shash
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testNodes = []string{"10.0.0.1:6379", "10.0.0.2:6379", "10.0.0.3:6379", "10.0.0.4:6379"}
+
+func TestRing_Get(t *testing.T) {
+	for _, h := range []HashFunc{HashFNV, HashXXHash, HashKetama} {
+		r := NewRing(Options{Hash: h}, testNodes...)
+		assert.Equal(t, len(testNodes)*DefaultVirtualNodes, len(r.points), h.String())
+
+		counts := map[string]int{}
+		for i := 0; i < 10000; i++ {
+			key := fmt.Sprintf("key%d", i)
+			node := r.Get(key)
+			assert.Equal(t, node, r.Get(key))
+			counts[node]++
+		}
+		assert.Equal(t, len(testNodes), len(counts), h.String())
+		for node, n := range counts {
+			assert.True(t, n > 1500 && n < 3500, "%s %s %d", h, node, n)
+		}
+	}
+
+	assert.Equal(t, "", NewRing(Options{}).Get("key"))
+}
+
+func TestRing_AddRemove(t *testing.T) {
+	r := NewRing(Options{Hash: HashXXHash}, testNodes...)
+	before := map[string]string{}
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		before[key] = r.Get(key)
+	}
+
+	// only keys moved to the new node change
+	r.Add("10.0.0.5:6379", 1)
+	moved := 0
+	for key, node := range before {
+		if n := r.Get(key); n != node {
+			assert.Equal(t, "10.0.0.5:6379", n)
+			moved++
+		}
+	}
+	assert.True(t, moved > 1000 && moved < 3000, "moved %d", moved)
+
+	r.Remove("10.0.0.5:6379")
+	for key, node := range before {
+		assert.Equal(t, node, r.Get(key))
+	}
+	assert.Equal(t, len(testNodes), r.Len())
+}
+
+func TestRing_Weight(t *testing.T) {
+	r := NewRing(Options{Hash: HashKetama}, testNodes[:2]...)
+	r.Add(testNodes[1], 3)
+
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		counts[r.Get(fmt.Sprintf("key%d", i))]++
+	}
+	assert.True(t, counts[testNodes[1]] > 2*counts[testNodes[0]], "%v", counts)
+
+	r.Add(testNodes[1], 0)
+	assert.Equal(t, []string{testNodes[0]}, r.Nodes())
+}
+
+func TestRing_GetN(t *testing.T) {
+	r := NewRing(Options{}, testNodes...)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		nodes := r.GetN(key, 3)
+		assert.Equal(t, 3, len(nodes))
+		assert.Equal(t, r.Get(key), nodes[0])
+		assert.NotEqual(t, nodes[0], nodes[1])
+		assert.NotEqual(t, nodes[1], nodes[2])
+		assert.NotEqual(t, nodes[0], nodes[2])
+	}
+
+	assert.Equal(t, len(testNodes), len(r.GetN("key", 10)))
+	assert.Nil(t, r.GetN("key", 0))
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/pprof"
 	"runtime"
+	"sync"
 )
 
 var (
@@ -56,6 +57,11 @@ func (p *Metricsprocessor) Driver() (string, interface{}) {
 	router.HandlerFunc("POST", "/debug/pprof/trace", pprof.Trace)
 	router.HandlerFunc("GET", "/debug/pprof/symbol", pprof.Symbol)
 	router.HandlerFunc("POST", "/debug/pprof/symbol", pprof.Symbol)
+	extraHandlersMu.Lock()
+	for _, h := range extraHandlers {
+		router.Handler(h.method, h.path, h.handler)
+	}
+	extraHandlersMu.Unlock()
 	//router.Handler("POST", p.location,handlerFor)
 	router.HandlerFunc("GET", "/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
@@ -82,3 +88,21 @@ func (p *Metricsprocessor) getListenerAddress() string {
 	//	port++
 	//}
 }
+
+type extraHandler struct {
+	method, path string
+	handler      http.Handler
+}
+
+var (
+	extraHandlersMu sync.Mutex
+	extraHandlers   []extraHandler
+)
+
+// RegisterHandler mount handler on the metrics router besides /metrics and pprof, e.g. debug
+// pages of other packages. It must be called before Driver.
+func RegisterHandler(method, path string, handler http.Handler) {
+	extraHandlersMu.Lock()
+	defer extraHandlersMu.Unlock()
+	extraHandlers = append(extraHandlers, extraHandler{method, path, handler})
+}